@@ -0,0 +1,583 @@
+package builtin
+
+import (
+	"bitbucket.org/primelogic_io/bitlantern/service/dataflow"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+func init() {
+	//Register function with default builtin.FunctionProvider
+	DefaultInstance().RegisterFunction(
+		Function{
+			FunctionSpec: dataflow.FunctionSpec{
+				Key:           "aggregate",
+				Name:          "Aggregate Records",
+				Description:   "Groups records by fields and summarizes each group",
+				Category:      "Data",
+				ExecutionMode: "sync",
+				InputPorts:    dataflowPorts(recordInputPort),
+				OutputPorts:   dataflowPorts(PortSpec{Name: dataflow.DEFAULT_OUTPUT_PORT_NAME, Description: "One record per group", DataType: PortDataTypeRecord}, errorOutputPort),
+			},
+			ConfigSchema: ConfigSchema{
+				Fields: []ConfigField{
+					{Key: "groupBy", Type: ConfigTypeArray, Items: &ConfigField{Type: ConfigTypeString}, Description: "Fields to group by. If empty all records are one group"},
+					{Key: "aggregations", Type: ConfigTypeArray, Required: true, Items: &ConfigField{
+						Type: ConfigTypeObject,
+						Fields: []ConfigField{
+							{Key: "function", Type: ConfigTypeString, Required: true, Enum: aggregateFunctions},
+							{Key: "field", Type: ConfigTypeString, Description: "Field to aggregate. Not needed for count, which then counts records"},
+							{Key: "outputField", Type: ConfigTypeString, Required: true},
+							{Key: "separator", Type: ConfigTypeString, Default: ",", Description: "Separator between concatenated values"},
+						},
+					}},
+					{Key: "maxGroupsInMemory", Type: ConfigTypeInteger, Default: float64(100000), Description: "Number of groups held in memory before partial results are spilled to temp files. This bounds the number of groups, not their size: countDistinct and concat keep every distinct value or value of a group in memory"},
+					{Key: "maxMergeRuns", Type: ConfigTypeInteger, Default: float64(64), Description: "Number of spilled temp files open at once while merging. More than this are merged in several passes"},
+				},
+			},
+			NewFunction: func() dataflow.Function {
+				return &(aggregate{})
+			},
+		})
+}
+
+// Aggregate functions
+const (
+	aggregateCount         = "count"
+	aggregateSum           = "sum"
+	aggregateMin           = "min"
+	aggregateMax           = "max"
+	aggregateAvg           = "avg"
+	aggregateFirst         = "first"
+	aggregateLast          = "last"
+	aggregateCountDistinct = "countDistinct"
+	aggregateConcat        = "concat"
+)
+
+var aggregateFunctions = []interface{}{
+	aggregateCount, aggregateSum, aggregateMin, aggregateMax, aggregateAvg,
+	aggregateFirst, aggregateLast, aggregateCountDistinct, aggregateConcat,
+}
+
+type aggregate struct {
+	config aggregateConfig
+}
+
+type aggregateConfig struct {
+	groupBy      []*fieldPath
+	aggregations []aggregation
+
+	// maxGroupsInMemory is how many groups are held before they're spilled to a temp file
+	maxGroupsInMemory int
+
+	// maxMergeRuns is how many runs are merged at once, which bounds the number of open files
+	maxMergeRuns int
+}
+
+type aggregation struct {
+	function    string
+	field       *fieldPath
+	outputField *fieldPath
+	separator   string
+}
+
+// aggregateGroup is the (partial) result for one group. The fields are exported so it can be gob encoded when spilled.
+type aggregateGroup struct {
+	// Key identifies the group; see valueKey
+	Key string
+
+	// KeyValues are the values of the groupBy fields, from the group's first record
+	KeyValues []interface{}
+
+	// States holds the state of each aggregation
+	States []aggregateState
+}
+
+// aggregateState is the running state of one aggregation of one group. Every function other than count without a
+// field skips null values.
+type aggregateState struct {
+	// Count is the number of (non-null) values seen
+	Count int64
+
+	// Sums are kept as integers until a non-integer is added, so sums of integers stay exact
+	IntSum   int64
+	FloatSum float64
+	IsFloat  bool
+
+	Min   interface{}
+	Max   interface{}
+	First interface{}
+	Last  interface{}
+
+	// Distinct and Values grow with the number of values in the group, and aren't bounded by maxGroupsInMemory
+	Distinct map[string]bool
+	Values   []string
+}
+
+// buildConfig builds an aggregateConfig from the passed in map. The map must be in the form:
+// {
+//		"groupBy": ["accountNumber", "customer.state"],
+//		"aggregations": [
+//			{ "function": "count", "outputField": "transactions" },
+//			{ "function": "sum", "field": "amount", "outputField": "total" },
+//			{ "function": "concat", "field": "reference", "outputField": "references", "separator": ";" }
+//		],
+//		"maxGroupsInMemory": 100000,
+//		"maxMergeRuns": 64
+// }
+//
+// Each output record has the groupBy fields and the outputField of each aggregation. The functions are count, sum,
+// min, max, avg, first, last, countDistinct and concat. Groups are written in the order they first appear in the input,
+// unless there were more than maxGroupsInMemory of them, in which case they're written in group key order.
+//
+// maxGroupsInMemory bounds how many groups are held, not how big one gets. countDistinct and concat hold every
+// distinct value, or every value, of their group until it's written, so they need memory for the largest group.
+func (f *aggregate) buildConfig(config map[string]interface{}) (aggregateConfig, error) {
+	c := aggregateConfig{}
+
+	groupBy, _ := config["groupBy"].([]interface{})
+	var err error
+	c.groupBy, err = parseFieldPaths("groupBy", groupBy)
+	if err != nil {
+		return c, err
+	}
+
+	aggregations := config["aggregations"].([]interface{})
+	if len(aggregations) == 0 {
+		return c, fmt.Errorf("at least one aggregation is required")
+	}
+	c.aggregations = make([]aggregation, len(aggregations))
+
+	for i := 0; i < len(aggregations); i++ {
+		curAggMap := aggregations[i].(map[string]interface{})
+		newAgg := aggregation{}
+
+		newAgg.function = curAggMap["function"].(string)
+		newAgg.separator, _ = curAggMap["separator"].(string)
+
+		newAgg.outputField, err = parseFieldPath(curAggMap["outputField"].(string))
+		if err != nil {
+			return c, fmt.Errorf("aggregations[%d].outputField: %w", i, err)
+		}
+
+		if field, _ := curAggMap["field"].(string); field != "" {
+			newAgg.field, err = parseFieldPath(field)
+			if err != nil {
+				return c, fmt.Errorf("aggregations[%d].field: %w", i, err)
+			}
+		} else if newAgg.function != aggregateCount {
+			return c, fmt.Errorf("aggregations[%d]: field is required for %v", i, newAgg.function)
+		}
+
+		c.aggregations[i] = newAgg
+	}
+
+	c.maxGroupsInMemory = int(config["maxGroupsInMemory"].(float64))
+	if c.maxGroupsInMemory < 1 {
+		return c, fmt.Errorf("maxGroupsInMemory must be at least 1")
+	}
+
+	c.maxMergeRuns = int(config["maxMergeRuns"].(float64))
+	if c.maxMergeRuns < 2 {
+		return c, fmt.Errorf("maxMergeRuns must be at least 2")
+	}
+
+	return c, nil
+}
+
+func (f *aggregate) Execute(in dataflow.InputReader, out dataflow.OutputWriter, config map[string]interface{}) error {
+	defer out.Close()
+
+	//Parse/read config options
+	config, err := prepareConfig("aggregate", config)
+	if err != nil {
+		return err
+	}
+
+	f.config, err = f.buildConfig(config)
+	if err != nil {
+		return newFunctionError("aggregate", "building config", err)
+	}
+
+	//Open the data stream
+	reader := in.PortReader(dataflow.DEFAULT_INPUT_PORT_NAME)
+	err = reader.Open()
+	if err != nil {
+		return newFunctionError("aggregate", "opening input", err)
+	}
+
+	groups := make(map[string]*aggregateGroup)
+	var groupOrder []string
+	var runs []*spillRun
+	defer func() {
+		removeSpillRuns(runs)
+	}()
+
+	//Loop through all data, spilling the groups whenever there are too many to keep in memory
+	for reader.HasNext() {
+		rec, err := reader.Next()
+		if err != nil {
+			return newFunctionError("aggregate", "reading input", err)
+		}
+
+		recVal, err := rec.GetAsRecord()
+		if err != nil {
+			writeRecordError(out, &(RecordError{FunctionKey: "aggregate", Err: err}))
+			continue
+		}
+
+		keyValues := make([]interface{}, len(f.config.groupBy))
+		keyParts := make([]string, len(f.config.groupBy))
+		for i := range f.config.groupBy {
+			keyValues[i], _ = f.config.groupBy[i].get(recVal)
+			keyParts[i] = valueKey(keyValues[i])
+		}
+		key := strings.Join(keyParts, "\x1f")
+
+		group, ok := groups[key]
+		if !ok {
+			group = &(aggregateGroup{Key: key, KeyValues: keyValues, States: make([]aggregateState, len(f.config.aggregations))})
+		}
+
+		err = f.accumulate(group, recVal)
+		if err != nil {
+			writeRecordError(out, &(RecordError{FunctionKey: "aggregate", Record: recVal, Err: err}))
+			continue
+		}
+
+		if !ok {
+			groups[key] = group
+			groupOrder = append(groupOrder, key)
+		}
+
+		if len(groups) > f.config.maxGroupsInMemory {
+			run, err := f.spill(groups)
+			if err != nil {
+				return newFunctionError("aggregate", "spilling groups", err)
+			}
+			runs = append(runs, run)
+			groups = make(map[string]*aggregateGroup)
+			groupOrder = nil
+		}
+	}
+
+	if len(runs) == 0 {
+		for _, key := range groupOrder {
+			f.writeGroup(out, groups[key])
+		}
+		return nil
+	}
+
+	if len(groups) > 0 {
+		run, err := f.spill(groups)
+		if err != nil {
+			return newFunctionError("aggregate", "spilling groups", err)
+		}
+		runs = append(runs, run)
+	}
+
+	//Merge groups of runs into new runs until they can all be merged at once
+	for len(runs) > f.config.maxMergeRuns {
+		runs, err = mergeSpillPass("aggregate", runs, f.config.maxMergeRuns, f.mergeRuns)
+		if err != nil {
+			return newFunctionError("aggregate", "merging spilled groups", err)
+		}
+	}
+
+	err = f.mergeRuns(runs, func(val interface{}) error {
+		f.writeGroup(out, val.(*aggregateGroup))
+		return nil
+	})
+	if err != nil {
+		return newFunctionError("aggregate", "merging spilled groups", err)
+	}
+
+	return nil
+}
+
+// accumulate adds the record to the group. The values are all checked first, so a bad value leaves the group as it was.
+func (f *aggregate) accumulate(group *aggregateGroup, recVal dataflow.Record) error {
+	values := make([]interface{}, len(f.config.aggregations))
+	for i := range f.config.aggregations {
+		agg := &(f.config.aggregations[i])
+		if agg.field == nil {
+			continue
+		}
+
+		values[i], _ = agg.field.get(recVal)
+		err := agg.check(&(group.States[i]), values[i])
+		if err != nil {
+			return fmt.Errorf("aggregations[%d]: %w", i, err)
+		}
+	}
+
+	for i := range f.config.aggregations {
+		f.config.aggregations[i].add(&(group.States[i]), values[i])
+	}
+
+	return nil
+}
+
+// check returns an error if the value can't be added to the state
+func (a *aggregation) check(state *aggregateState, value interface{}) error {
+	if value == nil {
+		return nil
+	}
+
+	switch a.function {
+	case aggregateSum, aggregateAvg:
+		if _, ok := configValueAsFloat(value); !ok {
+			return fmt.Errorf("%v of %v: %v is not a number", a.function, a.field, value)
+		}
+	case aggregateMin, aggregateMax:
+		if state.Min != nil {
+			_, err := compareRecordValues(value, state.Min)
+			if err != nil {
+				return fmt.Errorf("%v of %v: %w", a.function, a.field, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// add adds a value that has passed check to the state
+func (a *aggregation) add(state *aggregateState, value interface{}) {
+	if a.field == nil {
+		//Count of records
+		state.Count++
+		return
+	}
+	if value == nil {
+		return
+	}
+
+	state.Count++
+	switch a.function {
+	case aggregateSum, aggregateAvg:
+		addToSum(state, value)
+	case aggregateMin, aggregateMax:
+		if state.Min == nil {
+			state.Min, state.Max = value, value
+		}
+		if cmp, _ := compareRecordValues(value, state.Min); cmp < 0 {
+			state.Min = value
+		}
+		if cmp, _ := compareRecordValues(value, state.Max); cmp > 0 {
+			state.Max = value
+		}
+	case aggregateFirst, aggregateLast:
+		if state.First == nil {
+			state.First = value
+		}
+		state.Last = value
+	case aggregateCountDistinct:
+		if state.Distinct == nil {
+			state.Distinct = make(map[string]bool)
+		}
+		state.Distinct[valueKey(value)] = true
+	case aggregateConcat:
+		state.Values = append(state.Values, fmt.Sprintf("%v", value))
+	}
+}
+
+func addToSum(state *aggregateState, value interface{}) {
+	switch v := value.(type) {
+	case int:
+		state.IntSum += int64(v)
+	case int8:
+		state.IntSum += int64(v)
+	case int16:
+		state.IntSum += int64(v)
+	case int32:
+		state.IntSum += int64(v)
+	case int64:
+		state.IntSum += v
+	default:
+		num, _ := configValueAsFloat(value)
+		state.FloatSum += num
+		state.IsFloat = true
+	}
+}
+
+// merge adds the state of a later partial result for the same group into the state
+func (a *aggregation) merge(state *aggregateState, later *aggregateState) error {
+	state.Count += later.Count
+	state.IntSum += later.IntSum
+	state.FloatSum += later.FloatSum
+	state.IsFloat = state.IsFloat || later.IsFloat
+
+	if state.Min == nil {
+		state.Min, state.Max = later.Min, later.Max
+	} else if later.Min != nil {
+		cmp, err := compareRecordValues(later.Min, state.Min)
+		if err != nil {
+			return fmt.Errorf("%v of %v: %w", a.function, a.field, err)
+		}
+		if cmp < 0 {
+			state.Min = later.Min
+		}
+		if cmp, _ := compareRecordValues(later.Max, state.Max); cmp > 0 {
+			state.Max = later.Max
+		}
+	}
+
+	if state.First == nil {
+		state.First = later.First
+	}
+	if later.Last != nil {
+		state.Last = later.Last
+	}
+
+	if len(later.Distinct) > 0 && state.Distinct == nil {
+		state.Distinct = make(map[string]bool)
+	}
+	for key := range later.Distinct {
+		state.Distinct[key] = true
+	}
+	state.Values = append(state.Values, later.Values...)
+
+	return nil
+}
+
+// result returns the value of the aggregation for the group. Functions other than count and countDistinct are null
+// for a group without any (non-null) values.
+func (a *aggregation) result(state *aggregateState) interface{} {
+	switch a.function {
+	case aggregateCount:
+		return state.Count
+	case aggregateCountDistinct:
+		return int64(len(state.Distinct))
+	}
+
+	if state.Count == 0 {
+		return nil
+	}
+
+	switch a.function {
+	case aggregateSum:
+		if state.IsFloat {
+			return float64(state.IntSum) + state.FloatSum
+		}
+		return state.IntSum
+	case aggregateAvg:
+		return (float64(state.IntSum) + state.FloatSum) / float64(state.Count)
+	case aggregateMin:
+		return state.Min
+	case aggregateMax:
+		return state.Max
+	case aggregateFirst:
+		return state.First
+	case aggregateLast:
+		return state.Last
+	case aggregateConcat:
+		return strings.Join(state.Values, a.separator)
+	}
+
+	return nil
+}
+
+func (f *aggregate) writeGroup(out dataflow.OutputWriter, group *aggregateGroup) {
+	rec := dataflow.Record{}
+	for i := range f.config.groupBy {
+		err := f.config.groupBy[i].set(rec, group.KeyValues[i])
+		if err != nil {
+			writeRecordError(out, &(RecordError{FunctionKey: "aggregate", Record: rec, Err: err}))
+			return
+		}
+	}
+
+	for i := range f.config.aggregations {
+		agg := &(f.config.aggregations[i])
+		err := agg.outputField.set(rec, agg.result(&(group.States[i])))
+		if err != nil {
+			writeRecordError(out, &(RecordError{FunctionKey: "aggregate", Record: rec, Err: err}))
+			return
+		}
+	}
+
+	out.WriteRecord(dataflow.DEFAULT_OUTPUT_PORT_NAME, &rec)
+}
+
+// spill writes the groups to a new run, in key order
+func (f *aggregate) spill(groups map[string]*aggregateGroup) (*spillRun, error) {
+	keys := make([]string, 0, len(groups))
+	for key := range groups {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	run, err := newSpillRun("aggregate")
+	if err != nil {
+		return nil, err
+	}
+
+	for _, key := range keys {
+		err = run.write(spillGroup(groups[key]))
+		if err != nil {
+			run.remove()
+			return nil, err
+		}
+	}
+
+	err = run.close()
+	if err != nil {
+		run.remove()
+		return nil, err
+	}
+
+	return run, nil
+}
+
+// spillGroup returns a copy of the group with the field values it holds converted by spillValue, so it can be encoded
+func spillGroup(group *aggregateGroup) *aggregateGroup {
+	spilled := &(aggregateGroup{Key: group.Key, KeyValues: spillValue(group.KeyValues).([]interface{})})
+	spilled.States = make([]aggregateState, len(group.States))
+	for i, state := range group.States {
+		state.Min, state.Max = spillValue(state.Min), spillValue(state.Max)
+		state.First, state.Last = spillValue(state.First), spillValue(state.Last)
+		spilled.States[i] = state
+	}
+
+	return spilled
+}
+
+// mergeRuns reads the runs together in key order, merging the partial results for each group and passing the merged
+// *aggregateGroup to fn. Partial results are merged in the order the runs were written, which is input order, so first,
+// last and concat are right.
+func (f *aggregate) mergeRuns(runs []*spillRun, fn func(interface{}) error) error {
+	var pending *aggregateGroup
+	err := mergeSpillRuns(runs, func() interface{} {
+		return &(aggregateGroup{})
+	}, func(a interface{}, b interface{}) int {
+		return strings.Compare(a.(*aggregateGroup).Key, b.(*aggregateGroup).Key)
+	}, func(val interface{}) error {
+		group := val.(*aggregateGroup)
+
+		//Equal keys come out one after the other, so a group is complete once a different key comes out
+		if pending != nil && pending.Key == group.Key {
+			for i := range f.config.aggregations {
+				err := f.config.aggregations[i].merge(&(pending.States[i]), &(group.States[i]))
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+
+		if pending != nil {
+			err := fn(pending)
+			if err != nil {
+				return err
+			}
+		}
+		pending = group
+		return nil
+	})
+	if err != nil || pending == nil {
+		return err
+	}
+
+	return fn(pending)
+}
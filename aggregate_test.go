@@ -0,0 +1,228 @@
+package builtin
+
+import (
+	"bitbucket.org/primelogic_io/bitlantern/service/dataflow"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func aggregateTestConfig() map[string]interface{} {
+	return map[string]interface{}{
+		"groupBy": []interface{}{"account"},
+		"aggregations": []interface{}{
+			map[string]interface{}{"function": "count", "outputField": "records"},
+			map[string]interface{}{"function": "count", "field": "memo", "outputField": "memos"},
+			map[string]interface{}{"function": "sum", "field": "amount", "outputField": "total"},
+			map[string]interface{}{"function": "sum", "field": "units", "outputField": "units"},
+			map[string]interface{}{"function": "avg", "field": "amount", "outputField": "average"},
+			map[string]interface{}{"function": "min", "field": "posted", "outputField": "firstPosted"},
+			map[string]interface{}{"function": "max", "field": "amount", "outputField": "largest"},
+			map[string]interface{}{"function": "first", "field": "memo", "outputField": "firstMemo"},
+			map[string]interface{}{"function": "last", "field": "memo", "outputField": "lastMemo"},
+			map[string]interface{}{"function": "countDistinct", "field": "units", "outputField": "distinctUnits"},
+			map[string]interface{}{"function": "concat", "field": "memo", "outputField": "memoList", "separator": "|"},
+		},
+	}
+}
+
+func aggregateTestRecords() []dataflow.Record {
+	day := func(d int) time.Time { return time.Date(2020, 1, d, 0, 0, 0, 0, time.UTC) }
+
+	return []dataflow.Record{
+		{"account": "A", "amount": 10.0, "units": int64(1), "posted": day(3), "memo": "rent"},
+		{"account": "B", "amount": 5.0, "units": int64(2), "posted": day(2)},
+		{"account": "A", "amount": 2.5, "units": int64(1), "posted": day(1), "memo": "fee"},
+		{"account": "A", "amount": 7.5, "units": int64(3), "posted": day(5), "memo": "refund"},
+	}
+}
+
+func aggregateTestWant() []dataflow.Record {
+	day := func(d int) time.Time { return time.Date(2020, 1, d, 0, 0, 0, 0, time.UTC) }
+
+	return []dataflow.Record{
+		{
+			"account": "A", "records": int64(3), "memos": int64(3), "total": 20.0, "units": int64(5), "average": 20.0 / 3,
+			"firstPosted": day(1), "largest": 10.0, "firstMemo": "rent", "lastMemo": "refund", "distinctUnits": int64(2),
+			"memoList": "rent|fee|refund",
+		},
+		{
+			"account": "B", "records": int64(1), "memos": int64(0), "total": 5.0, "units": int64(2), "average": 5.0,
+			"firstPosted": day(2), "largest": 5.0, "firstMemo": nil, "lastMemo": nil, "distinctUnits": int64(1),
+			"memoList": nil,
+		},
+	}
+}
+
+func TestAggregate(t *testing.T) {
+	out, err := runFunction(t, "aggregate", aggregateTestConfig(), recordInput(aggregateTestRecords()...))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//Groups come out in the order they first appear
+	got := out.Records(dataflow.DEFAULT_OUTPUT_PORT_NAME)
+	if want := aggregateTestWant(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v\nwant %v", got, want)
+	}
+}
+
+func TestAggregateSpills(t *testing.T) {
+	config := aggregateTestConfig()
+	config["maxGroupsInMemory"] = 1.0
+
+	out, err := runFunction(t, "aggregate", config, recordInput(aggregateTestRecords()...))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := out.Records(dataflow.DEFAULT_OUTPUT_PORT_NAME)
+	sort.Slice(got, func(i, j int) bool { return got[i]["account"].(string) < got[j]["account"].(string) })
+	if want := aggregateTestWant(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v\nwant %v", got, want)
+	}
+}
+
+func TestAggregateWithoutGroupBy(t *testing.T) {
+	config := map[string]interface{}{
+		"aggregations": []interface{}{
+			map[string]interface{}{"function": "sum", "field": "amount", "outputField": "total"},
+		},
+	}
+
+	bad := dataflow.Record{"amount": "ten"}
+	out, err := runFunction(t, "aggregate", config, recordInput(dataflow.Record{"amount": int64(3)}, bad, dataflow.Record{"amount": int64(4)}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []dataflow.Record{{"total": int64(7)}}
+	if got := out.Records(dataflow.DEFAULT_OUTPUT_PORT_NAME); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	assertErrorRecords(t, out, []dataflow.Record{{
+		"functionKey": "aggregate",
+		"record":      bad,
+		"error":       "aggregations[0]: sum of amount: ten is not a number",
+	}})
+}
+
+func TestAggregateInvalidConfig(t *testing.T) {
+	config := map[string]interface{}{
+		"aggregations": []interface{}{
+			map[string]interface{}{"function": "sum", "outputField": "total"},
+		},
+	}
+
+	_, err := runFunction(t, "aggregate", config, recordInput())
+	if err == nil {
+		t.Error("expected an error for sum without a field")
+	}
+}
+
+func TestAggregateSpillsNestedValues(t *testing.T) {
+	config := map[string]interface{}{
+		"groupBy": []interface{}{"account"},
+		"aggregations": []interface{}{
+			map[string]interface{}{"function": "first", "field": "items", "outputField": "firstItems"},
+			map[string]interface{}{"function": "last", "field": "items", "outputField": "lastItems"},
+		},
+		"maxGroupsInMemory": 1.0,
+	}
+
+	items := func(skus ...string) []map[string]interface{} {
+		list := make([]map[string]interface{}, len(skus))
+		for i := range skus {
+			list[i] = map[string]interface{}{"sku": skus[i]}
+		}
+		return list
+	}
+	out, err := runFunction(t, "aggregate", config, recordInput(
+		dataflow.Record{"account": "A", "items": items("a1")},
+		dataflow.Record{"account": "B", "items": items("b1", "b2")},
+		dataflow.Record{"account": "A", "items": items("a2", "a3")},
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []dataflow.Record{
+		{
+			"account":    "A",
+			"firstItems": []interface{}{map[string]interface{}{"sku": "a1"}},
+			"lastItems":  []interface{}{map[string]interface{}{"sku": "a2"}, map[string]interface{}{"sku": "a3"}},
+		},
+		{
+			"account":    "B",
+			"firstItems": []interface{}{map[string]interface{}{"sku": "b1"}, map[string]interface{}{"sku": "b2"}},
+			"lastItems":  []interface{}{map[string]interface{}{"sku": "b1"}, map[string]interface{}{"sku": "b2"}},
+		},
+	}
+	if got := out.Records(dataflow.DEFAULT_OUTPUT_PORT_NAME); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v\nwant %v", got, want)
+	}
+}
+
+func TestAggregateLargeIntegerKeys(t *testing.T) {
+	//These differ past a float64's precision, so they'd be merged into one group if keyed as floats
+	low, high := int64(1<<53), int64(1<<53+1)
+	config := map[string]interface{}{
+		"groupBy": []interface{}{"account"},
+		"aggregations": []interface{}{
+			map[string]interface{}{"function": "count", "outputField": "records"},
+			map[string]interface{}{"function": "countDistinct", "field": "ref", "outputField": "refs"},
+		},
+	}
+
+	out, err := runFunction(t, "aggregate", config, recordInput(
+		dataflow.Record{"account": low, "ref": low},
+		dataflow.Record{"account": high, "ref": high},
+		dataflow.Record{"account": low, "ref": high},
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []dataflow.Record{
+		{"account": low, "records": int64(2), "refs": int64(2)},
+		{"account": high, "records": int64(1), "refs": int64(1)},
+	}
+	if got := out.Records(dataflow.DEFAULT_OUTPUT_PORT_NAME); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v\nwant %v", got, want)
+	}
+}
+
+func TestAggregateMergePasses(t *testing.T) {
+	config := map[string]interface{}{
+		"groupBy": []interface{}{"account"},
+		"aggregations": []interface{}{
+			map[string]interface{}{"function": "count", "outputField": "records"},
+			map[string]interface{}{"function": "concat", "field": "memo", "outputField": "memos"},
+		},
+		"maxGroupsInMemory": 1.0,
+		"maxMergeRuns":      2.0,
+	}
+
+	//Spills 3 runs: C and D, C and E, then C, so the first two are merged in a pass before the final merge
+	recs := []dataflow.Record{
+		{"account": "C", "memo": "1"},
+		{"account": "D", "memo": "2"},
+		{"account": "C", "memo": "3"},
+		{"account": "E", "memo": "4"},
+		{"account": "C", "memo": "5"},
+	}
+	out, err := runFunction(t, "aggregate", config, recordInput(recs...))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []dataflow.Record{
+		{"account": "C", "records": int64(3), "memos": "1,3,5"},
+		{"account": "D", "records": int64(1), "memos": "2"},
+		{"account": "E", "records": int64(1), "memos": "4"},
+	}
+	if got := out.Records(dataflow.DEFAULT_OUTPUT_PORT_NAME); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v\nwant %v", got, want)
+	}
+}
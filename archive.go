@@ -0,0 +1,196 @@
+package builtin
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bitbucket.org/primelogic_io/bitlantern/service/dataflow"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+)
+
+// Archive formats understood by expandFile. archiveFormatAuto detects the format from the file's first bytes.
+const (
+	archiveFormatAuto  = "auto"
+	archiveFormatGzip  = "gzip"
+	archiveFormatZip   = "zip"
+	archiveFormatTar   = "tar"
+	archiveFormatTarGz = "tar.gz"
+	archiveFormatNone  = "none"
+)
+
+var archiveFormats = []interface{}{archiveFormatAuto, archiveFormatGzip, archiveFormatZip, archiveFormatTar, archiveFormatTarGz}
+
+// archiveEntry is a file inside an archive. Its reader can only be read until the callback it was passed to returns.
+type archiveEntry struct {
+	filename string
+	reader   io.Reader
+}
+
+func (e *archiveEntry) Filename() string {
+	return e.filename
+}
+
+func (e *archiveEntry) Reader() io.Reader {
+	return e.reader
+}
+
+// detectArchiveFormat works out the format of a file from its first bytes (at least 512 of them, for tar)
+func detectArchiveFormat(head []byte) string {
+	switch {
+	case bytes.HasPrefix(head, []byte{0x1F, 0x8B}):
+		return archiveFormatGzip
+	case bytes.HasPrefix(head, []byte("PK\x03\x04")), bytes.HasPrefix(head, []byte("PK\x05\x06")):
+		return archiveFormatZip
+	case len(head) >= 262 && string(head[257:262]) == "ustar":
+		return archiveFormatTar
+	}
+
+	return archiveFormatNone
+}
+
+// expandFile calls fn with every file inside file, which is a gzip, zip, tar or gzipped tar archive. Directories and
+// links in archives are skipped. With the auto format the format is detected, and a file that isn't an archive is
+// passed to fn as it is. The filename of each file is its path inside the archive; for gzip, which only holds one
+// file, it's the name stored in the gzip header or the archive's name without .gz.
+func expandFile(file dataflow.File, format string, fn func(dataflow.File) error) error {
+	bufReader := bufio.NewReader(file.Reader())
+
+	if format == archiveFormatAuto {
+		head, _ := bufReader.Peek(512)
+		format = detectArchiveFormat(head)
+	}
+
+	switch format {
+	case archiveFormatGzip, archiveFormatTarGz:
+		gzReader, err := gzip.NewReader(bufReader)
+		if err != nil {
+			return err
+		}
+		defer gzReader.Close()
+
+		//A gzip file may well be a compressed tar
+		gzBufReader := bufio.NewReader(gzReader)
+		head, _ := gzBufReader.Peek(512)
+		if format == archiveFormatTarGz || detectArchiveFormat(head) == archiveFormatTar {
+			return expandTar(gzBufReader, fn)
+		}
+
+		filename := gunzippedFilename(file.Filename())
+		if gzReader.Header.Name != "" {
+			filename, err = archiveEntryFilename(gzReader.Header.Name)
+			if err != nil {
+				return err
+			}
+		}
+		return fn(&(archiveEntry{filename: filename, reader: gzBufReader}))
+	case archiveFormatZip:
+		return expandZip(bufReader, fn)
+	case archiveFormatTar:
+		return expandTar(bufReader, fn)
+	case archiveFormatNone:
+		return fn(&(archiveEntry{filename: file.Filename(), reader: bufReader}))
+	}
+
+	return fmt.Errorf("unsupported archive format %v", format)
+}
+
+func expandTar(r io.Reader, fn func(dataflow.File) error) error {
+	tarReader := tar.NewReader(r)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		filename, err := archiveEntryFilename(header.Name)
+		if err != nil {
+			return err
+		}
+
+		err = fn(&(archiveEntry{filename: filename, reader: tarReader}))
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// expandZip expands a zip archive. Zip's index is at the end of the file, so the archive is copied to a temp file
+// first rather than being held in memory.
+func expandZip(r io.Reader, fn func(dataflow.File) error) error {
+	tmpFile, err := ioutil.TempFile("", "expandZip")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+	defer tmpFile.Close()
+
+	size, err := io.Copy(tmpFile, r)
+	if err != nil {
+		return err
+	}
+
+	zipReader, err := zip.NewReader(tmpFile, size)
+	if err != nil {
+		return err
+	}
+
+	for _, zipFile := range zipReader.File {
+		if !zipFile.Mode().IsRegular() {
+			continue
+		}
+
+		filename, err := archiveEntryFilename(zipFile.Name)
+		if err != nil {
+			return err
+		}
+
+		entryReader, err := zipFile.Open()
+		if err != nil {
+			return err
+		}
+
+		err = fn(&(archiveEntry{filename: filename, reader: entryReader}))
+		entryReader.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// archiveEntryFilename cleans up the path of a file inside an archive. Paths that would escape the directory the
+// archive is expanded into (e.g. ../../etc/passwd) are rejected, since the files may be written to disk.
+func archiveEntryFilename(name string) (string, error) {
+	cleaned := path.Clean(strings.TrimLeft(strings.ReplaceAll(name, "\\", "/"), "/"))
+	if cleaned == "." || cleaned == ".." || strings.HasPrefix(cleaned, "../") {
+		return "", fmt.Errorf("invalid path %q in archive", name)
+	}
+
+	return cleaned, nil
+}
+
+// gunzippedFilename is the name of a gzipped file once it's decompressed, e.g. customers.csv for customers.csv.gz
+func gunzippedFilename(filename string) string {
+	lower := strings.ToLower(filename)
+	for _, ext := range []string{".gz", ".gzip"} {
+		if strings.HasSuffix(lower, ext) {
+			return filename[:len(filename)-len(ext)]
+		}
+	}
+
+	return filename
+}
@@ -1,6 +1,9 @@
 package builtin
 
-import "bitbucket.org/primelogic_io/bitlantern/service/dataflow"
+import (
+	"bitbucket.org/primelogic_io/bitlantern/service/dataflow"
+	"fmt"
+)
 
 var (
 	// This should be one of the rare cases where a package variable makes sense, since these are built-in functions.
@@ -11,11 +14,22 @@ var (
 // BuiltinFunctionProvider implements FunctionProvider for built-in (i.e. Go implemented) functions.
 type FunctionProvider struct {
 	functions []Function
+
+	// configFileDir is the directory files named in configs are read from; see SetConfigFileDir
+	configFileDir string
 }
 
+// Function is a registered builtin function. Its ports are declared in FunctionSpec.InputPorts and
+// FunctionSpec.OutputPorts (see dataflowPorts), so the workflow engine sees them.
 type Function struct {
 	FunctionSpec dataflow.FunctionSpec
-	NewFunction  func() dataflow.Function
+	ConfigSchema ConfigSchema
+
+	// ResolveOutputPorts, if set, returns the output ports for a given config. It is used by functions whose output
+	// ports depend on their config, in which case FunctionSpec.OutputPorts only lists the ports every config has.
+	ResolveOutputPorts func(config map[string]interface{}) ([]PortSpec, error)
+
+	NewFunction func() dataflow.Function
 }
 
 // DefaultInstance returns the default instance of the builtin.FunctionProvider. This instance should be used as it is
@@ -46,6 +60,89 @@ func (bfp *FunctionProvider) GetFunctionSpecByKey(key string) (*dataflow.Functio
 	return nil, nil
 }
 
+// GetConfigSchemaByKey returns the ConfigSchema of the function whose key matches the one passed in.
+func (bfp *FunctionProvider) GetConfigSchemaByKey(key string) (*ConfigSchema, error) {
+	for i := range bfp.functions {
+		cur := bfp.functions[i]
+		if cur.FunctionSpec.Key == key {
+			return &(bfp.functions[i].ConfigSchema), nil
+		}
+	}
+
+	return nil, nil
+}
+
+// ValidateConfig checks config against the ConfigSchema of the function whose key matches the one passed in. If the
+// config is invalid a *ConfigValidationError listing every violation is returned. This should be called before
+// NewFunction(key).Execute so that bad configs are rejected up front instead of failing mid-run.
+func (bfp *FunctionProvider) ValidateConfig(key string, config map[string]interface{}) error {
+	schema, err := bfp.GetConfigSchemaByKey(key)
+	if err != nil {
+		return err
+	}
+	if schema == nil {
+		return fmt.Errorf("no builtin function with key %v", key)
+	}
+
+	violations := schema.Validate(config)
+	if len(violations) > 0 {
+		return &(ConfigValidationError{FunctionKey: key, Violations: violations})
+	}
+
+	return nil
+}
+
+// ApplyConfigDefaults returns a copy of config with the schema defaults of the function whose key matches the one
+// passed in filled in.
+func (bfp *FunctionProvider) ApplyConfigDefaults(key string, config map[string]interface{}) (map[string]interface{}, error) {
+	schema, err := bfp.GetConfigSchemaByKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if schema == nil {
+		return nil, fmt.Errorf("no builtin function with key %v", key)
+	}
+
+	return schema.ApplyDefaults(config), nil
+}
+
+// GetInputPortsByKey returns the input ports of the function whose key matches the one passed in.
+func (bfp *FunctionProvider) GetInputPortsByKey(key string) ([]PortSpec, error) {
+	for i := range bfp.functions {
+		cur := bfp.functions[i]
+		if cur.FunctionSpec.Key == key {
+			return portSpecs(cur.FunctionSpec.InputPorts), nil
+		}
+	}
+
+	return nil, fmt.Errorf("no builtin function with key %v", key)
+}
+
+// ResolveOutputPorts returns the effective output ports of the function whose key matches the one passed in, for the
+// given config. Functions that route to ports named in their config (splitOnField, splitOnFieldJS, fileRouter) return
+// one port per distinct name, so the config must be valid.
+func (bfp *FunctionProvider) ResolveOutputPorts(key string, config map[string]interface{}) ([]PortSpec, error) {
+	for i := range bfp.functions {
+		cur := bfp.functions[i]
+		if cur.FunctionSpec.Key != key {
+			continue
+		}
+
+		if cur.ResolveOutputPorts == nil {
+			return portSpecs(cur.FunctionSpec.OutputPorts), nil
+		}
+
+		err := bfp.ValidateConfig(key, config)
+		if err != nil {
+			return nil, err
+		}
+
+		return cur.ResolveOutputPorts(cur.ConfigSchema.ApplyDefaults(config))
+	}
+
+	return nil, fmt.Errorf("no builtin function with key %v", key)
+}
+
 // GetExecutableFunction finds, builds, and returns an executable Function whose key matches the one passed in.
 func (bfp *FunctionProvider) NewFunction(key string) (dataflow.Function, error) {
 	for i := range bfp.functions {
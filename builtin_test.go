@@ -0,0 +1,202 @@
+package builtin
+
+import (
+	"bitbucket.org/primelogic_io/bitlantern/service/dataflow"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// runFunction executes the registered builtin with the given input and returns everything it wrote
+func runFunction(t *testing.T, key string, config map[string]interface{}, in *MemoryInputReader) (*MemoryOutputWriter, error) {
+	t.Helper()
+
+	fn, err := DefaultInstance().NewFunction(key)
+	if err != nil || fn == nil {
+		t.Fatalf("no builtin function registered with key %v", key)
+	}
+
+	out := NewMemoryOutputWriter()
+	err = fn.Execute(in, out, config)
+
+	if !out.Closed() {
+		t.Errorf("%v did not close its output writer", key)
+	}
+
+	return out, err
+}
+
+func recordInput(recs ...dataflow.Record) *MemoryInputReader {
+	in := NewMemoryInputReader()
+	for i := range recs {
+		in.AddRecord(dataflow.DEFAULT_INPUT_PORT_NAME, recs[i])
+	}
+
+	return in
+}
+
+func fileInput(filename string, data string) *MemoryInputReader {
+	return NewMemoryInputReader().AddFileFromString(dataflow.DEFAULT_INPUT_PORT_NAME, filename, data)
+}
+
+func TestValidateConfig(t *testing.T) {
+	tests := []struct {
+		name      string
+		key       string
+		config    map[string]interface{}
+		wantPaths []string
+	}{
+		{
+			name:   "valid",
+			key:    "writeFileToDisk",
+			config: map[string]interface{}{"destinationFolder": "/tmp"},
+		},
+		{
+			name:      "missing required key",
+			key:       "writeFileToDisk",
+			config:    map[string]interface{}{},
+			wantPaths: []string{"destinationFolder"},
+		},
+		{
+			name: "nested violations are all reported",
+			key:  "splitOnField",
+			config: map[string]interface{}{
+				"defaultOutputPort": "other",
+				"rules": []interface{}{
+					map[string]interface{}{"field": "state", "op": "~", "value": "TX", "valueType": "literal", "outputPort": "tx"},
+					map[string]interface{}{"field": 5.0, "op": "==", "value": "CA", "valueType": "literal"},
+				},
+			},
+			wantPaths: []string{"rules[0].op", "rules[1].field", "rules[1].outputPort"},
+		},
+		{
+			name: "integer must not have a fraction",
+			key:  "parseFixedLength",
+			config: map[string]interface{}{
+				"columns": []interface{}{
+					map[string]interface{}{"start": 0.5, "length": 2.0, "datatype": "string", "fieldName": "a"},
+				},
+			},
+			wantPaths: []string{"columns[0].start"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := DefaultInstance().ValidateConfig(tt.key, tt.config)
+			if len(tt.wantPaths) == 0 {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+
+			var validationErr *ConfigValidationError
+			if !errors.As(err, &validationErr) {
+				t.Fatalf("expected a *ConfigValidationError, got %v", err)
+			}
+
+			gotPaths := make([]string, len(validationErr.Violations))
+			for i := range validationErr.Violations {
+				gotPaths[i] = validationErr.Violations[i].Path
+			}
+			if !reflect.DeepEqual(gotPaths, tt.wantPaths) {
+				t.Errorf("violation paths = %v, want %v", gotPaths, tt.wantPaths)
+			}
+		})
+	}
+}
+
+func TestApplyConfigDefaults(t *testing.T) {
+	config := map[string]interface{}{"filename": "out.csv", "headerValue": []interface{}{"a"}}
+	withDefaults, err := DefaultInstance().ApplyConfigDefaults("generateCSV", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if withDefaults["delimiter"] != "," || withDefaults["header"] != "false" {
+		t.Errorf("defaults not applied: %v", withDefaults)
+	}
+	if _, ok := config["delimiter"]; ok {
+		t.Errorf("ApplyConfigDefaults modified the passed in config")
+	}
+}
+
+func TestResolveOutputPorts(t *testing.T) {
+	tests := []struct {
+		name   string
+		key    string
+		config map[string]interface{}
+		want   []string
+	}{
+		{
+			name: "static ports",
+			key:  "parseCSV",
+			want: []string{dataflow.DEFAULT_OUTPUT_PORT_NAME, ERROR_OUTPUT_PORT_NAME},
+		},
+		{
+			name: "ports from rules are de-duplicated",
+			key:  "splitOnFieldJS",
+			config: map[string]interface{}{
+				"defaultOutputPort": "other",
+				"rules": []interface{}{
+					map[string]interface{}{"jsCondition": "data.a == 1", "outputPort": "one"},
+					map[string]interface{}{"jsCondition": "data.a == 2", "outputPort": "other"},
+					map[string]interface{}{"jsCondition": "data.a == 3", "outputPort": "one"},
+				},
+			},
+			want: []string{"other", "one", ERROR_OUTPUT_PORT_NAME},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ports, err := DefaultInstance().ResolveOutputPorts(tt.key, tt.config)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := make([]string, len(ports))
+			for i := range ports {
+				got[i] = ports[i].Name
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ports = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolveOutputPortsRejectsErrorPort(t *testing.T) {
+	configs := map[string]map[string]interface{}{
+		"splitOnField": {
+			"defaultOutputPort": "other",
+			"rules":             []interface{}{splitRuleMap("a", "==", "x", "literal", ERROR_OUTPUT_PORT_NAME)},
+		},
+		"splitOnFieldJS": {
+			"defaultOutputPort": ERROR_OUTPUT_PORT_NAME,
+			"rules":             []interface{}{map[string]interface{}{"jsCondition": "true", "outputPort": "one"}},
+		},
+		"fileRouter": {
+			"defaultOutputPort": "other",
+			"rules":             []interface{}{map[string]interface{}{"jsCondition": "true", "outputPort": ERROR_OUTPUT_PORT_NAME}},
+		},
+	}
+
+	for key, config := range configs {
+		if _, err := DefaultInstance().ResolveOutputPorts(key, config); err == nil {
+			t.Errorf("%v: expected an error for a port named %q", key, ERROR_OUTPUT_PORT_NAME)
+		}
+	}
+}
+
+func TestRegisteredFunctionsDeclarePorts(t *testing.T) {
+	for _, f := range DefaultInstance().functions {
+		if len(f.FunctionSpec.InputPorts) == 0 {
+			t.Errorf("%v has no input ports", f.FunctionSpec.Key)
+		}
+		if len(f.FunctionSpec.OutputPorts) == 0 {
+			t.Errorf("%v has no output ports", f.FunctionSpec.Key)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+// runPipeline runs a chain of builtin functions locally, without the workflow engine. It is meant for prototyping
+// pipelines against files on disk:
+//
+//	runPipeline -pipeline pipeline.yaml -output ./out data/customers.csv data/more.csv
+//
+// See builtin.Pipeline for the pipeline definition format.
+package main
+
+import (
+	"bitbucket.org/primelogic_io/bitlantern/service/builtin"
+	"bitbucket.org/primelogic_io/bitlantern/service/dataflow"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+func main() {
+	pipelinePath := flag.String("pipeline", "", "Path to the pipeline definition (.yaml, .yml or .json)")
+	outputDir := flag.String("output", "output", "Directory the output of every step is written to")
+	configFileDir := flag.String("configFiles", "", "Directory files named in step configs (helperScripts, copybookFile) are read from. Defaults to the pipeline's directory")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %v -pipeline <file> [-output <dir>] <input files...>\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if *pipelinePath == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if *configFileDir == "" {
+		*configFileDir = filepath.Dir(*pipelinePath)
+	}
+	builtin.DefaultInstance().SetConfigFileDir(*configFileDir)
+
+	err := run(*pipelinePath, *outputDir, flag.Args())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func run(pipelinePath string, outputDir string, inputPaths []string) error {
+	pipeline, err := builtin.LoadPipelineFile(pipelinePath)
+	if err != nil {
+		return err
+	}
+
+	inputFiles := make([]dataflow.File, 0, len(inputPaths))
+	for _, path := range inputPaths {
+		file, err := builtin.NewMemoryFileFromDisk(path)
+		if err != nil {
+			return err
+		}
+		inputFiles = append(inputFiles, file)
+	}
+
+	results, runErr := pipeline.Run(builtin.DefaultInstance(), inputFiles)
+
+	//Save whatever was produced, even if a step failed, since the partial output helps with debugging
+	err = builtin.WritePipelineOutputs(results, outputDir)
+	if err != nil {
+		return err
+	}
+
+	printSummary(pipeline, results)
+
+	return runErr
+}
+
+func printSummary(pipeline *builtin.Pipeline, results map[string]*builtin.MemoryOutputWriter) {
+	for _, step := range pipeline.Steps {
+		out, ok := results[step.Name]
+		if !ok {
+			continue
+		}
+
+		for _, port := range out.Ports() {
+			fmt.Printf("%v.%v: %d records, %d files\n", step.Name, port, len(out.Records(port)), len(out.Files(port)))
+		}
+	}
+}
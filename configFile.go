@@ -0,0 +1,61 @@
+package builtin
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+// SetConfigFileDir sets the directory that files named in function configs (helperScripts, copybookFile) are read
+// from. Paths in configs are relative to it and can't refer to anything outside it. Until it's set, configs can't name
+// files at all, so a pipeline author can't read arbitrary files from the server.
+func (bfp *FunctionProvider) SetConfigFileDir(dir string) {
+	bfp.configFileDir = dir
+}
+
+// readConfigFile reads a file named in a function config, from the default instance's config file directory
+func readConfigFile(path string) ([]byte, error) {
+	resolved, err := DefaultInstance().resolveConfigFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return ioutil.ReadFile(resolved)
+}
+
+// resolveConfigFile returns the path of a file named in a function config, which must be inside the config file
+// directory once symlinks are followed
+func (bfp *FunctionProvider) resolveConfigFile(path string) (string, error) {
+	if bfp.configFileDir == "" {
+		return "", fmt.Errorf("can't read %v: no config file directory is set", path)
+	}
+	if filepath.IsAbs(path) {
+		return "", fmt.Errorf("can't read %v: config file paths must be relative", path)
+	}
+
+	dir, err := filepath.EvalSymlinks(bfp.configFileDir)
+	if err != nil {
+		return "", fmt.Errorf("config file directory: %v", err)
+	}
+	dir, err = filepath.Abs(dir)
+	if err != nil {
+		return "", fmt.Errorf("config file directory: %v", err)
+	}
+
+	resolved, err := filepath.EvalSymlinks(filepath.Join(dir, path))
+	if err != nil {
+		return "", err
+	}
+	resolved, err = filepath.Abs(resolved)
+	if err != nil {
+		return "", err
+	}
+
+	rel, err := filepath.Rel(dir, resolved)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("can't read %v: it's outside the config file directory", path)
+	}
+
+	return resolved, nil
+}
@@ -0,0 +1,62 @@
+package builtin
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// setTestConfigFileDir sets the default instance's config file directory to a new temp dir for the test, and returns it
+func setTestConfigFileDir(t *testing.T) string {
+	t.Helper()
+
+	dir := t.TempDir()
+	previous := DefaultInstance().configFileDir
+	DefaultInstance().SetConfigFileDir(dir)
+	t.Cleanup(func() {
+		DefaultInstance().SetConfigFileDir(previous)
+	})
+
+	return dir
+}
+
+func TestReadConfigFile(t *testing.T) {
+	outside := t.TempDir()
+	err := ioutil.WriteFile(filepath.Join(outside, "secret.txt"), []byte("secret"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	DefaultInstance().SetConfigFileDir("")
+	if _, err := readConfigFile("helpers.js"); err == nil {
+		t.Error("expected an error without a config file directory")
+	}
+
+	dir := setTestConfigFileDir(t)
+	err = os.MkdirAll(filepath.Join(dir, "scripts"), 0755)
+	if err == nil {
+		err = ioutil.WriteFile(filepath.Join(dir, "scripts", "helpers.js"), []byte("helpers"), 0644)
+	}
+	if err == nil {
+		err = os.Symlink(filepath.Join(outside, "secret.txt"), filepath.Join(dir, "link.txt"))
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := readConfigFile("scripts/../scripts/helpers.js")
+	if err != nil || string(data) != "helpers" {
+		t.Errorf("got %q, %v, want the helper script", data, err)
+	}
+
+	for _, path := range []string{
+		filepath.Join(outside, "secret.txt"),
+		"../" + filepath.Base(outside) + "/secret.txt",
+		"link.txt",
+	} {
+		if data, err := readConfigFile(path); err == nil {
+			t.Errorf("%v: got %q, want an error", path, data)
+		}
+	}
+}
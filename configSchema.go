@@ -0,0 +1,251 @@
+package builtin
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+// Config value types understood by ConfigField.Type. These line up with the types produced by decoding JSON (and
+// YAML) config into a map[string]interface{}.
+const (
+	ConfigTypeString  = "string"
+	ConfigTypeBoolean = "boolean"
+	ConfigTypeNumber  = "number"
+	ConfigTypeInteger = "integer"
+	ConfigTypeArray   = "array"
+	ConfigTypeObject  = "object"
+	ConfigTypeAny     = "any"
+)
+
+// ConfigSchema is a machine readable description of the config map a builtin function accepts. It is declared
+// alongside the dataflow.FunctionSpec so that configs can be checked (e.g. by the pipeline editor) before a function
+// is ever executed.
+type ConfigSchema struct {
+	Fields []ConfigField `json:"fields"`
+}
+
+// ConfigField describes a single key in a config map (or, when used as ConfigField.Items, a single array element).
+type ConfigField struct {
+	Key         string `json:"key,omitempty"`
+	Type        string `json:"type"`
+	Description string `json:"description,omitempty"`
+	Required    bool   `json:"required,omitempty"`
+
+	// Enum, if not empty, lists the only values allowed for this field
+	Enum []interface{} `json:"enum,omitempty"`
+
+	// Default is the value used when the key is missing. It is only applied by ConfigSchema.ApplyDefaults.
+	Default interface{} `json:"default,omitempty"`
+
+	// Items describes each element of an array field
+	Items *ConfigField `json:"items,omitempty"`
+
+	// Fields describes the keys of an object field
+	Fields []ConfigField `json:"fields,omitempty"`
+}
+
+// ConfigViolation is a single problem found in a config map. Path points at the offending value, for example
+// "rules[2].outputPort".
+type ConfigViolation struct {
+	Path    string `json:"path"`
+	Message string `json:"message"`
+}
+
+// ConfigValidationError is returned when a config map doesn't match the function's ConfigSchema. It carries every
+// violation found, not just the first.
+type ConfigValidationError struct {
+	FunctionKey string
+	Violations  []ConfigViolation
+}
+
+func (e *ConfigValidationError) Error() string {
+	msgs := make([]string, len(e.Violations))
+	for i := range e.Violations {
+		msgs[i] = fmt.Sprintf("%v: %v", e.Violations[i].Path, e.Violations[i].Message)
+	}
+
+	return fmt.Sprintf("invalid config for function %v: %v", e.FunctionKey, strings.Join(msgs, "; "))
+}
+
+// Validate checks config against the schema and returns every violation found. A nil result means the config is valid.
+func (s ConfigSchema) Validate(config map[string]interface{}) []ConfigViolation {
+	var violations []ConfigViolation
+	validateConfigFields("", s.Fields, config, &violations)
+	return violations
+}
+
+// ApplyDefaults returns a copy of config with the default value filled in for every missing key that has one,
+// including keys of nested objects and objects inside arrays. The passed in map is not modified.
+func (s ConfigSchema) ApplyDefaults(config map[string]interface{}) map[string]interface{} {
+	return applyConfigDefaults(s.Fields, config)
+}
+
+func validateConfigFields(prefix string, fields []ConfigField, config map[string]interface{}, violations *[]ConfigViolation) {
+	for i := range fields {
+		field := &(fields[i])
+		path := field.Key
+		if prefix != "" {
+			path = prefix + "." + field.Key
+		}
+
+		val, ok := config[field.Key]
+		if !ok || val == nil {
+			if field.Required {
+				*violations = append(*violations, ConfigViolation{Path: path, Message: "is required"})
+			}
+			continue
+		}
+
+		validateConfigValue(path, field, val, violations)
+	}
+}
+
+func validateConfigValue(path string, field *ConfigField, val interface{}, violations *[]ConfigViolation) {
+	if !configValueHasType(val, field.Type) {
+		*violations = append(*violations, ConfigViolation{
+			Path:    path,
+			Message: fmt.Sprintf("must be of type %v, got %v", field.Type, configValueTypeName(val)),
+		})
+		return
+	}
+
+	if len(field.Enum) > 0 && !configEnumContains(field.Enum, val) {
+		*violations = append(*violations, ConfigViolation{
+			Path:    path,
+			Message: fmt.Sprintf("must be one of %v, got %v", field.Enum, val),
+		})
+	}
+
+	switch field.Type {
+	case ConfigTypeArray:
+		if field.Items == nil {
+			return
+		}
+		items := val.([]interface{})
+		for idx := range items {
+			validateConfigValue(fmt.Sprintf("%v[%d]", path, idx), field.Items, items[idx], violations)
+		}
+	case ConfigTypeObject:
+		validateConfigFields(path, field.Fields, val.(map[string]interface{}), violations)
+	}
+}
+
+func configValueHasType(val interface{}, configType string) bool {
+	switch configType {
+	case ConfigTypeString:
+		_, ok := val.(string)
+		return ok
+	case ConfigTypeBoolean:
+		_, ok := val.(bool)
+		return ok
+	case ConfigTypeNumber:
+		_, ok := configValueAsFloat(val)
+		return ok
+	case ConfigTypeInteger:
+		f, ok := configValueAsFloat(val)
+		return ok && f == math.Trunc(f)
+	case ConfigTypeArray:
+		_, ok := val.([]interface{})
+		return ok
+	case ConfigTypeObject:
+		_, ok := val.(map[string]interface{})
+		return ok
+	case ConfigTypeAny, "":
+		return true
+	default:
+		return false
+	}
+}
+
+func configValueAsFloat(val interface{}) (float64, bool) {
+	switch v := val.(type) {
+	case float64:
+		return v, true
+	case float32:
+		return float64(v), true
+	case int:
+		return float64(v), true
+	case int8:
+		return float64(v), true
+	case int16:
+		return float64(v), true
+	case int32:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	default:
+		return 0, false
+	}
+}
+
+func configValueTypeName(val interface{}) string {
+	for _, t := range []string{ConfigTypeString, ConfigTypeBoolean, ConfigTypeInteger, ConfigTypeNumber, ConfigTypeArray, ConfigTypeObject} {
+		if configValueHasType(val, t) {
+			return t
+		}
+	}
+
+	return fmt.Sprintf("%T", val)
+}
+
+func configEnumContains(enum []interface{}, val interface{}) bool {
+	for i := range enum {
+		if enum[i] == val {
+			return true
+		}
+
+		//Numbers may have been decoded as a different numeric type than the enum was declared with
+		enumFloat, enumIsNum := configValueAsFloat(enum[i])
+		valFloat, valIsNum := configValueAsFloat(val)
+		if enumIsNum && valIsNum && enumFloat == valFloat {
+			return true
+		}
+	}
+
+	return false
+}
+
+func applyConfigDefaults(fields []ConfigField, config map[string]interface{}) map[string]interface{} {
+	result := make(map[string]interface{}, len(config))
+	for key, val := range config {
+		result[key] = val
+	}
+
+	for i := range fields {
+		field := &(fields[i])
+
+		val, ok := result[field.Key]
+		if !ok || val == nil {
+			if field.Default != nil {
+				result[field.Key] = field.Default
+			}
+			continue
+		}
+
+		result[field.Key] = applyConfigValueDefaults(field, val)
+	}
+
+	return result
+}
+
+func applyConfigValueDefaults(field *ConfigField, val interface{}) interface{} {
+	switch field.Type {
+	case ConfigTypeObject:
+		if valMap, ok := val.(map[string]interface{}); ok {
+			return applyConfigDefaults(field.Fields, valMap)
+		}
+	case ConfigTypeArray:
+		items, ok := val.([]interface{})
+		if !ok || field.Items == nil {
+			return val
+		}
+		newItems := make([]interface{}, len(items))
+		for idx := range items {
+			newItems[idx] = applyConfigValueDefaults(field.Items, items[idx])
+		}
+		return newItems
+	}
+
+	return val
+}
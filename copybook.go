@@ -0,0 +1,629 @@
+package builtin
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// copybookConfigFields are the config fields that let parseFixedLength derive its columns from a COBOL copybook,
+// rather than listing each column by hand. They are accepted at the top level and in each recordTypes layout.
+var copybookConfigFields = []ConfigField{
+	{Key: "copybook", Type: ConfigTypeString, Description: "COBOL copybook the columns are derived from"},
+	{Key: "copybookFile", Type: ConfigTypeString, Description: "Path of a COBOL copybook the columns are derived from, relative to the config file directory"},
+	{Key: "copybookRecord", Type: ConfigTypeString, Description: "Name of the 01 level record to use, when the copybook has more than one"},
+	{Key: "copybookFormat", Type: ConfigTypeString, Enum: []interface{}{"fixed", "free"}, Default: "fixed", Description: "fixed ignores the sequence area (columns 1-6) and everything after column 72"},
+}
+
+// copybookItem is a single data description entry from a copybook, e.g. "05 CUST-NAME PIC X(20)."
+type copybookItem struct {
+	level     int
+	name      string
+	pic       string
+	usage     string
+	occurs    int
+	redefines string
+	values    []copybookValue //level 88 only
+
+	children   []*copybookItem
+	conditions []*copybookItem //level 88 items that belong to this item
+}
+
+// copybookValue is a single VALUE of a level 88 condition name. thru is only set for ranges, e.g. VALUE 1 THRU 5.
+type copybookValue struct {
+	value string
+	thru  string
+}
+
+// copybookConfig holds the copybook related config of parseFixedLength, or of one of its layouts
+type copybookConfig struct {
+	text   string
+	record string
+	format string
+}
+
+// buildCopybookConfig reads the copybook fields from config, loading copybookFile if it's set. It returns false if
+// neither copybook nor copybookFile is set.
+func buildCopybookConfig(config map[string]interface{}) (copybookConfig, bool, error) {
+	c := copybookConfig{}
+	c.record, _ = config["copybookRecord"].(string)
+	c.format, _ = config["copybookFormat"].(string)
+
+	text, hasText := config["copybook"].(string)
+	path, hasPath := config["copybookFile"].(string)
+
+	if hasText && hasPath {
+		return c, false, fmt.Errorf("only one of copybook and copybookFile can be set")
+	}
+
+	if hasPath {
+		data, err := readConfigFile(path)
+		if err != nil {
+			return c, false, fmt.Errorf("unable to read copybook: %v", err)
+		}
+		text = string(data)
+	} else if !hasText {
+		return c, false, nil
+	}
+
+	c.text = text
+	return c, true, nil
+}
+
+// copybookColumns parses the copybook and returns a column for every elementary item of the selected 01 level record.
+//
+// PIC X and A items become string columns. Unsigned PIC 9 items become integer columns, or decimal columns if they
+// have an implied decimal point (V), and signed (S9) items become zoned columns. COMP-3 items become packed columns and
+// COMP, COMP-4, COMP-5 and BINARY items become binary columns. Edited pictures (e.g. ZZ9.99) are read as strings.
+// OCCURS repeats the item, with the occurrence number appended to the field name (PHONE OCCURS 2 gives phone_1 and
+// phone_2), REDEFINES items share the offset of the item they redefine and FILLER items are skipped. Each level 88
+// condition name adds a boolean field that is true when the item's value matches one of the condition's values.
+// Names are converted to camel case, so CUST-NAME becomes custName.
+func copybookColumns(c copybookConfig) ([]parseFixedLengthColumn, error) {
+	records, err := parseCopybook(c.text, c.format)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(records) == 0 {
+		return nil, fmt.Errorf("copybook doesn't contain any data items")
+	}
+
+	record := records[0]
+	if c.record != "" {
+		record = nil
+		for i := range records {
+			if strings.EqualFold(records[i].name, c.record) {
+				record = records[i]
+			}
+		}
+		if record == nil {
+			return nil, fmt.Errorf("copybook doesn't contain record %v", c.record)
+		}
+	} else if len(records) > 1 {
+		return nil, fmt.Errorf("copybook contains %d records, copybookRecord must be set", len(records))
+	}
+
+	var columns []parseFixedLengthColumn
+	_, err = copybookItemColumns(record, 0, "", "", &columns)
+	if err != nil {
+		return nil, err
+	}
+
+	return columns, nil
+}
+
+// copybookItemColumns appends the columns for the item, which starts at offset, and returns the item's length. usage is
+// inherited from the parent group and suffix is the occurrence suffix of any enclosing OCCURS.
+func copybookItemColumns(item *copybookItem, offset int, usage string, suffix string, columns *[]parseFixedLengthColumn) (int, error) {
+	if item.usage != "" {
+		usage = item.usage
+	}
+
+	occurs := item.occurs
+	if occurs == 0 {
+		occurs = 1
+	}
+
+	length := 0
+	for occurrence := 1; occurrence <= occurs; occurrence++ {
+		curSuffix := suffix
+		if item.occurs > 0 {
+			curSuffix = fmt.Sprintf("%v_%d", suffix, occurrence)
+		}
+
+		var err error
+		if len(item.children) > 0 {
+			length, err = copybookGroupColumns(item, offset, usage, curSuffix, columns)
+		} else {
+			length, err = copybookElementaryColumn(item, offset, usage, curSuffix, columns)
+		}
+		if err != nil {
+			return 0, err
+		}
+
+		offset += length
+	}
+
+	return length * occurs, nil
+}
+
+func copybookGroupColumns(item *copybookItem, offset int, usage string, suffix string, columns *[]parseFixedLengthColumn) (int, error) {
+	if item.pic != "" {
+		return 0, fmt.Errorf("copybook item %v: group items can't have a PIC clause", item.name)
+	}
+	if len(item.conditions) > 0 {
+		return 0, fmt.Errorf("copybook item %v: level 88 conditions are only supported on elementary items", item.name)
+	}
+
+	starts := make(map[string]int)
+	pos := offset
+	end := offset
+
+	for _, child := range item.children {
+		start := pos
+		if child.redefines != "" {
+			redefined, ok := starts[strings.ToUpper(child.redefines)]
+			if !ok {
+				return 0, fmt.Errorf("copybook item %v: REDEFINES unknown item %v", child.name, child.redefines)
+			}
+			start = redefined
+		}
+
+		length, err := copybookItemColumns(child, start, usage, suffix, columns)
+		if err != nil {
+			return 0, err
+		}
+
+		starts[strings.ToUpper(child.name)] = start
+		if child.redefines == "" || start+length > pos {
+			//A REDEFINES item only moves the next item along if it's larger than the item it redefines
+			pos = start + length
+		}
+
+		if pos > end {
+			end = pos
+		}
+	}
+
+	return end - offset, nil
+}
+
+func copybookElementaryColumn(item *copybookItem, offset int, usage string, suffix string, columns *[]parseFixedLengthColumn) (int, error) {
+	if item.pic == "" {
+		return 0, fmt.Errorf("copybook item %v: elementary items must have a PIC clause", item.name)
+	}
+
+	pic, err := parseCopybookPicture(item.pic)
+	if err != nil {
+		return 0, fmt.Errorf("copybook item %v: %v", item.name, err)
+	}
+
+	col := parseFixedLengthColumn{
+		columnFormat: columnFormat{
+			datatype:        "string",
+			location:        time.UTC,
+			impliedDecimals: pic.scale,
+			signed:          pic.signed,
+		},
+		start:     offset,
+		length:    pic.length,
+		fieldName: copybookFieldName(item.name) + suffix,
+	}
+
+	switch usage {
+	case "", "DISPLAY":
+		if pic.numeric && pic.signed {
+			col.datatype = "zoned"
+		} else if pic.numeric && pic.scale > 0 {
+			col.datatype = "decimal"
+		} else if pic.numeric {
+			col.datatype = "integer"
+		}
+	case "COMP-3":
+		if !pic.numeric {
+			return 0, fmt.Errorf("copybook item %v: COMP-3 items must have a numeric PIC", item.name)
+		}
+		col.datatype = "packed"
+		col.length = pic.length/2 + 1
+	case "COMP", "COMP-5":
+		if !pic.numeric {
+			return 0, fmt.Errorf("copybook item %v: COMP items must have a numeric PIC", item.name)
+		}
+		col.datatype = "binary"
+		if pic.length <= 4 {
+			col.length = 2
+		} else if pic.length <= 9 {
+			col.length = 4
+		} else {
+			col.length = 8
+		}
+	default:
+		return 0, fmt.Errorf("copybook item %v: USAGE %v is not supported", item.name, usage)
+	}
+
+	if !pic.numeric {
+		col.impliedDecimals = 0
+	}
+
+	if strings.EqualFold(item.name, "FILLER") {
+		return col.length, nil
+	}
+
+	for _, condition := range item.conditions {
+		newCondition := parseFixedLengthCondition{fieldName: copybookFieldName(condition.name) + suffix}
+		for _, val := range condition.values {
+			newCondition.values = append(newCondition.values, parseFixedLengthConditionValue{value: val.value, thru: val.thru})
+		}
+		col.conditions = append(col.conditions, newCondition)
+	}
+
+	*columns = append(*columns, col)
+	return col.length, nil
+}
+
+// copybookPicture describes a PIC clause
+type copybookPicture struct {
+	length  int  //number of characters the item takes up
+	numeric bool //only 9, S and V symbols
+	signed  bool //starts with S
+	scale   int  //digits after the implied decimal point
+}
+
+// parseCopybookPicture expands a picture string such as S9(5)V99 and works out its size
+func parseCopybookPicture(pic string) (copybookPicture, error) {
+	p := copybookPicture{numeric: true}
+	afterV := false
+	upper := strings.ToUpper(pic)
+
+	for i := 0; i < len(upper); i++ {
+		symbol := upper[i]
+		count := 1
+
+		if i+1 < len(upper) && upper[i+1] == '(' {
+			end := strings.IndexByte(upper[i:], ')')
+			if end < 0 {
+				return p, fmt.Errorf("invalid PIC %v", pic)
+			}
+			n, err := strconv.Atoi(upper[i+2 : i+end])
+			if err != nil || n <= 0 {
+				return p, fmt.Errorf("invalid PIC %v", pic)
+			}
+			count = n
+			i += end
+		}
+
+		switch symbol {
+		case '9':
+			p.length += count
+			if afterV {
+				p.scale += count
+			}
+		case 'S':
+			if i != 0 {
+				p.numeric = false
+			}
+			p.signed = true
+		case 'V':
+			afterV = true
+		case 'P':
+			return p, fmt.Errorf("PIC %v: scaling positions (P) are not supported", pic)
+		default:
+			p.numeric = false
+			p.length += count
+		}
+	}
+
+	if p.length == 0 {
+		return p, fmt.Errorf("invalid PIC %v", pic)
+	}
+
+	if !p.numeric && (afterV || strings.HasPrefix(upper, "S")) {
+		return p, fmt.Errorf("PIC %v: S and V are only valid in numeric pictures", pic)
+	}
+
+	return p, nil
+}
+
+// copybookFieldName converts a COBOL data name such as CUST-NAME to custName
+func copybookFieldName(name string) string {
+	parts := strings.FieldsFunc(strings.ToLower(name), func(r rune) bool {
+		return r == '-' || r == '_'
+	})
+
+	for i := 1; i < len(parts); i++ {
+		parts[i] = strings.ToUpper(parts[i][:1]) + parts[i][1:]
+	}
+
+	return strings.Join(parts, "")
+}
+
+// parseCopybook parses the data description entries in a copybook and returns the 01 level records. Level 77 items
+// are treated as records of their own.
+func parseCopybook(text string, format string) ([]*copybookItem, error) {
+	statements, err := copybookStatements(text, format)
+	if err != nil {
+		return nil, err
+	}
+
+	var records []*copybookItem
+	var stack []*copybookItem
+
+	for _, tokens := range statements {
+		item, err := parseCopybookStatement(tokens)
+		if err != nil {
+			return nil, err
+		}
+
+		if item.level == 88 {
+			if len(stack) == 0 {
+				return nil, fmt.Errorf("copybook item %v: level 88 must follow a data item", item.name)
+			}
+			parent := stack[len(stack)-1]
+			parent.conditions = append(parent.conditions, item)
+			continue
+		}
+
+		if item.level == 1 || item.level == 77 {
+			records = append(records, item)
+			stack = []*copybookItem{item}
+			continue
+		}
+
+		for len(stack) > 0 && stack[len(stack)-1].level >= item.level {
+			stack = stack[:len(stack)-1]
+		}
+		if len(stack) == 0 || stack[len(stack)-1].level == 77 {
+			return nil, fmt.Errorf("copybook item %v: level %02d item must belong to an 01 level record", item.name, item.level)
+		}
+
+		parent := stack[len(stack)-1]
+		parent.children = append(parent.children, item)
+		stack = append(stack, item)
+	}
+
+	return records, nil
+}
+
+// parseCopybookStatement parses the tokens of a single entry, e.g. [05 CUST-NAME PIC X(20)]
+func parseCopybookStatement(tokens []string) (*copybookItem, error) {
+	level, err := strconv.Atoi(tokens[0])
+	if err != nil || level < 1 || (level > 49 && level != 77 && level != 88) {
+		if level == 66 {
+			return nil, fmt.Errorf("copybook: level 66 (RENAMES) is not supported")
+		}
+		return nil, fmt.Errorf("copybook: invalid level number %v", tokens[0])
+	}
+
+	item := copybookItem{level: level, name: "FILLER"}
+	i := 1
+	if i < len(tokens) && !isCopybookKeyword(tokens[i]) {
+		item.name = tokens[i]
+		i++
+	}
+
+	next := func() string {
+		if i < len(tokens) {
+			i++
+			return tokens[i-1]
+		}
+		return ""
+	}
+	skip := func(optional ...string) {
+		for i < len(tokens) {
+			found := false
+			for _, word := range optional {
+				if strings.EqualFold(tokens[i], word) {
+					found = true
+				}
+			}
+			if !found {
+				return
+			}
+			i++
+		}
+	}
+
+	for i < len(tokens) {
+		keyword := strings.ToUpper(next())
+
+		switch keyword {
+		case "PIC", "PICTURE":
+			skip("IS")
+			item.pic = next()
+		case "USAGE":
+			skip("IS")
+			item.usage = copybookUsage(strings.ToUpper(next()))
+		case "DISPLAY", "COMP", "COMP-1", "COMP-2", "COMP-3", "COMP-4", "COMP-5", "COMPUTATIONAL", "COMPUTATIONAL-1",
+			"COMPUTATIONAL-2", "COMPUTATIONAL-3", "COMPUTATIONAL-4", "COMPUTATIONAL-5", "BINARY", "PACKED-DECIMAL":
+			item.usage = copybookUsage(keyword)
+		case "OCCURS":
+			n, err := strconv.Atoi(next())
+			if err != nil || n <= 0 {
+				return nil, fmt.Errorf("copybook item %v: invalid OCCURS", item.name)
+			}
+			item.occurs = n
+			if i < len(tokens) && strings.EqualFold(tokens[i], "TO") {
+				return nil, fmt.Errorf("copybook item %v: OCCURS DEPENDING ON is not supported", item.name)
+			}
+			skip("TIMES")
+		case "REDEFINES":
+			item.redefines = next()
+		case "SIGN":
+			return nil, fmt.Errorf("copybook item %v: SIGN clauses are not supported", item.name)
+		case "VALUE", "VALUES":
+			skip("IS", "ARE")
+			if item.level == 88 {
+				item.values, err = parseCopybookValues(item.name, tokens[i:])
+				if err != nil {
+					return nil, err
+				}
+				i = len(tokens)
+			}
+		default:
+			//Clauses that don't affect the layout (JUSTIFIED, SYNC, BLANK WHEN ZERO, INDEXED BY, initial VALUEs etc.)
+		}
+	}
+
+	if item.level == 88 && len(item.values) == 0 {
+		return nil, fmt.Errorf("copybook item %v: level 88 items must have a VALUE", item.name)
+	}
+
+	return &item, nil
+}
+
+// parseCopybookValues parses the literals of a level 88 VALUE clause, e.g. 'A' 'B' or 1 THRU 5
+func parseCopybookValues(name string, tokens []string) ([]copybookValue, error) {
+	var values []copybookValue
+
+	for i := 0; i < len(tokens); i++ {
+		token := strings.ToUpper(tokens[i])
+		if token == "THRU" || token == "THROUGH" {
+			if len(values) == 0 || i+1 >= len(tokens) {
+				return nil, fmt.Errorf("copybook item %v: invalid THRU range", name)
+			}
+			i++
+			thru, err := copybookLiteral(name, tokens[i])
+			if err != nil {
+				return nil, err
+			}
+			values[len(values)-1].thru = thru
+			continue
+		}
+
+		val, err := copybookLiteral(name, tokens[i])
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, copybookValue{value: val})
+	}
+
+	return values, nil
+}
+
+// copybookLiteral converts a literal or figurative constant into the value it's compared with
+func copybookLiteral(name string, token string) (string, error) {
+	if len(token) >= 2 && (token[0] == '\'' || token[0] == '"') {
+		return token[1 : len(token)-1], nil
+	}
+
+	switch strings.ToUpper(token) {
+	case "SPACE", "SPACES":
+		return "", nil
+	case "ZERO", "ZEROS", "ZEROES":
+		return "0", nil
+	}
+
+	if _, err := strconv.ParseFloat(token, 64); err != nil {
+		return "", fmt.Errorf("copybook item %v: unsupported VALUE %v", name, token)
+	}
+
+	return token, nil
+}
+
+// copybookUsage normalizes the synonyms for each usage
+func copybookUsage(usage string) string {
+	switch usage {
+	case "COMPUTATIONAL", "COMP-4", "COMPUTATIONAL-4", "BINARY":
+		return "COMP"
+	case "COMPUTATIONAL-3", "PACKED-DECIMAL":
+		return "COMP-3"
+	case "COMPUTATIONAL-1":
+		return "COMP-1"
+	case "COMPUTATIONAL-2":
+		return "COMP-2"
+	case "COMPUTATIONAL-5":
+		return "COMP-5"
+	}
+
+	return usage
+}
+
+func isCopybookKeyword(token string) bool {
+	switch strings.ToUpper(token) {
+	case "PIC", "PICTURE", "USAGE", "OCCURS", "REDEFINES", "VALUE", "VALUES", "SIGN", "DISPLAY", "COMP", "COMP-3",
+		"BINARY", "PACKED-DECIMAL", "COMPUTATIONAL", "COMPUTATIONAL-3":
+		return true
+	}
+
+	return false
+}
+
+// copybookStatements strips comments and the fixed format margins, then splits the copybook into period terminated
+// entries, each of which is a list of tokens. Quoted literals are kept as a single token, including the quotes.
+func copybookStatements(text string, format string) ([][]string, error) {
+	var code strings.Builder
+
+	for _, line := range strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n") {
+		if format != "free" {
+			if len(line) < 7 {
+				continue
+			}
+			if line[6] == '*' || line[6] == '/' {
+				continue
+			}
+			if line[6] == '-' {
+				return nil, fmt.Errorf("copybook: continuation lines are not supported")
+			}
+			line = line[7:]
+			if len(line) > 65 {
+				line = line[:65]
+			}
+		} else {
+			if idx := strings.Index(line, "*>"); idx >= 0 {
+				line = line[:idx]
+			}
+			if strings.HasPrefix(strings.TrimSpace(line), "*") {
+				continue
+			}
+		}
+
+		code.WriteString(line)
+		code.WriteString("\n")
+	}
+
+	var statements [][]string
+	var tokens []string
+	var token strings.Builder
+	src := code.String()
+
+	endToken := func() {
+		if token.Len() > 0 {
+			tokens = append(tokens, token.String())
+			token.Reset()
+		}
+	}
+
+	for i := 0; i < len(src); i++ {
+		ch := src[i]
+
+		switch {
+		case ch == '\'' || ch == '"':
+			end := strings.IndexByte(src[i+1:], ch)
+			if end < 0 {
+				return nil, fmt.Errorf("copybook: unterminated literal")
+			}
+			token.WriteString(src[i : i+end+2])
+			i += end + 1
+		case ch == '.' && (i+1 == len(src) || unicode.IsSpace(rune(src[i+1]))):
+			endToken()
+			if len(tokens) > 0 {
+				statements = append(statements, tokens)
+			}
+			tokens = nil
+		case unicode.IsSpace(rune(ch)) || ((ch == ',' || ch == ';') && (i+1 == len(src) || unicode.IsSpace(rune(src[i+1])))):
+			endToken()
+		default:
+			token.WriteByte(ch)
+		}
+	}
+
+	endToken()
+	if len(tokens) > 0 {
+		return nil, fmt.Errorf("copybook: entry %v is missing its terminating period", strings.Join(tokens, " "))
+	}
+
+	return statements, nil
+}
@@ -0,0 +1,155 @@
+package builtin
+
+import (
+	"bitbucket.org/primelogic_io/bitlantern/service/dataflow"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testCopybook = `
+      * Customer master record
+       01  CUSTOMER-RECORD.
+           05  CUST-ID             PIC 9(5).
+           05  CUST-NAME           PIC X(10).
+           05  CUST-STATUS         PIC X.
+               88  CUST-ACTIVE     VALUE 'A'.
+               88  CUST-CLOSED     VALUE 'C' 'X'.
+           05  BALANCE             PIC S9(5)V99.
+           05  FILLER              PIC X(2).
+           05  PHONE OCCURS 2 TIMES.
+               10  AREA-CODE       PIC 9(3).
+               10  PHONE-NUMBER    PIC X(4).
+           05  JOINED              PIC X(8).
+           05  JOINED-PARTS REDEFINES JOINED.
+               10  JOINED-YEAR     PIC 9(4).
+               10  FILLER          PIC X(4).
+           05  RISK-SCORE          PIC 99.
+               88  HIGH-RISK       VALUE 80 THRU 99.
+`
+
+func TestCopybookColumns(t *testing.T) {
+	columns, err := copybookColumns(copybookConfig{text: testCopybook, format: "fixed"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type col struct {
+		fieldName string
+		start     int
+		length    int
+		datatype  string
+	}
+	want := []col{
+		{"custId", 0, 5, "integer"},
+		{"custName", 5, 10, "string"},
+		{"custStatus", 15, 1, "string"},
+		{"balance", 16, 7, "zoned"},
+		{"areaCode_1", 25, 3, "integer"},
+		{"phoneNumber_1", 28, 4, "string"},
+		{"areaCode_2", 32, 3, "integer"},
+		{"phoneNumber_2", 35, 4, "string"},
+		{"joined", 39, 8, "string"},
+		{"joinedYear", 39, 4, "integer"},
+		{"riskScore", 47, 2, "integer"},
+	}
+
+	var got []col
+	for _, c := range columns {
+		got = append(got, col{c.fieldName, c.start, c.length, c.datatype})
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("columns = %v, want %v", got, want)
+	}
+
+	if columns[3].impliedDecimals != 2 {
+		t.Errorf("balance impliedDecimals = %d, want 2", columns[3].impliedDecimals)
+	}
+	if len(columns[2].conditions) != 2 {
+		t.Errorf("custStatus has %d conditions, want 2", len(columns[2].conditions))
+	}
+}
+
+func TestCopybookErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		copybook string
+		record   string
+		wantErr  string
+	}{
+		{"unsupported usage", "01 REC.\n 05 AMT COMP-1.", "", "must have a PIC clause"},
+		{"floating point usage", "01 REC.\n 05 AMT PIC S9(5) COMP-2.", "", "USAGE COMP-2 is not supported"},
+		{"occurs depending on", "01 REC.\n 05 CNT PIC 9.\n 05 ITEM OCCURS 1 TO 5 DEPENDING ON CNT PIC X.", "", "DEPENDING ON"},
+		{"unknown redefines", "01 REC.\n 05 A REDEFINES B PIC X.", "", "REDEFINES unknown item"},
+		{"missing period", "01 REC.\n 05 A PIC X", "", "missing its terminating period"},
+		{"several records", "01 REC-A.\n 05 A PIC X.\n01 REC-B.\n 05 B PIC X.", "", "copybookRecord must be set"},
+		{"unknown record", "01 REC-A.\n 05 A PIC X.", "REC-C", "doesn't contain record"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := copybookColumns(copybookConfig{text: tt.copybook, record: tt.record, format: "free"})
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("err = %v, want it to contain %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestParseFixedLengthCopybook(t *testing.T) {
+	config := map[string]interface{}{"copybook": testCopybook}
+	data := "00042Alice     A+012345  555123455598762020010285\n"
+
+	out, err := runFunction(t, "parseFixedLength", config, fileInput("customers.dat", data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []dataflow.Record{{
+		"custId":        int64(42),
+		"custName":      "Alice",
+		"custStatus":    "A",
+		"custActive":    true,
+		"custClosed":    false,
+		"balance":       123.45,
+		"areaCode_1":    int64(555),
+		"phoneNumber_1": "1234",
+		"areaCode_2":    int64(555),
+		"phoneNumber_2": "9876",
+		"joined":        "20200102",
+		"joinedYear":    int64(2020),
+		"riskScore":     int64(85),
+		"highRisk":      true,
+	}}
+
+	got := out.Records(dataflow.DEFAULT_OUTPUT_PORT_NAME)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("records = %v, want %v", got, want)
+	}
+	assertErrorRecords(t, out, nil)
+}
+
+func TestParseFixedLengthCopybookFile(t *testing.T) {
+	dir := setTestConfigFileDir(t)
+	err := ioutil.WriteFile(filepath.Join(dir, "customer.cpy"), []byte(testCopybook), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := map[string]interface{}{"copybookFile": "customer.cpy"}
+	ports, err := DefaultInstance().ResolveOutputPorts("parseFixedLength", config)
+	if err != nil || len(ports) != 2 {
+		t.Errorf("ports = %v, %v", ports, err)
+	}
+
+	//Files outside the config file directory can't be read, even when resolving ports
+	config = map[string]interface{}{"copybookFile": "../customer.cpy"}
+	if _, err := DefaultInstance().ResolveOutputPorts("parseFixedLength", config); err == nil {
+		t.Error("expected an error for a copybook outside the config file directory")
+	}
+	if _, err := runFunction(t, "parseFixedLength", config, fileInput("customers.dat", "")); err == nil {
+		t.Error("expected an error for a copybook outside the config file directory")
+	}
+}
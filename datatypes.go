@@ -0,0 +1,292 @@
+package builtin
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// columnDatatype converts the value of a text file column (parseCSV, parseFixedLength) into a record value
+type columnDatatype struct {
+	// parse converts the column's text. It's nil for binary datatypes, which can only be read from raw bytes.
+	parse func(text string, c *columnFormat) (interface{}, error)
+
+	// parseRaw converts the column's raw bytes, for datatypes that aren't text (e.g. packed decimal). Only parsers that
+	// read raw records (parseFixedLength) support these datatypes.
+	parseRaw func(raw []byte, c *columnFormat) (interface{}, error)
+
+	// impliedDecimals indicates the datatype supports an implied decimal point
+	impliedDecimals bool
+}
+
+// columnDatatypeRegistry holds every datatype the text file parsers can convert column values to, by name. Both
+// parsers, and the datatype enum in their config schemas, are driven from here, so a datatype added here is available
+// everywhere it makes sense.
+var columnDatatypeRegistry = map[string]*columnDatatype{
+	"string": {
+		parse: func(text string, c *columnFormat) (interface{}, error) {
+			return text, nil
+		},
+	},
+	"integer": {
+		parse: func(text string, c *columnFormat) (interface{}, error) {
+			return strconv.ParseInt(strings.TrimSpace(text), 10, 64)
+		},
+	},
+	"decimal": {
+		parse: func(text string, c *columnFormat) (interface{}, error) {
+			if c.impliedDecimals > 0 {
+				valInt, err := strconv.ParseInt(strings.TrimSpace(text), 10, 64)
+				if err != nil {
+					return nil, err
+				}
+				return scaleImpliedDecimals(valInt, c.impliedDecimals), nil
+			}
+			return strconv.ParseFloat(strings.TrimSpace(text), 64)
+		},
+		impliedDecimals: true,
+	},
+	"boolean": {
+		parse: func(text string, c *columnFormat) (interface{}, error) {
+			text = strings.TrimSpace(text)
+			for _, token := range c.trueValues {
+				if strings.EqualFold(text, token) {
+					return true, nil
+				}
+			}
+			for _, token := range c.falseValues {
+				if strings.EqualFold(text, token) {
+					return false, nil
+				}
+			}
+			return nil, fmt.Errorf("%q is not one of the true or false values", text)
+		},
+	},
+	"date": {
+		parse: func(text string, c *columnFormat) (interface{}, error) {
+			return time.ParseInLocation(c.layout("2006-01-02"), strings.TrimSpace(text), c.location)
+		},
+	},
+	"datetime": {
+		parse: func(text string, c *columnFormat) (interface{}, error) {
+			return time.ParseInLocation(c.layout(time.RFC3339), strings.TrimSpace(text), c.location)
+		},
+	},
+	"zoned": {
+		parse: func(text string, c *columnFormat) (interface{}, error) {
+			valInt, err := decodeZoned(text)
+			if err != nil {
+				return nil, err
+			}
+			return scaleImpliedDecimals(valInt, c.impliedDecimals), nil
+		},
+		impliedDecimals: true,
+	},
+	"packed": {
+		parseRaw: func(raw []byte, c *columnFormat) (interface{}, error) {
+			valInt, err := decodePacked(raw)
+			if err != nil {
+				return nil, err
+			}
+			return scaleImpliedDecimals(valInt, c.impliedDecimals), nil
+		},
+		impliedDecimals: true,
+	},
+	"binary": {
+		parseRaw: func(raw []byte, c *columnFormat) (interface{}, error) {
+			valInt, err := decodeBinary(raw, c.signed)
+			if err != nil {
+				return nil, err
+			}
+			return scaleImpliedDecimals(valInt, c.impliedDecimals), nil
+		},
+		impliedDecimals: true,
+	},
+}
+
+// columnDatatypeNames returns the sorted names of the registered datatypes, for use as a config schema enum. Binary
+// datatypes are only included if includeRaw is set.
+func columnDatatypeNames(includeRaw bool) []interface{} {
+	var names []string
+	for name, dt := range columnDatatypeRegistry {
+		if dt.parse != nil || includeRaw {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	result := make([]interface{}, len(names))
+	for i := range names {
+		result[i] = names[i]
+	}
+
+	return result
+}
+
+// columnFormatConfigFields are the column config fields that control how values are converted. They're shared by the
+// column schemas of parseCSV and parseFixedLength.
+var columnFormatConfigFields = []ConfigField{
+	{Key: "format", Type: ConfigTypeString, Description: "Go time layout, for date and datetime columns"},
+	{Key: "timeZone", Type: ConfigTypeString, Description: "IANA time zone (e.g. America/Chicago) of date and datetime values without an offset. Defaults to UTC"},
+	{Key: "impliedDecimals", Type: ConfigTypeInteger, Default: float64(0), Description: "Digits after an implied decimal point, e.g. 0001250 with 2 implied decimals is 12.50"},
+	{Key: "trueValues", Type: ConfigTypeArray, Items: &ConfigField{Type: ConfigTypeString}, Description: "Values of boolean columns that are true. Defaults to true, t, yes, y and 1"},
+	{Key: "falseValues", Type: ConfigTypeArray, Items: &ConfigField{Type: ConfigTypeString}, Description: "Values of boolean columns that are false. Defaults to false, f, no, n and 0"},
+	{Key: "nullValues", Type: ConfigTypeArray, Items: &ConfigField{Type: ConfigTypeString}, Description: "Values (e.g. \"\", \"NULL\", \"000000\") that produce a nil field"},
+}
+
+var (
+	defaultTrueValues  = []string{"true", "t", "yes", "y", "1"}
+	defaultFalseValues = []string{"false", "f", "no", "n", "0"}
+)
+
+// columnFormat describes how a column's value is converted
+type columnFormat struct {
+	datatype string
+
+	// format is the time layout of date and datetime columns
+	format string
+
+	// location is the time zone of date and datetime values without an offset
+	location *time.Location
+
+	// impliedDecimals is the number of digits after an implied decimal point, e.g. 2 for a COBOL PIC 9(5)V99
+	impliedDecimals int
+
+	// signed indicates a binary column is two's complement, rather than unsigned
+	signed bool
+
+	trueValues  []string
+	falseValues []string
+
+	// nullValues are compared with the trimmed text of the column. A match produces a nil value.
+	nullValues []string
+}
+
+// buildColumnFormat reads the columnFormatConfigFields (plus datatype and signed) of a column config
+func buildColumnFormat(colMap map[string]interface{}) (columnFormat, error) {
+	c := columnFormat{location: time.UTC, signed: true, trueValues: defaultTrueValues, falseValues: defaultFalseValues}
+
+	c.datatype, _ = colMap["datatype"].(string)
+	c.format, _ = colMap["format"].(string) //Ignore if can't convert, probably means its missing
+	if signed, ok := colMap["signed"].(bool); ok {
+		c.signed = signed
+	}
+	if impliedDecimals, ok := colMap["impliedDecimals"].(float64); ok {
+		c.impliedDecimals = int(impliedDecimals)
+	}
+
+	if timeZone, ok := colMap["timeZone"].(string); ok && timeZone != "" {
+		location, err := time.LoadLocation(timeZone)
+		if err != nil {
+			return c, fmt.Errorf("invalid timeZone: %v", err)
+		}
+		c.location = location
+	}
+
+	if trueValues, ok := colMap["trueValues"].([]interface{}); ok {
+		c.trueValues = configStrings(trueValues)
+	}
+	if falseValues, ok := colMap["falseValues"].([]interface{}); ok {
+		c.falseValues = configStrings(falseValues)
+	}
+	if nullValues, ok := colMap["nullValues"].([]interface{}); ok {
+		c.nullValues = configStrings(nullValues)
+	}
+
+	return c, c.validate()
+}
+
+// validate checks the datatype is registered and the options make sense for it
+func (c *columnFormat) validate() error {
+	dt, ok := columnDatatypeRegistry[c.datatype]
+	if !ok {
+		return fmt.Errorf("unsupported datatype %v", c.datatype)
+	}
+
+	if c.impliedDecimals > 0 && !dt.impliedDecimals {
+		return fmt.Errorf("impliedDecimals can't be used with %v columns", c.datatype)
+	}
+
+	return nil
+}
+
+func configStrings(vals []interface{}) []string {
+	result := make([]string, len(vals))
+	for i := range vals {
+		result[i], _ = vals[i].(string)
+	}
+
+	return result
+}
+
+// layout returns the configured time layout, or def if there isn't one
+func (c *columnFormat) layout(def string) string {
+	if c.format == "" {
+		return def
+	}
+
+	return c.format
+}
+
+// isNull reports whether the text matches one of the column's null values
+func (c *columnFormat) isNull(text string) bool {
+	text = strings.TrimSpace(text)
+	for _, nullValue := range c.nullValues {
+		if text == nullValue {
+			return true
+		}
+	}
+
+	return false
+}
+
+// parse converts a column's text to the column's datatype. Values that match one of the null values are nil.
+func (c *columnFormat) parse(text string) (interface{}, error) {
+	if c.isNull(text) {
+		return nil, nil
+	}
+
+	dt := columnDatatypeRegistry[c.datatype]
+	if dt == nil || dt.parse == nil {
+		return nil, fmt.Errorf("unsupported datatype %v", c.datatype)
+	}
+
+	val, err := dt.parse(text, c)
+	if err != nil {
+		return nil, err
+	}
+
+	return val, nil
+}
+
+// parseRaw is parse for parsers that read raw records. text is raw converted from the file's encoding, which is what
+// text datatypes and null values are compared with.
+func (c *columnFormat) parseRaw(raw []byte, text string) (interface{}, error) {
+	dt := columnDatatypeRegistry[c.datatype]
+	if dt == nil || dt.parseRaw == nil {
+		return c.parse(text)
+	}
+
+	if c.isNull(text) {
+		return nil, nil
+	}
+
+	val, err := dt.parseRaw(raw, c)
+	if err != nil {
+		return nil, err
+	}
+
+	return val, nil
+}
+
+// scaleImpliedDecimals applies an implied decimal point. Values without implied decimals stay as int64.
+func scaleImpliedDecimals(val int64, impliedDecimals int) interface{} {
+	if impliedDecimals == 0 {
+		return val
+	}
+
+	return float64(val) / math.Pow10(impliedDecimals)
+}
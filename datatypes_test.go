@@ -0,0 +1,99 @@
+package builtin
+
+import (
+	"bitbucket.org/primelogic_io/bitlantern/service/dataflow"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestColumnFormatParse(t *testing.T) {
+	chicago, err := time.LoadLocation("America/Chicago")
+	if err != nil {
+		t.Skip("time zone database not available")
+	}
+
+	tests := []struct {
+		name    string
+		column  map[string]interface{}
+		text    string
+		want    interface{}
+		wantErr bool
+	}{
+		{"string is kept as is", map[string]interface{}{"datatype": "string"}, " a ", " a ", false},
+		{"integer", map[string]interface{}{"datatype": "integer"}, " 42 ", int64(42), false},
+		{"empty integer is an error", map[string]interface{}{"datatype": "integer"}, "", nil, true},
+		{"decimal", map[string]interface{}{"datatype": "decimal"}, "12.5", 12.5, false},
+		{"implied decimals", map[string]interface{}{"datatype": "decimal", "impliedDecimals": 2.0}, "0001250", 12.5, false},
+		{"default true values", map[string]interface{}{"datatype": "boolean"}, "Yes", true, false},
+		{"default false values", map[string]interface{}{"datatype": "boolean"}, "0", false, false},
+		{"custom true values", map[string]interface{}{"datatype": "boolean", "trueValues": []interface{}{"A"}, "falseValues": []interface{}{"I"}}, "I", false, false},
+		{"unknown boolean", map[string]interface{}{"datatype": "boolean"}, "maybe", nil, true},
+		{"date defaults to ISO", map[string]interface{}{"datatype": "date"}, "2020-01-02", time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC), false},
+		{"datetime in a time zone", map[string]interface{}{"datatype": "datetime", "format": "2006-01-02 15:04", "timeZone": "America/Chicago"}, "2020-01-02 08:30", time.Date(2020, 1, 2, 8, 30, 0, 0, chicago), false},
+		{"datetime with an offset", map[string]interface{}{"datatype": "datetime"}, "2020-01-02T08:30:00Z", time.Date(2020, 1, 2, 8, 30, 0, 0, time.UTC), false},
+		{"null sentinel", map[string]interface{}{"datatype": "integer", "nullValues": []interface{}{"", "NULL", "000000"}}, "000000", nil, false},
+		{"empty null sentinel", map[string]interface{}{"datatype": "date", "nullValues": []interface{}{""}}, "  ", nil, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			format, err := buildColumnFormat(tt.column)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := format.parse(tt.text)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %v", err, tt.wantErr)
+			}
+			if gotTime, ok := got.(time.Time); ok {
+				if !gotTime.Equal(tt.want.(time.Time)) {
+					t.Errorf("got %v, want %v", got, tt.want)
+				}
+			} else if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBuildColumnFormatErrors(t *testing.T) {
+	tests := []map[string]interface{}{
+		{"datatype": "money"},
+		{"datatype": "integer", "impliedDecimals": 2.0},
+		{"datatype": "datetime", "timeZone": "Mars/Olympus"},
+	}
+
+	for _, column := range tests {
+		if _, err := buildColumnFormat(column); err == nil {
+			t.Errorf("buildColumnFormat(%v) expected an error", column)
+		}
+	}
+}
+
+func TestParseCSVDatatypes(t *testing.T) {
+	config := map[string]interface{}{
+		"hasHeaderRow": true,
+		"columns": []interface{}{
+			map[string]interface{}{"columnName": "id", "datatype": "integer", "fieldName": "id"},
+			map[string]interface{}{"columnName": "active", "datatype": "boolean", "trueValues": []interface{}{"Y"}, "falseValues": []interface{}{"N"}, "fieldName": "active"},
+			map[string]interface{}{"columnName": "amount", "datatype": "decimal", "impliedDecimals": 2.0, "nullValues": []interface{}{"", "NULL"}, "fieldName": "amount"},
+		},
+	}
+
+	out, err := runFunction(t, "parseCSV", config, fileInput("accounts.csv", "id,active,amount\n1,Y,0001250\n2,N,NULL\n3,N,\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []dataflow.Record{
+		{"id": int64(1), "active": true, "amount": 12.5},
+		{"id": int64(2), "active": false, "amount": nil},
+		{"id": int64(3), "active": false, "amount": nil},
+	}
+	if got := out.Records(dataflow.DEFAULT_OUTPUT_PORT_NAME); !reflect.DeepEqual(got, want) {
+		t.Errorf("records = %v, want %v", got, want)
+	}
+	assertErrorRecords(t, out, nil)
+}
@@ -0,0 +1,152 @@
+package builtin
+
+import (
+	"bitbucket.org/primelogic_io/bitlantern/service/dataflow"
+	"fmt"
+	"io"
+	"path"
+)
+
+func init() {
+	//Register function with default builtin.FunctionProvider
+	DefaultInstance().RegisterFunction(
+		Function{
+			FunctionSpec: dataflow.FunctionSpec{
+				Key:           "expandArchive",
+				Name:          "Expand Archive",
+				Description:   "Decompresses gzip files and expands zip and tar archives, outputting each file inside them",
+				Category:      "File",
+				ExecutionMode: "sync",
+				InputPorts:    dataflowPorts(fileInputPort),
+				OutputPorts:   dataflowPorts(PortSpec{Name: dataflow.DEFAULT_OUTPUT_PORT_NAME, Description: "Each file inside the archives, named by its path inside the archive", DataType: PortDataTypeFile}, errorOutputPort),
+			},
+			ConfigSchema: ConfigSchema{
+				Fields: []ConfigField{
+					{Key: "format", Type: ConfigTypeString, Enum: archiveFormats, Default: archiveFormatAuto, Description: "Archive format. auto detects the format of each file and passes files that aren't archives through unchanged"},
+					{Key: "include", Type: ConfigTypeArray, Items: &ConfigField{Type: ConfigTypeString}, Description: "Glob patterns (e.g. *.csv, reports/*.txt) matched against the path or name of each file inside the archive. Other files are skipped. Defaults to every file"},
+				},
+			},
+			NewFunction: func() dataflow.Function {
+				return &(expandArchive{})
+			},
+		})
+}
+
+type expandArchive struct {
+	config expandArchiveConfig
+}
+
+type expandArchiveConfig struct {
+	// format is one of archiveFormats
+	format string
+
+	// include are glob patterns for the files to output. If it's empty every file is output.
+	include []string
+}
+
+// buildConfig builds an expandArchiveConfig from the passed in map. The map must be in the form:
+// {
+//		"format": "auto",
+//		"include": ["*.csv", "*.txt"]
+// }
+//
+func (f *expandArchive) buildConfig(config map[string]interface{}) (expandArchiveConfig, error) {
+	c := expandArchiveConfig{}
+
+	c.format = config["format"].(string)
+	if include, ok := config["include"].([]interface{}); ok {
+		c.include = configStrings(include)
+	}
+
+	for _, pattern := range c.include {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return c, fmt.Errorf("include pattern %q: %v", pattern, err)
+		}
+	}
+
+	return c, nil
+}
+
+func (f *expandArchive) Execute(in dataflow.InputReader, out dataflow.OutputWriter, config map[string]interface{}) error {
+	defer out.Close()
+
+	//Parse/read config options
+	config, err := prepareConfig("expandArchive", config)
+	if err != nil {
+		return err
+	}
+
+	parsedConfig, err := f.buildConfig(config)
+	if err != nil {
+		return newFunctionError("expandArchive", "building config", err)
+	}
+	f.config = parsedConfig
+
+	//Open the data stream
+	reader := in.PortReader(dataflow.DEFAULT_INPUT_PORT_NAME)
+	err = reader.Open()
+	if err != nil {
+		return newFunctionError("expandArchive", "opening input", err)
+	}
+
+	//For each archive, output the files inside it
+	for reader.HasNext() {
+		curEntry, err := reader.Next()
+		if err != nil {
+			return newFunctionError("expandArchive", "reading input", err)
+		}
+
+		curFile, err := curEntry.GetAsFile()
+		if err != nil {
+			writeRecordError(out, &(RecordError{FunctionKey: "expandArchive", Err: err}))
+			continue
+		}
+
+		err = expandFile(curFile, f.config.format, func(innerFile dataflow.File) error {
+			return f.writeFile(innerFile, out)
+		})
+		if err != nil {
+			writeRecordError(out, &(RecordError{FunctionKey: "expandArchive", Filename: curFile.Filename(), Err: err}))
+		}
+	}
+
+	return nil
+}
+
+// writeFile copies a file from inside an archive to the output, unless it doesn't match the include patterns
+func (f *expandArchive) writeFile(file dataflow.File, out dataflow.OutputWriter) error {
+	if !f.included(file.Filename()) {
+		return nil
+	}
+
+	outFile, err := out.NewFileWriter(dataflow.DEFAULT_OUTPUT_PORT_NAME, file.Filename())
+	if err != nil {
+		return err
+	}
+	defer outFile.Close()
+
+	_, err = io.Copy(outFile.Writer(), file.Reader())
+	if err != nil {
+		return fmt.Errorf("%v: %v", file.Filename(), err)
+	}
+
+	return nil
+}
+
+// included reports whether the path matches one of the include patterns, either as a whole or by its base name
+func (f *expandArchive) included(filename string) bool {
+	if len(f.config.include) == 0 {
+		return true
+	}
+
+	for _, pattern := range f.config.include {
+		if matched, _ := path.Match(pattern, filename); matched {
+			return true
+		}
+		if matched, _ := path.Match(pattern, path.Base(filename)); matched {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,174 @@
+package builtin
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bitbucket.org/primelogic_io/bitlantern/service/dataflow"
+	"bytes"
+	"compress/gzip"
+	"reflect"
+	"testing"
+)
+
+// testTar builds a tar archive of the files, by name
+func testTar(t *testing.T, files map[string]string, names ...string) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, name := range names {
+		err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(files[name])), Typeflag: tar.TypeReg})
+		if err != nil {
+			t.Fatal(err)
+		}
+		tw.Write([]byte(files[name]))
+	}
+	tw.Close()
+
+	return buf.Bytes()
+}
+
+func testZip(t *testing.T, files map[string]string, names ...string) []byte {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, name := range names {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(files[name]))
+	}
+	zw.Close()
+
+	return buf.Bytes()
+}
+
+func testGzip(data []byte) []byte {
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	gw.Write(data)
+	gw.Close()
+
+	return buf.Bytes()
+}
+
+func TestExpandArchive(t *testing.T) {
+	files := map[string]string{"customers.csv": "name\nAlice\n", "reports/payroll.txt": "BOB  042\n", "notes.md": "# notes"}
+
+	tests := []struct {
+		name      string
+		config    map[string]interface{}
+		filename  string
+		data      []byte
+		wantFiles map[string]string
+	}{
+		{
+			name:      "zip",
+			filename:  "bundle.zip",
+			data:      testZip(t, files, "customers.csv", "reports/payroll.txt"),
+			wantFiles: map[string]string{"customers.csv": files["customers.csv"], "reports/payroll.txt": files["reports/payroll.txt"]},
+		},
+		{
+			name:      "tar.gz",
+			filename:  "bundle.tar.gz",
+			data:      testGzip(testTar(t, files, "customers.csv", "reports/payroll.txt")),
+			wantFiles: map[string]string{"customers.csv": files["customers.csv"], "reports/payroll.txt": files["reports/payroll.txt"]},
+		},
+		{
+			name:      "gzip",
+			filename:  "customers.csv.gz",
+			data:      testGzip([]byte(files["customers.csv"])),
+			wantFiles: map[string]string{"customers.csv": files["customers.csv"]},
+		},
+		{
+			name:      "files that aren't archives are passed through",
+			filename:  "customers.csv",
+			data:      []byte(files["customers.csv"]),
+			wantFiles: map[string]string{"customers.csv": files["customers.csv"]},
+		},
+		{
+			name:      "include patterns",
+			config:    map[string]interface{}{"include": []interface{}{"*.csv", "*.txt"}},
+			filename:  "bundle.tar",
+			data:      testTar(t, files, "customers.csv", "reports/payroll.txt", "notes.md"),
+			wantFiles: map[string]string{"customers.csv": files["customers.csv"], "reports/payroll.txt": files["reports/payroll.txt"]},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			in := NewMemoryInputReader().AddFile(dataflow.DEFAULT_INPUT_PORT_NAME, NewMemoryFile(tt.filename, tt.data))
+			out, err := runFunction(t, "expandArchive", tt.config, in)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := map[string]string{}
+			for _, file := range out.Files(dataflow.DEFAULT_OUTPUT_PORT_NAME) {
+				got[file.Filename()] = file.String()
+				if !file.Closed() {
+					t.Errorf("%v was not closed", file.Filename())
+				}
+			}
+			if !reflect.DeepEqual(got, tt.wantFiles) {
+				t.Errorf("files = %v, want %v", got, tt.wantFiles)
+			}
+			assertErrorRecords(t, out, nil)
+		})
+	}
+}
+
+func TestExpandArchiveRejectsEscapingPaths(t *testing.T) {
+	data := testTar(t, map[string]string{"../../etc/passwd": "root"}, "../../etc/passwd")
+	in := NewMemoryInputReader().AddFile(dataflow.DEFAULT_INPUT_PORT_NAME, NewMemoryFile("evil.tar", data))
+
+	out, err := runFunction(t, "expandArchive", nil, in)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if files := out.Files(dataflow.DEFAULT_OUTPUT_PORT_NAME); len(files) != 0 {
+		t.Errorf("expected no files, got %v", files)
+	}
+	assertErrorRecords(t, out, []dataflow.Record{{"functionKey": "expandArchive", "filename": "evil.tar"}})
+}
+
+func TestParseCSVDecompress(t *testing.T) {
+	files := map[string]string{"a.csv": "name\nAlice\n", "b.csv": "name\nBob\n"}
+	config := map[string]interface{}{
+		"hasHeaderRow": true,
+		"decompress":   true,
+		"columns":      []interface{}{map[string]interface{}{"columnName": "name", "datatype": "string", "fieldName": "name"}},
+	}
+
+	in := NewMemoryInputReader().
+		AddFile(dataflow.DEFAULT_INPUT_PORT_NAME, NewMemoryFile("bundle.zip", testZip(t, files, "a.csv", "b.csv"))).
+		AddFile(dataflow.DEFAULT_INPUT_PORT_NAME, NewMemoryFile("c.csv.gz", testGzip([]byte("name\nCy\n"))))
+	out, err := runFunction(t, "parseCSV", config, in)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []dataflow.Record{{"name": "Alice"}, {"name": "Bob"}, {"name": "Cy"}}
+	if got := out.Records(dataflow.DEFAULT_OUTPUT_PORT_NAME); !reflect.DeepEqual(got, want) {
+		t.Errorf("records = %v, want %v", got, want)
+	}
+	assertErrorRecords(t, out, nil)
+}
+
+func TestParseFixedLengthDecompress(t *testing.T) {
+	config := map[string]interface{}{
+		"decompress": true,
+		"columns":    []interface{}{map[string]interface{}{"start": 0.0, "length": 5.0, "datatype": "string", "fieldName": "name"}},
+	}
+
+	in := NewMemoryInputReader().AddFile(dataflow.DEFAULT_INPUT_PORT_NAME, NewMemoryFile("payroll.txt.gz", testGzip([]byte("ALICE\nBOB  \n"))))
+	out, err := runFunction(t, "parseFixedLength", config, in)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []dataflow.Record{{"name": "ALICE"}, {"name": "BOB"}}
+	if got := out.Records(dataflow.DEFAULT_OUTPUT_PORT_NAME); !reflect.DeepEqual(got, want) {
+		t.Errorf("records = %v, want %v", got, want)
+	}
+	assertErrorRecords(t, out, nil)
+}
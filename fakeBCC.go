@@ -2,6 +2,7 @@ package builtin
 
 import (
 	"bitbucket.org/primelogic_io/bitlantern/service/dataflow"
+	"fmt"
 	_ "github.com/robertkrimen/otto"
 	_ "github.com/robertkrimen/otto/underscore"
 )
@@ -16,8 +17,13 @@ func init() {
 				Description:   "Fakes a BCC SOAP API call",
 				Category:      "API",
 				ExecutionMode: "sync",
-				InputPorts:    nil,
-				OutputPorts:   nil,
+				InputPorts:    dataflowPorts(recordInputPort),
+				OutputPorts:   dataflowPorts(PortSpec{Name: dataflow.DEFAULT_OUTPUT_PORT_NAME, Description: "Input records with error_code set", DataType: PortDataTypeRecord}, errorOutputPort),
+			},
+			ConfigSchema: ConfigSchema{
+				Fields: []ConfigField{
+					{Key: "stateField", Type: ConfigTypeString, Required: true, Description: "Field containing the two letter state code. Can be a nested path, e.g. customer.address.state"},
+				},
 			},
 			NewFunction: func() dataflow.Function {
 				return &(fakeBCC{})
@@ -29,14 +35,18 @@ type fakeBCC struct {
 }
 
 type fakeBCCConfig struct {
-	stateField string
+	stateField *fieldPath
 }
 
 // The available fields for conditions are: filename, size (in bytes), mime type (future)
 func (f *fakeBCC) buildConfig(config map[string]interface{}) (fakeBCCConfig, error) {
 	c := fakeBCCConfig{}
 
-	c.stateField = config["stateField"].(string)
+	var err error
+	c.stateField, err = parseFieldPath(config["stateField"].(string))
+	if err != nil {
+		return c, fmt.Errorf("stateField: %w", err)
+	}
 
 	return c, nil
 }
@@ -45,31 +55,38 @@ func (f *fakeBCC) Execute(in dataflow.InputReader, out dataflow.OutputWriter, co
 	defer out.Close()
 
 	//Parse/read config options
+	config, err := prepareConfig("fakeBCC", config)
+	if err != nil {
+		return err
+	}
+
 	configOpts, err := f.buildConfig(config)
 	if err != nil {
-		panic("Error generating a csv")
+		return newFunctionError("fakeBCC", "building config", err)
 	}
 
 	//Open the data stream
 	reader := in.PortReader(dataflow.DEFAULT_INPUT_PORT_NAME)
 	err = reader.Open()
 	if err != nil {
-		panic("Unable to read record from input")
+		return newFunctionError("fakeBCC", "opening input", err)
 	}
 
 	//Loop through all files, routing them based on the conditions
 	for reader.HasNext() {
 		curEntry, err := reader.Next()
 		if err != nil {
-			panic(err)
+			return newFunctionError("fakeBCC", "reading input", err)
 		}
 
 		rec, err := curEntry.GetAsRecord()
 		if err != nil {
-			panic(err)
+			writeRecordError(out, &(RecordError{FunctionKey: "fakeBCC", Err: err}))
+			continue
 		}
 
-		stateVal, ok := rec[configOpts.stateField].(string)
+		stateField, _ := configOpts.stateField.get(rec)
+		stateVal, ok := stateField.(string)
 
 		if !ok || len(stateVal) != 2 {
 			rec["error_code"] = 22
@@ -0,0 +1,32 @@
+package builtin
+
+import (
+	"bitbucket.org/primelogic_io/bitlantern/service/dataflow"
+	"testing"
+)
+
+func TestFakeBCC(t *testing.T) {
+	tests := []struct {
+		name          string
+		record        dataflow.Record
+		wantErrorCode int
+	}{
+		{name: "valid state", record: dataflow.Record{"st": "TX"}, wantErrorCode: 0},
+		{name: "long state", record: dataflow.Record{"st": "Texas"}, wantErrorCode: 22},
+		{name: "missing state", record: dataflow.Record{}, wantErrorCode: 22},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, err := runFunction(t, "fakeBCC", map[string]interface{}{"stateField": "st"}, recordInput(tt.record))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := out.Records(dataflow.DEFAULT_OUTPUT_PORT_NAME)
+			if len(got) != 1 || got[0]["error_code"] != tt.wantErrorCode {
+				t.Errorf("records = %v, want error_code %v", got, tt.wantErrorCode)
+			}
+		})
+	}
+}
@@ -0,0 +1,272 @@
+package builtin
+
+import (
+	"bitbucket.org/primelogic_io/bitlantern/service/dataflow"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// fieldPath is a reference to a field inside a record, which may be nested in objects and lists, e.g.
+// customer.address.zip or items[0].sku. Keys that contain dots or brackets can be quoted: ["first.name"].
+//
+// A record key that matches the whole path is always used as it is, so flat keys that happen to contain dots (e.g. CSV
+// headers) keep working.
+type fieldPath struct {
+	path  string
+	parts []fieldPathPart
+}
+
+// fieldPathPart is one step of a fieldPath: either an object key, or an index into a list
+type fieldPathPart struct {
+	key     string
+	index   int
+	isIndex bool
+}
+
+// parseFieldPath parses a field reference such as customer.address.zip, items[0].sku or ["first.name"]
+func parseFieldPath(path string) (*fieldPath, error) {
+	p := &(fieldPath{path: path})
+
+	i := 0
+	expectKey := true
+	for i < len(path) {
+		switch {
+		case path[i] == '[':
+			end := strings.IndexByte(path[i:], ']')
+			if end < 0 {
+				return nil, fmt.Errorf("invalid field path %q: missing ]", path)
+			}
+			inner := path[i+1 : i+end]
+
+			if len(inner) >= 2 && inner[0] == '"' && inner[len(inner)-1] == '"' {
+				key, err := strconv.Unquote(inner)
+				if err != nil {
+					return nil, fmt.Errorf("invalid field path %q: %v", path, err)
+				}
+				p.parts = append(p.parts, fieldPathPart{key: key})
+			} else {
+				index, err := strconv.Atoi(inner)
+				if err != nil || index < 0 {
+					return nil, fmt.Errorf("invalid field path %q: %q is not a list index", path, inner)
+				}
+				p.parts = append(p.parts, fieldPathPart{index: index, isIndex: true})
+			}
+
+			i += end + 1
+			expectKey = false
+		case path[i] == '.':
+			if expectKey {
+				return nil, fmt.Errorf("invalid field path %q: empty key", path)
+			}
+
+			i++
+			expectKey = true
+			if i == len(path) {
+				return nil, fmt.Errorf("invalid field path %q: empty key", path)
+			}
+		default:
+			if !expectKey {
+				return nil, fmt.Errorf("invalid field path %q: expected . or [ after ]", path)
+			}
+
+			end := strings.IndexAny(path[i:], ".[")
+			if end < 0 {
+				end = len(path) - i
+			}
+			p.parts = append(p.parts, fieldPathPart{key: path[i : i+end]})
+
+			i += end
+			expectKey = false
+		}
+	}
+
+	if len(p.parts) == 0 {
+		return nil, fmt.Errorf("invalid field path %q: empty key", path)
+	}
+	if p.parts[0].isIndex {
+		return nil, fmt.Errorf("invalid field path %q: must start with a field name", path)
+	}
+
+	return p, nil
+}
+
+// parseFieldPaths parses a config list of field paths. name is the config key of the list, for error messages.
+func parseFieldPaths(name string, paths []interface{}) ([]*fieldPath, error) {
+	result := make([]*fieldPath, len(paths))
+	for i := range paths {
+		var err error
+		result[i], err = parseFieldPath(paths[i].(string))
+		if err != nil {
+			return nil, fmt.Errorf("%v[%d]: %w", name, i, err)
+		}
+	}
+
+	return result, nil
+}
+
+func (p *fieldPath) String() string {
+	return p.path
+}
+
+// get returns the value at the path in rec. The bool is false if any step of the path is missing.
+func (p *fieldPath) get(rec dataflow.Record) (interface{}, bool) {
+	if val, ok := rec[p.path]; ok {
+		return val, true
+	}
+
+	var cur interface{} = map[string]interface{}(rec)
+	for _, part := range p.parts {
+		if part.isIndex {
+			list, ok := cur.([]interface{})
+			if !ok || part.index >= len(list) {
+				return nil, false
+			}
+			cur = list[part.index]
+			continue
+		}
+
+		m, ok := fieldPathObject(cur)
+		if !ok {
+			return nil, false
+		}
+		cur, ok = m[part.key]
+		if !ok {
+			return nil, false
+		}
+	}
+
+	return cur, true
+}
+
+// set stores val at the path in rec. Missing objects along the path are created, and lists are extended (with nulls)
+// to reach an index. It's an error for the path to go through a value that isn't an object or list.
+func (p *fieldPath) set(rec dataflow.Record, val interface{}) error {
+	if _, ok := rec[p.path]; ok {
+		rec[p.path] = val
+		return nil
+	}
+
+	_, err := p.setIn(map[string]interface{}(rec), 0, val)
+	return err
+}
+
+// setIn stores val at parts[partIdx:] inside container, and returns the container, which is new if it had to be
+// created or a list had to grow
+func (p *fieldPath) setIn(container interface{}, partIdx int, val interface{}) (interface{}, error) {
+	if partIdx == len(p.parts) {
+		return val, nil
+	}
+	part := p.parts[partIdx]
+
+	if part.isIndex {
+		var list []interface{}
+		switch c := container.(type) {
+		case nil:
+		case []interface{}:
+			list = c
+		default:
+			return nil, fmt.Errorf("can't set %v: %v is %T, not a list", p.path, p.prefix(partIdx), container)
+		}
+
+		for len(list) <= part.index {
+			list = append(list, nil)
+		}
+
+		newVal, err := p.setIn(list[part.index], partIdx+1, val)
+		if err != nil {
+			return nil, err
+		}
+		list[part.index] = newVal
+		return list, nil
+	}
+
+	m, ok := fieldPathObject(container)
+	if container == nil {
+		m, ok = map[string]interface{}{}, true
+	}
+	if !ok {
+		return nil, fmt.Errorf("can't set %v: %v is %T, not an object", p.path, p.prefix(partIdx), container)
+	}
+
+	newVal, err := p.setIn(m[part.key], partIdx+1, val)
+	if err != nil {
+		return nil, err
+	}
+	m[part.key] = newVal
+	return m, nil
+}
+
+// delete removes the field at the path from rec, if it's there. Deleting a list element removes it from the list, so
+// the elements after it move down.
+func (p *fieldPath) delete(rec dataflow.Record) {
+	if _, ok := rec[p.path]; ok {
+		delete(rec, p.path)
+		return
+	}
+
+	p.deleteIn(map[string]interface{}(rec), 0)
+}
+
+// deleteIn removes parts[partIdx:] from container, and returns the container, which is new if a list shrank
+func (p *fieldPath) deleteIn(container interface{}, partIdx int) interface{} {
+	part := p.parts[partIdx]
+	last := partIdx == len(p.parts)-1
+
+	if part.isIndex {
+		list, ok := container.([]interface{})
+		if !ok || part.index >= len(list) {
+			return container
+		}
+
+		if last {
+			return append(list[:part.index:part.index], list[part.index+1:]...)
+		}
+		list[part.index] = p.deleteIn(list[part.index], partIdx+1)
+		return list
+	}
+
+	m, ok := fieldPathObject(container)
+	if !ok {
+		return container
+	}
+	if _, ok := m[part.key]; !ok {
+		return container
+	}
+
+	if last {
+		delete(m, part.key)
+	} else {
+		m[part.key] = p.deleteIn(m[part.key], partIdx+1)
+	}
+	return m
+}
+
+// prefix returns the path up to, but not including, parts[partIdx], for error messages
+func (p *fieldPath) prefix(partIdx int) string {
+	var sb strings.Builder
+	for i := 0; i < partIdx; i++ {
+		if p.parts[i].isIndex {
+			fmt.Fprintf(&sb, "[%d]", p.parts[i].index)
+		} else {
+			if i > 0 {
+				sb.WriteString(".")
+			}
+			sb.WriteString(p.parts[i].key)
+		}
+	}
+
+	return sb.String()
+}
+
+// fieldPathObject returns val as a map if it's an object: a decoded JSON object or a nested record
+func fieldPathObject(val interface{}) (map[string]interface{}, bool) {
+	switch v := val.(type) {
+	case map[string]interface{}:
+		return v, true
+	case dataflow.Record:
+		return v, true
+	}
+
+	return nil, false
+}
@@ -0,0 +1,115 @@
+package builtin
+
+import (
+	"bitbucket.org/primelogic_io/bitlantern/service/dataflow"
+	"reflect"
+	"testing"
+)
+
+func TestFieldPathGet(t *testing.T) {
+	rec := dataflow.Record{
+		"customer": map[string]interface{}{
+			"address": map[string]interface{}{"zip": "75001"},
+		},
+		"items":      []interface{}{map[string]interface{}{"sku": "A1"}, map[string]interface{}{"sku": "B2"}},
+		"first.name": "ada",
+		"meta":       map[string]interface{}{"a.b": 1.0},
+	}
+
+	tests := []struct {
+		path   string
+		want   interface{}
+		wantOk bool
+	}{
+		{path: "customer.address.zip", want: "75001", wantOk: true},
+		{path: "items[1].sku", want: "B2", wantOk: true},
+		{path: "items[2].sku", wantOk: false},
+		{path: "first.name", want: "ada", wantOk: true},
+		{path: `meta["a.b"]`, want: 1.0, wantOk: true},
+		{path: "customer.phone", wantOk: false},
+		{path: "customer.address.zip.plus4", wantOk: false},
+		{path: "items.sku", wantOk: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			p, err := parseFieldPath(tt.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, ok := p.get(rec)
+			if ok != tt.wantOk || !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("get = %v, %v, want %v, %v", got, ok, tt.want, tt.wantOk)
+			}
+		})
+	}
+}
+
+func TestFieldPathSet(t *testing.T) {
+	rec := dataflow.Record{"name": "ada", "tags": []interface{}{"a"}}
+
+	for path, val := range map[string]interface{}{
+		"customer.address.zip": "75001",
+		"items[1].sku":         "B2",
+		"tags[0]":              "b",
+		`meta["a.b"]`:          1.0,
+	} {
+		p, err := parseFieldPath(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := p.set(rec, val); err != nil {
+			t.Fatalf("set %v: %v", path, err)
+		}
+	}
+
+	want := dataflow.Record{
+		"name":     "ada",
+		"tags":     []interface{}{"b"},
+		"customer": map[string]interface{}{"address": map[string]interface{}{"zip": "75001"}},
+		"items":    []interface{}{nil, map[string]interface{}{"sku": "B2"}},
+		"meta":     map[string]interface{}{"a.b": 1.0},
+	}
+	if !reflect.DeepEqual(rec, want) {
+		t.Errorf("got %v, want %v", rec, want)
+	}
+
+	p, _ := parseFieldPath("name.first")
+	err := p.set(rec, "x")
+	if err == nil || err.Error() != "can't set name.first: name is string, not an object" {
+		t.Errorf("got error %v", err)
+	}
+}
+
+func TestParseFieldPathInvalid(t *testing.T) {
+	for _, path := range []string{"", "a..b", "a.", ".a", "[0]", "a[x]", "a[-1]", "a[0", "a[0]b"} {
+		if _, err := parseFieldPath(path); err == nil {
+			t.Errorf("expected an error for %q", path)
+		}
+	}
+}
+
+func TestFieldPathDelete(t *testing.T) {
+	rec := dataflow.Record{
+		"customer": map[string]interface{}{"id": 1.0, "name": "ada"},
+		"items":    []interface{}{"a", "b", "c"},
+		"a.b":      true,
+	}
+
+	for _, path := range []string{"customer.name", "items[1]", "a.b", "missing.field", "items[9]"} {
+		p, err := parseFieldPath(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p.delete(rec)
+	}
+
+	want := dataflow.Record{
+		"customer": map[string]interface{}{"id": 1.0},
+		"items":    []interface{}{"a", "c"},
+	}
+	if !reflect.DeepEqual(rec, want) {
+		t.Errorf("got %v, want %v", rec, want)
+	}
+}
@@ -2,13 +2,16 @@ package builtin
 
 import (
 	"bitbucket.org/primelogic_io/bitlantern/service/dataflow"
+	"bufio"
 	"bytes"
+	"encoding/hex"
 	"fmt"
-	"github.com/robertkrimen/otto"
-	_ "github.com/robertkrimen/otto"
-	_ "github.com/robertkrimen/otto/underscore"
 	"io"
-	"text/template"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strings"
 )
 
 func init() {
@@ -18,11 +21,29 @@ func init() {
 			FunctionSpec: dataflow.FunctionSpec{
 				Key:           "fileRouter",
 				Name:          "File Router",
-				Description:   "Routes input files to different outputs based on certain conditions",
+				Description:   "Routes input files to different outputs based on certain conditions. By default a file goes to the output port of the last rule that matches (matchMode last)",
 				Category:      "File",
 				ExecutionMode: "sync",
-				InputPorts:    nil,
-				OutputPorts:   nil,
+				InputPorts:    dataflowPorts(fileInputPort),
+				OutputPorts:   dataflowPorts(errorOutputPort),
+			},
+			ConfigSchema: ConfigSchema{
+				Fields: append([]ConfigField{
+					{Key: "defaultOutputPort", Type: ConfigTypeString, Required: true, Description: "Output port for files that don't match any rule"},
+					{Key: "rules", Type: ConfigTypeArray, Required: true, Items: &ConfigField{
+						Type: ConfigTypeObject,
+						Fields: []ConfigField{
+							{Key: "jsCondition", Type: ConfigTypeString, Required: true, Description: "Javascript condition evaluated against the file info"},
+							{Key: "outputPort", Type: ConfigTypeString, Required: true},
+						},
+					}},
+					matchModeConfigField(matchModeLast),
+					{Key: "sniffBytes", Type: ConfigTypeInteger, Default: float64(512), Description: "Number of bytes at the start of each file made available to conditions as FirstBytes"},
+					{Key: "computeSize", Type: ConfigTypeBoolean, Default: false, Description: "Work out Size for files that don't report it by copying them to a temp file first. Otherwise their Size is -1"},
+				}, jsRuntimeConfigFields...),
+			},
+			ResolveOutputPorts: func(config map[string]interface{}) ([]PortSpec, error) {
+				return (&(fileRouter{})).outputPorts(config)
 			},
 			NewFunction: func() dataflow.Function {
 				return &(fileRouter{})
@@ -34,11 +55,24 @@ type fileRouter struct {
 }
 
 type fileRouterConfig struct {
-	// splits contains the rules for data splitting. The first rule that matches the data will be used.
+	// rules are the JS conditions run against the fileInfo of each file. matchMode decides which of the matching
+	// rules' output ports the file is copied to.
 	rules []fileRouterRule
 
 	// defaultOutputPort specifies the output port into which to send data that doesn't match any other split rule
 	defaultOutputPort string
+
+	// matchMode is one of matchModeFirst, matchModeLast or matchModeAll
+	matchMode string
+
+	// js holds the JS runtime options: helper scripts and execution limits
+	js jsRuntimeConfig
+
+	// sniffBytes is the number of bytes at the start of each file passed to the conditions
+	sniffBytes int
+
+	// computeSize is set to spool files that don't report their size to a temp file, so conditions get their Size
+	computeSize bool
 }
 
 type fileRouterRule struct {
@@ -47,32 +81,108 @@ type fileRouterRule struct {
 	jsFuncName  string
 }
 
+// fileInfo is what the conditions know about a file, as the data object
 type fileInfo struct {
 	Filename string
-	//size
-	//mime type
+
+	// Size is the size of the file in bytes. It's -1 if the file doesn't report it and computeSize isn't set.
+	Size int64
+
+	// Extension is the lower case extension of the filename, including the dot (e.g. ".csv")
+	Extension string
+
+	// MimeType is sniffed from the content, so it doesn't depend on the extension. Delimited text is text/csv.
+	MimeType string
+
+	// FirstBytes are the first sniffBytes bytes of the file, in upper case hex (e.g. "504B0304" for a zip)
+	FirstBytes string
+
+	// FirstLine is the first line of text, without the line ending
+	FirstLine string
+}
+
+// fileRouterPeekBytes is how much of the start of a file is read to find its first line and MIME type
+const fileRouterPeekBytes = 64 * 1024
+
+// newFileInfo builds the fileInfo of a file from its first bytes (up to fileRouterPeekBytes of them) and size
+func newFileInfo(filename string, head []byte, size int64, sniffBytes int) fileInfo {
+	info := fileInfo{
+		Filename:  filename,
+		Size:      size,
+		Extension: strings.ToLower(path.Ext(filename)),
+	}
+
+	if sniffBytes > len(head) {
+		sniffBytes = len(head)
+	}
+	info.FirstBytes = strings.ToUpper(hex.EncodeToString(head[:sniffBytes]))
+
+	firstLine := bytes.TrimPrefix(head, []byte{0xEF, 0xBB, 0xBF})
+	if idx := bytes.IndexByte(firstLine, '\n'); idx >= 0 {
+		firstLine = firstLine[:idx]
+	}
+	info.FirstLine = string(bytes.TrimSuffix(firstLine, []byte("\r")))
+
+	info.MimeType = http.DetectContentType(head)
+	if strings.HasPrefix(info.MimeType, "text/plain") && looksDelimited(head) {
+		info.MimeType = "text/csv"
+	}
+
+	return info
+}
+
+// looksDelimited reports whether the first lines of text have the same, non-zero, number of commas, tabs, semicolons
+// or pipes
+func looksDelimited(head []byte) bool {
+	lines := bytes.SplitN(head, []byte("\n"), 3)
+	if len(lines) < 3 {
+		//The second line must be complete to be compared
+		return false
+	}
+
+	for _, delimiter := range []byte{',', '\t', ';', '|'} {
+		count := bytes.Count(lines[0], []byte{delimiter})
+		if count > 0 && bytes.Count(lines[1], []byte{delimiter}) == count {
+			return true
+		}
+	}
+
+	return false
 }
 
 // buildConfig builds a splitConfig from the passed in map. The map must be in the form:
 // {
 //		"defaultOutputPort": "ignoredFiles",
+//		"matchMode": "first",
 //		"rules": [
 //			{
-//				"jsCondition": "filename.toLowerCase().endsWith(".csv")",
+//				"jsCondition": "data.Filename.toLowerCase().endsWith(".csv")",
 //				"outputPort": "csv"
 //			},
 //			{
-//				"jsCondition": "filename.toLowerCase().endsWith(".txt")",
+//				"jsCondition": "data.Filename.toLowerCase().endsWith(".txt")",
 //				"outputPort": "fixedLength"
 //			}
-//		]
+//		],
+//		"computeSize": false
 // }
 //
-// The available fields for conditions are: filename, size (in bytes), mime type (future)
+// The available fields for conditions are the fields of fileInfo, e.g. data.FirstLine.indexOf("|") >= 0
+//
+// matchMode defaults to last, so the last matching rule wins, as it did before match modes were added.
+//
+// Size is only worked out for files that don't report it if computeSize is set, since that means reading the whole
+// file into a temp file before routing it.
+//
+// helperScripts (files) and helperScript (inline JS) can optionally be used to load extra JS functions for the rules.
 func (f *fileRouter) buildConfig(config map[string]interface{}) (fileRouterConfig, error) {
 	c := fileRouterConfig{}
 
 	c.defaultOutputPort = config["defaultOutputPort"].(string)
+	if err := checkRoutedPortName(c.defaultOutputPort); err != nil {
+		return c, fmt.Errorf("defaultOutputPort: %w", err)
+	}
+	c.matchMode, _ = config["matchMode"].(string)
 	rules := config["rules"].([]interface{})
 	c.rules = make([]fileRouterRule, len(rules))
 
@@ -81,106 +191,186 @@ func (f *fileRouter) buildConfig(config map[string]interface{}) (fileRouterConfi
 		newRule := fileRouterRule{}
 
 		newRule.outputPort = curRuleMap["outputPort"].(string)
+		if err := checkRoutedPortName(newRule.outputPort); err != nil {
+			return c, fmt.Errorf("rules[%d].outputPort: %w", i, err)
+		}
 		newRule.jsCondition = curRuleMap["jsCondition"].(string)
 
 		c.rules[i] = newRule
 	}
 
+	c.js = buildJSRuntimeConfig(config)
+	c.computeSize, _ = config["computeSize"].(bool)
+	c.sniffBytes = int(config["sniffBytes"].(float64))
+	if c.sniffBytes < 0 || c.sniffBytes > fileRouterPeekBytes {
+		return c, fmt.Errorf("sniffBytes must be between 0 and %d", fileRouterPeekBytes)
+	}
+
 	return c, nil
 }
 
+// outputPorts returns the default output port and the output ports named in the rules
+func (f *fileRouter) outputPorts(config map[string]interface{}) ([]PortSpec, error) {
+	c, err := f.buildConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
+	rulePorts := make([]string, len(c.rules))
+	for i := range c.rules {
+		rulePorts[i] = c.rules[i].outputPort
+	}
+
+	return routedOutputPorts(c.defaultOutputPort, rulePorts, PortDataTypeFile)
+}
+
 func (f *fileRouter) Execute(in dataflow.InputReader, out dataflow.OutputWriter, config map[string]interface{}) error {
 	defer out.Close()
 
 	//Parse/read config options
+	config, err := prepareConfig("fileRouter", config)
+	if err != nil {
+		return err
+	}
+
 	configOpts, err := f.buildConfig(config)
 	if err != nil {
-		panic("Error generating a csv")
+		return newFunctionError("fileRouter", "building config", err)
 	}
 
 	//Open the data stream
 	reader := in.PortReader(dataflow.DEFAULT_INPUT_PORT_NAME)
 	err = reader.Open()
 	if err != nil {
-		panic("Unable to read record from input")
+		return newFunctionError("fileRouter", "opening input", err)
 	}
 
-	//JS Template - We will wrap the condition express in a function that can be called more easily
-	jsFuncTemplate, err := template.New("someName").Parse(`
-		var {{.FuncName}} = function(data) {
-			if ({{.Condition}}) {
-				return true;
-			} else {
-				return false;
-			}
-		};
-	`)
-
-	vm := otto.New()
+	vm, err := newJSRuntime(configOpts.js)
+	if err != nil {
+		return newFunctionError("fileRouter", "starting JS runtime", err)
+	}
 
-	//Parse all the JS rules
+	//Compile all the JS rules
+	compileErrs := jsRuleCompileErrors{}
 	for i := range configOpts.rules {
 		curRule := &(configOpts.rules[i])
 
-		var b bytes.Buffer
-		templateVars := make(map[string]string)
-		templateVars["Condition"] = curRule.jsCondition
-		templateVars["FuncName"] = fmt.Sprintf("splitRuleFunc_%d", i)
-		jsFuncTemplate.Execute(&b, templateVars)
-
-		fmt.Printf("\n\n%s", b.String())
-
-		_, err := vm.Run(b.String())
+		curRule.jsFuncName, err = vm.compileCondition(curRule.jsCondition)
 		if err != nil {
-			panic(err)
+			compileErrs.add(fmt.Sprintf("rules[%d].jsCondition", i), err)
 		}
-
-		curRule.jsFuncName = templateVars["FuncName"]
+	}
+	if err := compileErrs.err("fileRouter"); err != nil {
+		return newFunctionError("fileRouter", "compiling rules", err)
 	}
 
 	//Loop through all files, routing them based on the conditions
 	for reader.HasNext() {
 		curEntry, err := reader.Next()
 		if err != nil {
-			panic(err)
+			return newFunctionError("fileRouter", "reading input", err)
 		}
 
 		curFile, err := curEntry.GetAsFile()
 		if err != nil {
-			panic(err)
+			writeRecordError(out, &(RecordError{FunctionKey: "fileRouter", Err: err}))
+			continue
+		}
+
+		err = f.routeFile(vm, &configOpts, curFile, out)
+		if err != nil {
+			writeRecordError(out, &(RecordError{FunctionKey: "fileRouter", Filename: curFile.Filename(), Err: err}))
+			if isJSRunBudgetExceeded(err) {
+				return newFunctionError("fileRouter", "running rules", err)
+			}
 		}
+	}
+
+	return nil
+}
 
-		fileReader := curFile.Reader()
+// routeFile evaluates the rules against the file and streams it to the matching output ports. If computeSize is set
+// and the file doesn't report its size, the file is spooled to a temp file first to find it out.
+func (f *fileRouter) routeFile(vm *jsRuntime, configOpts *fileRouterConfig, curFile dataflow.File, out dataflow.OutputWriter) error {
+	fileReader := curFile.Reader()
+	size := knownFileSize(curFile, fileReader)
 
-		fileInfo := fileInfo{
-			Filename: curFile.Filename(),
+	bufReader := bufio.NewReaderSize(fileReader, fileRouterPeekBytes)
+	head, _ := bufReader.Peek(fileRouterPeekBytes)
+
+	var content io.Reader = bufReader
+	if size < 0 && configOpts.computeSize {
+		tmpFile, err := ioutil.TempFile("", "fileRouter")
+		if err != nil {
+			return err
 		}
+		defer os.Remove(tmpFile.Name())
+		defer tmpFile.Close()
 
-		// Run the script rules for each record
-		outputPort := configOpts.defaultOutputPort
-		for i := range configOpts.rules {
-			curRule := configOpts.rules[i]
+		size, err = io.Copy(tmpFile, bufReader)
+		if err != nil {
+			return err
+		}
 
-			value, err := vm.Call(curRule.jsFuncName, nil, fileInfo)
-			if err != nil {
-				panic(err)
-			}
+		_, err = tmpFile.Seek(0, io.SeekStart)
+		if err != nil {
+			return err
+		}
+		content = tmpFile
+	}
 
-			matches, err := value.ToBoolean()
-			if err != nil {
-				panic(err)
-			}
+	fileInfo := newFileInfo(curFile.Filename(), head, size, configOpts.sniffBytes)
 
-			if matches {
-				outputPort = curRule.outputPort
-			}
+	// Run the script rules for the file
+	rulePorts := make([]string, len(configOpts.rules))
+	for i := range configOpts.rules {
+		rulePorts[i] = configOpts.rules[i].outputPort
+	}
+
+	outputPorts, err := matchPorts(configOpts.matchMode, configOpts.defaultOutputPort, rulePorts, func(i int) (bool, error) {
+		return vm.callCondition(configOpts.rules[i].jsFuncName, fileInfo)
+	})
+	if err != nil {
+		return err
+	}
+
+	//Copy file from input to the correct outputs
+	return f.copyFile(content, curFile.Filename(), outputPorts, out)
+}
+
+// copyFile copies the file to every output port at once, so it's only read once
+func (f *fileRouter) copyFile(r io.Reader, filename string, outputPorts []string, out dataflow.OutputWriter) error {
+	writers := make([]io.Writer, len(outputPorts))
+	for i, outputPort := range outputPorts {
+		outFile, err := out.NewFileWriter(outputPort, filename)
+		if err != nil {
+			return err
 		}
+		defer outFile.Close()
 
-		//Copy file from input to the correct output
-		outFile, err := out.NewFileWriter(outputPort, curFile.Filename())
-		size, err := io.Copy(outFile.Writer(), fileReader)
-		fmt.Printf("Copied file %v with size %v bytes to %v\n", curFile.Filename(), size, outputPort)
+		writers[i] = outFile.Writer()
 	}
 
-	return nil
+	_, err := io.Copy(io.MultiWriter(writers...), r)
+	return err
+}
+
+// knownFileSize returns the size of a file if the file or its reader reports it without the file being read (e.g. an
+// *os.File or a bytes.Reader), or -1
+func knownFileSize(file dataflow.File, r io.Reader) int64 {
+	if sized, ok := file.(interface{ Size() int64 }); ok {
+		return sized.Size()
+	}
+
+	switch v := r.(type) {
+	case interface{ Stat() (os.FileInfo, error) }:
+		info, err := v.Stat()
+		if err == nil && info.Mode().IsRegular() {
+			return info.Size()
+		}
+	case interface{ Len() int }:
+		return int64(v.Len())
+	}
+
+	return -1
 }
@@ -0,0 +1,173 @@
+package builtin
+
+import (
+	"bitbucket.org/primelogic_io/bitlantern/service/dataflow"
+	"io"
+	"reflect"
+	"testing"
+)
+
+func TestFileRouter(t *testing.T) {
+	config := map[string]interface{}{
+		"defaultOutputPort": "ignoredFiles",
+		"rules": []interface{}{
+			map[string]interface{}{"jsCondition": "data.Filename.toLowerCase().indexOf('.csv') > 0", "outputPort": "csv"},
+			map[string]interface{}{"jsCondition": "data.Filename.toLowerCase().indexOf('.txt') > 0", "outputPort": "fixedLength"},
+		},
+	}
+
+	tests := []struct {
+		filename string
+		wantPort string
+	}{
+		{filename: "customers.CSV", wantPort: "csv"},
+		{filename: "payroll.txt", wantPort: "fixedLength"},
+		{filename: "image.png", wantPort: "ignoredFiles"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.filename, func(t *testing.T) {
+			out, err := runFunction(t, "fileRouter", config, fileInput(tt.filename, "contents of "+tt.filename))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			files := out.Files(tt.wantPort)
+			if len(files) != 1 {
+				t.Fatalf("expected one file on port %v, ports written: %v", tt.wantPort, out.Ports())
+			}
+			if files[0].Filename() != tt.filename || files[0].String() != "contents of "+tt.filename {
+				t.Errorf("file not copied unchanged: %v %q", files[0].Filename(), files[0].String())
+			}
+			if !files[0].Closed() {
+				t.Errorf("output file was not closed")
+			}
+		})
+	}
+}
+
+func TestFileRouterContent(t *testing.T) {
+	config := map[string]interface{}{
+		"defaultOutputPort": "other",
+		"sniffBytes":        4.0,
+		"rules": []interface{}{
+			map[string]interface{}{"jsCondition": "data.FirstBytes == '504B0304'", "outputPort": "zip"},
+			map[string]interface{}{"jsCondition": "data.MimeType == 'text/csv'", "outputPort": "csv"},
+			map[string]interface{}{"jsCondition": "data.FirstLine.indexOf('HDR') == 0 && data.Size > 10", "outputPort": "fixedLength"},
+		},
+	}
+
+	tests := []struct {
+		filename string
+		data     string
+		wantPort string
+	}{
+		{filename: "customers.txt", data: "name,state\nada,TX\n", wantPort: "csv"},
+		{filename: "bundle.dat", data: "PK\x03\x04rest of the zip", wantPort: "zip"},
+		{filename: "payroll.dat", data: "HDR20200102\nDTLALICE\n", wantPort: "fixedLength"},
+		{filename: "empty.dat", data: "HDR", wantPort: "other"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.filename, func(t *testing.T) {
+			out, err := runFunction(t, "fileRouter", config, fileInput(tt.filename, tt.data))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			files := out.Files(tt.wantPort)
+			if len(files) != 1 {
+				t.Fatalf("expected one file on port %v, ports written: %v", tt.wantPort, out.Ports())
+			}
+			if files[0].String() != tt.data {
+				t.Errorf("file not copied unchanged: %q", files[0].String())
+			}
+		})
+	}
+}
+
+func TestFileRouterMatchAll(t *testing.T) {
+	config := map[string]interface{}{
+		"defaultOutputPort": "ignoredFiles",
+		"matchMode":         "all",
+		"rules": []interface{}{
+			map[string]interface{}{"jsCondition": "true", "outputPort": "audit"},
+			map[string]interface{}{"jsCondition": "data.Extension == '.csv'", "outputPort": "csv"},
+		},
+	}
+
+	out, err := runFunction(t, "fileRouter", config, fileInput("customers.csv", "name,state\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, port := range []string{"audit", "csv"} {
+		files := out.Files(port)
+		if len(files) != 1 || files[0].String() != "name,state\n" {
+			t.Errorf("expected the whole file on port %v, ports written: %v", port, out.Ports())
+		}
+	}
+}
+
+// unsizedFile is a file whose reader can't report its size, like a network stream
+type unsizedFile struct {
+	*MemoryFile
+}
+
+func (f unsizedFile) Reader() io.Reader {
+	return io.MultiReader(f.MemoryFile.Reader())
+}
+
+func TestFileRouterUnsizedFiles(t *testing.T) {
+	data := "HDR20200102\nDTLALICE\n"
+	configs := []map[string]interface{}{
+		//Spooled to find the size
+		{"defaultOutputPort": "other", "computeSize": true, "rules": []interface{}{
+			map[string]interface{}{"jsCondition": "data.Size == 21", "outputPort": "a"},
+		}},
+		//Streamed without a size
+		{"defaultOutputPort": "other", "rules": []interface{}{
+			map[string]interface{}{"jsCondition": "data['Si' + 'ze'] == -1", "outputPort": "a"},
+		}},
+		//Streamed straight to both ports
+		{"defaultOutputPort": "other", "matchMode": "all", "rules": []interface{}{
+			map[string]interface{}{"jsCondition": "data.FirstLine.indexOf('HDR') == 0", "outputPort": "a"},
+			map[string]interface{}{"jsCondition": "data.Extension == '.dat'", "outputPort": "b"},
+		}},
+	}
+
+	for i, config := range configs {
+		in := NewMemoryInputReader().AddFile(dataflow.DEFAULT_INPUT_PORT_NAME, unsizedFile{NewMemoryFileFromString("payroll.dat", data)})
+		out, err := runFunction(t, "fileRouter", config, in)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		wantPorts := len(config["rules"].([]interface{}))
+		if len(out.Ports()) != wantPorts {
+			t.Errorf("config %d: ports written: %v, want %d", i, out.Ports(), wantPorts)
+		}
+		for _, port := range []string{"a", "b"}[:wantPorts] {
+			files := out.Files(port)
+			if len(files) != 1 || files[0].String() != data {
+				t.Errorf("config %d: expected the whole file on port %v, got %v", i, port, files)
+			}
+		}
+	}
+}
+
+func TestNewFileInfo(t *testing.T) {
+	got := newFileInfo("Report.CSV", []byte("\xEF\xBB\xBFa|b\r\n1|2\r\n"), 1234, 2)
+	want := fileInfo{
+		Filename:   "Report.CSV",
+		Size:       1234,
+		Extension:  ".csv",
+		MimeType:   "text/csv",
+		FirstBytes: "EFBB",
+		FirstLine:  "a|b",
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
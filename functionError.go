@@ -0,0 +1,131 @@
+package builtin
+
+import (
+	"bitbucket.org/primelogic_io/bitlantern/service/dataflow"
+	"fmt"
+)
+
+// ERROR_OUTPUT_PORT_NAME is the output port every builtin writes per-record failures to. Each record written to this
+// port is built by RecordError.ToRecord.
+const ERROR_OUTPUT_PORT_NAME = "error"
+
+// FunctionError is returned from Execute when a builtin can't continue at all, e.g. the config is invalid or the
+// input can't be opened. Problems with individual records are not FunctionErrors; they are written to the error port.
+type FunctionError struct {
+	// FunctionKey is the key of the builtin that failed
+	FunctionKey string
+
+	// Op describes what the function was doing when it failed, e.g. "validating config"
+	Op string
+
+	Err error
+}
+
+func (e *FunctionError) Error() string {
+	return fmt.Sprintf("%v: %v: %v", e.FunctionKey, e.Op, e.Err)
+}
+
+func (e *FunctionError) Unwrap() error {
+	return e.Err
+}
+
+func newFunctionError(functionKey string, op string, err error) *FunctionError {
+	return &(FunctionError{FunctionKey: functionKey, Op: op, Err: err})
+}
+
+// RecordError describes a single input record, line or file that couldn't be processed. Only the fields that are
+// known for the failure are set, e.g. parsers set Filename, LineNumber and Line while record based functions set Record.
+type RecordError struct {
+	FunctionKey string
+	Filename    string
+	LineNumber  int
+	Line        string
+	Record      dataflow.Record
+	Err         error
+}
+
+func (e *RecordError) Error() string {
+	if e.Filename != "" && e.LineNumber > 0 {
+		return fmt.Sprintf("%v: %v line %d: %v", e.FunctionKey, e.Filename, e.LineNumber, e.Err)
+	} else if e.Filename != "" {
+		return fmt.Sprintf("%v: %v: %v", e.FunctionKey, e.Filename, e.Err)
+	}
+
+	return fmt.Sprintf("%v: %v", e.FunctionKey, e.Err)
+}
+
+func (e *RecordError) Unwrap() error {
+	return e.Err
+}
+
+// ToRecord converts the error into the record that is written to the error port. It always contains the
+// "functionKey" and "error" fields, plus "filename", "lineNumber", "line" and "record" when they are known.
+func (e *RecordError) ToRecord() dataflow.Record {
+	rec := dataflow.Record{}
+	rec.Set("functionKey", e.FunctionKey)
+	rec.Set("error", e.Err.Error())
+
+	if e.Filename != "" {
+		rec.Set("filename", e.Filename)
+	}
+	if e.LineNumber > 0 {
+		rec.Set("lineNumber", e.LineNumber)
+	}
+	if e.Line != "" {
+		rec.Set("line", e.Line)
+	}
+	if e.Record != nil {
+		rec.Set("record", e.Record)
+	}
+
+	return rec
+}
+
+// writeRecordError writes the failure to the error port so the rest of the batch can keep flowing
+func writeRecordError(out dataflow.OutputWriter, recErr *RecordError) {
+	errRec := recErr.ToRecord()
+	out.WriteRecord(ERROR_OUTPUT_PORT_NAME, &errRec)
+}
+
+// copyRecord copies a record, so the original can be reported if processing fails part way through. Nested objects
+// and lists are copied too, since fields can be set inside them (see fieldPath).
+func copyRecord(rec dataflow.Record) dataflow.Record {
+	c := dataflow.Record{}
+	for key, val := range rec {
+		c[key] = copyRecordValue(val)
+	}
+
+	return c
+}
+
+func copyRecordValue(val interface{}) interface{} {
+	switch v := val.(type) {
+	case map[string]interface{}:
+		c := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			c[key] = copyRecordValue(item)
+		}
+		return c
+	case dataflow.Record:
+		return copyRecord(v)
+	case []interface{}:
+		c := make([]interface{}, len(v))
+		for i := range v {
+			c[i] = copyRecordValue(v[i])
+		}
+		return c
+	}
+
+	return val
+}
+
+// prepareConfig validates config against the ConfigSchema registered for the function key and returns a copy with
+// the schema defaults filled in. Builtins call this before buildConfig, so buildConfig can rely on the types.
+func prepareConfig(functionKey string, config map[string]interface{}) (map[string]interface{}, error) {
+	err := DefaultInstance().ValidateConfig(functionKey, config)
+	if err != nil {
+		return nil, newFunctionError(functionKey, "validating config", err)
+	}
+
+	return DefaultInstance().ApplyConfigDefaults(functionKey, config)
+}
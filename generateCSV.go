@@ -18,8 +18,16 @@ func init() {
 				Description:   "Writes a file to the data pipeline",
 				Category:      "Data",
 				ExecutionMode: "sync",
-				InputPorts:    nil,
-				OutputPorts:   nil,
+				InputPorts:    dataflowPorts(recordInputPort),
+				OutputPorts:   dataflowPorts(PortSpec{Name: dataflow.DEFAULT_OUTPUT_PORT_NAME, Description: "The generated CSV file", DataType: PortDataTypeFile}, errorOutputPort),
+			},
+			ConfigSchema: ConfigSchema{
+				Fields: []ConfigField{
+					{Key: "filename", Type: ConfigTypeString, Required: true, Description: "Name of the generated file"},
+					{Key: "headerValue", Type: ConfigTypeArray, Required: true, Items: &ConfigField{Type: ConfigTypeString}, Description: "Fields to write, in column order. Nested fields can be referenced by path, e.g. customer.address.zip"},
+					{Key: "header", Type: ConfigTypeString, Enum: []interface{}{"true", "false"}, Default: "false", Description: "Whether to write a header row"},
+					{Key: "delimiter", Type: ConfigTypeString, Default: ",", Description: "Single character column delimiter"},
+				},
 			},
 			NewFunction: func() dataflow.Function {
 				return &(generateCSV{})
@@ -38,6 +46,7 @@ type generateCSVJSConfig struct {
 type generateCSVConfig struct {
 	header       string
 	headerValues []string
+	headerPaths  []*fieldPath
 	dataFields   []string
 	delimiter    string
 	filename     string
@@ -58,7 +67,7 @@ type generateCSVConfig struct {
 // rules.valueType accepts the values: "literal", "field"
 func (f *generateCSV) buildConfig(config map[string]interface{}) (generateCSVConfig, error) {
 	c := generateCSVConfig{}
-	c.header = config["header"].(string)
+	c.header, _ = config["header"].(string)
 
 	headerValsRaw := config["headerValue"].([]interface{})
 	headerVals := make([]string, 0, len(headerValsRaw))
@@ -67,9 +76,23 @@ func (f *generateCSV) buildConfig(config map[string]interface{}) (generateCSVCon
 	}
 	c.headerValues = headerVals
 
+	c.headerPaths = make([]*fieldPath, len(headerVals))
+	for idx := range headerVals {
+		var err error
+		c.headerPaths[idx], err = parseFieldPath(headerVals[idx])
+		if err != nil {
+			return c, fmt.Errorf("headerValue[%d]: %w", idx, err)
+		}
+	}
+
 	//c.dataFields = config["dataFields"].([]string)
-	c.delimiter = config["delimiter"].(string)
+	c.delimiter, _ = config["delimiter"].(string)
 	c.filename = config["filename"].(string)
+
+	if len([]rune(c.delimiter)) > 1 {
+		return c, fmt.Errorf("CSV delimiter can only be a single character")
+	}
+
 	return c, nil
 }
 
@@ -77,31 +100,31 @@ func (f *generateCSV) Execute(in dataflow.InputReader, out dataflow.OutputWriter
 	defer out.Close()
 
 	//Parse/read config options
+	config, err := prepareConfig("generateCSV", config)
+	if err != nil {
+		return err
+	}
+
 	splitOpts, err := f.buildConfig(config)
 	if err != nil {
-		panic("Error generating a csv")
+		return newFunctionError("generateCSV", "building config", err)
 	}
 
 	//Open the data stream
 	reader := in.PortReader(dataflow.DEFAULT_INPUT_PORT_NAME)
 	err = reader.Open()
 	if err != nil {
-		panic("Unable to read record from input")
+		return newFunctionError("generateCSV", "opening input", err)
 	}
 
-	//csvfile, err := os.Create("/Users/matthewpaden/go/src/TestingGo/Output/test.csv")
-	//if err != nil {
-	//	panic("Something went wrong writing the file")
-	//}
 	csvfile, err := out.NewFileWriter(dataflow.DEFAULT_OUTPUT_PORT_NAME, splitOpts.filename)
+	if err != nil {
+		return newFunctionError("generateCSV", "creating output file", err)
+	}
 	defer csvfile.Close()
 	csvwriter := csv.NewWriter(csvfile.Writer())
 
 	//Set the delimeter
-	if len(splitOpts.delimiter) > 1 {
-		panic("CSV delimiter can only be a single character")
-	}
-
 	if splitOpts.delimiter != "" {
 		csvwriter.Comma = ([]rune(splitOpts.delimiter))[0]
 	}
@@ -115,13 +138,14 @@ func (f *generateCSV) Execute(in dataflow.InputReader, out dataflow.OutputWriter
 	for reader.HasNext() {
 		rec, err := reader.Next()
 		if err != nil {
-			panic("Failed to read record")
+			return newFunctionError("generateCSV", "reading input", err)
 		}
 
 		//We should perform a check here to make sure we are getting records instead of files
 		recData, err := rec.GetAsRecord()
 		if err != nil {
-			panic("Failed to read record as a map")
+			writeRecordError(out, &(RecordError{FunctionKey: "generateCSV", Err: err}))
+			continue
 		}
 
 		/* START - The actual work */
@@ -129,8 +153,8 @@ func (f *generateCSV) Execute(in dataflow.InputReader, out dataflow.OutputWriter
 		//and then joins with what is in the delimiter config.
 		newRow := make([]string, 0, len(splitOpts.headerValues))
 
-		for c := range splitOpts.headerValues {
-			val, ok := recData.Get(splitOpts.headerValues[c])
+		for c := range splitOpts.headerPaths {
+			val, ok := splitOpts.headerPaths[c].get(recData)
 			if !ok {
 				val = ""
 			}
@@ -138,11 +162,16 @@ func (f *generateCSV) Execute(in dataflow.InputReader, out dataflow.OutputWriter
 			newRow = append(newRow, fmt.Sprintf("%v", val))
 		}
 
-		csvwriter.Write(newRow)
+		err = csvwriter.Write(newRow)
+		if err != nil {
+			writeRecordError(out, &(RecordError{FunctionKey: "generateCSV", Filename: splitOpts.filename, Record: recData, Err: err}))
+		}
 	}
 
 	csvwriter.Flush()
+	if err := csvwriter.Error(); err != nil {
+		return newFunctionError("generateCSV", "writing output file", err)
+	}
 
-	csvfile.Close()
 	return nil
 }
@@ -0,0 +1,63 @@
+package builtin
+
+import (
+	"bitbucket.org/primelogic_io/bitlantern/service/dataflow"
+	"testing"
+)
+
+func TestGenerateCSV(t *testing.T) {
+	records := []dataflow.Record{
+		{"name": "Alice", "age": int64(30), "state": "TX", "address": map[string]interface{}{"zip": "75001"}},
+		{"name": "Bob, Jr.", "state": "CA"},
+	}
+
+	tests := []struct {
+		name   string
+		config map[string]interface{}
+		want   string
+	}{
+		{
+			name:   "header and quoting",
+			config: map[string]interface{}{"filename": "out.csv", "header": "true", "headerValue": []interface{}{"name", "age", "state"}},
+			want:   "name,age,state\nAlice,30,TX\n\"Bob, Jr.\",,CA\n",
+		},
+		{
+			name:   "no header and custom delimiter",
+			config: map[string]interface{}{"filename": "out.csv", "delimiter": "|", "headerValue": []interface{}{"state", "name"}},
+			want:   "TX|Alice\nCA|Bob, Jr.\n",
+		},
+		{
+			name:   "nested field",
+			config: map[string]interface{}{"filename": "out.csv", "headerValue": []interface{}{"name", "address.zip"}},
+			want:   "Alice,75001\n\"Bob, Jr.\",\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, err := runFunction(t, "generateCSV", tt.config, recordInput(records...))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			files := out.Files(dataflow.DEFAULT_OUTPUT_PORT_NAME)
+			if len(files) != 1 {
+				t.Fatalf("expected one file, got %d", len(files))
+			}
+			if files[0].Filename() != "out.csv" || !files[0].Closed() {
+				t.Errorf("unexpected file %v (closed: %v)", files[0].Filename(), files[0].Closed())
+			}
+			if files[0].String() != tt.want {
+				t.Errorf("csv = %q, want %q", files[0].String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestGenerateCSVBadDelimiter(t *testing.T) {
+	config := map[string]interface{}{"filename": "out.csv", "delimiter": "||", "headerValue": []interface{}{"a"}}
+	_, err := runFunction(t, "generateCSV", config, recordInput())
+	if err == nil {
+		t.Error("expected an error for a multi-character delimiter")
+	}
+}
@@ -1,189 +1,385 @@
 package builtin
 
-//
-//import (
-//	"bitbucket.org/primelogic_io/bitlantern"
-//	"bytes"
-//	"fmt"
-//	"github.com/robertkrimen/otto"
-//	_ "github.com/robertkrimen/otto"
-//	_ "github.com/robertkrimen/otto/underscore"
-//	"io"
-//	"text/template"
-//)
-//
-//func init() {
-//	//Register function with default builtin.FunctionProvider
-//	DefaultInstance().RegisterFunction(
-//		Function{
-//			FunctionSpec: bitlantern.FunctionSpec{
-//				Key:           "httpCall",
-//				Name:          "HTTP API Call",
-//				Description:   "Makes an HTTP(S) API call for each record in the input, reads the response, and merges the response data back into the record for further processing.",
-//				Category:      "API",
-//				ExecutionMode: "sync",
-//				InputPorts:    nil,
-//				OutputPorts:   nil,
-//			},
-//			NewFunction: func() bitlantern.Function {
-//				return &(fileRouter{})
-//			},
-//		})
-//}
-//
-//type fileRouter struct {
-//}
-//
-//type fileRouterConfig struct {
-//	requestMethod       string
-//	requestBodyType     string //xml, json
-//	requestBodyTemplate string
-//	requestURL          string
-//
-//	parameters map[string]interface{} //Parameters that can be used in the the template, URL, etc.
-//
-//}
-//
-//type fileRouterRule struct {
-//	jsCondition string
-//	outputPort  string
-//	jsFuncName  string
-//}
-//
-//type fileInfo struct {
-//	Filename string
-//	//size
-//	//mime type
-//}
-//
-//// buildConfig builds a splitConfig from the passed in map. The map must be in the form:
-//// {
-////		"defaultOutputPort": "ignoredFiles",
-////		"rules": [
-////			{
-////				"jsCondition": "filename.toLowerCase().endsWith(".csv")",
-////				"outputPort": "csv"
-////			},
-////			{
-////				"jsCondition": "filename.toLowerCase().endsWith(".txt")",
-////				"outputPort": "fixedLength"
-////			}
-////		]
-//// }
-////
-//// The available fields for conditions are: filename, size (in bytes), mime type (future)
-//func (f *fileRouter) buildConfig(config map[string]interface{}) (fileRouterConfig, error) {
-//	c := fileRouterConfig{}
-//
-//	c.defaultOutputPort = config["defaultOutputPort"].(string)
-//	rules := config["rules"].([]interface{})
-//	c.rules = make([]fileRouterRule, len(rules))
-//
-//	for i := 0; i < len(rules); i++ {
-//		curRuleMap := rules[i].(map[string]interface{})
-//		newRule := fileRouterRule{}
-//
-//		newRule.outputPort = curRuleMap["outputPort"].(string)
-//		newRule.jsCondition = curRuleMap["jsCondition"].(string)
-//
-//		c.rules[i] = newRule
-//	}
-//
-//	return c, nil
-//}
-//
-//func (f *fileRouter) Execute(in bitlantern.InputReader, out bitlantern.OutputWriter, config map[string]interface{}) error {
-//	defer out.Close()
-//
-//	//Parse/read config options
-//	configOpts, err := f.buildConfig(config)
-//	if err != nil {
-//		panic("Error generating a csv")
-//	}
-//
-//	//Open the data stream
-//	reader := in.PortReader(bitlantern.DEFAULT_INPUT_PORT_NAME)
-//	err = reader.Open()
-//	if err != nil {
-//		panic("Unable to read record from input")
-//	}
-//
-//	//JS Template - We will wrap the condition express in a function that can be called more easily
-//	jsFuncTemplate, err := template.New("someName").Parse(`
-//		var {{.FuncName}} = function(data) {
-//			if ({{.Condition}}) {
-//				return true;
-//			} else {
-//				return false;
-//			}
-//		};
-//	`)
-//
-//	vm := otto.New()
-//
-//	//Parse all the JS rules
-//	for i := range configOpts.rules {
-//		curRule := &(configOpts.rules[i])
-//
-//		var b bytes.Buffer
-//		templateVars := make(map[string]string)
-//		templateVars["Condition"] = curRule.jsCondition
-//		templateVars["FuncName"] = fmt.Sprintf("splitRuleFunc_%d", i)
-//		jsFuncTemplate.Execute(&b, templateVars)
-//
-//		fmt.Printf("\n\n%s", b.String())
-//
-//		_, err := vm.Run(b.String())
-//		if err != nil {
-//			panic(err)
-//		}
-//
-//		curRule.jsFuncName = templateVars["FuncName"]
-//	}
-//
-//	//Loop through all files, routing them based on the conditions
-//	for reader.HasNext() {
-//		curEntry, err := reader.Next()
-//		if err != nil {
-//			panic(err)
-//		}
-//
-//		curFile, err := curEntry.GetAsFile()
-//		if err != nil {
-//			panic(err)
-//		}
-//
-//		fileReader := curFile.Reader()
-//
-//		fileInfo := fileInfo{
-//			Filename: curFile.Filename(),
-//		}
-//
-//		// Run the script rules for each record
-//		outputPort := configOpts.defaultOutputPort
-//		for i := range configOpts.rules {
-//			curRule := configOpts.rules[i]
-//
-//			value, err := vm.Call(curRule.jsFuncName, nil, fileInfo)
-//			if err != nil {
-//				panic(err)
-//			}
-//
-//			matches, err := value.ToBoolean()
-//			if err != nil {
-//				panic(err)
-//			}
-//
-//			if matches {
-//				outputPort = curRule.outputPort
-//			}
+import (
+	"bitbucket.org/primelogic_io/bitlantern/service/dataflow"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"text/template"
+	"time"
+)
+
+func init() {
+	//Register function with default builtin.FunctionProvider
+	DefaultInstance().RegisterFunction(
+		Function{
+			FunctionSpec: dataflow.FunctionSpec{
+				Key:           "httpCall",
+				Name:          "HTTP API Call",
+				Description:   "Makes an HTTP(S) API call for each record in the input, reads the response, and merges the response data back into the record for further processing.",
+				Category:      "API",
+				ExecutionMode: "sync",
+				InputPorts:    dataflowPorts(recordInputPort),
+				OutputPorts:   dataflowPorts(PortSpec{Name: dataflow.DEFAULT_OUTPUT_PORT_NAME, Description: "Input records merged with the API response", DataType: PortDataTypeRecord}, errorOutputPort),
+			},
+			ConfigSchema: ConfigSchema{
+				Fields: []ConfigField{
+					{Key: "method", Type: ConfigTypeString, Enum: []interface{}{"GET", "POST", "PUT", "PATCH", "DELETE", "HEAD"}, Default: "GET"},
+					{Key: "url", Type: ConfigTypeString, Required: true, Description: "URL template rendered against each record"},
+					{Key: "timeoutSeconds", Type: ConfigTypeNumber, Default: float64(30), Description: "Per-request timeout. 0 or less uses the default of 30 seconds"},
+					{Key: "maxResponseBytes", Type: ConfigTypeInteger, Default: float64(httpCallDefaultMaxResponseBytes), Description: "Maximum size of a response body. Larger responses are record errors"},
+					{Key: "request", Type: ConfigTypeObject, Fields: []ConfigField{
+						{Key: "headers", Type: ConfigTypeArray, Items: &ConfigField{
+							Type: ConfigTypeObject,
+							Fields: []ConfigField{
+								{Key: "name", Type: ConfigTypeString, Required: true},
+								{Key: "value", Type: ConfigTypeString, Required: true, Description: "Header value template"},
+							},
+						}},
+						{Key: "bodyTemplate", Type: ConfigTypeString, Description: "Request body template rendered against each record"},
+					}},
+					{Key: "response", Type: ConfigTypeObject, Fields: []ConfigField{
+						{Key: "outputField", Type: ConfigTypeString, Description: "Field to store the response in. If empty the response object is merged into the record"},
+						{Key: "statusField", Type: ConfigTypeString, Description: "Field to store the HTTP status code in"},
+					}},
+				},
+			},
+			NewFunction: func() dataflow.Function {
+				return &(httpCall{})
+			},
+		})
+}
+
+const (
+	httpCallDefaultTimeout          = 30 * time.Second
+	httpCallDefaultMaxResponseBytes = 10 * 1024 * 1024
+
+	// httpCallErrorBodyBytes is how much of the body of an error response is put in the record error
+	httpCallErrorBodyBytes = 512
+)
+
+type httpCall struct {
+	config httpCallConfig
+	client *http.Client
+}
+
+type httpCallConfig struct {
+	// method is the HTTP method (GET, POST, etc.) used for every request. Defaults to GET.
+	method string
+
+	// url is a text/template rendered against each record to produce the request URL
+	url string
+
+	// headers are sent with every request. Both the names and values are fixed, but the values are templates.
+	headers []httpCallHeader
+
+	// bodyTemplate is a text/template rendered against each record to produce the request body. Empty means no body.
+	bodyTemplate string
+
+	// outputField is the field the parsed response is stored in. If empty, the response must be a JSON object and its
+	// keys are merged directly into the record.
+	outputField *fieldPath
+
+	// statusField, if set, is the field the HTTP status code of the response is stored in
+	statusField *fieldPath
+
+	// timeout is the per-request timeout. It's never 0, since that would let a call hang forever.
+	timeout time.Duration
+
+	// maxResponseBytes is the most of a response body that's read
+	maxResponseBytes int64
+}
+
+type httpCallHeader struct {
+	name  string
+	value string
+}
+
+// buildConfig builds a httpCallConfig from the passed in map. The map must be in the form:
+// {
+//		"method": "POST",
+//		"url": "https://api.example.com/customers/{{pathEscape .customerId}}?state={{urlquery .state}}",
+//		"timeoutSeconds": 30,
+//		"maxResponseBytes": 10485760,
+//		"request": {
+//			"headers": [
+//				{ "name": "Content-Type", "value": "application/json" },
+//				{ "name": "Authorization", "value": "Bearer {{.token}}" }
+//			],
+//			"bodyTemplate": "{ \"name\": {{json .name}}, \"state\": {{json .state}} }"
+//		},
+//		"response": {
+//			"outputField": "customer",
+//			"statusField": "customerStatus"
 //		}
-//
-//		//Copy file from input to the correct output
-//		outFile, err := out.NewFileWriter(outputPort, curFile.Filename())
-//		size, err := io.Copy(outFile.Writer(), fileReader)
-//		fmt.Printf("Copied file %v with size %v bytes to %v\n", curFile.Filename(), size, outputPort)
-//	}
-//
-//	return nil
-//}
+// }
+//
+// The url, header values and bodyTemplate are Go text/templates executed with the current record as the data, so
+// any field can be referenced as {{.fieldName}}. The "json" template function renders a value as a JSON literal, and
+// "pathEscape" and "urlquery" escape a value for a URL path segment or query parameter. Values put in the url should
+// always be escaped, or characters like &, ?, / and spaces in them change the request.
+// Referencing a field the record doesn't have is a record error rather than rendering "<no value>".
+func (f *httpCall) buildConfig(config map[string]interface{}) (httpCallConfig, error) {
+	c := httpCallConfig{}
+
+	c.method, _ = config["method"].(string)
+	if c.method == "" {
+		c.method = http.MethodGet
+	}
+	c.method = strings.ToUpper(c.method)
+
+	c.url = config["url"].(string)
+
+	c.timeout = httpCallDefaultTimeout
+	if timeoutSecs, ok := config["timeoutSeconds"].(float64); ok && timeoutSecs > 0 {
+		c.timeout = time.Duration(timeoutSecs * float64(time.Second))
+	}
+
+	c.maxResponseBytes = httpCallDefaultMaxResponseBytes
+	if maxResponseBytes, ok := config["maxResponseBytes"].(float64); ok {
+		c.maxResponseBytes = int64(maxResponseBytes)
+	}
+	if c.maxResponseBytes < 1 {
+		return c, fmt.Errorf("maxResponseBytes must be at least 1")
+	}
+
+	if request, ok := config["request"].(map[string]interface{}); ok {
+		headers, _ := request["headers"].([]interface{})
+		c.headers = make([]httpCallHeader, len(headers))
+
+		for i := 0; i < len(headers); i++ {
+			curHeaderMap := headers[i].(map[string]interface{})
+			newHeader := httpCallHeader{}
+
+			newHeader.name = curHeaderMap["name"].(string)
+			newHeader.value = curHeaderMap["value"].(string)
+
+			c.headers[i] = newHeader
+		}
+
+		c.bodyTemplate, _ = request["bodyTemplate"].(string)
+	}
+
+	if response, ok := config["response"].(map[string]interface{}); ok {
+		var err error
+		if outputField, _ := response["outputField"].(string); outputField != "" {
+			c.outputField, err = parseFieldPath(outputField)
+			if err != nil {
+				return c, fmt.Errorf("response.outputField: %w", err)
+			}
+		}
+		if statusField, _ := response["statusField"].(string); statusField != "" {
+			c.statusField, err = parseFieldPath(statusField)
+			if err != nil {
+				return c, fmt.Errorf("response.statusField: %w", err)
+			}
+		}
+	}
+
+	return c, nil
+}
+
+// httpCallTemplates holds the parsed templates for a single run, so they are only parsed once
+type httpCallTemplates struct {
+	url     *template.Template
+	headers []*template.Template
+	body    *template.Template
+}
+
+var httpCallTemplateFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+	"pathEscape": func(v interface{}) string {
+		return url.PathEscape(fmt.Sprint(v))
+	},
+	"urlquery": func(v interface{}) string {
+		return url.QueryEscape(fmt.Sprint(v))
+	},
+}
+
+// newHTTPCallTemplate parses a template. Missing fields are errors so a request is never sent with "<no value>" in it.
+func newHTTPCallTemplate(name string, text string) (*template.Template, error) {
+	return template.New(name).Funcs(httpCallTemplateFuncs).Option("missingkey=error").Parse(text)
+}
+
+func (f *httpCall) parseTemplates() (httpCallTemplates, error) {
+	t := httpCallTemplates{}
+
+	var err error
+	t.url, err = newHTTPCallTemplate("url", f.config.url)
+	if err != nil {
+		return t, err
+	}
+
+	t.headers = make([]*template.Template, len(f.config.headers))
+	for i := range f.config.headers {
+		name := fmt.Sprintf("header_%d", i)
+		t.headers[i], err = newHTTPCallTemplate(name, f.config.headers[i].value)
+		if err != nil {
+			return t, err
+		}
+	}
+
+	if f.config.bodyTemplate != "" {
+		t.body, err = newHTTPCallTemplate("body", f.config.bodyTemplate)
+		if err != nil {
+			return t, err
+		}
+	}
+
+	return t, nil
+}
+
+func renderTemplate(t *template.Template, data interface{}) (string, error) {
+	var b bytes.Buffer
+	err := t.Execute(&b, data)
+	return b.String(), err
+}
+
+func (f *httpCall) Execute(in dataflow.InputReader, out dataflow.OutputWriter, config map[string]interface{}) error {
+	defer out.Close()
+
+	//Parse/read config options
+	config, err := prepareConfig("httpCall", config)
+	if err != nil {
+		return err
+	}
+
+	parsedConfig, err := f.buildConfig(config)
+	if err != nil {
+		return newFunctionError("httpCall", "building config", err)
+	}
+	f.config = parsedConfig
+	f.client = &http.Client{Timeout: f.config.timeout}
+
+	templates, err := f.parseTemplates()
+	if err != nil {
+		return newFunctionError("httpCall", "parsing templates", err)
+	}
+
+	//Open the data stream
+	reader := in.PortReader(dataflow.DEFAULT_INPUT_PORT_NAME)
+	err = reader.Open()
+	if err != nil {
+		return newFunctionError("httpCall", "opening input", err)
+	}
+
+	//Loop through all data, making one call per record
+	for reader.HasNext() {
+		rec, err := reader.Next()
+		if err != nil {
+			return newFunctionError("httpCall", "reading input", err)
+		}
+
+		recVal, err := rec.GetAsRecord()
+		if err != nil {
+			writeRecordError(out, &(RecordError{FunctionKey: "httpCall", Err: err}))
+			continue
+		}
+
+		original := copyRecord(recVal)
+		err = f.callAndMerge(&templates, recVal)
+		if err != nil {
+			writeRecordError(out, &(RecordError{FunctionKey: "httpCall", Record: original, Err: err}))
+			continue
+		}
+
+		out.WriteRecord(dataflow.DEFAULT_OUTPUT_PORT_NAME, &recVal)
+	}
+
+	return nil
+}
+
+// callAndMerge builds the request for the record, sends it, and merges the parsed response back into the record
+func (f *httpCall) callAndMerge(templates *httpCallTemplates, rec dataflow.Record) error {
+	data := map[string]interface{}(rec)
+
+	reqURL, err := renderTemplate(templates.url, data)
+	if err != nil {
+		return err
+	}
+
+	var body io.Reader
+	if templates.body != nil {
+		bodyStr, err := renderTemplate(templates.body, data)
+		if err != nil {
+			return err
+		}
+		body = strings.NewReader(bodyStr)
+	}
+
+	req, err := http.NewRequest(f.config.method, reqURL, body)
+	if err != nil {
+		return err
+	}
+
+	for i := range f.config.headers {
+		value, err := renderTemplate(templates.headers[i], data)
+		if err != nil {
+			return err
+		}
+		req.Header.Set(f.config.headers[i].name, value)
+	}
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	//Read one byte past the limit so a body of exactly maxResponseBytes isn't mistaken for a larger one
+	respBody, err := ioutil.ReadAll(io.LimitReader(resp.Body, f.config.maxResponseBytes+1))
+	if err != nil {
+		return err
+	}
+	if int64(len(respBody)) > f.config.maxResponseBytes {
+		return fmt.Errorf("response from %v is larger than maxResponseBytes (%d)", reqURL, f.config.maxResponseBytes)
+	}
+
+	if f.config.statusField != nil {
+		err = f.config.statusField.set(rec, resp.StatusCode)
+		if err != nil {
+			return err
+		}
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		if len(respBody) > httpCallErrorBodyBytes {
+			respBody = append(respBody[:httpCallErrorBodyBytes:httpCallErrorBodyBytes], "..."...)
+		}
+		return fmt.Errorf("%v %v returned status %v: %s", f.config.method, reqURL, resp.StatusCode, respBody)
+	}
+
+	//Nothing to merge
+	if len(bytes.TrimSpace(respBody)) == 0 {
+		return nil
+	}
+
+	var respData interface{}
+	err = json.Unmarshal(respBody, &respData)
+	if err != nil {
+		return err
+	}
+
+	if f.config.outputField != nil {
+		return f.config.outputField.set(rec, respData)
+	}
+
+	respMap, ok := respData.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("response from %v is not a JSON object, so response.outputField must be set", reqURL)
+	}
+
+	for key, val := range respMap {
+		rec.Set(key, val)
+	}
+
+	return nil
+}
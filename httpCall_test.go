@@ -0,0 +1,175 @@
+package builtin
+
+import (
+	"bitbucket.org/primelogic_io/bitlantern/service/dataflow"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestHTTPCall(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.EscapedPath() {
+		case "/customers/42":
+			body, _ := ioutil.ReadAll(r.Body)
+			var req map[string]interface{}
+			json.Unmarshal(body, &req)
+
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"method": r.Method,
+				"auth":   r.Header.Get("Authorization"),
+				"echo":   req["name"],
+			})
+		case "/list":
+			w.Write([]byte(`[1, 2]`))
+		case "/big":
+			w.Write([]byte(`"0123456789"`))
+		case "/items/x%2Fy%20z/search":
+			json.NewEncoder(w).Encode(map[string]interface{}{"q": r.URL.Query().Get("q"), "sort": r.URL.Query().Get("sort")})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	request := map[string]interface{}{
+		"headers":      []interface{}{map[string]interface{}{"name": "Authorization", "value": "Bearer {{.token}}"}},
+		"bodyTemplate": `{"name": {{json .name}}}`,
+	}
+
+	tests := []struct {
+		name       string
+		config     map[string]interface{}
+		record     dataflow.Record
+		want       dataflow.Record
+		wantErrors int
+	}{
+		{
+			name:   "response object is merged into the record",
+			config: map[string]interface{}{"method": "POST", "url": server.URL + "/customers/{{.id}}", "request": request},
+			record: dataflow.Record{"id": "42", "token": "abc", "name": "Ada \"Countess\""},
+			want: dataflow.Record{
+				"id": "42", "token": "abc", "name": "Ada \"Countess\"",
+				"method": "POST", "auth": "Bearer abc", "echo": "Ada \"Countess\"",
+			},
+		},
+		{
+			name: "response stored in outputField with status",
+			config: map[string]interface{}{
+				"url":      server.URL + "/list",
+				"response": map[string]interface{}{"outputField": "items", "statusField": "status"},
+			},
+			record: dataflow.Record{},
+			want:   dataflow.Record{"items": []interface{}{1.0, 2.0}, "status": 200},
+		},
+		{
+			name:       "non object response without outputField is an error",
+			config:     map[string]interface{}{"url": server.URL + "/list"},
+			record:     dataflow.Record{},
+			wantErrors: 1,
+		},
+		{
+			name:   "escaped url values",
+			config: map[string]interface{}{"url": server.URL + "/items/{{pathEscape .item}}/search?q={{urlquery .q}}&sort=name"},
+			record: dataflow.Record{"item": "x/y z", "q": "a&sort=c d?"},
+			want:   dataflow.Record{"item": "x/y z", "q": "a&sort=c d?", "sort": "name"},
+		},
+		{
+			name: "missing template field is an error",
+			config: map[string]interface{}{
+				"method":   "POST",
+				"url":      server.URL + "/list",
+				"request":  map[string]interface{}{"bodyTemplate": `{"name": {{json .name}}}`},
+				"response": map[string]interface{}{"outputField": "items"},
+			},
+			record:     dataflow.Record{"id": "42"},
+			wantErrors: 1,
+		},
+		{
+			name: "response at maxResponseBytes",
+			config: map[string]interface{}{
+				"url":              server.URL + "/big",
+				"maxResponseBytes": 12.0,
+				"response":         map[string]interface{}{"outputField": "digits"},
+			},
+			record: dataflow.Record{},
+			want:   dataflow.Record{"digits": "0123456789"},
+		},
+		{
+			name: "response over maxResponseBytes is an error",
+			config: map[string]interface{}{
+				"url":              server.URL + "/big",
+				"maxResponseBytes": 11.0,
+				"response":         map[string]interface{}{"outputField": "digits"},
+			},
+			record:     dataflow.Record{},
+			wantErrors: 1,
+		},
+		{
+			name:       "error status",
+			config:     map[string]interface{}{"url": server.URL + "/nope"},
+			record:     dataflow.Record{},
+			wantErrors: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, err := runFunction(t, "httpCall", tt.config, recordInput(tt.record))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := out.Records(ERROR_OUTPUT_PORT_NAME); len(got) != tt.wantErrors {
+				t.Fatalf("got %d error records, want %d: %v", len(got), tt.wantErrors, got)
+			}
+			if tt.want == nil {
+				return
+			}
+
+			got := out.Records(dataflow.DEFAULT_OUTPUT_PORT_NAME)
+			if len(got) != 1 || !reflect.DeepEqual(got[0], tt.want) {
+				t.Errorf("records = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHTTPCallErrorBodyIsTruncated(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(strings.Repeat("x", 4096)))
+	}))
+	defer server.Close()
+
+	out, err := runFunction(t, "httpCall", map[string]interface{}{"url": server.URL}, recordInput(dataflow.Record{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errs := out.Records(ERROR_OUTPUT_PORT_NAME)
+	if len(errs) != 1 {
+		t.Fatalf("got %d error records, want 1", len(errs))
+	}
+	if msg := errs[0]["error"].(string); strings.Count(msg, "x") != httpCallErrorBodyBytes || !strings.HasSuffix(msg, "...") {
+		t.Errorf("error body not truncated to %d bytes: %d bytes", httpCallErrorBodyBytes, len(msg))
+	}
+}
+
+func TestHTTPCallDefaultTimeout(t *testing.T) {
+	for _, timeoutSeconds := range []float64{0, -1} {
+		f := &(httpCall{})
+		c, err := f.buildConfig(map[string]interface{}{"url": "http://localhost", "timeoutSeconds": timeoutSeconds})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.timeout != httpCallDefaultTimeout {
+			t.Errorf("timeoutSeconds %v: got timeout %v, want %v", timeoutSeconds, c.timeout, httpCallDefaultTimeout)
+		}
+	}
+}
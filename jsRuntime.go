@@ -0,0 +1,463 @@
+package builtin
+
+import (
+	"bitbucket.org/primelogic_io/bitlantern/service/dataflow"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/robertkrimen/otto"
+	_ "github.com/robertkrimen/otto/underscore"
+	"math"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// jsHelperLibrary is loaded into every JS runtime, so the helpers are available to all jsCondition and jsExpression
+// rules (transformData, splitOnFieldJS, fileRouter). Dates use Go time layouts (e.g. "2006-01-02"), the same as the
+// "format" of date columns in the parsers.
+const jsHelperLibrary = `
+	String.prototype.toTitleCase = function() {
+		return this.replace(/\w\S*/g, function(txt){return txt.charAt(0).toUpperCase() + txt.substr(1).toLowerCase();});
+	};
+
+	var upper = function(s) { return s == null ? s : String(s).toUpperCase(); };
+	var lower = function(s) { return s == null ? s : String(s).toLowerCase(); };
+	var titleCase = function(s) { return s == null ? s : String(s).toTitleCase(); };
+	var trim = function(s) { return s == null ? s : String(s).trim(); };
+
+	var padLeft = function(s, length, padChar) {
+		s = s == null ? "" : String(s);
+		padChar = padChar == null ? " " : String(padChar);
+		while (s.length < length) { s = padChar + s; }
+		return s;
+	};
+
+	var padRight = function(s, length, padChar) {
+		s = s == null ? "" : String(s);
+		padChar = padChar == null ? " " : String(padChar);
+		while (s.length < length) { s = s + padChar; }
+		return s;
+	};
+
+	var round = function(n, places) {
+		var factor = Math.pow(10, places || 0);
+		return Math.round(n * factor) / factor;
+	};
+
+	var coalesce = function() {
+		for (var i = 0; i < arguments.length; i++) {
+			if (arguments[i] !== null && arguments[i] !== undefined) { return arguments[i]; }
+		}
+		return null;
+	};
+
+	var parseDate = function(s, layout) {
+		if (s == null || s === "") { return null; }
+		return new Date(_parseDateMillis(String(s), layout));
+	};
+
+	var formatDate = function(d, layout) {
+		if (d == null) { return null; }
+		return _formatDateMillis(d instanceof Date ? d.getTime() : d, layout);
+	};
+`
+
+// jsLockdownScript is run after the helper library, and replaces the Function constructor, which can also be reached
+// through the constructor of any function, so rules can't compile code from strings. Function.prototype is kept, so
+// instanceof Function still works. eval is removed from each copy in newJSRuntime, since otto can't copy a VM without
+// it.
+const jsLockdownScript = `
+	(function() {
+		var blocked = function() {
+			throw new EvalError("compiling code from strings is not allowed in rules");
+		};
+		blocked.prototype = Function.prototype;
+
+		Function.prototype.constructor = blocked;
+		Function = blocked;
+	})();
+`
+
+// JS Templates - We wrap each condition/expression in a function that can be called more easily
+var (
+	jsConditionTemplate = template.Must(template.New("jsCondition").Parse(`
+		var {{.FuncName}} = function(data) {
+			if ({{.Condition}}) {
+				return true;
+			} else {
+				return false;
+			}
+		};
+	`))
+
+	jsExpressionTemplate = template.Must(template.New("jsExpression").Parse(`
+		var {{.FuncName}} = function(data) {
+			return ({{.Expression}});
+		};
+	`))
+)
+
+var (
+	// jsBaseVM has the helper library loaded. It is built once and copied for every run, since an otto VM can't be
+	// shared between goroutines.
+	jsBaseVM     *otto.Otto
+	jsBaseVMErr  error
+	jsBaseVMOnce sync.Once
+)
+
+func buildJSBaseVM() (*otto.Otto, error) {
+	vm := otto.New()
+
+	vm.Set("_parseDateMillis", func(call otto.FunctionCall) otto.Value {
+		value := call.Argument(0).String()
+		layout := call.Argument(1).String()
+
+		t, err := time.Parse(layout, value)
+		if err != nil {
+			panic(call.Otto.MakeCustomError("DateError", err.Error()))
+		}
+
+		result, _ := call.Otto.ToValue(float64(t.UnixNano() / int64(time.Millisecond)))
+		return result
+	})
+
+	vm.Set("_formatDateMillis", func(call otto.FunctionCall) otto.Value {
+		layout := call.Argument(1).String()
+
+		var t time.Time
+		exported, _ := call.Argument(0).Export()
+		switch v := exported.(type) {
+		case time.Time:
+			t = v
+		default:
+			millis, err := call.Argument(0).ToFloat()
+			if err != nil || math.IsNaN(millis) {
+				panic(call.Otto.MakeTypeError(fmt.Sprintf("formatDate: %v is not a date", exported)))
+			}
+			t = time.Unix(0, int64(millis)*int64(time.Millisecond)).UTC()
+		}
+
+		result, _ := call.Otto.ToValue(t.Format(layout))
+		return result
+	})
+
+	script, err := vm.Compile("helpers.js", jsHelperLibrary)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = vm.Run(script)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = vm.Run(jsLockdownScript)
+	if err != nil {
+		return nil, err
+	}
+
+	return vm, nil
+}
+
+// jsRuntimeConfigFields are the config keys shared by every function that evaluates JS rules
+var jsRuntimeConfigFields = []ConfigField{
+	{Key: "helperScripts", Type: ConfigTypeArray, Items: &ConfigField{Type: ConfigTypeString}, Description: "Paths of JS files to load before the rules are compiled, relative to the config file directory"},
+	{Key: "helperScript", Type: ConfigTypeString, Description: "Inline JS loaded before the rules are compiled"},
+	{Key: "jsRecordTimeoutMs", Type: ConfigTypeNumber, Default: float64(1000), Description: "Maximum time a single rule call may run. 0 means no limit"},
+	{Key: "jsRunTimeoutMs", Type: ConfigTypeNumber, Default: float64(0), Description: "Maximum total time all rule calls in a run may take. 0 means no limit"},
+	{Key: "jsMaxStackDepth", Type: ConfigTypeInteger, Default: float64(200), Description: "Maximum JS call stack depth. 0 means no limit"},
+	{Key: "jsMaxOutputBytes", Type: ConfigTypeInteger, Default: float64(1024 * 1024), Description: "Maximum size of a jsExpression result, checked once the expression returns. 0 means no limit"},
+}
+
+// jsRuntimeConfig holds the user supplied helper scripts and execution limits read from a function's config
+type jsRuntimeConfig struct {
+	helperScripts []string
+	helperScript  string
+
+	recordTimeout  time.Duration
+	runTimeout     time.Duration
+	maxStackDepth  int
+	maxOutputBytes int
+}
+
+func buildJSRuntimeConfig(config map[string]interface{}) jsRuntimeConfig {
+	c := jsRuntimeConfig{}
+
+	scripts, _ := config["helperScripts"].([]interface{})
+	for i := range scripts {
+		c.helperScripts = append(c.helperScripts, scripts[i].(string))
+	}
+	c.helperScript, _ = config["helperScript"].(string)
+
+	recordTimeoutMs, _ := configValueAsFloat(config["jsRecordTimeoutMs"])
+	c.recordTimeout = time.Duration(recordTimeoutMs * float64(time.Millisecond))
+	runTimeoutMs, _ := configValueAsFloat(config["jsRunTimeoutMs"])
+	c.runTimeout = time.Duration(runTimeoutMs * float64(time.Millisecond))
+	maxStackDepth, _ := configValueAsFloat(config["jsMaxStackDepth"])
+	c.maxStackDepth = int(maxStackDepth)
+	maxOutputBytes, _ := configValueAsFloat(config["jsMaxOutputBytes"])
+	c.maxOutputBytes = int(maxOutputBytes)
+
+	return c
+}
+
+// JSTimeoutError is returned when a rule call runs longer than its time budget. If RunBudget is true the budget for
+// the whole run is used up, so no further rule calls can be made and the function should stop.
+type JSTimeoutError struct {
+	Budget    time.Duration
+	RunBudget bool
+}
+
+func (e *JSTimeoutError) Error() string {
+	if e.RunBudget {
+		return fmt.Sprintf("JS run time budget of %v exceeded", e.Budget)
+	}
+
+	return fmt.Sprintf("JS rule took longer than %v", e.Budget)
+}
+
+// isJSRunBudgetExceeded reports whether err (or an error it wraps) means the run's JS time budget is used up
+func isJSRunBudgetExceeded(err error) bool {
+	var timeoutErr *JSTimeoutError
+	return errors.As(err, &timeoutErr) && timeoutErr.RunBudget
+}
+
+// jsInterrupt is the value panicked with by the interrupt function, so it can be told apart from other panics
+type jsInterrupt struct{}
+
+// jsRuntime is the JS expression subsystem shared by the builtins. Each run gets its own runtime (a copy of the base
+// VM, plus the user's helper scripts) into which the rules are compiled once, then called per record/file.
+type jsRuntime struct {
+	vm        *otto.Otto
+	funcCount int
+	config    jsRuntimeConfig
+
+	// elapsed is the total time spent in rule calls so far, counted against config.runTimeout
+	elapsed time.Duration
+}
+
+func newJSRuntime(config jsRuntimeConfig) (*jsRuntime, error) {
+	jsBaseVMOnce.Do(func() {
+		jsBaseVM, jsBaseVMErr = buildJSBaseVM()
+	})
+	if jsBaseVMErr != nil {
+		return nil, fmt.Errorf("loading JS helper library: %v", jsBaseVMErr)
+	}
+
+	rt := &(jsRuntime{vm: jsBaseVM.Copy(), config: config})
+
+	if config.maxStackDepth > 0 {
+		rt.vm.SetStackDepthLimit(config.maxStackDepth)
+	}
+
+	//Rules get the helper library and the data passed to them, but can't compile code (see jsLockdownScript). They can
+	//still use as much memory as they like within their time limits.
+	rt.vm.Set("eval", otto.UndefinedValue())
+
+	for _, path := range config.helperScripts {
+		src, err := readConfigFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("reading helper script: %v", err)
+		}
+
+		_, err = rt.run(string(src))
+		if err != nil {
+			return nil, fmt.Errorf("helper script %v: %v", path, err)
+		}
+	}
+
+	if config.helperScript != "" {
+		_, err := rt.run(config.helperScript)
+		if err != nil {
+			return nil, fmt.Errorf("helperScript: %v", err)
+		}
+	}
+
+	return rt, nil
+}
+
+// run runs a script (e.g. a helper script) with the per-record time limit, so a script with an infinite loop at the
+// top level can't hang the run either
+func (rt *jsRuntime) run(src string) (otto.Value, error) {
+	return rt.withTimeLimit(func() (otto.Value, error) {
+		return rt.vm.Run(src)
+	})
+}
+
+// withTimeLimit runs fn, interrupting the VM if it runs longer than the per-record budget or the remaining run budget
+func (rt *jsRuntime) withTimeLimit(fn func() (otto.Value, error)) (value otto.Value, err error) {
+	budget := rt.config.recordTimeout
+	isRunBudget := false
+
+	if rt.config.runTimeout > 0 {
+		remaining := rt.config.runTimeout - rt.elapsed
+		if remaining <= 0 {
+			return otto.UndefinedValue(), &(JSTimeoutError{Budget: rt.config.runTimeout, RunBudget: true})
+		}
+		if budget <= 0 || remaining < budget {
+			budget = remaining
+			isRunBudget = true
+		}
+	}
+
+	start := time.Now()
+	defer func() {
+		rt.elapsed += time.Since(start)
+	}()
+
+	if budget > 0 {
+		//A new channel for every call, so an interrupt that fires just as a call finishes can't hit the next call
+		interrupt := make(chan func(), 1)
+		rt.vm.Interrupt = interrupt
+		timer := time.AfterFunc(budget, func() {
+			interrupt <- func() {
+				panic(jsInterrupt{})
+			}
+		})
+
+		defer func() {
+			timer.Stop()
+			rt.vm.Interrupt = nil
+
+			if caught := recover(); caught != nil {
+				if _, ok := caught.(jsInterrupt); !ok {
+					panic(caught)
+				}
+
+				timeoutErr := &(JSTimeoutError{Budget: budget, RunBudget: isRunBudget})
+				if isRunBudget {
+					timeoutErr.Budget = rt.config.runTimeout
+				}
+				value, err = otto.UndefinedValue(), timeoutErr
+			}
+		}()
+	}
+
+	return fn()
+}
+
+// compile wraps the source using the template and defines the resulting function in the VM, returning its name
+func (rt *jsRuntime) compile(tmpl *template.Template, key string, source string) (string, error) {
+	funcName := fmt.Sprintf("rule_%d", rt.funcCount)
+	rt.funcCount++
+
+	var b bytes.Buffer
+	templateVars := make(map[string]string)
+	templateVars[key] = source
+	templateVars["FuncName"] = funcName
+
+	err := tmpl.Execute(&b, templateVars)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = rt.run(b.String())
+	if err != nil {
+		return "", err
+	}
+
+	return funcName, nil
+}
+
+// compileCondition compiles a JS condition into a function that returns true or false
+func (rt *jsRuntime) compileCondition(condition string) (string, error) {
+	return rt.compile(jsConditionTemplate, "Condition", condition)
+}
+
+// compileExpression compiles a JS expression into a function that returns its value
+func (rt *jsRuntime) compileExpression(expression string) (string, error) {
+	return rt.compile(jsExpressionTemplate, "Expression", expression)
+}
+
+// call calls a compiled rule function within the time limits
+func (rt *jsRuntime) call(funcName string, data interface{}) (otto.Value, error) {
+	return rt.withTimeLimit(func() (otto.Value, error) {
+		return rt.vm.Call(funcName, nil, data)
+	})
+}
+
+// setEmitter defines emit(record) in the VM, which passes each object it's called with to fn as a record
+func (rt *jsRuntime) setEmitter(fn func(dataflow.Record)) {
+	rt.vm.Set("emit", func(call otto.FunctionCall) otto.Value {
+		exported, _ := call.Argument(0).Export()
+		rec, ok := exported.(map[string]interface{})
+		if !ok {
+			panic(call.Otto.MakeTypeError(fmt.Sprintf("emit: %v is not an object", exported)))
+		}
+
+		fn(dataflow.Record(rec))
+		return otto.UndefinedValue()
+	})
+}
+
+// callCondition calls a function built by compileCondition
+func (rt *jsRuntime) callCondition(funcName string, data interface{}) (bool, error) {
+	value, err := rt.call(funcName, data)
+	if err != nil {
+		return false, err
+	}
+
+	return value.ToBoolean()
+}
+
+// callExpression calls a function built by compileExpression and exports the result as a Go value. Results larger
+// than the configured maximum output size are rejected. The size is only checked once the expression returns, so it
+// doesn't stop an expression building large values inside the VM; only the time limits bound that.
+func (rt *jsRuntime) callExpression(funcName string, data interface{}) (interface{}, error) {
+	value, err := rt.call(funcName, data)
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := value.Export()
+	if err != nil {
+		return nil, err
+	}
+
+	if rt.config.maxOutputBytes > 0 {
+		size := jsResultSize(result)
+		if size > rt.config.maxOutputBytes {
+			return nil, fmt.Errorf("JS result is %d bytes, which is more than the maximum of %d", size, rt.config.maxOutputBytes)
+		}
+	}
+
+	return result, nil
+}
+
+// jsResultSize approximates the size of an exported JS value in bytes
+func jsResultSize(result interface{}) int {
+	switch v := result.(type) {
+	case nil:
+		return 0
+	case string:
+		return len(v)
+	case bool, float64, int64, time.Time:
+		return 8
+	default:
+		b, err := json.Marshal(v)
+		if err != nil {
+			return 0
+		}
+		return len(b)
+	}
+}
+
+// jsRuleCompileErrors collects the compile errors of a function's rules, so they can all be reported together
+type jsRuleCompileErrors struct {
+	violations []ConfigViolation
+}
+
+func (e *jsRuleCompileErrors) add(path string, err error) {
+	e.violations = append(e.violations, ConfigViolation{Path: path, Message: err.Error()})
+}
+
+// err returns a *ConfigValidationError listing every rule that didn't compile, or nil if they all did
+func (e *jsRuleCompileErrors) err(functionKey string) error {
+	if len(e.violations) == 0 {
+		return nil
+	}
+
+	return &(ConfigValidationError{FunctionKey: functionKey, Violations: e.violations})
+}
@@ -0,0 +1,178 @@
+package builtin
+
+import (
+	"bitbucket.org/primelogic_io/bitlantern/service/dataflow"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestJSHelperLibrary(t *testing.T) {
+	tests := []struct {
+		expression string
+		data       dataflow.Record
+		want       interface{}
+	}{
+		{expression: "padLeft(data.n, 5, '0')", data: dataflow.Record{"n": "42"}, want: "00042"},
+		{expression: "padRight('ab', 4)", want: "ab  "},
+		{expression: "upper(data.s) + lower('CD')", data: dataflow.Record{"s": "ab"}, want: "ABcd"},
+		{expression: "titleCase('hello wORLD')", want: "Hello World"},
+		{expression: "'ada lovelace'.toTitleCase()", want: "Ada Lovelace"},
+		{expression: "round(2.345, 2)", want: 2.35},
+		{expression: "round(2.5)", want: 3.0},
+		{expression: "coalesce(data.missing, null, 'x')", data: dataflow.Record{}, want: "x"},
+		{expression: "formatDate(parseDate('31/12/2019', '02/01/2006'), '2006-01-02')", want: "2019-12-31"},
+		{expression: "formatDate(data.d, 'Jan 2 2006')", data: dataflow.Record{"d": time.Date(2020, 3, 4, 0, 0, 0, 0, time.UTC)}, want: "Mar 4 2020"},
+		{expression: "parseDate('', '2006')", want: nil},
+	}
+
+	rt, err := newJSRuntime(jsRuntimeConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.expression, func(t *testing.T) {
+			funcName, err := rt.compileExpression(tt.expression)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := rt.callExpression(funcName, tt.data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestJSHelperScripts(t *testing.T) {
+	dir := setTestConfigFileDir(t)
+	err := ioutil.WriteFile(filepath.Join(dir, "helpers.js"), []byte("var fromFile = function(s) { return 'file:' + s; };"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := map[string]interface{}{
+		"helperScripts": []interface{}{"helpers.js"},
+		"helperScript":  "var inline = function(s) { return 'inline:' + s; };",
+		"rules":         []interface{}{transformRuleMap("out", "inline(fromFile(data.v))")},
+	}
+
+	out, err := runFunction(t, "transformData", config, recordInput(dataflow.Record{"v": "x"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := out.Records(dataflow.DEFAULT_OUTPUT_PORT_NAME)
+	if len(got) != 1 || got[0]["out"] != "inline:file:x" {
+		t.Errorf("records = %v", got)
+	}
+}
+
+func TestJSCompileErrorsReportedPerRule(t *testing.T) {
+	config := map[string]interface{}{
+		"defaultOutputPort": "other",
+		"rules": []interface{}{
+			map[string]interface{}{"jsCondition": "data.a ==", "outputPort": "a"},
+			map[string]interface{}{"jsCondition": "data.b == 1", "outputPort": "b"},
+			map[string]interface{}{"jsCondition": "((", "outputPort": "c"},
+		},
+	}
+
+	_, err := runFunction(t, "splitOnFieldJS", config, recordInput())
+
+	var validationErr *ConfigValidationError
+	if !errors.As(err, &validationErr) {
+		t.Fatalf("expected a *ConfigValidationError, got %v", err)
+	}
+	if len(validationErr.Violations) != 2 ||
+		validationErr.Violations[0].Path != "rules[0].jsCondition" ||
+		validationErr.Violations[1].Path != "rules[2].jsCondition" {
+		t.Errorf("violations = %v", validationErr.Violations)
+	}
+}
+
+func TestJSLimits(t *testing.T) {
+	tests := []struct {
+		name       string
+		config     map[string]interface{}
+		expression string
+	}{
+		{
+			name:       "record timeout",
+			config:     map[string]interface{}{"jsRecordTimeoutMs": 50.0},
+			expression: "(function() { while (data.loop) {} return 1; })()",
+		},
+		{
+			name:       "stack depth",
+			config:     map[string]interface{}{"jsMaxStackDepth": 50.0},
+			expression: "(function f(n) { return data.loop ? f(n + 1) : n; })(0)",
+		},
+		{
+			name:       "output size",
+			config:     map[string]interface{}{"jsMaxOutputBytes": 100.0},
+			expression: "data.loop ? new Array(1000).join('x') : 'ok'",
+		},
+		{
+			name:       "no eval",
+			config:     map[string]interface{}{},
+			expression: "data.loop ? eval('1') : 'ok'",
+		},
+		{
+			name:       "no Function constructor",
+			config:     map[string]interface{}{},
+			expression: "data.loop ? Function('return 1')() : 'ok'",
+		},
+		{
+			name:       "no Function constructor through a function",
+			config:     map[string]interface{}{},
+			expression: "data.loop ? (function() {}).constructor('return 1')() : (function() {}) instanceof Function && 'ok'",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.config["rules"] = []interface{}{transformRuleMap("out", tt.expression)}
+
+			bad := dataflow.Record{"loop": true}
+			good := dataflow.Record{"loop": false}
+			out, err := runFunction(t, "transformData", tt.config, recordInput(bad, good))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(out.Records(dataflow.DEFAULT_OUTPUT_PORT_NAME)) != 1 {
+				t.Errorf("expected the good record to keep flowing, got ports %v", out.Ports())
+			}
+			assertErrorRecords(t, out, []dataflow.Record{{"functionKey": "transformData", "record": bad}})
+		})
+	}
+}
+
+func TestJSRunTimeout(t *testing.T) {
+	config := map[string]interface{}{
+		"jsRunTimeoutMs": 100.0,
+		"rules":          []interface{}{transformRuleMap("out", "(function() { var end = Date.now() + 30; while (Date.now() < end) {} return 1; })()")},
+	}
+
+	recs := make([]dataflow.Record, 20)
+	for i := range recs {
+		recs[i] = dataflow.Record{"i": i}
+	}
+
+	out, err := runFunction(t, "transformData", config, recordInput(recs...))
+	if !isJSRunBudgetExceeded(err) {
+		t.Fatalf("expected the run budget to be exceeded, got %v", err)
+	}
+
+	if n := len(out.Records(dataflow.DEFAULT_OUTPUT_PORT_NAME)); n == 0 || n >= len(recs) {
+		t.Errorf("expected some records to be processed before the budget ran out, got %d", n)
+	}
+}
@@ -0,0 +1,172 @@
+package builtin
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"golang.org/x/text/encoding/charmap"
+	"math"
+	"strings"
+)
+
+// decodeFixedLengthText converts raw bytes in the given encoding to a string
+func decodeFixedLengthText(cm *charmap.Charmap, raw []byte) string {
+	if cm == nil {
+		return string(raw)
+	}
+
+	var sb strings.Builder
+	for _, b := range raw {
+		sb.WriteRune(cm.DecodeByte(b))
+	}
+
+	return sb.String()
+}
+
+// fixedLengthSplitFunc splits a file into records. If recordLength is set every record is exactly that many bytes, which
+// is how z/OS writes fixed block (FB) datasets and is the only safe option when records contain packed or binary
+// fields. Otherwise records are separated by newlines, which for EBCDIC files is NL (0x15) or LF (0x25).
+func fixedLengthSplitFunc(recordLength int, ebcdic bool) bufio.SplitFunc {
+	if recordLength > 0 {
+		return func(data []byte, atEOF bool) (int, []byte, error) {
+			if len(data) >= recordLength {
+				return recordLength, data[:recordLength], nil
+			}
+			if atEOF && len(data) > 0 {
+				//Short last record, which is reported when its columns are parsed
+				return len(data), data, nil
+			}
+			return 0, nil, nil
+		}
+	}
+
+	if !ebcdic {
+		return bufio.ScanLines
+	}
+
+	return func(data []byte, atEOF bool) (int, []byte, error) {
+		for i, b := range data {
+			if b == 0x15 || b == 0x25 {
+				return i + 1, bytes.TrimSuffix(data[:i], []byte{0x0D}), nil
+			}
+		}
+		if atEOF && len(data) > 0 {
+			return len(data), bytes.TrimSuffix(data, []byte{0x0D}), nil
+		}
+		return 0, nil, nil
+	}
+}
+
+// decodePacked decodes a COMP-3 packed decimal: two digits per byte, with the sign in the last nibble (C or F for
+// positive, D or B for negative)
+func decodePacked(raw []byte) (int64, error) {
+	if len(raw) == 0 || len(raw) > 10 {
+		return 0, fmt.Errorf("packed decimals must be between 1 and 10 bytes long")
+	}
+
+	var val int64
+	for i, b := range raw {
+		high, low := b>>4, b&0x0F
+		if val > (math.MaxInt64-99)/100 {
+			return 0, fmt.Errorf("packed decimal %X is too large", raw)
+		}
+
+		if high > 9 {
+			return 0, fmt.Errorf("invalid packed decimal %X", raw)
+		}
+		val = val*10 + int64(high)
+
+		if i == len(raw)-1 {
+			switch low {
+			case 0x0D, 0x0B:
+				return -val, nil
+			case 0x0C, 0x0F, 0x0A, 0x0E:
+				return val, nil
+			default:
+				return 0, fmt.Errorf("invalid packed decimal sign in %X", raw)
+			}
+		}
+
+		if low > 9 {
+			return 0, fmt.Errorf("invalid packed decimal %X", raw)
+		}
+		val = val*10 + int64(low)
+	}
+
+	return val, nil
+}
+
+// decodeZoned decodes a zoned decimal that has already been converted to text. The sign is overpunched on the last
+// digit ({ and A-I are +0 to +9, } and J-R are -0 to -9), although a leading + or - is also accepted.
+func decodeZoned(text string) (int64, error) {
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return 0, fmt.Errorf("empty zoned decimal")
+	}
+
+	negative := false
+	if text[0] == '+' || text[0] == '-' {
+		negative = text[0] == '-'
+		text = text[1:]
+		if text == "" {
+			return 0, fmt.Errorf("invalid zoned decimal")
+		}
+	}
+
+	var val int64
+	for i := 0; i < len(text); i++ {
+		ch := text[i]
+		digit := int64(0)
+
+		switch {
+		case ch >= '0' && ch <= '9':
+			digit = int64(ch - '0')
+		case i == len(text)-1 && ch == '{':
+			digit = 0
+		case i == len(text)-1 && ch >= 'A' && ch <= 'I':
+			digit = int64(ch-'A') + 1
+		case i == len(text)-1 && ch == '}':
+			digit, negative = 0, true
+		case i == len(text)-1 && ch >= 'J' && ch <= 'R':
+			digit, negative = int64(ch-'J')+1, true
+		default:
+			return 0, fmt.Errorf("invalid zoned decimal %q", text)
+		}
+
+		if val > (math.MaxInt64-digit)/10 {
+			return 0, fmt.Errorf("zoned decimal %q is too large", text)
+		}
+		val = val*10 + digit
+	}
+
+	if negative {
+		val = -val
+	}
+
+	return val, nil
+}
+
+// decodeBinary decodes a big endian COMP (binary) integer of 2, 4 or 8 bytes
+func decodeBinary(raw []byte, signed bool) (int64, error) {
+	switch len(raw) {
+	case 2:
+		if signed {
+			return int64(int16(binary.BigEndian.Uint16(raw))), nil
+		}
+		return int64(binary.BigEndian.Uint16(raw)), nil
+	case 4:
+		if signed {
+			return int64(int32(binary.BigEndian.Uint32(raw))), nil
+		}
+		return int64(binary.BigEndian.Uint32(raw)), nil
+	case 8:
+		val := binary.BigEndian.Uint64(raw)
+		if !signed && val > math.MaxInt64 {
+			return 0, fmt.Errorf("unsigned binary value %d is too large", val)
+		}
+		return int64(val), nil
+	}
+
+	return 0, fmt.Errorf("binary fields must be 2, 4 or 8 bytes long")
+}
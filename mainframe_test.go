@@ -0,0 +1,124 @@
+package builtin
+
+import (
+	"bitbucket.org/primelogic_io/bitlantern/service/dataflow"
+	"golang.org/x/text/encoding/charmap"
+	"reflect"
+	"testing"
+)
+
+func TestDecodePacked(t *testing.T) {
+	tests := []struct {
+		raw     []byte
+		want    int64
+		wantErr bool
+	}{
+		{[]byte{0x12, 0x34, 0x5C}, 12345, false},
+		{[]byte{0x12, 0x34, 0x5D}, -12345, false},
+		{[]byte{0x00, 0x7F}, 7, false},
+		{[]byte{0x0C}, 0, false},
+		{[]byte{0x1A, 0x3C}, 0, true},
+		{[]byte{0x12, 0x34}, 0, true},
+	}
+
+	for _, tt := range tests {
+		got, err := decodePacked(tt.raw)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("decodePacked(%X) = %v, %v, want %v, error %v", tt.raw, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestDecodeZoned(t *testing.T) {
+	tests := []struct {
+		text    string
+		want    int64
+		wantErr bool
+	}{
+		{"12345", 12345, false},
+		{"1234E", 12345, false},
+		{"1234N", -12345, false},
+		{"000{", 0, false},
+		{"012}", -120, false},
+		{"-0042", -42, false},
+		{"12A45", 0, true},
+		{"   ", 0, true},
+	}
+
+	for _, tt := range tests {
+		got, err := decodeZoned(tt.text)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("decodeZoned(%q) = %v, %v, want %v, error %v", tt.text, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestDecodeBinary(t *testing.T) {
+	tests := []struct {
+		raw    []byte
+		signed bool
+		want   int64
+	}{
+		{[]byte{0xFF, 0xFE}, true, -2},
+		{[]byte{0xFF, 0xFE}, false, 65534},
+		{[]byte{0x00, 0x01, 0x00, 0x00}, true, 65536},
+		{[]byte{0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0x9C}, true, -100},
+	}
+
+	for _, tt := range tests {
+		got, err := decodeBinary(tt.raw, tt.signed)
+		if err != nil || got != tt.want {
+			t.Errorf("decodeBinary(%X, %v) = %v, %v, want %v", tt.raw, tt.signed, got, err, tt.want)
+		}
+	}
+
+	if _, err := decodeBinary([]byte{0x01, 0x02, 0x03}, true); err == nil {
+		t.Error("expected an error for a 3 byte binary field")
+	}
+}
+
+func TestParseFixedLengthEBCDIC(t *testing.T) {
+	ebcdic := func(s string) []byte {
+		out := make([]byte, len(s))
+		for i := range s {
+			out[i], _ = charmap.CodePage037.EncodeRune(rune(s[i]))
+		}
+		return out
+	}
+
+	//Two 15 byte records with no newlines: name (5), zoned amount (4, 2 implied decimals), packed (3), binary (2), flag (1)
+	var data []byte
+	data = append(data, ebcdic("ALICE123D")...)
+	data = append(data, 0x01, 0x23, 0x4D, 0x00, 0x2A)
+	data = append(data, ebcdic("Y")...)
+	data = append(data, ebcdic("BOB  0050")...)
+	data = append(data, 0x00, 0x00, 0x5C, 0xFF, 0xFF)
+	data = append(data, ebcdic("N")...)
+
+	config := map[string]interface{}{
+		"encoding":     "cp037",
+		"recordLength": 15.0,
+		"columns": []interface{}{
+			map[string]interface{}{"start": 0.0, "length": 5.0, "datatype": "string", "fieldName": "name"},
+			map[string]interface{}{"start": 5.0, "length": 4.0, "datatype": "zoned", "impliedDecimals": 2.0, "fieldName": "amount"},
+			map[string]interface{}{"start": 9.0, "length": 3.0, "datatype": "packed", "fieldName": "balance"},
+			map[string]interface{}{"start": 12.0, "length": 2.0, "datatype": "binary", "fieldName": "count"},
+			map[string]interface{}{"start": 14.0, "length": 1.0, "datatype": "string", "fieldName": "flag"},
+		},
+	}
+
+	in := NewMemoryInputReader().AddFile(dataflow.DEFAULT_INPUT_PORT_NAME, NewMemoryFile("accounts.dat", data))
+	out, err := runFunction(t, "parseFixedLength", config, in)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []dataflow.Record{
+		{"name": "ALICE", "amount": 12.34, "balance": int64(-1234), "count": int64(42), "flag": "Y"},
+		{"name": "BOB", "amount": 0.5, "balance": int64(5), "count": int64(-1), "flag": "N"},
+	}
+	if got := out.Records(dataflow.DEFAULT_OUTPUT_PORT_NAME); !reflect.DeepEqual(got, want) {
+		t.Errorf("records = %v, want %v", got, want)
+	}
+	assertErrorRecords(t, out, nil)
+}
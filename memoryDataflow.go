@@ -0,0 +1,266 @@
+package builtin
+
+import (
+	"bitbucket.org/primelogic_io/bitlantern/service/dataflow"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// The Memory* types are an in-memory implementation of the dataflow input/output interfaces. They let builtin
+// functions be executed (and tested) without the workflow engine: feed records and files in through a
+// MemoryInputReader, run Execute, then inspect everything that was written to each port of the MemoryOutputWriter.
+
+// MemoryEntry is a single record or file read from a MemoryPortReader
+type MemoryEntry struct {
+	record dataflow.Record
+	file   dataflow.File
+}
+
+func (e *MemoryEntry) GetAsRecord() (dataflow.Record, error) {
+	if e.record == nil {
+		return nil, fmt.Errorf("entry is a file, not a record")
+	}
+
+	return e.record, nil
+}
+
+func (e *MemoryEntry) GetAsFile() (dataflow.File, error) {
+	if e.file == nil {
+		return nil, fmt.Errorf("entry is a record, not a file")
+	}
+
+	return e.file, nil
+}
+
+// MemoryFile is a dataflow.File whose contents are held in memory. Every call to Reader starts from the beginning.
+type MemoryFile struct {
+	filename string
+	data     []byte
+}
+
+func NewMemoryFile(filename string, data []byte) *MemoryFile {
+	return &(MemoryFile{filename: filename, data: data})
+}
+
+func NewMemoryFileFromString(filename string, data string) *MemoryFile {
+	return NewMemoryFile(filename, []byte(data))
+}
+
+// NewMemoryFileFromDisk reads a file (e.g. a test fixture) into memory. The filename is the base name of the path.
+func NewMemoryFileFromDisk(path string) (*MemoryFile, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewMemoryFile(filepath.Base(path), data), nil
+}
+
+func (f *MemoryFile) Filename() string {
+	return f.filename
+}
+
+func (f *MemoryFile) Reader() io.Reader {
+	return bytes.NewReader(f.data)
+}
+
+func (f *MemoryFile) Bytes() []byte {
+	return f.data
+}
+
+// MemoryInputReader is a dataflow.InputReader over records and files added to it ahead of time
+type MemoryInputReader struct {
+	ports map[string][]*MemoryEntry
+}
+
+func NewMemoryInputReader() *MemoryInputReader {
+	return &(MemoryInputReader{ports: make(map[string][]*MemoryEntry)})
+}
+
+// AddRecord queues a record on the port. It returns the reader so calls can be chained.
+func (r *MemoryInputReader) AddRecord(port string, rec dataflow.Record) *MemoryInputReader {
+	r.ports[port] = append(r.ports[port], &(MemoryEntry{record: rec}))
+	return r
+}
+
+// AddFile queues a file on the port. It returns the reader so calls can be chained.
+func (r *MemoryInputReader) AddFile(port string, file dataflow.File) *MemoryInputReader {
+	r.ports[port] = append(r.ports[port], &(MemoryEntry{file: file}))
+	return r
+}
+
+// AddFileFromString queues a file with the given contents on the port
+func (r *MemoryInputReader) AddFileFromString(port string, filename string, data string) *MemoryInputReader {
+	return r.AddFile(port, NewMemoryFileFromString(filename, data))
+}
+
+func (r *MemoryInputReader) PortReader(name string) dataflow.PortReader {
+	return &(MemoryPortReader{entries: r.ports[name]})
+}
+
+// MemoryPortReader reads the entries queued on a single port of a MemoryInputReader
+type MemoryPortReader struct {
+	entries []*MemoryEntry
+	pos     int
+	opened  bool
+}
+
+func (r *MemoryPortReader) Open() error {
+	r.opened = true
+	return nil
+}
+
+func (r *MemoryPortReader) HasNext() bool {
+	return r.opened && r.pos < len(r.entries)
+}
+
+func (r *MemoryPortReader) Next() (dataflow.Entry, error) {
+	if !r.opened {
+		return nil, fmt.Errorf("port reader has not been opened")
+	}
+	if r.pos >= len(r.entries) {
+		return nil, io.EOF
+	}
+
+	entry := r.entries[r.pos]
+	r.pos++
+	return entry, nil
+}
+
+// MemoryOutputWriter is a dataflow.OutputWriter that captures every record and file written to it, by port
+type MemoryOutputWriter struct {
+	mu      sync.Mutex
+	records map[string][]dataflow.Record
+	files   map[string][]*MemoryFileWriter
+	closed  bool
+}
+
+func NewMemoryOutputWriter() *MemoryOutputWriter {
+	return &(MemoryOutputWriter{
+		records: make(map[string][]dataflow.Record),
+		files:   make(map[string][]*MemoryFileWriter),
+	})
+}
+
+// WriteRecord captures a copy of the record, so later changes made by the function don't affect what was captured
+func (w *MemoryOutputWriter) WriteRecord(port string, rec *dataflow.Record) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed {
+		return fmt.Errorf("output writer is closed")
+	}
+
+	w.records[port] = append(w.records[port], copyRecord(*rec))
+	return nil
+}
+
+func (w *MemoryOutputWriter) NewFileWriter(port string, filename string) (dataflow.FileWriter, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed {
+		return nil, fmt.Errorf("output writer is closed")
+	}
+
+	fw := &(MemoryFileWriter{filename: filename})
+	w.files[port] = append(w.files[port], fw)
+	return fw, nil
+}
+
+func (w *MemoryOutputWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.closed = true
+	return nil
+}
+
+// Closed reports whether Close has been called
+func (w *MemoryOutputWriter) Closed() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.closed
+}
+
+// Records returns the records written to the port, in order
+func (w *MemoryOutputWriter) Records(port string) []dataflow.Record {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.records[port]
+}
+
+// Files returns the files written to the port, in the order they were created
+func (w *MemoryOutputWriter) Files(port string) []*MemoryFileWriter {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.files[port]
+}
+
+// Ports returns the sorted names of every port that had a record or file written to it
+func (w *MemoryOutputWriter) Ports() []string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	seen := make(map[string]bool)
+	for port := range w.records {
+		seen[port] = true
+	}
+	for port := range w.files {
+		seen[port] = true
+	}
+
+	ports := make([]string, 0, len(seen))
+	for port := range seen {
+		ports = append(ports, port)
+	}
+	sort.Strings(ports)
+
+	return ports
+}
+
+// MemoryFileWriter captures the contents of a file written through a MemoryOutputWriter
+type MemoryFileWriter struct {
+	filename string
+	buf      bytes.Buffer
+	closed   bool
+}
+
+func (fw *MemoryFileWriter) Writer() io.Writer {
+	return &(fw.buf)
+}
+
+func (fw *MemoryFileWriter) Close() error {
+	fw.closed = true
+	return nil
+}
+
+func (fw *MemoryFileWriter) Filename() string {
+	return fw.filename
+}
+
+// Closed reports whether Close has been called
+func (fw *MemoryFileWriter) Closed() bool {
+	return fw.closed
+}
+
+func (fw *MemoryFileWriter) Bytes() []byte {
+	return fw.buf.Bytes()
+}
+
+func (fw *MemoryFileWriter) String() string {
+	return fw.buf.String()
+}
+
+// AsFile returns the written contents as a MemoryFile, so the output of one function can be fed into another
+func (fw *MemoryFileWriter) AsFile() *MemoryFile {
+	return NewMemoryFile(fw.filename, fw.buf.Bytes())
+}
@@ -2,12 +2,11 @@ package builtin
 
 import (
 	"bitbucket.org/primelogic_io/bitlantern/service/dataflow"
+	"bufio"
 	"encoding/csv"
 	"fmt"
 	"io"
-	"strconv"
 	"strings"
-	"time"
 )
 
 func init() {
@@ -20,8 +19,37 @@ func init() {
 				Description:   "Parses delimited text files and outputs the records",
 				Category:      "File",
 				ExecutionMode: "sync",
-				InputPorts:    nil,
-				OutputPorts:   nil,
+				InputPorts:    dataflowPorts(fileInputPort),
+				OutputPorts:   dataflowPorts(parseCSVRecordsPort, errorOutputPort),
+			},
+			ConfigSchema: ConfigSchema{
+				Fields: []ConfigField{
+					{Key: "hasHeaderRow", Type: ConfigTypeBoolean, Default: false},
+					{Key: "useHeaderColumnNamesAsFieldNames", Type: ConfigTypeBoolean, Default: false},
+					{Key: "ignoreUnmappedColumns", Type: ConfigTypeBoolean, Default: false},
+					{Key: "delimiter", Type: ConfigTypeString, Default: ","},
+					{Key: "decompress", Type: ConfigTypeBoolean, Default: false, Description: "Decompress gzip input files, and parse each file inside zip and tar archives"},
+					{Key: "encoding", Type: ConfigTypeString, Enum: textEncodingNames(), Default: "utf-8", Description: "Character encoding of the file. auto detects the encoding of each file, except EBCDIC"},
+					{Key: "inferSchema", Type: ConfigTypeBoolean, Default: false, Description: "Infer the datatype of every column that isn't in columns from the first rows of each file"},
+					{Key: "inferSampleRows", Type: ConfigTypeInteger, Default: float64(100), Description: "Number of rows sampled to infer the schema"},
+					{Key: "inferDateFormats", Type: ConfigTypeArray, Items: &ConfigField{Type: ConfigTypeString}, Default: defaultInferDateFormats, Description: "Go time layouts tried, in order, when inferring date columns"},
+					{Key: "publishSchema", Type: ConfigTypeBoolean, Default: false, Description: "Write the inferred schema of each file to the schema port"},
+					{Key: "columns", Type: ConfigTypeArray, Description: "Required unless inferSchema is set", Items: &ConfigField{
+						Type: ConfigTypeObject,
+						Fields: append([]ConfigField{
+							{Key: "columnName", Type: ConfigTypeString, Required: true},
+							{Key: "datatype", Type: ConfigTypeString, Required: true, Enum: columnDatatypeNames(false)},
+							{Key: "fieldName", Type: ConfigTypeString, Required: true, Description: "Field the value is written to, which can be a nested path (e.g. customer.name)"},
+						}, columnFormatConfigFields...),
+					}},
+				},
+			},
+			ResolveOutputPorts: func(config map[string]interface{}) ([]PortSpec, error) {
+				ports := []PortSpec{parseCSVRecordsPort}
+				if publishSchema, _ := config["publishSchema"].(bool); publishSchema {
+					ports = append(ports, PortSpec{Name: SCHEMA_OUTPUT_PORT_NAME, Description: "The inferred schema of each file", DataType: PortDataTypeRecord})
+				}
+				return append(ports, errorOutputPort), nil
 			},
 			NewFunction: func() dataflow.Function {
 				return &(parseCSV{})
@@ -29,10 +57,20 @@ func init() {
 		})
 }
 
+// parseCSVRecordsPort is the output port of the parsed rows, which every config has
+var parseCSVRecordsPort = PortSpec{Name: dataflow.DEFAULT_OUTPUT_PORT_NAME, Description: "One record per row", DataType: PortDataTypeRecord}
+
+// SCHEMA_OUTPUT_PORT_NAME is the port parseCSV writes inferred schemas to. Each record has the filename and the
+// inferred columns, in the same form as the columns config.
+const SCHEMA_OUTPUT_PORT_NAME = "schema"
+
 type parseCSV struct {
 	config         parseCSVConfig
 	headerNames    []string
 	headerIndexMap map[string]int
+
+	// columns are the columns of the file being parsed: the configured columns plus any inferred ones
+	columns []parseCSVColumn
 }
 
 type parseCSVConfig struct {
@@ -48,23 +86,83 @@ type parseCSVConfig struct {
 	// delimiter specifies the delimiter, if not a comma
 	delimiter string
 
+	// decompress indicates input files are expanded with expandFile, and each file inside them parsed
+	decompress bool
+
+	// encoding is the name of the file's character encoding (see textEncodings), or auto. Files are transcoded to UTF-8 before they're parsed.
+	encoding string
+
 	// columns specify the parsing rules for each column. If ignoreUnmappedColumns is true, then only the columns specified here will be included in the output.
 	columns []parseCSVColumn
+
+	// inferSchema indicates the datatypes of columns not in columns are inferred from the first inferSampleRows rows of each file
+	inferSchema     bool
+	inferSampleRows int
+
+	// inferDateFormats are the time layouts tried when inferring date columns
+	inferDateFormats []string
+
+	// publishSchema indicates the inferred schema of each file is written to the schema port
+	publishSchema bool
+}
+
+// parseCSVRow is a row read from the file. err is set if the row couldn't be read as CSV.
+type parseCSVRow struct {
+	fields     []string
+	lineNumber int
+	err        error
+
+	// line is the text the row was read from, as it was in the file (after transcoding to UTF-8)
+	line string
+}
+
+// parseCSVLineRecorder keeps the text the CSV reader has read but not yet returned as a row, so a row's text can be
+// reported exactly as it was in the file, quotes and all
+type parseCSVLineRecorder struct {
+	r io.Reader
+
+	// buf is the text read from r from offset onwards
+	buf    []byte
+	offset int64
+}
+
+func (l *parseCSVLineRecorder) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	l.buf = append(l.buf, p[:n]...)
+	return n, err
+}
+
+// take returns the text up to end, an offset in the input (see csv.Reader.InputOffset), without the line ending,
+// and forgets it
+func (l *parseCSVLineRecorder) take(end int64) string {
+	n := int(end - l.offset)
+	if n > len(l.buf) {
+		n = len(l.buf)
+	}
+
+	line := string(l.buf[:n])
+	l.buf = l.buf[n:]
+	l.offset += int64(n)
+
+	return strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r")
 }
 
 type parseCSVColumn struct {
-	//The index of the column in the CSV file, either this or the column name must be specified, and if column name the file must have a header
+	//The index of the column in the CSV file, which is its position in the columns config. Columns are only matched by index if the file has no header row.
 	index int
 
 	// columnName is the csv header/column name for this column. This config option is only valid if the CSV file has a header row.
 	columnName string
 
-	// datatype is the type of data in each row in the field/column. This will
-	datatype string //number, string, date
-	format   string //String describing the format of the string to be converted (currently only for date)
+	// columnFormat describes how the text of the column is converted. See columnDatatypeRegistry.
+	columnFormat
 
 	// fieldName to use for the output
 	fieldName string
+
+	// field is fieldName as a field path, so configured columns can be written to nested fields. Columns named after
+	// the header row don't have one, since header names aren't paths.
+	field *fieldPath
 }
 
 // buildConfig builds a splitConfig from the passed in map. The map must be in the form:
@@ -83,25 +181,50 @@ type parseCSVColumn struct {
 func (f *parseCSV) buildConfig(config map[string]interface{}) (parseCSVConfig, error) {
 	c := parseCSVConfig{}
 
-	columns := config["columns"].([]interface{})
+	c.inferSchema, _ = config["inferSchema"].(bool)
+	c.publishSchema, _ = config["publishSchema"].(bool)
+	if sampleRows, ok := config["inferSampleRows"].(float64); ok {
+		c.inferSampleRows = int(sampleRows)
+	}
+	if dateFormats, ok := config["inferDateFormats"].([]interface{}); ok {
+		c.inferDateFormats = configStrings(dateFormats)
+	}
+
+	columns, _ := config["columns"].([]interface{})
+	if len(columns) == 0 && !c.inferSchema {
+		return c, fmt.Errorf("columns must be set unless inferSchema is set")
+	}
 	c.columns = make([]parseCSVColumn, len(columns))
 
 	for i := 0; i < len(columns); i++ {
 		curRuleMap := columns[i].(map[string]interface{})
-		newRule := parseCSVColumn{}
+		newRule := parseCSVColumn{index: i}
 
 		//FIXME: Use a better type conversion here
 		newRule.columnName = curRuleMap["columnName"].(string)
-		newRule.datatype = curRuleMap["datatype"].(string)
-		newRule.format, _ = curRuleMap["format"].(string) //Ignore if can't convert, probably means its missing
 		newRule.fieldName = curRuleMap["fieldName"].(string)
 
+		var err error
+		newRule.field, err = parseFieldPath(newRule.fieldName)
+		if err != nil {
+			return c, fmt.Errorf("column %v: fieldName: %v", newRule.columnName, err)
+		}
+
+		format, err := buildColumnFormat(curRuleMap)
+		if err != nil {
+			return c, fmt.Errorf("column %v: %v", newRule.columnName, err)
+		}
+		newRule.columnFormat = format
+
 		c.columns[i] = newRule
 	}
 
-	c.hasHeaderRow = config["hasHeaderRow"].(bool)
-	c.useHeaderColumnNamesAsFieldNames = config["useHeaderColumnNamesAsFieldNames"].(bool)
+	c.hasHeaderRow, _ = config["hasHeaderRow"].(bool)
+	c.useHeaderColumnNamesAsFieldNames, _ = config["useHeaderColumnNamesAsFieldNames"].(bool)
+	c.ignoreUnmappedColumns, _ = config["ignoreUnmappedColumns"].(bool)
 	c.delimiter, _ = config["delimiter"].(string)
+	c.encoding, _ = config["encoding"].(string)
+	c.decompress, _ = config["decompress"].(bool)
 
 	return c, nil
 }
@@ -110,9 +233,14 @@ func (f *parseCSV) Execute(in dataflow.InputReader, out dataflow.OutputWriter, c
 	defer out.Close()
 
 	//Parse/read config options
+	config, err := prepareConfig("parseCSV", config)
+	if err != nil {
+		return err
+	}
+
 	parsedConfig, err := f.buildConfig(config)
 	if err != nil {
-		panic("Error generating a csv")
+		return newFunctionError("parseCSV", "building config", err)
 	}
 	f.config = parsedConfig
 
@@ -120,79 +248,213 @@ func (f *parseCSV) Execute(in dataflow.InputReader, out dataflow.OutputWriter, c
 	reader := in.PortReader(dataflow.DEFAULT_INPUT_PORT_NAME)
 	err = reader.Open()
 	if err != nil {
-		panic("Unable to read record from input")
+		return newFunctionError("parseCSV", "opening input", err)
 	}
 
 	//For each file, parse the records and output them
 	for reader.HasNext() {
 		curEntry, err := reader.Next()
 		if err != nil {
-			panic(err)
+			return newFunctionError("parseCSV", "reading input", err)
 		}
 
 		curFile, err := curEntry.GetAsFile()
 		if err != nil {
-			panic(err)
+			writeRecordError(out, &(RecordError{FunctionKey: "parseCSV", Err: err}))
+			continue
 		}
 
-		f.parseFile(curFile, out)
+		if !f.config.decompress {
+			f.parseFile(curFile, out)
+			continue
+		}
+
+		err = expandFile(curFile, archiveFormatAuto, func(innerFile dataflow.File) error {
+			f.parseFile(innerFile, out)
+			return nil
+		})
+		if err != nil {
+			writeRecordError(out, &(RecordError{FunctionKey: "parseCSV", Filename: curFile.Filename(), Err: err}))
+		}
 	}
 
 	return nil
 }
 
+// parseFile parses every row in the file. Rows that can't be parsed are written to the error port; a file that can't
+// be read at all is reported as a single error.
 func (f *parseCSV) parseFile(file dataflow.File, out dataflow.OutputWriter) {
-	csv := csv.NewReader(file.Reader())
+	bufReader := bufio.NewReader(file.Reader())
+	encodingName := resolveTextEncoding(bufReader, f.config.encoding)
+	lines := &(parseCSVLineRecorder{r: transcodeToUTF8(bufReader, encodingName)})
+	csvReader := csv.NewReader(lines)
 
 	if len(f.config.delimiter) == 1 {
-		csv.Comma = ([]rune(f.config.delimiter))[0]
+		csvReader.Comma = ([]rune(f.config.delimiter))[0]
 	}
 
 	if f.config.hasHeaderRow {
 		f.headerIndexMap = make(map[string]int)
-		header, err := csv.Read()
-		if err != nil {
-			panic(err)
+		header, err := csvReader.Read()
+		if err == io.EOF {
+			//Empty file
+			return
+		} else if err != nil {
+			writeRecordError(out, &(RecordError{FunctionKey: "parseCSV", Filename: file.Filename(), LineNumber: 1, Err: err}))
+			return
 		}
 
 		f.headerNames = header
+		lines.take(csvReader.InputOffset())
 
 		for idx := range header {
 			f.headerIndexMap[header[idx]] = idx
 		}
 	}
 
+	f.columns = f.config.columns
+
+	//Rows read to infer the schema are parsed once it's known
+	var sample []parseCSVRow
+	if f.config.inferSchema {
+		for len(sample) < f.config.inferSampleRows {
+			row, err := f.readRow(csvReader, lines)
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				writeRecordError(out, &(RecordError{FunctionKey: "parseCSV", Filename: file.Filename(), Err: err}))
+				return
+			}
+			sample = append(sample, row)
+		}
+
+		f.columns = f.inferColumns(sample)
+
+		if f.config.publishSchema {
+			schemaRec := f.schemaRecord(file.Filename())
+			out.WriteRecord(SCHEMA_OUTPUT_PORT_NAME, &schemaRec)
+		}
+	}
+
+	for i := range sample {
+		f.writeRow(file, out, sample[i])
+	}
+
 	//Read each record
-	curRec, err := csv.Read()
+	for {
+		row, err := f.readRow(csvReader, lines)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			//Not a problem with this row, so there's no point trying to read any more of the file
+			writeRecordError(out, &(RecordError{FunctionKey: "parseCSV", Filename: file.Filename(), Err: err}))
+			return
+		}
+
+		f.writeRow(file, out, row)
+	}
+}
+
+// readRow reads the next row. Rows that aren't valid CSV are returned with err set; an error is only returned if the
+// file can't be read any further (including io.EOF).
+func (f *parseCSV) readRow(csvReader *csv.Reader, lines *parseCSVLineRecorder) (parseCSVRow, error) {
+	fields, err := csvReader.Read()
+	if err == nil {
+		lineNumber, _ := csvReader.FieldPos(0)
+		return parseCSVRow{fields: fields, lineNumber: lineNumber, line: lines.take(csvReader.InputOffset())}, nil
+	}
+
+	if parseErr, ok := err.(*csv.ParseError); ok {
+		return parseCSVRow{fields: fields, lineNumber: parseErr.StartLine, err: err, line: lines.take(csvReader.InputOffset())}, nil
+	}
+
+	return parseCSVRow{}, err
+}
+
+// writeRow parses the row and writes the record, or writes the row to the error port if it can't be parsed
+func (f *parseCSV) writeRow(file dataflow.File, out dataflow.OutputWriter, row parseCSVRow) {
+	var recObj dataflow.Record
+	err := row.err
+	if err == nil {
+		recObj, err = f.parseLine(row.fields)
+	}
+
 	if err != nil {
-		panic(err)
+		writeRecordError(out, &(RecordError{
+			FunctionKey: "parseCSV",
+			Filename:    file.Filename(),
+			LineNumber:  row.lineNumber,
+			Line:        row.line,
+			Err:         err,
+		}))
+		return
 	}
 
-	for curRec != nil {
-		recObj, err := f.parseLine(curRec)
-		if err != nil {
-			panic(err)
+	out.WriteRecord(dataflow.DEFAULT_OUTPUT_PORT_NAME, &recObj)
+}
+
+// inferColumns infers a column for every column of the sampled rows that isn't configured, and returns them along with
+// the configured columns in file order. Inferred columns are named after the header, or column1, column2, etc. if the
+// file has no header row.
+func (f *parseCSV) inferColumns(sample []parseCSVRow) []parseCSVColumn {
+	width := len(f.headerNames)
+	for i := range sample {
+		if len(sample[i].fields) > width {
+			width = len(sample[i].fields)
 		}
+	}
 
-		out.WriteRecord(dataflow.DEFAULT_OUTPUT_PORT_NAME, &recObj)
+	var columns []parseCSVColumn
+	for idx := 0; idx < width; idx++ {
+		col := parseCSVColumn{index: idx, fieldName: fmt.Sprintf("column%d", idx+1)}
+
+		var configured *parseCSVColumn
+		if f.config.hasHeaderRow && idx < len(f.headerNames) {
+			configured = f.getColumnConfigByHeaderName(f.headerNames[idx])
+			col.columnName = f.headerNames[idx]
+			col.fieldName = f.headerNames[idx]
+		} else if !f.config.hasHeaderRow {
+			configured = f.getColumnConfigByIndex(idx)
+		}
 
-		//Read next line
-		curRec, err = csv.Read()
-		if err != nil {
-			if err == io.EOF {
-				//EOF
-				break
-			} else {
-				panic(err)
+		if configured != nil {
+			columns = append(columns, *configured)
+			continue
+		}
+
+		var values []string
+		for i := range sample {
+			if sample[i].err == nil && idx < len(sample[i].fields) {
+				values = append(values, sample[i].fields[idx])
 			}
 		}
+		col.columnFormat = inferColumnFormat(values, f.config.inferDateFormats)
+
+		columns = append(columns, col)
 	}
+
+	return columns
+}
+
+// schemaRecord builds the record written to the schema port, listing the columns of the file being parsed
+func (f *parseCSV) schemaRecord(filename string) dataflow.Record {
+	columns := make([]interface{}, len(f.columns))
+	for i := range f.columns {
+		colMap := f.columns[i].configMap()
+		if f.columns[i].columnName != "" {
+			colMap["columnName"] = f.columns[i].columnName
+		}
+		colMap["fieldName"] = f.columns[i].fieldName
+		columns[i] = colMap
+	}
+
+	return dataflow.Record{"filename": filename, "columns": columns}
 }
 
 func (f *parseCSV) getColumnConfigByHeaderName(headerName string) *parseCSVColumn {
-	for i := range f.config.columns {
-		if f.config.columns[i].columnName == headerName {
-			return &(f.config.columns[i])
+	for i := range f.columns {
+		if f.columns[i].columnName == headerName {
+			return &(f.columns[i])
 		}
 	}
 
@@ -200,9 +462,9 @@ func (f *parseCSV) getColumnConfigByHeaderName(headerName string) *parseCSVColum
 }
 
 func (f *parseCSV) getColumnConfigByIndex(index int) *parseCSVColumn {
-	for i := range f.config.columns {
-		if f.config.columns[i].index == index {
-			return &(f.config.columns[i])
+	for i := range f.columns {
+		if f.columns[i].index == index {
+			return &(f.columns[i])
 		}
 	}
 
@@ -222,7 +484,7 @@ func (f *parseCSV) parseLine(record []string) (dataflow.Record, error) {
 			colConfig = f.getColumnConfigByHeaderName(f.headerNames[recIdx])
 		}
 
-		if colConfig == nil {
+		if colConfig == nil && !f.config.hasHeaderRow {
 			colConfig = f.getColumnConfigByIndex(recIdx)
 		}
 
@@ -233,33 +495,27 @@ func (f *parseCSV) parseLine(record []string) (dataflow.Record, error) {
 
 		if colConfig == nil && !f.config.hasHeaderRow {
 			//Then we don't have enough information to parse this column
-			panic("Unable to output CSV field. There must be a header row OR a column config for each column, if ignoreUnmappedColumns is false")
+			return nil, fmt.Errorf("unable to output CSV field %d. There must be a header row OR a column config for each column, if ignoreUnmappedColumns is false", recIdx)
+		}
+
+		if colConfig == nil {
+			//Unmapped columns are kept as strings, named after their header
+			colConfig = &(parseCSVColumn{columnName: f.headerNames[recIdx], columnFormat: columnFormat{datatype: "string"}, fieldName: f.headerNames[recIdx]})
 		}
 
 		//Read the record value
-		if colConfig.datatype == "string" {
-			//Already done :-)
-			rec.Set(colConfig.fieldName, curRec)
-		} else if colConfig.datatype == "integer" {
-			valInt, err := strconv.ParseInt(curRec, 10, 64)
-			if err != nil {
-				panic(err)
-			}
-			rec.Set(colConfig.fieldName, valInt)
-		} else if colConfig.datatype == "decimal" {
-			valFloat, err := strconv.ParseFloat(curRec, 64)
-			if err != nil {
-				panic(err)
-			}
-			rec.Set(colConfig.fieldName, valFloat)
-		} else if colConfig.datatype == "date" {
-			valDate, err := time.Parse(colConfig.format, strings.TrimSpace(curRec))
-			if err != nil {
-				panic(err)
-			}
-			rec.Set(colConfig.fieldName, valDate)
-		} else {
-			panic(fmt.Sprintf("Unsupported dataype %v for column %v", colConfig.datatype, colConfig.fieldName))
+		val, err := colConfig.parse(curRec)
+		if err != nil {
+			return nil, fmt.Errorf("column %v: %v", colConfig.fieldName, err)
+		}
+
+		if colConfig.field == nil {
+			rec.Set(colConfig.fieldName, val)
+			continue
+		}
+		err = colConfig.field.set(rec, val)
+		if err != nil {
+			return nil, fmt.Errorf("column %v: %v", colConfig.fieldName, err)
 		}
 	}
 
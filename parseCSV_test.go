@@ -0,0 +1,212 @@
+package builtin
+
+import (
+	"bitbucket.org/primelogic_io/bitlantern/service/dataflow"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseCSV(t *testing.T) {
+	columns := []interface{}{
+		map[string]interface{}{"columnName": "name", "datatype": "string", "fieldName": "customerName"},
+		map[string]interface{}{"columnName": "age", "datatype": "integer", "fieldName": "age"},
+		map[string]interface{}{"columnName": "balance", "datatype": "decimal", "fieldName": "balance"},
+		map[string]interface{}{"columnName": "joined", "datatype": "date", "format": "2006-01-02", "fieldName": "joined"},
+	}
+
+	tests := []struct {
+		name       string
+		config     map[string]interface{}
+		data       string
+		want       []dataflow.Record
+		wantErrors []dataflow.Record
+	}{
+		{
+			name:   "header names map to field names and datatypes",
+			config: map[string]interface{}{"hasHeaderRow": true, "columns": columns},
+			data:   "name,age,balance,joined\nAlice,30,10.5,2020-01-02\nBob,41,0,2019-12-31\n",
+			want: []dataflow.Record{
+				{"customerName": "Alice", "age": int64(30), "balance": 10.5, "joined": time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC)},
+				{"customerName": "Bob", "age": int64(41), "balance": 0.0, "joined": time.Date(2019, 12, 31, 0, 0, 0, 0, time.UTC)},
+			},
+		},
+		{
+			name:   "header columns can be in any order",
+			config: map[string]interface{}{"hasHeaderRow": true, "columns": columns},
+			data:   "joined,balance,age,name\n2020-01-02,1,2,Carol\n",
+			want: []dataflow.Record{
+				{"customerName": "Carol", "age": int64(2), "balance": 1.0, "joined": time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC)},
+			},
+		},
+		{
+			name:   "unmapped columns are ignored",
+			config: map[string]interface{}{"hasHeaderRow": true, "ignoreUnmappedColumns": true, "columns": columns[:2]},
+			data:   "name,age,extra\nAlice,30,x\n",
+			want:   []dataflow.Record{{"customerName": "Alice", "age": int64(30)}},
+		},
+		{
+			name:   "custom delimiter",
+			config: map[string]interface{}{"hasHeaderRow": true, "delimiter": ";", "columns": columns[:2]},
+			data:   "name;age\nAlice;30\n",
+			want:   []dataflow.Record{{"customerName": "Alice", "age": int64(30)}},
+		},
+		{
+			name:   "bad rows go to the error port and the rest keep flowing",
+			config: map[string]interface{}{"hasHeaderRow": true, "columns": columns[:2]},
+			data:   "name,age\nAlice,thirty\nBob,41\n",
+			want:   []dataflow.Record{{"customerName": "Bob", "age": int64(41)}},
+			wantErrors: []dataflow.Record{
+				{"functionKey": "parseCSV", "filename": "customers.csv", "lineNumber": 2, "line": "Alice,thirty"},
+			},
+		},
+		{
+			name:   "error lines are reported as they were in the file",
+			config: map[string]interface{}{"hasHeaderRow": true, "columns": columns[:2]},
+			data:   "name,age\n\"Smith, Al\",x\nBad \"quote,1\r\nBob,41\n",
+			want:   []dataflow.Record{{"customerName": "Bob", "age": int64(41)}},
+			wantErrors: []dataflow.Record{
+				{"functionKey": "parseCSV", "filename": "customers.csv", "lineNumber": 2, "line": `"Smith, Al",x`},
+				{"functionKey": "parseCSV", "filename": "customers.csv", "lineNumber": 3, "line": `Bad "quote,1`},
+			},
+		},
+		{
+			name: "field names can be nested paths, but header names stay flat",
+			config: map[string]interface{}{"hasHeaderRow": true, "columns": []interface{}{
+				map[string]interface{}{"columnName": "name", "datatype": "string", "fieldName": "customer.name"},
+				map[string]interface{}{"columnName": "age", "datatype": "integer", "fieldName": "customer.age"},
+			}},
+			data: "name,age,first.name\nAlice,30,A\n",
+			want: []dataflow.Record{
+				{"customer": map[string]interface{}{"name": "Alice", "age": int64(30)}, "first.name": "A"},
+			},
+		},
+		{
+			name:   "header only",
+			config: map[string]interface{}{"hasHeaderRow": true, "columns": columns},
+			data:   "name,age,balance,joined\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, err := runFunction(t, "parseCSV", tt.config, fileInput("customers.csv", tt.data))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := out.Records(dataflow.DEFAULT_OUTPUT_PORT_NAME)
+			if len(got) != 0 || len(tt.want) != 0 {
+				if !reflect.DeepEqual(got, tt.want) {
+					t.Errorf("records = %v, want %v", got, tt.want)
+				}
+			}
+
+			assertErrorRecords(t, out, tt.wantErrors)
+		})
+	}
+}
+
+func TestParseCSVInvalidConfig(t *testing.T) {
+	_, err := runFunction(t, "parseCSV", map[string]interface{}{"hasHeaderRow": "yes"}, fileInput("a.csv", ""))
+	if err == nil {
+		t.Fatal("expected an error for an invalid config")
+	}
+}
+
+func TestParseCSVInferSchema(t *testing.T) {
+	config := map[string]interface{}{
+		"hasHeaderRow":    true,
+		"inferSchema":     true,
+		"inferSampleRows": 2.0,
+		"publishSchema":   true,
+		"columns": []interface{}{
+			map[string]interface{}{"columnName": "zip", "datatype": "string", "fieldName": "postalCode"},
+		},
+	}
+	data := "id,active,balance,opened,zip\n1,true,10.5,2020-01-02,75001\n2,false,,2021-12-31,02134\nx,true,1,2022-03-04,10001\n"
+
+	out, err := runFunction(t, "parseCSV", config, fileInput("vendor.csv", data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []dataflow.Record{
+		{"id": int64(1), "active": true, "balance": 10.5, "opened": time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC), "postalCode": "75001"},
+		{"id": int64(2), "active": false, "balance": nil, "opened": time.Date(2021, 12, 31, 0, 0, 0, 0, time.UTC), "postalCode": "02134"},
+	}
+	if got := out.Records(dataflow.DEFAULT_OUTPUT_PORT_NAME); !reflect.DeepEqual(got, want) {
+		t.Errorf("records = %v, want %v", got, want)
+	}
+
+	//Rows after the sample that don't fit the inferred schema are errors, like any other bad row
+	assertErrorRecords(t, out, []dataflow.Record{{"lineNumber": 4, "line": "x,true,1,2022-03-04,10001"}})
+
+	schemas := out.Records(SCHEMA_OUTPUT_PORT_NAME)
+	if len(schemas) != 1 {
+		t.Fatalf("got %d schema records, want 1", len(schemas))
+	}
+	wantColumns := []interface{}{
+		map[string]interface{}{"columnName": "id", "datatype": "integer", "fieldName": "id", "nullValues": []interface{}{""}},
+		map[string]interface{}{"columnName": "active", "datatype": "boolean", "fieldName": "active", "nullValues": []interface{}{""}},
+		map[string]interface{}{"columnName": "balance", "datatype": "decimal", "fieldName": "balance", "nullValues": []interface{}{""}},
+		map[string]interface{}{"columnName": "opened", "datatype": "date", "format": "2006-01-02", "fieldName": "opened", "nullValues": []interface{}{""}},
+		map[string]interface{}{"columnName": "zip", "datatype": "string", "fieldName": "postalCode"},
+	}
+	if schemas[0]["filename"] != "vendor.csv" || !reflect.DeepEqual(schemas[0]["columns"], wantColumns) {
+		t.Errorf("schema = %v, want columns %v", schemas[0], wantColumns)
+	}
+}
+
+func TestParseCSVInferSchemaWithoutHeader(t *testing.T) {
+	out, err := runFunction(t, "parseCSV", map[string]interface{}{"inferSchema": true}, fileInput("vendor.csv", "a,1\nb,2\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []dataflow.Record{{"column1": "a", "column2": int64(1)}, {"column1": "b", "column2": int64(2)}}
+	if got := out.Records(dataflow.DEFAULT_OUTPUT_PORT_NAME); !reflect.DeepEqual(got, want) {
+		t.Errorf("records = %v, want %v", got, want)
+	}
+	assertErrorRecords(t, out, nil)
+}
+
+func TestParseCSVUnmappedColumnsAreStrings(t *testing.T) {
+	config := map[string]interface{}{
+		"hasHeaderRow": true,
+		"columns":      []interface{}{map[string]interface{}{"columnName": "age", "datatype": "integer", "fieldName": "age"}},
+	}
+
+	out, err := runFunction(t, "parseCSV", config, fileInput("customers.csv", "name,age\nAlice,30\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []dataflow.Record{{"name": "Alice", "age": int64(30)}}
+	if got := out.Records(dataflow.DEFAULT_OUTPUT_PORT_NAME); !reflect.DeepEqual(got, want) {
+		t.Errorf("records = %v, want %v", got, want)
+	}
+}
+
+// assertErrorRecords checks the records written to the error port. Only the keys present in each wanted record are
+// compared, and every error record must have an error message.
+func assertErrorRecords(t *testing.T, out *MemoryOutputWriter, want []dataflow.Record) {
+	t.Helper()
+
+	got := out.Records(ERROR_OUTPUT_PORT_NAME)
+	if len(got) != len(want) {
+		t.Fatalf("got %d error records, want %d: %v", len(got), len(want), got)
+	}
+
+	for i := range want {
+		if msg, _ := got[i]["error"].(string); msg == "" {
+			t.Errorf("error record %d has no error message: %v", i, got[i])
+		}
+
+		for key, val := range want[i] {
+			if !reflect.DeepEqual(got[i][key], val) {
+				t.Errorf("error record %d: %v = %v, want %v", i, key, got[i][key], val)
+			}
+		}
+	}
+}
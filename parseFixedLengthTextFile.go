@@ -3,12 +3,16 @@ package builtin
 import (
 	"bitbucket.org/primelogic_io/bitlantern/service/dataflow"
 	"bufio"
+	"bytes"
 	"fmt"
 	_ "github.com/robertkrimen/otto"
 	_ "github.com/robertkrimen/otto/underscore"
+	"golang.org/x/text/encoding/charmap"
+	"io"
+	"math"
 	"strconv"
 	"strings"
-	"time"
+	"unicode/utf8"
 )
 
 func init() {
@@ -21,8 +25,46 @@ func init() {
 				Description:   "Parses a fixed length text file and outputs the records",
 				Category:      "Data",
 				ExecutionMode: "sync",
-				InputPorts:    nil,
-				OutputPorts:   nil,
+				InputPorts:    dataflowPorts(fileInputPort),
+				OutputPorts:   dataflowPorts(errorOutputPort),
+			},
+			ConfigSchema: ConfigSchema{
+				Fields: append([]ConfigField{
+					{Key: "hasHeaderRow", Type: ConfigTypeBoolean, Default: false},
+					{Key: "decompress", Type: ConfigTypeBoolean, Default: false, Description: "Decompress gzip input files, and parse each file inside zip and tar archives"},
+					{Key: "encoding", Type: ConfigTypeString, Enum: textEncodingNames(), Default: "utf-8", Description: "Character encoding of the file. cp037 and cp1047 are EBCDIC. auto detects the encoding of each file, except EBCDIC"},
+					{Key: "recordLength", Type: ConfigTypeInteger, Default: float64(0), Description: "Length of every record in bytes, for files without newlines. 0 means records are separated by newlines"},
+					{Key: "columns", Type: ConfigTypeArray, Items: &fixedLengthColumnSchema, Description: "Columns of every line. Required unless recordTypes or a copybook is set"},
+					{Key: "recordTypes", Type: ConfigTypeObject, Description: "Layouts for files that mix several record types", Fields: []ConfigField{
+						{Key: "start", Type: ConfigTypeInteger, Required: true, Description: "Zero based offset of the record type code"},
+						{Key: "length", Type: ConfigTypeInteger, Required: true},
+						{Key: "unknownRecordTypes", Type: ConfigTypeString, Enum: []interface{}{"error", "skip"}, Default: "error"},
+						{Key: "layouts", Type: ConfigTypeArray, Required: true, Items: &ConfigField{
+							Type: ConfigTypeObject,
+							Fields: append([]ConfigField{
+								{Key: "code", Type: ConfigTypeString, Required: true, Description: "Record type code that selects this layout"},
+								{Key: "name", Type: ConfigTypeString, Required: true},
+								{Key: "outputPort", Type: ConfigTypeString, Required: true},
+								{Key: "columns", Type: ConfigTypeArray, Items: &fixedLengthColumnSchema, Description: "Required unless a copybook is set"},
+								{Key: "controls", Type: ConfigTypeObject, Description: "Checks a trailer record against the records since the previous trailer of the same layout", Fields: []ConfigField{
+									{Key: "countField", Type: ConfigTypeString, Description: "Field holding the expected number of records"},
+									{Key: "countLayouts", Type: ConfigTypeArray, Items: &ConfigField{Type: ConfigTypeString}, Description: "Names of the layouts counted by countField"},
+									{Key: "totals", Type: ConfigTypeArray, Items: &ConfigField{
+										Type: ConfigTypeObject,
+										Fields: []ConfigField{
+											{Key: "field", Type: ConfigTypeString, Required: true, Description: "Field holding the expected total"},
+											{Key: "sumLayout", Type: ConfigTypeString, Required: true},
+											{Key: "sumField", Type: ConfigTypeString, Required: true},
+										},
+									}},
+								}},
+							}, copybookConfigFields...),
+						}},
+					}},
+				}, copybookConfigFields...),
+			},
+			ResolveOutputPorts: func(config map[string]interface{}) ([]PortSpec, error) {
+				return (&(parseFixedLength{})).outputPorts(config)
 			},
 			NewFunction: func() dataflow.Function {
 				return &(parseFixedLength{})
@@ -30,68 +72,391 @@ func init() {
 		})
 }
 
+// fixedLengthColumnSchema is the schema of a single column, used both for "columns" and for each layout's columns
+var fixedLengthColumnSchema = ConfigField{
+	Type: ConfigTypeObject,
+	Fields: append([]ConfigField{
+		{Key: "start", Type: ConfigTypeInteger, Required: true, Description: "Zero based offset of the column"},
+		{Key: "length", Type: ConfigTypeInteger, Required: true},
+		{Key: "datatype", Type: ConfigTypeString, Required: true, Enum: columnDatatypeNames(true), Description: "zoned is a zoned decimal with an overpunched sign, packed is COMP-3 packed decimal and binary is a big endian COMP integer"},
+		{Key: "signed", Type: ConfigTypeBoolean, Default: true, Description: "Whether a binary column is signed"},
+		{Key: "fieldName", Type: ConfigTypeString, Required: true, Description: "Field the value is written to, which can be a nested path (e.g. customer.name)"},
+	}, columnFormatConfigFields...),
+}
+
 type parseFixedLength struct {
 	config parseFixedLengthConfig
+
+	// charmap converts the bytes of the file being parsed to text. It's nil for UTF-8 files, and for UTF-16 files,
+	// which are transcoded to UTF-8 as they're read.
+	charmap *charmap.Charmap
+
+	// byteOffsets indicates column offsets in the file being parsed are in bytes rather than characters
+	byteOffsets bool
 }
 
 type parseFixedLengthConfig struct {
 	hasHeaderRow bool
-	columns      []parseFixedLengthColumn
+
+	// encoding is the name of the file's character encoding (see textEncodings), or auto
+	encoding string
+
+	// decompress indicates input files are expanded with expandFile, and each file inside them parsed
+	decompress bool
+
+	// recordLength is the number of bytes in every record. If it's 0 records are separated by newlines.
+	recordLength int
+
+	// recordTypeStart and recordTypeLength give the position of the record type code. A length of 0 means the file
+	// only has one record type, in which case there is a single layout.
+	recordTypeStart  int
+	recordTypeLength int
+
+	// skipUnknownRecordTypes indicates lines whose record type code doesn't match a layout are skipped rather than
+	// written to the error port
+	skipUnknownRecordTypes bool
+
+	layouts []parseFixedLengthLayout
+}
+
+// parseFixedLengthLayout is the set of columns for one record type (e.g. header, detail, trailer)
+type parseFixedLengthLayout struct {
+	code       string
+	name       string
+	outputPort string
+	columns    []parseFixedLengthColumn
+	controls   *parseFixedLengthControls
+}
+
+// parseFixedLengthControls describes the checks made when a trailer record is parsed
+type parseFixedLengthControls struct {
+	countField   *fieldPath
+	countLayouts []string
+	totals       []parseFixedLengthControlTotal
+}
+
+type parseFixedLengthControlTotal struct {
+	field     *fieldPath
+	sumLayout string
+	sumField  *fieldPath
 }
 
 type parseFixedLengthColumn struct {
+	columnFormat
+
 	start     int
 	length    int
-	datatype  string //number, string,
-	format    string //String describing the format of the string to be converted (currently only for date)
 	fieldName string
+
+	// field is fieldName as a field path, so columns can be written to nested fields
+	field *fieldPath
+
+	// conditions are the level 88 condition names from a copybook, each of which adds a boolean field to the record
+	conditions []parseFixedLengthCondition
+}
+
+// parseFixedLengthCondition sets fieldName to true when the column's value matches one of the values
+type parseFixedLengthCondition struct {
+	fieldName string
+	field     *fieldPath
+	values    []parseFixedLengthConditionValue
+}
+
+// parseFixedLengthConditionValue is a single value, or a range of values when thru is set
+type parseFixedLengthConditionValue struct {
+	value string
+	thru  string
 }
 
-// buildConfig builds a splitConfig from the passed in map. The map must be in the form:
+// buildConfig builds a parseFixedLengthConfig from the passed in map. For files with a single record type the map
+// must be in the form:
 // {
-//		"defaultOutputPort": "not poor",
-//		"rules": [
-//			{
-//				"jsCondition": "gender.lowerCase().startsWith('f')",
-//				"outputPort": "poor"
-//			}
+//		"hasHeaderRow": true,
+//		"columns": [
+//			{ "start": 0, "length": 10, "datatype": "string", "fieldName": "name" },
+//			{ "start": 10, "length": 8, "datatype": "date", "format": "20060102", "fieldName": "birthDate" }
 //		]
 // }
 //
-// rules.value can either be a value literal (ex: 100.00, "M", etc.) or a reference to another field in the record.
-// rules.valueType accepts the values: "literal", "field"
+// Files that mix record types (e.g. NACHA) use recordTypes instead of columns. The record type code at start/length
+// selects the layout used for each line, and each layout writes to its own output port:
+// {
+//		"recordTypes": {
+//			"start": 0,
+//			"length": 1,
+//			"unknownRecordTypes": "error",
+//			"layouts": [
+//				{ "code": "5", "name": "batchHeader", "outputPort": "batches", "columns": [...] },
+//				{ "code": "6", "name": "entry", "outputPort": "entries", "columns": [...] },
+//				{
+//					"code": "8", "name": "batchControl", "outputPort": "batchControls", "columns": [...],
+//					"controls": {
+//						"countField": "entryCount",
+//						"countLayouts": ["entry"],
+//						"totals": [ { "field": "totalAmount", "sumLayout": "entry", "sumField": "amount" } ]
+//					}
+//				}
+//			]
+//		}
+// }
+//
+// controls are checked against the records parsed since the previous record with the same layout (or the start of the
+// file), so a batch trailer covers its batch and a file trailer covers the whole file. A trailer that fails its
+// checks is written to the error port instead of its output port.
+//
+// Instead of columns, the top level or any layout can set copybook (or copybookFile) to derive its columns from a
+// COBOL copybook. See copybookColumns for how each item is mapped.
 func (f *parseFixedLength) buildConfig(config map[string]interface{}) (parseFixedLengthConfig, error) {
 	c := parseFixedLengthConfig{}
 
-	columns := config["columns"].([]interface{})
-	c.columns = make([]parseFixedLengthColumn, len(columns))
+	c.hasHeaderRow, _ = config["hasHeaderRow"].(bool)
+	c.encoding = config["encoding"].(string)
+	c.decompress = config["decompress"].(bool)
+	c.recordLength = int(config["recordLength"].(float64))
+
+	recordTypes, ok := config["recordTypes"].(map[string]interface{})
+	if !ok {
+		columns, err := buildFixedLengthColumns(config)
+		if err != nil {
+			return c, err
+		}
+
+		c.layouts = []parseFixedLengthLayout{{outputPort: dataflow.DEFAULT_OUTPUT_PORT_NAME, columns: columns}}
+		return c, nil
+	}
+
+	c.recordTypeStart = int(recordTypes["start"].(float64))
+	c.recordTypeLength = int(recordTypes["length"].(float64))
+	c.skipUnknownRecordTypes = recordTypes["unknownRecordTypes"] == "skip"
+	if c.recordTypeLength <= 0 {
+		return c, fmt.Errorf("recordTypes.length must be greater than 0")
+	}
+
+	layouts := recordTypes["layouts"].([]interface{})
+	c.layouts = make([]parseFixedLengthLayout, len(layouts))
+
+	for i := 0; i < len(layouts); i++ {
+		curLayoutMap := layouts[i].(map[string]interface{})
+		newLayout := parseFixedLengthLayout{}
+
+		newLayout.code = curLayoutMap["code"].(string)
+		newLayout.name = curLayoutMap["name"].(string)
+		newLayout.outputPort = curLayoutMap["outputPort"].(string)
+
+		columns, err := buildFixedLengthColumns(curLayoutMap)
+		if err != nil {
+			return c, fmt.Errorf("layout %v: %v", newLayout.name, err)
+		}
+		newLayout.columns = columns
+
+		if controlsMap, ok := curLayoutMap["controls"].(map[string]interface{}); ok {
+			newLayout.controls, err = buildFixedLengthControls(controlsMap)
+			if err != nil {
+				return c, fmt.Errorf("layout %v: controls.%v", newLayout.name, err)
+			}
+		}
+
+		c.layouts[i] = newLayout
+	}
+
+	return c, c.validateLayouts()
+}
+
+// hasRawColumns reports whether any layout has packed or binary columns, which are read from the raw bytes of a record
+func (c *parseFixedLengthConfig) hasRawColumns() bool {
+	for i := range c.layouts {
+		for _, col := range c.layouts[i].columns {
+			if dt := columnDatatypeRegistry[col.datatype]; dt != nil && dt.parseRaw != nil {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// validateLayouts checks that layout codes and names are unique and that controls only refer to known layouts
+func (c *parseFixedLengthConfig) validateLayouts() error {
+	codes := make(map[string]bool)
+	names := make(map[string]bool)
+
+	for i := range c.layouts {
+		layout := &(c.layouts[i])
+		if len(layout.code) != c.recordTypeLength {
+			return fmt.Errorf("layout %v: code %q is not %d characters long", layout.name, layout.code, c.recordTypeLength)
+		}
+		if codes[layout.code] {
+			return fmt.Errorf("layout %v: duplicate code %q", layout.name, layout.code)
+		}
+		if names[layout.name] {
+			return fmt.Errorf("duplicate layout name %v", layout.name)
+		}
+		codes[layout.code] = true
+		names[layout.name] = true
+	}
+
+	for i := range c.layouts {
+		controls := c.layouts[i].controls
+		if controls == nil {
+			continue
+		}
+
+		for _, name := range controls.countLayouts {
+			if !names[name] {
+				return fmt.Errorf("layout %v: countLayouts refers to unknown layout %v", c.layouts[i].name, name)
+			}
+		}
+		for _, total := range controls.totals {
+			if !names[total.sumLayout] {
+				return fmt.Errorf("layout %v: totals refers to unknown layout %v", c.layouts[i].name, total.sumLayout)
+			}
+		}
+	}
+
+	return nil
+}
+
+// buildFixedLengthColumns reads the columns from either the "columns" list or a copybook
+func buildFixedLengthColumns(config map[string]interface{}) ([]parseFixedLengthColumn, error) {
+	copybook, hasCopybook, err := buildCopybookConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
+	columns, hasColumns := config["columns"].([]interface{})
+	if hasCopybook && hasColumns {
+		return nil, fmt.Errorf("only one of columns and copybook can be set")
+	} else if hasCopybook {
+		result, err := copybookColumns(copybook)
+		if err != nil {
+			return nil, err
+		}
+		return result, parseFixedLengthFieldPaths(result)
+	} else if !hasColumns {
+		return nil, fmt.Errorf("either columns or a copybook must be set")
+	}
+
+	result := make([]parseFixedLengthColumn, len(columns))
 
 	for i := 0; i < len(columns); i++ {
 		curRuleMap := columns[i].(map[string]interface{})
 		newRule := parseFixedLengthColumn{}
 
-		//FIXME: Use a better type conversion here
 		newRule.start = int(curRuleMap["start"].(float64))
 		newRule.length = int(curRuleMap["length"].(float64))
-		newRule.datatype = curRuleMap["datatype"].(string)
-		newRule.format, _ = curRuleMap["format"].(string) //Ignore if can't convert, probably means its missing
 		newRule.fieldName = curRuleMap["fieldName"].(string)
 
-		c.columns[i] = newRule
+		format, err := buildColumnFormat(curRuleMap)
+		if err != nil {
+			return nil, fmt.Errorf("column %v: %v", newRule.fieldName, err)
+		}
+		newRule.columnFormat = format
+
+		if newRule.datatype == "binary" && newRule.length != 2 && newRule.length != 4 && newRule.length != 8 {
+			return nil, fmt.Errorf("column %v: binary columns must be 2, 4 or 8 bytes long", newRule.fieldName)
+		}
+
+		result[i] = newRule
 	}
 
-	c.hasHeaderRow = config["hasHeaderRow"].(bool)
+	return result, parseFixedLengthFieldPaths(result)
+}
+
+// parseFixedLengthFieldPaths parses the field names of the columns, and of their conditions, as field paths
+func parseFixedLengthFieldPaths(columns []parseFixedLengthColumn) error {
+	for i := range columns {
+		col := &(columns[i])
+
+		var err error
+		col.field, err = parseFieldPath(col.fieldName)
+		if err != nil {
+			return fmt.Errorf("column %v: fieldName: %v", col.fieldName, err)
+		}
+
+		for j := range col.conditions {
+			col.conditions[j].field, err = parseFieldPath(col.conditions[j].fieldName)
+			if err != nil {
+				return fmt.Errorf("column %v: condition %v: %v", col.fieldName, col.conditions[j].fieldName, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+func buildFixedLengthControls(controlsMap map[string]interface{}) (*parseFixedLengthControls, error) {
+	controls := parseFixedLengthControls{}
 
-	return c, nil
+	if countField, _ := controlsMap["countField"].(string); countField != "" {
+		var err error
+		controls.countField, err = parseFieldPath(countField)
+		if err != nil {
+			return nil, fmt.Errorf("countField: %w", err)
+		}
+	}
+	countLayouts, _ := controlsMap["countLayouts"].([]interface{})
+	for i := range countLayouts {
+		controls.countLayouts = append(controls.countLayouts, countLayouts[i].(string))
+	}
+
+	totals, _ := controlsMap["totals"].([]interface{})
+	for i := range totals {
+		curTotalMap := totals[i].(map[string]interface{})
+		total := parseFixedLengthControlTotal{sumLayout: curTotalMap["sumLayout"].(string)}
+
+		var err error
+		total.field, err = parseFieldPath(curTotalMap["field"].(string))
+		if err != nil {
+			return nil, fmt.Errorf("totals[%d].field: %w", i, err)
+		}
+		total.sumField, err = parseFieldPath(curTotalMap["sumField"].(string))
+		if err != nil {
+			return nil, fmt.Errorf("totals[%d].sumField: %w", i, err)
+		}
+
+		controls.totals = append(controls.totals, total)
+	}
+
+	return &controls, nil
+}
+
+// outputPorts returns the output port of every layout
+func (f *parseFixedLength) outputPorts(config map[string]interface{}) ([]PortSpec, error) {
+	c, err := f.buildConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
+	ports := []PortSpec{}
+	seen := make(map[string]bool)
+	for i := range c.layouts {
+		if seen[c.layouts[i].outputPort] {
+			continue
+		}
+		seen[c.layouts[i].outputPort] = true
+
+		description := "One record per line"
+		if c.layouts[i].name != "" {
+			description = fmt.Sprintf("One record per %v line", c.layouts[i].name)
+		}
+		ports = append(ports, PortSpec{Name: c.layouts[i].outputPort, Description: description, DataType: PortDataTypeRecord})
+	}
+
+	return append(ports, errorOutputPort), nil
 }
 
 func (f *parseFixedLength) Execute(in dataflow.InputReader, out dataflow.OutputWriter, config map[string]interface{}) error {
 	defer out.Close()
 
 	//Parse/read config options
+	config, err := prepareConfig("parseFixedLength", config)
+	if err != nil {
+		return err
+	}
+
 	parsedConfig, err := f.buildConfig(config)
 	if err != nil {
-		panic("Error generating a csv")
+		return newFunctionError("parseFixedLength", "building config", err)
 	}
 	f.config = parsedConfig
 
@@ -99,81 +464,334 @@ func (f *parseFixedLength) Execute(in dataflow.InputReader, out dataflow.OutputW
 	reader := in.PortReader(dataflow.DEFAULT_INPUT_PORT_NAME)
 	err = reader.Open()
 	if err != nil {
-		panic("Unable to read record from input")
+		return newFunctionError("parseFixedLength", "opening input", err)
 	}
 
 	//For each file, parse the records and output them
 	for reader.HasNext() {
 		curEntry, err := reader.Next()
 		if err != nil {
-			panic(err)
+			return newFunctionError("parseFixedLength", "reading input", err)
 		}
 
 		curFile, err := curEntry.GetAsFile()
 		if err != nil {
-			panic(err)
+			writeRecordError(out, &(RecordError{FunctionKey: "parseFixedLength", Err: err}))
+			continue
 		}
 
-		f.parseFile(curFile, out)
+		if !f.config.decompress {
+			f.parseFile(curFile, out)
+			continue
+		}
+
+		err = expandFile(curFile, archiveFormatAuto, func(innerFile dataflow.File) error {
+			f.parseFile(innerFile, out)
+			return nil
+		})
+		if err != nil {
+			writeRecordError(out, &(RecordError{FunctionKey: "parseFixedLength", Filename: curFile.Filename(), Err: err}))
+		}
 	}
 
 	return nil
 }
 
+// parseFile parses every record in the file. Records that can't be parsed are written to the error port.
 func (f *parseFixedLength) parseFile(file dataflow.File, out dataflow.OutputWriter) {
-	fileReader := file.Reader()
+	bufReader := bufio.NewReader(file.Reader())
+	encodingName := resolveTextEncoding(bufReader, f.config.encoding)
+
+	//Single byte encodings are decoded a column at a time, so packed and binary columns can be read from the raw bytes
+	var fileReader io.Reader = bufReader
+	f.charmap, _ = textEncodings[encodingName].(*charmap.Charmap)
+	if f.charmap == nil {
+		fileReader = transcodeToUTF8(bufReader, encodingName)
+	}
+
+	//Offsets are in characters, which in single byte encodings are bytes. Packed and binary columns are binary data,
+	//so layouts with them are counted in bytes, which rules out UTF-16.
+	f.byteOffsets = f.charmap != nil || f.config.hasRawColumns()
+	if f.byteOffsets && f.charmap == nil && textEncodings[encodingName] != nil {
+		writeRecordError(out, &(RecordError{FunctionKey: "parseFixedLength", Filename: file.Filename(), Err: fmt.Errorf("packed and binary columns can't be read from %v files", encodingName)}))
+		return
+	}
 
 	scan := bufio.NewScanner(fileReader)
+	scan.Split(fixedLengthSplitFunc(f.config.recordLength, ebcdicEncodings[encodingName]))
+	lineNumber := 0
+	tracker := newFixedLengthControlTracker(f.config.layouts)
 
 	if f.config.hasHeaderRow {
 		//throw away first row. we dont even need it for the column names, since we got them in the config
 		scan.Scan()
+		lineNumber++
 	}
 
 	for scan.Scan() {
-		line := scan.Text()
-		rec, err := f.parseLine(line)
+		lineNumber++
+		raw := scan.Bytes()
+		line := f.newLine(raw)
+
+		layout, err := f.layoutForLine(line)
+		if err == nil && layout == nil {
+			//Unknown record type, configured to be skipped
+			continue
+		}
+
+		var rec dataflow.Record
+		if err == nil {
+			rec, err = f.parseLine(line, layout.columns)
+		}
+
+		if err == nil && layout.controls != nil {
+			err = tracker.check(layout, rec)
+		}
+		if layout != nil && layout.controls != nil {
+			//A trailer ends what it covers whether or not its checks pass, so the next one is checked on its own
+			tracker.reset(layout)
+		}
 
 		if err != nil {
-			panic(err)
+			writeRecordError(out, &(RecordError{
+				FunctionKey: "parseFixedLength",
+				Filename:    file.Filename(),
+				LineNumber:  lineNumber,
+				Line:        decodeFixedLengthText(f.charmap, raw),
+				Err:         err,
+			}))
+			continue
 		}
 
-		out.WriteRecord(dataflow.DEFAULT_OUTPUT_PORT_NAME, &rec)
+		tracker.add(layout, rec)
+		out.WriteRecord(layout.outputPort, &rec)
 	}
+
+	if err := scan.Err(); err != nil {
+		writeRecordError(out, &(RecordError{FunctionKey: "parseFixedLength", Filename: file.Filename(), LineNumber: lineNumber + 1, Err: err}))
+	}
+}
+
+// fixedLengthLine is a record being parsed. Offsets into it are in characters, or bytes if the parser's byteOffsets is
+// set.
+type fixedLengthLine struct {
+	raw []byte
+
+	// runes are the characters of the line, if it's UTF-8 text with multi-byte characters
+	runes []rune
+}
+
+func (f *parseFixedLength) newLine(raw []byte) fixedLengthLine {
+	line := fixedLengthLine{raw: raw}
+	if !f.byteOffsets && utf8.RuneCount(raw) != len(raw) {
+		line.runes = bytes.Runes(raw)
+	}
+
+	return line
+}
+
+// length returns the number of characters in the line
+func (l *fixedLengthLine) length() int {
+	if l.runes == nil {
+		return len(l.raw)
+	}
+
+	return len(l.runes)
+}
+
+// slice returns the bytes of the characters from start up to end
+func (l *fixedLengthLine) slice(start int, end int) []byte {
+	if l.runes == nil {
+		return l.raw[start:end]
+	}
+
+	return []byte(string(l.runes[start:end]))
+}
+
+// layoutForLine finds the layout for the record type code of the raw record. It returns nil, nil if the record should
+// be skipped.
+func (f *parseFixedLength) layoutForLine(line fixedLengthLine) (*parseFixedLengthLayout, error) {
+	if f.config.recordTypeLength == 0 {
+		return &(f.config.layouts[0]), nil
+	}
+
+	end := f.config.recordTypeStart + f.config.recordTypeLength
+	if end > line.length() {
+		return nil, fmt.Errorf("line is %d characters long, but the record type code ends at %d", line.length(), end)
+	}
+
+	code := decodeFixedLengthText(f.charmap, line.slice(f.config.recordTypeStart, end))
+	for i := range f.config.layouts {
+		if f.config.layouts[i].code == code {
+			return &(f.config.layouts[i]), nil
+		}
+	}
+
+	if f.config.skipUnknownRecordTypes {
+		return nil, nil
+	}
+
+	return nil, fmt.Errorf("unknown record type %q", code)
 }
 
-func (f *parseFixedLength) parseLine(line string) (dataflow.Record, error) {
+func (f *parseFixedLength) parseLine(line fixedLengthLine, columns []parseFixedLengthColumn) (dataflow.Record, error) {
 	rec := dataflow.Record{}
 
-	for idx := range f.config.columns {
-		col := f.config.columns[idx]
-		valStr := line[col.start:(col.start + col.length)]
+	for idx := range columns {
+		col := columns[idx]
+		if col.start+col.length > line.length() {
+			return nil, fmt.Errorf("line is %d characters long, but column %v ends at %d", line.length(), col.fieldName, col.start+col.length)
+		}
+		valRaw := line.slice(col.start, col.start+col.length)
 
+		valStr := decodeFixedLengthText(f.charmap, valRaw)
 		if col.datatype == "string" {
-			//Already done :-)
-			rec.Set(col.fieldName, strings.TrimSpace(valStr))
-		} else if col.datatype == "integer" {
-			valInt, err := strconv.ParseInt(strings.TrimSpace(valStr), 10, 64)
+			valStr = strings.TrimSpace(valStr)
+		}
+
+		val, err := col.parseRaw(valRaw, valStr)
+		if err != nil {
+			return nil, fmt.Errorf("column %v: %v", col.fieldName, err)
+		}
+
+		err = col.field.set(rec, val)
+		if err != nil {
+			return nil, fmt.Errorf("column %v: %v", col.fieldName, err)
+		}
+
+		for _, condition := range col.conditions {
+			err = condition.field.set(rec, condition.matches(val))
 			if err != nil {
-				panic(err)
+				return nil, fmt.Errorf("column %v: %v", col.fieldName, err)
 			}
-			rec.Set(col.fieldName, valInt)
-		} else if col.datatype == "decimal" {
-			valFloat, err := strconv.ParseFloat(strings.TrimSpace(valStr), 64)
+		}
+	}
+
+	return rec, nil
+}
+
+// matches reports whether the parsed column value is one of the condition's values. Numbers are compared numerically
+// and everything else as trimmed strings.
+func (c *parseFixedLengthCondition) matches(val interface{}) bool {
+	num, isNum := configValueAsFloat(val)
+	str := strings.TrimSpace(fmt.Sprint(val))
+
+	for _, condVal := range c.values {
+		if isNum {
+			from, err := strconv.ParseFloat(condVal.value, 64)
 			if err != nil {
-				panic(err)
+				continue
 			}
-			rec.Set(col.fieldName, valFloat)
-		} else if col.datatype == "date" {
-			valDate, err := time.Parse(col.format, strings.TrimSpace(valStr))
-			if err != nil {
-				panic(err)
+			to := from
+			if condVal.thru != "" {
+				if to, err = strconv.ParseFloat(condVal.thru, 64); err != nil {
+					continue
+				}
+			}
+			if num >= from && num <= to {
+				return true
 			}
-			rec.Set(col.fieldName, valDate)
-		} else {
-			panic(fmt.Sprintf("Unsupported dataype %v for column %v", col.datatype, col.fieldName))
+		} else if condVal.thru != "" {
+			if str >= strings.TrimSpace(condVal.value) && str <= strings.TrimSpace(condVal.thru) {
+				return true
+			}
+		} else if str == strings.TrimSpace(condVal.value) {
+			return true
 		}
 	}
 
-	return rec, nil
+	return false
+}
+
+// fixedLengthControlTracker accumulates the record counts and control totals checked by trailer layouts. There is one
+// counter per layout with controls, which starts again each time a record with that layout is parsed.
+type fixedLengthControlTracker struct {
+	counters map[string]*fixedLengthControlCounter
+}
+
+// fixedLengthControlCounter holds the counts and totals for one trailer layout
+type fixedLengthControlCounter struct {
+	controls *parseFixedLengthControls
+	counts   map[string]int //by layout name
+	sums     []float64      //by index in controls.totals
+}
+
+func newFixedLengthControlTracker(layouts []parseFixedLengthLayout) *fixedLengthControlTracker {
+	t := fixedLengthControlTracker{counters: make(map[string]*fixedLengthControlCounter)}
+	for i := range layouts {
+		if layouts[i].controls != nil {
+			t.counters[layouts[i].name] = newFixedLengthControlCounter(layouts[i].controls)
+		}
+	}
+
+	return &t
+}
+
+func newFixedLengthControlCounter(controls *parseFixedLengthControls) *fixedLengthControlCounter {
+	return &(fixedLengthControlCounter{controls: controls, counts: make(map[string]int), sums: make([]float64, len(controls.totals))})
+}
+
+// check compares a trailer record's count and totals with the records parsed since the previous trailer
+func (t *fixedLengthControlTracker) check(layout *parseFixedLengthLayout, rec dataflow.Record) error {
+	c := t.counters[layout.name]
+	controls := layout.controls
+
+	if controls.countField != nil {
+		val, _ := controls.countField.get(rec)
+		expected, ok := configValueAsFloat(val)
+		if !ok {
+			return fmt.Errorf("%v control field %v is not a number", layout.name, controls.countField)
+		}
+
+		actual := 0
+		for _, name := range controls.countLayouts {
+			actual += c.counts[name]
+		}
+
+		if int(expected) != actual {
+			return fmt.Errorf("%v %v is %v, but %d records were parsed", layout.name, controls.countField, expected, actual)
+		}
+	}
+
+	for i, total := range controls.totals {
+		val, _ := total.field.get(rec)
+		expected, ok := configValueAsFloat(val)
+		if !ok {
+			return fmt.Errorf("%v control field %v is not a number", layout.name, total.field)
+		}
+
+		actual := c.sums[i]
+		if math.Abs(expected-actual) > 1e-6 {
+			return fmt.Errorf("%v %v is %v, but the %v %v total is %v", layout.name, total.field, expected, total.sumLayout, total.sumField, actual)
+		}
+	}
+
+	return nil
+}
+
+// reset starts the counter of a trailer layout again
+func (t *fixedLengthControlTracker) reset(layout *parseFixedLengthLayout) {
+	t.counters[layout.name] = newFixedLengthControlCounter(layout.controls)
+}
+
+// add counts a parsed record towards every trailer other than its own layout, and adds it to the totals that sum its
+// layout
+func (t *fixedLengthControlTracker) add(layout *parseFixedLengthLayout, rec dataflow.Record) {
+	for name, c := range t.counters {
+		if name == layout.name {
+			continue
+		}
+
+		c.counts[layout.name]++
+		for i, total := range c.controls.totals {
+			if total.sumLayout != layout.name {
+				continue
+			}
+
+			val, _ := total.sumField.get(rec)
+			if num, ok := configValueAsFloat(val); ok {
+				c.sums[i] += num
+			}
+		}
+	}
 }
@@ -0,0 +1,226 @@
+package builtin
+
+import (
+	"bitbucket.org/primelogic_io/bitlantern/service/dataflow"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseFixedLength(t *testing.T) {
+	columns := []interface{}{
+		map[string]interface{}{"start": 0.0, "length": 6.0, "datatype": "string", "fieldName": "name"},
+		map[string]interface{}{"start": 6.0, "length": 3.0, "datatype": "integer", "fieldName": "age"},
+		map[string]interface{}{"start": 9.0, "length": 6.0, "datatype": "decimal", "fieldName": "balance"},
+		map[string]interface{}{"start": 15.0, "length": 8.0, "datatype": "date", "format": "20060102", "fieldName": "joined"},
+	}
+
+	tests := []struct {
+		name       string
+		config     map[string]interface{}
+		data       string
+		want       []dataflow.Record
+		wantErrors []dataflow.Record
+	}{
+		{
+			name:   "columns are sliced, trimmed and converted",
+			config: map[string]interface{}{"columns": columns},
+			data:   "Alice  30 10.5020200102\nBob    41  0.0020191231\n",
+			want: []dataflow.Record{
+				{"name": "Alice", "age": int64(30), "balance": 10.5, "joined": time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC)},
+				{"name": "Bob", "age": int64(41), "balance": 0.0, "joined": time.Date(2019, 12, 31, 0, 0, 0, 0, time.UTC)},
+			},
+		},
+		{
+			name:   "header row is skipped",
+			config: map[string]interface{}{"hasHeaderRow": true, "columns": columns[:2]},
+			data:   "NAME  AGE\nAlice  30\n",
+			want:   []dataflow.Record{{"name": "Alice", "age": int64(30)}},
+		},
+		{
+			name:   "short and malformed lines go to the error port",
+			config: map[string]interface{}{"hasHeaderRow": true, "columns": columns[:2]},
+			data:   "NAME  AGE\nAl\nBob    4x\nCarol  22\n",
+			want:   []dataflow.Record{{"name": "Carol", "age": int64(22)}},
+			wantErrors: []dataflow.Record{
+				{"functionKey": "parseFixedLength", "filename": "people.txt", "lineNumber": 2, "line": "Al"},
+				{"functionKey": "parseFixedLength", "filename": "people.txt", "lineNumber": 3, "line": "Bob    4x"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, err := runFunction(t, "parseFixedLength", tt.config, fileInput("people.txt", tt.data))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := out.Records(dataflow.DEFAULT_OUTPUT_PORT_NAME)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("records = %v, want %v", got, tt.want)
+			}
+
+			assertErrorRecords(t, out, tt.wantErrors)
+		})
+	}
+}
+
+func TestParseFixedLengthRecordTypes(t *testing.T) {
+	column := func(start float64, length float64, datatype string, fieldName string) interface{} {
+		return map[string]interface{}{"start": start, "length": length, "datatype": datatype, "fieldName": fieldName}
+	}
+
+	config := map[string]interface{}{
+		"recordTypes": map[string]interface{}{
+			"start":  0.0,
+			"length": 1.0,
+			"layouts": []interface{}{
+				map[string]interface{}{"code": "5", "name": "batchHeader", "outputPort": "batches", "columns": []interface{}{
+					column(1, 4, "string", "batchName"),
+				}},
+				map[string]interface{}{"code": "6", "name": "entry", "outputPort": "entries", "columns": []interface{}{
+					column(1, 5, "string", "account"),
+					column(6, 6, "integer", "amount"),
+				}},
+				map[string]interface{}{"code": "8", "name": "batchControl", "outputPort": "controls", "columns": []interface{}{
+					column(1, 3, "integer", "entryCount"),
+					column(4, 8, "integer", "totalAmount"),
+				}, "controls": map[string]interface{}{
+					"countField":   "entryCount",
+					"countLayouts": []interface{}{"entry"},
+					"totals": []interface{}{
+						map[string]interface{}{"field": "totalAmount", "sumLayout": "entry", "sumField": "amount"},
+					},
+				}},
+			},
+		},
+	}
+
+	data := "5PAY1\n" +
+		"6ACC01000100\n" +
+		"6ACC02000250\n" +
+		"800200000350\n" +
+		"5PAY2\n" +
+		"6ACC03000010\n" +
+		"800200000010\n" +
+		"9XYZ\n"
+
+	out, err := runFunction(t, "parseFixedLength", config, fileInput("ach.txt", data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wantBatches := []dataflow.Record{{"batchName": "PAY1"}, {"batchName": "PAY2"}}
+	if got := out.Records("batches"); !reflect.DeepEqual(got, wantBatches) {
+		t.Errorf("batches = %v, want %v", got, wantBatches)
+	}
+
+	if got := len(out.Records("entries")); got != 3 {
+		t.Errorf("got %d entries, want 3", got)
+	}
+
+	wantControls := []dataflow.Record{{"entryCount": int64(2), "totalAmount": int64(350)}}
+	if got := out.Records("controls"); !reflect.DeepEqual(got, wantControls) {
+		t.Errorf("controls = %v, want %v", got, wantControls)
+	}
+
+	//The second batch control claims 2 entries but only has 1, and 9 isn't a known record type
+	assertErrorRecords(t, out, []dataflow.Record{
+		{"functionKey": "parseFixedLength", "filename": "ach.txt", "lineNumber": 7, "line": "800200000010"},
+		{"functionKey": "parseFixedLength", "filename": "ach.txt", "lineNumber": 8, "line": "9XYZ"},
+	})
+
+	//Unknown record types can be skipped instead
+	config["recordTypes"].(map[string]interface{})["unknownRecordTypes"] = "skip"
+	out, err = runFunction(t, "parseFixedLength", config, fileInput("ach.txt", data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := len(out.Records(ERROR_OUTPUT_PORT_NAME)); got != 1 {
+		t.Errorf("got %d errors, want 1", got)
+	}
+
+	//A batch that fails its checks doesn't carry over into the next one
+	data = "5PAY1\n" +
+		"6ACC01000100\n" +
+		"800900000999\n" +
+		"5PAY2\n" +
+		"6ACC02000010\n" +
+		"800100000010\n"
+	out, err = runFunction(t, "parseFixedLength", config, fileInput("ach.txt", data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantControls = []dataflow.Record{{"entryCount": int64(1), "totalAmount": int64(10)}}
+	if got := out.Records("controls"); !reflect.DeepEqual(got, wantControls) {
+		t.Errorf("controls = %v, want %v", got, wantControls)
+	}
+	assertErrorRecords(t, out, []dataflow.Record{
+		{"functionKey": "parseFixedLength", "filename": "ach.txt", "lineNumber": 3, "line": "800900000999"},
+	})
+
+	ports, err := DefaultInstance().ResolveOutputPorts("parseFixedLength", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, port := range ports {
+		names = append(names, port.Name)
+	}
+	if want := []string{"batches", "entries", "controls", ERROR_OUTPUT_PORT_NAME}; !reflect.DeepEqual(names, want) {
+		t.Errorf("ports = %v, want %v", names, want)
+	}
+}
+
+func TestParseFixedLengthNestedFields(t *testing.T) {
+	column := func(start float64, length float64, datatype string, fieldName string) interface{} {
+		return map[string]interface{}{"start": start, "length": length, "datatype": datatype, "fieldName": fieldName}
+	}
+
+	config := map[string]interface{}{
+		"recordTypes": map[string]interface{}{
+			"start":  0.0,
+			"length": 1.0,
+			"layouts": []interface{}{
+				map[string]interface{}{"code": "6", "name": "entry", "outputPort": "entries", "columns": []interface{}{
+					column(1, 5, "string", "account.number"),
+					column(6, 6, "integer", "amount.cents"),
+				}},
+				map[string]interface{}{"code": "8", "name": "batchControl", "outputPort": "controls", "columns": []interface{}{
+					column(1, 3, "integer", "control.count"),
+					column(4, 8, "integer", "control.total"),
+				}, "controls": map[string]interface{}{
+					"countField":   "control.count",
+					"countLayouts": []interface{}{"entry"},
+					"totals": []interface{}{
+						map[string]interface{}{"field": "control.total", "sumLayout": "entry", "sumField": "amount.cents"},
+					},
+				}},
+			},
+		},
+	}
+
+	data := "6ACC01000100\n" +
+		"6ACC02000250\n" +
+		"800200000350\n"
+
+	out, err := runFunction(t, "parseFixedLength", config, fileInput("ach.txt", data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wantEntries := []dataflow.Record{
+		{"account": map[string]interface{}{"number": "ACC01"}, "amount": map[string]interface{}{"cents": int64(100)}},
+		{"account": map[string]interface{}{"number": "ACC02"}, "amount": map[string]interface{}{"cents": int64(250)}},
+	}
+	if got := out.Records("entries"); !reflect.DeepEqual(got, wantEntries) {
+		t.Errorf("entries = %v, want %v", got, wantEntries)
+	}
+
+	wantControls := []dataflow.Record{{"control": map[string]interface{}{"count": int64(2), "total": int64(350)}}}
+	if got := out.Records("controls"); !reflect.DeepEqual(got, wantControls) {
+		t.Errorf("controls = %v, want %v", got, wantControls)
+	}
+	assertErrorRecords(t, out, nil)
+}
@@ -0,0 +1,286 @@
+package builtin
+
+import (
+	"bitbucket.org/primelogic_io/bitlantern/service/dataflow"
+	"encoding/json"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// PIPELINE_INPUT_SOURCE is the source name that refers to the files passed into Pipeline.Run (e.g. from the command
+// line), rather than to the output of another step.
+const PIPELINE_INPUT_SOURCE = "input"
+
+// Pipeline is a chain of builtin functions that can be run locally, outside of the workflow engine, using the
+// in-memory dataflow implementation. It is loaded from YAML or JSON in the form:
+//
+// steps:
+//   - name: parse
+//     function: parseCSV
+//     inputs:
+//       default: [input]
+//     config:
+//       hasHeaderRow: true
+//       columns: [...]
+//   - name: split
+//     function: splitOnField
+//     inputs:
+//       default: [parse]
+//     config: {...}
+//   - name: texasCSV
+//     function: generateCSV
+//     inputs:
+//       default: [split.texas]
+//     config: {...}
+//
+// Each entry in inputs maps one of the step's input ports to a list of sources. A source is "input" (the files passed
+// to Run), "stepName" (that step's default output port) or "stepName.portName". If inputs is omitted, the default
+// input port is fed from the default output port of the previous step, or from "input" for the first step.
+type Pipeline struct {
+	Steps []PipelineStep `json:"steps" yaml:"steps"`
+}
+
+type PipelineStep struct {
+	Name     string                 `json:"name" yaml:"name"`
+	Function string                 `json:"function" yaml:"function"`
+	Config   map[string]interface{} `json:"config" yaml:"config"`
+	Inputs   map[string][]string    `json:"inputs" yaml:"inputs"`
+}
+
+// LoadPipelineFile reads a pipeline definition. Files ending in .json are parsed as JSON, everything else as YAML.
+func LoadPipelineFile(path string) (*Pipeline, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	p := Pipeline{}
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		err = json.Unmarshal(data, &p)
+	} else {
+		err = yaml.Unmarshal(data, &p)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse pipeline %v: %v", path, err)
+	}
+
+	//YAML decodes whole numbers as ints, but the builtins expect config numbers as float64, just like JSON
+	for i := range p.Steps {
+		p.Steps[i].Config, _ = normalizeConfigValue(p.Steps[i].Config).(map[string]interface{})
+	}
+
+	return &p, nil
+}
+
+func normalizeConfigValue(val interface{}) interface{} {
+	switch v := val.(type) {
+	case map[string]interface{}:
+		for key := range v {
+			v[key] = normalizeConfigValue(v[key])
+		}
+		return v
+	case []interface{}:
+		for i := range v {
+			v[i] = normalizeConfigValue(v[i])
+		}
+		return v
+	case int:
+		return float64(v)
+	case int64:
+		return float64(v)
+	case uint64:
+		return float64(v)
+	default:
+		return val
+	}
+}
+
+// stepInputs returns the input port to sources mapping for the step at index i, filling in the implied default
+func (p *Pipeline) stepInputs(i int) map[string][]string {
+	if len(p.Steps[i].Inputs) > 0 {
+		return p.Steps[i].Inputs
+	}
+
+	if i == 0 {
+		return map[string][]string{dataflow.DEFAULT_INPUT_PORT_NAME: {PIPELINE_INPUT_SOURCE}}
+	}
+
+	return map[string][]string{dataflow.DEFAULT_INPUT_PORT_NAME: {p.Steps[i-1].Name}}
+}
+
+// sortedPipelinePorts returns the input port names of inputs in sorted order, so steps are always fed the same way
+func sortedPipelinePorts(inputs map[string][]string) []string {
+	ports := make([]string, 0, len(inputs))
+	for port := range inputs {
+		ports = append(ports, port)
+	}
+	sort.Strings(ports)
+
+	return ports
+}
+
+// parsePipelineSource splits a "stepName.portName" source into its parts
+func parsePipelineSource(source string) (string, string) {
+	idx := strings.Index(source, ".")
+	if idx < 0 {
+		return source, dataflow.DEFAULT_OUTPUT_PORT_NAME
+	}
+
+	return source[:idx], source[idx+1:]
+}
+
+// Validate checks that every step refers to a registered function with a valid config, and that every input source
+// refers to an earlier step (so steps can simply be run in order). All problems are returned together.
+func (p *Pipeline) Validate(provider *FunctionProvider) error {
+	var problems []string
+	seen := make(map[string]bool)
+
+	for i := range p.Steps {
+		step := &(p.Steps[i])
+
+		if step.Name == "" || step.Name == PIPELINE_INPUT_SOURCE || strings.Contains(step.Name, ".") {
+			problems = append(problems, fmt.Sprintf("steps[%d]: invalid step name %q", i, step.Name))
+		} else if seen[step.Name] {
+			problems = append(problems, fmt.Sprintf("steps[%d]: duplicate step name %q", i, step.Name))
+		}
+
+		spec, _ := provider.GetFunctionSpecByKey(step.Function)
+		if spec == nil {
+			problems = append(problems, fmt.Sprintf("steps[%d]: unknown function %q", i, step.Function))
+		} else if err := provider.ValidateConfig(step.Function, step.Config); err != nil {
+			problems = append(problems, fmt.Sprintf("steps[%d]: %v", i, err))
+		}
+
+		for port, sources := range p.stepInputs(i) {
+			for _, source := range sources {
+				stepName, _ := parsePipelineSource(source)
+				if stepName != PIPELINE_INPUT_SOURCE && !seen[stepName] {
+					problems = append(problems, fmt.Sprintf("steps[%d].inputs.%v: %q is not an earlier step", i, port, source))
+				}
+			}
+		}
+
+		seen[step.Name] = true
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid pipeline: %v", strings.Join(problems, "; "))
+	}
+
+	return nil
+}
+
+// Run validates the pipeline and executes each step in order, feeding inputFiles to every step that reads from
+// "input". It returns the output of every step, by step name, so callers can inspect or save it.
+func (p *Pipeline) Run(provider *FunctionProvider, inputFiles []dataflow.File) (map[string]*MemoryOutputWriter, error) {
+	err := p.Validate(provider)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make(map[string]*MemoryOutputWriter)
+
+	for i := range p.Steps {
+		step := &(p.Steps[i])
+
+		in := NewMemoryInputReader()
+		inputs := p.stepInputs(i)
+		for _, port := range sortedPipelinePorts(inputs) {
+			for _, source := range inputs[port] {
+				stepName, outPort := parsePipelineSource(source)
+				if stepName == PIPELINE_INPUT_SOURCE {
+					for f := range inputFiles {
+						in.AddFile(port, inputFiles[f])
+					}
+					continue
+				}
+
+				//Each step gets its own copy of the records, since functions like transformData change them in place and
+				//that must not show up in the saved output of the earlier step or in the input of a sibling step
+				prev := results[stepName]
+				for _, rec := range prev.Records(outPort) {
+					in.AddRecord(port, copyRecord(rec))
+				}
+				for _, file := range prev.Files(outPort) {
+					in.AddFile(port, file.AsFile())
+				}
+			}
+		}
+
+		fn, err := provider.NewFunction(step.Function)
+		if err != nil {
+			return results, err
+		}
+
+		out := NewMemoryOutputWriter()
+		results[step.Name] = out
+
+		err = fn.Execute(in, out, step.Config)
+		if err != nil {
+			return results, fmt.Errorf("step %v failed: %v", step.Name, err)
+		}
+	}
+
+	return results, nil
+}
+
+// WritePipelineOutputs saves the output of every step under dir. Records written to a port are saved as JSON lines
+// in <dir>/<step>/<port>.jsonl and files are saved as <dir>/<step>/<port>/<filename>.
+func WritePipelineOutputs(results map[string]*MemoryOutputWriter, dir string) error {
+	for stepName, out := range results {
+		stepDir := filepath.Join(dir, stepName)
+
+		for _, port := range out.Ports() {
+			records := out.Records(port)
+			if len(records) > 0 {
+				err := writeRecordsAsJSONLines(filepath.Join(stepDir, port+".jsonl"), records)
+				if err != nil {
+					return err
+				}
+			}
+
+			for _, file := range out.Files(port) {
+				path := filepath.Join(stepDir, port, file.Filename())
+				err := os.MkdirAll(filepath.Dir(path), 0755)
+				if err != nil {
+					return err
+				}
+
+				err = ioutil.WriteFile(path, file.Bytes(), 0644)
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+func writeRecordsAsJSONLines(path string, records []dataflow.Record) error {
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+
+	diskFile, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer diskFile.Close()
+
+	enc := json.NewEncoder(diskFile)
+	for i := range records {
+		err = enc.Encode(records[i])
+		if err != nil {
+			return err
+		}
+	}
+
+	return diskFile.Close()
+}
@@ -0,0 +1,134 @@
+package builtin
+
+import (
+	"bitbucket.org/primelogic_io/bitlantern/service/dataflow"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testPipelineYAML = `
+steps:
+  - name: parse
+    function: parseCSV
+    config:
+      hasHeaderRow: true
+      columns:
+        - {columnName: name, datatype: string, fieldName: name}
+        - {columnName: state, datatype: string, fieldName: state}
+        - {columnName: balance, datatype: integer, fieldName: balance}
+  - name: enrich
+    function: transformData
+    config:
+      rules:
+        - {outputField: name, jsExpression: "data.name.toUpperCase()"}
+  - name: split
+    function: splitOnField
+    config:
+      defaultOutputPort: other
+      rules:
+        - {field: state, op: "==", value: TX, valueType: literal, outputPort: texas}
+  - name: texasCSV
+    function: generateCSV
+    inputs:
+      default: [split.texas]
+    config:
+      filename: texas.csv
+      header: "true"
+      headerValue: [name, balance]
+`
+
+func TestPipelineRun(t *testing.T) {
+	dir := t.TempDir()
+	pipelinePath := filepath.Join(dir, "pipeline.yaml")
+	err := ioutil.WriteFile(pipelinePath, []byte(testPipelineYAML), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := LoadPipelineFile(pipelinePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	input := NewMemoryFileFromString("customers.csv", "name,state,balance\nada,TX,10\nbob,CA,20\ncy,TX,30\n")
+	results, err := p.Run(DefaultInstance(), []dataflow.File{input})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files := results["texasCSV"].Files(dataflow.DEFAULT_OUTPUT_PORT_NAME)
+	if len(files) != 1 || files[0].String() != "name,balance\nADA,10\nCY,30\n" {
+		t.Fatalf("unexpected texasCSV output: %v", files)
+	}
+
+	outDir := filepath.Join(dir, "out")
+	err = WritePipelineOutputs(results, outDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	csvData, err := ioutil.ReadFile(filepath.Join(outDir, "texasCSV", dataflow.DEFAULT_OUTPUT_PORT_NAME, "texas.csv"))
+	if err != nil || string(csvData) != files[0].String() {
+		t.Errorf("texas.csv not written to disk: %v", err)
+	}
+
+	otherData, err := ioutil.ReadFile(filepath.Join(outDir, "split", "other.jsonl"))
+	if err != nil || strings.Count(string(otherData), "\n") != 1 {
+		t.Errorf("split.other not written as JSON lines: %q %v", otherData, err)
+	}
+}
+
+func TestPipelineFanOut(t *testing.T) {
+	//parse feeds two steps, and the first one changes its records in place
+	p := Pipeline{
+		Steps: []PipelineStep{
+			{Name: "parse", Function: "parseCSV", Config: map[string]interface{}{
+				"hasHeaderRow": true,
+				"columns":      []interface{}{map[string]interface{}{"columnName": "name", "datatype": "string", "fieldName": "name"}},
+			}},
+			{Name: "upper", Function: "transformData", Config: map[string]interface{}{
+				"rules": []interface{}{transformRuleMap("name", "data.name.toUpperCase()")},
+			}},
+			{Name: "suffix", Function: "transformData", Inputs: map[string][]string{"default": {"parse"}}, Config: map[string]interface{}{
+				"rules": []interface{}{transformRuleMap("name", "data.name + '!'")},
+			}},
+		},
+	}
+
+	input := NewMemoryFileFromString("customers.csv", "name\nada\n")
+	results, err := p.Run(DefaultInstance(), []dataflow.File{input})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{"parse": "ada", "upper": "ADA", "suffix": "ada!"}
+	for stepName, name := range want {
+		recs := results[stepName].Records(dataflow.DEFAULT_OUTPUT_PORT_NAME)
+		if len(recs) != 1 || recs[0]["name"] != name {
+			t.Errorf("step %v: got %v, want name %v", stepName, recs, name)
+		}
+	}
+}
+
+func TestPipelineValidate(t *testing.T) {
+	p := Pipeline{
+		Steps: []PipelineStep{
+			{Name: "parse", Function: "parseCSV", Config: map[string]interface{}{"hasHeaderRow": "yes"}},
+			{Name: "split", Function: "noSuchFunction"},
+			{Name: "csv", Function: "writeFileToDisk", Config: map[string]interface{}{"destinationFolder": "/tmp"}, Inputs: map[string][]string{"default": {"later"}}},
+		},
+	}
+
+	err := p.Validate(DefaultInstance())
+	if err == nil {
+		t.Fatal("expected the pipeline to be invalid")
+	}
+
+	for _, want := range []string{"steps[0]: invalid config", "unknown function \"noSuchFunction\"", "\"later\" is not an earlier step"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q does not mention %q", err, want)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package builtin
+
+import (
+	"bitbucket.org/primelogic_io/bitlantern/service/dataflow"
+	"fmt"
+)
+
+// Port data types. A port carries either records or files, never both.
+const (
+	PortDataTypeRecord = "record"
+	PortDataTypeFile   = "file"
+)
+
+// PortSpec describes a single input or output port of a builtin function
+type PortSpec struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	DataType    string `json:"dataType"`
+}
+
+var (
+	recordInputPort = PortSpec{Name: dataflow.DEFAULT_INPUT_PORT_NAME, Description: "Records to process", DataType: PortDataTypeRecord}
+	fileInputPort   = PortSpec{Name: dataflow.DEFAULT_INPUT_PORT_NAME, Description: "Files to process", DataType: PortDataTypeFile}
+	errorOutputPort = PortSpec{Name: ERROR_OUTPUT_PORT_NAME, Description: "Records, lines or files that could not be processed", DataType: PortDataTypeRecord}
+)
+
+// dataflowPorts converts port specs to the ports of a dataflow.FunctionSpec
+func dataflowPorts(specs ...PortSpec) []dataflow.Port {
+	ports := make([]dataflow.Port, len(specs))
+	for i := range specs {
+		ports[i] = dataflow.Port{Name: specs[i].Name, Description: specs[i].Description, DataType: specs[i].DataType}
+	}
+
+	return ports
+}
+
+// portSpecs converts the ports of a dataflow.FunctionSpec back to port specs
+func portSpecs(ports []dataflow.Port) []PortSpec {
+	specs := make([]PortSpec, len(ports))
+	for i := range ports {
+		specs[i] = PortSpec{Name: ports[i].Name, Description: ports[i].Description, DataType: ports[i].DataType}
+	}
+
+	return specs
+}
+
+// checkRoutedPortName rejects an output port named in a config that would collide with the error port
+func checkRoutedPortName(name string) error {
+	if name == ERROR_OUTPUT_PORT_NAME {
+		return fmt.Errorf("%q is reserved for the error port", name)
+	}
+
+	return nil
+}
+
+// routedOutputPorts builds the output ports of a function that routes its input to ports named in its config (e.g.
+// splitOnField). Port names used by more than one rule are only listed once. The error port is always included, so
+// no rule may use its name.
+func routedOutputPorts(defaultPort string, rulePorts []string, dataType string) ([]PortSpec, error) {
+	if err := checkRoutedPortName(defaultPort); err != nil {
+		return nil, fmt.Errorf("defaultOutputPort: %w", err)
+	}
+
+	ports := []PortSpec{{Name: defaultPort, Description: "Input that doesn't match any rule", DataType: dataType}}
+	seen := map[string]bool{defaultPort: true}
+
+	for i := range rulePorts {
+		if err := checkRoutedPortName(rulePorts[i]); err != nil {
+			return nil, fmt.Errorf("rules[%d].outputPort: %w", i, err)
+		}
+		if seen[rulePorts[i]] {
+			continue
+		}
+		seen[rulePorts[i]] = true
+
+		ports = append(ports, PortSpec{
+			Name:        rulePorts[i],
+			Description: fmt.Sprintf("Input matching rules[%d]", i),
+			DataType:    dataType,
+		})
+	}
+
+	return append(ports, errorOutputPort), nil
+}
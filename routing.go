@@ -0,0 +1,77 @@
+package builtin
+
+import (
+	"bitbucket.org/primelogic_io/bitlantern/service/dataflow"
+	"fmt"
+)
+
+// Match modes of the routing functions (splitOnField, splitOnFieldJS, fileRouter). They decide where input goes when
+// more than one rule matches: the first matching rule's port, the last one's, or every matching rule's port.
+const (
+	matchModeFirst = "first"
+	matchModeLast  = "last"
+	matchModeAll   = "all"
+)
+
+// matchModeConfigField returns the matchMode config field. Its default is each function's routing from before match
+// modes were added (the last match for splitOnField and fileRouter, the first for splitOnFieldJS), so existing
+// pipelines keep routing the same way.
+func matchModeConfigField(defaultMode string) ConfigField {
+	return ConfigField{
+		Key:         "matchMode",
+		Type:        ConfigTypeString,
+		Enum:        []interface{}{matchModeFirst, matchModeLast, matchModeAll},
+		Default:     defaultMode,
+		Description: fmt.Sprintf("Which matching rules route the input: the first, the last, or all of them (copying the input to every matching port). Defaults to %v", defaultMode),
+	}
+}
+
+// matchPorts evaluates the rules in order and returns the output ports the input is routed to under the match mode.
+// In first mode rules after the first match aren't evaluated. In all mode each port is only returned once, even if
+// several matching rules share it. If no rule matches the input goes to defaultPort.
+func matchPorts(matchMode string, defaultPort string, rulePorts []string, matches func(i int) (bool, error)) ([]string, error) {
+	var ports []string
+	seen := make(map[string]bool)
+
+	for i := range rulePorts {
+		matched, err := matches(i)
+		if err != nil {
+			return nil, fmt.Errorf("rules[%d]: %w", i, err)
+		}
+		if !matched {
+			continue
+		}
+
+		switch matchMode {
+		case matchModeFirst:
+			return []string{rulePorts[i]}, nil
+		case matchModeLast:
+			ports = []string{rulePorts[i]}
+		default:
+			if !seen[rulePorts[i]] {
+				seen[rulePorts[i]] = true
+				ports = append(ports, rulePorts[i])
+			}
+		}
+	}
+
+	if len(ports) == 0 {
+		return []string{defaultPort}, nil
+	}
+
+	return ports, nil
+}
+
+// writeRecordToPorts writes the record to each port. Ports after the first get their own copy, so a function further
+// down one branch can't change the record seen by another.
+func writeRecordToPorts(out dataflow.OutputWriter, ports []string, rec dataflow.Record) {
+	for i, port := range ports {
+		if i == 0 {
+			out.WriteRecord(port, &rec)
+			continue
+		}
+
+		recCopy := copyRecord(rec)
+		out.WriteRecord(port, &recCopy)
+	}
+}
@@ -0,0 +1,67 @@
+package builtin
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMatchPorts(t *testing.T) {
+	rulePorts := []string{"audit", "texas", "audit", "large"}
+	matched := []bool{true, true, true, false}
+
+	tests := []struct {
+		matchMode string
+		want      []string
+		wantCalls int
+	}{
+		{matchMode: matchModeFirst, want: []string{"audit"}, wantCalls: 1},
+		{matchMode: matchModeLast, want: []string{"audit"}, wantCalls: 4},
+		{matchMode: matchModeAll, want: []string{"audit", "texas"}, wantCalls: 4},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.matchMode, func(t *testing.T) {
+			calls := 0
+			got, err := matchPorts(tt.matchMode, "other", rulePorts, func(i int) (bool, error) {
+				calls++
+				return matched[i], nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(got, tt.want) || calls != tt.wantCalls {
+				t.Errorf("got %v after %d rules, want %v after %d", got, calls, tt.want, tt.wantCalls)
+			}
+		})
+	}
+
+	got, _ := matchPorts(matchModeAll, "other", rulePorts, func(i int) (bool, error) { return false, nil })
+	if !reflect.DeepEqual(got, []string{"other"}) {
+		t.Errorf("got %v, want the default port", got)
+	}
+
+	_, err := matchPorts(matchModeAll, "other", rulePorts, func(i int) (bool, error) {
+		return false, fmt.Errorf("bad value")
+	})
+	if err == nil || err.Error() != "rules[0]: bad value" {
+		t.Errorf("got error %v", err)
+	}
+}
+
+func TestSplittersDescribeDefaultMatchMode(t *testing.T) {
+	for _, key := range []string{"splitOnField", "splitOnFieldJS", "fileRouter"} {
+		spec, _ := DefaultInstance().GetFunctionSpecByKey(key)
+		defaults, err := DefaultInstance().ApplyConfigDefaults(key, map[string]interface{}{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		want := fmt.Sprintf("(matchMode %v)", defaults["matchMode"])
+		if !strings.Contains(spec.Description, want) {
+			t.Errorf("%v: description %q does not mention %v", key, spec.Description, want)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package builtin
+
+import (
+	"strings"
+	"time"
+)
+
+// defaultInferDateFormats are the Go time layouts tried, in order, when inferring date columns
+var defaultInferDateFormats = []interface{}{"2006-01-02", "01/02/2006", time.RFC3339, "2006-01-02 15:04:05"}
+
+// inferColumnFormat infers the datatype of a column from sampled values. The candidates are tried in order (integer,
+// decimal, boolean, then a date in each of dateFormats) and the first one every non-empty value parses as wins.
+// Anything else is a string. Empty values are ignored when inferring and are nil in the parsed records.
+func inferColumnFormat(values []string, dateFormats []string) columnFormat {
+	candidates := []columnFormat{{datatype: "integer"}, {datatype: "decimal"}, {datatype: "boolean"}}
+	for _, format := range dateFormats {
+		candidates = append(candidates, columnFormat{datatype: "date", format: format})
+	}
+
+	nonEmpty := make([]string, 0, len(values))
+	for _, val := range values {
+		if strings.TrimSpace(val) != "" {
+			nonEmpty = append(nonEmpty, val)
+		}
+	}
+
+	if len(nonEmpty) > 0 {
+		for _, candidate := range candidates {
+			candidate.location = time.UTC
+			candidate.trueValues = defaultTrueValues
+			candidate.falseValues = defaultFalseValues
+			candidate.nullValues = []string{""}
+
+			//Codes with leading zeros (zip codes, account numbers) would lose them as numbers
+			if (candidate.datatype == "integer" || candidate.datatype == "decimal") && anyLeadingZeros(nonEmpty) {
+				continue
+			}
+
+			if candidate.parsesAll(nonEmpty) {
+				return candidate
+			}
+		}
+	}
+
+	return columnFormat{datatype: "string", location: time.UTC}
+}
+
+// parsesAll reports whether every value can be converted to the column's datatype
+func (c *columnFormat) parsesAll(values []string) bool {
+	for _, val := range values {
+		if _, err := c.parse(val); err != nil {
+			return false
+		}
+	}
+
+	return true
+}
+
+func anyLeadingZeros(values []string) bool {
+	for _, val := range values {
+		val = strings.TrimLeft(strings.TrimSpace(val), "+-")
+		if len(val) > 1 && val[0] == '0' && val[1] >= '0' && val[1] <= '9' {
+			return true
+		}
+	}
+
+	return false
+}
+
+// configMap returns the column format in the form of a column config, so an inferred schema can be used as the
+// columns of a parser's config
+func (c *columnFormat) configMap() map[string]interface{} {
+	result := map[string]interface{}{"datatype": c.datatype}
+
+	if c.format != "" {
+		result["format"] = c.format
+	}
+	if len(c.nullValues) > 0 {
+		nullValues := make([]interface{}, len(c.nullValues))
+		for i := range c.nullValues {
+			nullValues[i] = c.nullValues[i]
+		}
+		result["nullValues"] = nullValues
+	}
+
+	return result
+}
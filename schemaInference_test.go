@@ -0,0 +1,36 @@
+package builtin
+
+import (
+	"testing"
+)
+
+func TestInferColumnFormat(t *testing.T) {
+	dateFormats := configStrings(defaultInferDateFormats)
+
+	tests := []struct {
+		name       string
+		values     []string
+		wantType   string
+		wantFormat string
+	}{
+		{"integers", []string{"1", "-20", "300"}, "integer", ""},
+		{"decimals", []string{"1", "2.5", "-0.25"}, "decimal", ""},
+		{"empty values are ignored", []string{"1", "", " "}, "integer", ""},
+		{"leading zeros stay strings", []string{"02134", "90210"}, "string", ""},
+		{"booleans", []string{"Y", "N", "y"}, "boolean", ""},
+		{"ISO dates", []string{"2020-01-02", "2021-12-31"}, "date", "2006-01-02"},
+		{"US dates", []string{"01/02/2020", "12/31/2021"}, "date", "01/02/2006"},
+		{"timestamps", []string{"2020-01-02T08:30:00Z"}, "date", "2006-01-02T15:04:05Z07:00"},
+		{"mixed values are strings", []string{"1", "abc"}, "string", ""},
+		{"all empty is a string", []string{"", ""}, "string", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := inferColumnFormat(tt.values, dateFormats)
+			if got.datatype != tt.wantType || got.format != tt.wantFormat {
+				t.Errorf("got %v %q, want %v %q", got.datatype, got.format, tt.wantType, tt.wantFormat)
+			}
+		})
+	}
+}
@@ -0,0 +1,368 @@
+package builtin
+
+import (
+	"bitbucket.org/primelogic_io/bitlantern/service/dataflow"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func init() {
+	//Register function with default builtin.FunctionProvider
+	DefaultInstance().RegisterFunction(
+		Function{
+			FunctionSpec: dataflow.FunctionSpec{
+				Key:           "sortRecords",
+				Name:          "Sort Records",
+				Description:   "Sorts records by one or more fields",
+				Category:      "Data",
+				ExecutionMode: "sync",
+				InputPorts:    dataflowPorts(recordInputPort),
+				OutputPorts:   dataflowPorts(PortSpec{Name: dataflow.DEFAULT_OUTPUT_PORT_NAME, Description: "The input records, sorted", DataType: PortDataTypeRecord}, errorOutputPort),
+			},
+			ConfigSchema: ConfigSchema{
+				Fields: []ConfigField{
+					{Key: "keys", Type: ConfigTypeArray, Required: true, Items: &ConfigField{
+						Type: ConfigTypeObject,
+						Fields: []ConfigField{
+							{Key: "field", Type: ConfigTypeString, Required: true},
+							{Key: "direction", Type: ConfigTypeString, Enum: []interface{}{sortAscending, sortDescending}, Default: sortAscending},
+							{Key: "type", Type: ConfigTypeString, Enum: []interface{}{sortTypeAuto, sortTypeString, sortTypeNumber, sortTypeDate}, Default: sortTypeAuto, Description: "How values are compared. auto compares them as the type they already are"},
+							{Key: "format", Type: ConfigTypeString, Default: "2006-01-02", Description: "Go time layout of string values sorted as dates"},
+							{Key: "ignoreCase", Type: ConfigTypeBoolean, Description: "Compare strings ignoring case"},
+						},
+					}},
+					{Key: "maxRecordsInMemory", Type: ConfigTypeInteger, Default: float64(100000), Description: "Number of records sorted in memory before they're written to a temp file as a sorted run"},
+					{Key: "maxMergeRuns", Type: ConfigTypeInteger, Default: float64(64), Description: "Number of sorted runs open at once while merging. More runs than this are merged in several passes"},
+				},
+			},
+			NewFunction: func() dataflow.Function {
+				return &(sortRecords{})
+			},
+		})
+}
+
+// Sort directions and key types
+const (
+	sortAscending  = "asc"
+	sortDescending = "desc"
+
+	sortTypeAuto   = "auto"
+	sortTypeString = "string"
+	sortTypeNumber = "number"
+	sortTypeDate   = "date"
+)
+
+type sortRecords struct {
+	config sortRecordsConfig
+}
+
+type sortRecordsConfig struct {
+	keys []sortKey
+
+	// maxRecordsInMemory is how many records are sorted in memory before they're spilled as a sorted run
+	maxRecordsInMemory int
+
+	// maxMergeRuns is how many runs are merged at once, which bounds the number of open files
+	maxMergeRuns int
+}
+
+type sortKey struct {
+	field      *fieldPath
+	descending bool
+	keyType    string
+	format     string
+	ignoreCase bool
+}
+
+// sortEntry is a record with the values of its sort keys, converted to the key types. The fields are exported so it
+// can be gob encoded when spilled.
+type sortEntry struct {
+	Keys   []interface{}
+	Record dataflow.Record
+}
+
+// buildConfig builds a sortRecordsConfig from the passed in map. The map must be in the form:
+// {
+//		"keys": [
+//			{ "field": "state" },
+//			{ "field": "opened", "direction": "desc", "type": "date", "format": "01/02/2006" },
+//			{ "field": "accountNumber", "type": "number" }
+//		],
+//		"maxRecordsInMemory": 100000,
+//		"maxMergeRuns": 64
+// }
+//
+// The sort is stable, so records with equal keys stay in input order. Null values sort first in ascending order and
+// last in descending order. With the auto type, values that are already numbers, strings, booleans or dates are
+// compared as such; string, number and date convert the values first, and records whose values can't be converted are
+// sent to the error port.
+func (f *sortRecords) buildConfig(config map[string]interface{}) (sortRecordsConfig, error) {
+	c := sortRecordsConfig{}
+
+	keys := config["keys"].([]interface{})
+	if len(keys) == 0 {
+		return c, fmt.Errorf("at least one sort key is required")
+	}
+	c.keys = make([]sortKey, len(keys))
+
+	for i := 0; i < len(keys); i++ {
+		curKeyMap := keys[i].(map[string]interface{})
+		newKey := sortKey{}
+
+		var err error
+		newKey.field, err = parseFieldPath(curKeyMap["field"].(string))
+		if err != nil {
+			return c, fmt.Errorf("keys[%d].field: %w", i, err)
+		}
+		newKey.descending = curKeyMap["direction"].(string) == sortDescending
+		newKey.keyType = curKeyMap["type"].(string)
+		newKey.format = curKeyMap["format"].(string)
+		newKey.ignoreCase, _ = curKeyMap["ignoreCase"].(bool)
+
+		c.keys[i] = newKey
+	}
+
+	c.maxRecordsInMemory = int(config["maxRecordsInMemory"].(float64))
+	if c.maxRecordsInMemory < 1 {
+		return c, fmt.Errorf("maxRecordsInMemory must be at least 1")
+	}
+
+	c.maxMergeRuns = int(config["maxMergeRuns"].(float64))
+	if c.maxMergeRuns < 2 {
+		return c, fmt.Errorf("maxMergeRuns must be at least 2")
+	}
+
+	return c, nil
+}
+
+func (f *sortRecords) Execute(in dataflow.InputReader, out dataflow.OutputWriter, config map[string]interface{}) error {
+	defer out.Close()
+
+	//Parse/read config options
+	config, err := prepareConfig("sortRecords", config)
+	if err != nil {
+		return err
+	}
+
+	f.config, err = f.buildConfig(config)
+	if err != nil {
+		return newFunctionError("sortRecords", "building config", err)
+	}
+
+	//Open the data stream
+	reader := in.PortReader(dataflow.DEFAULT_INPUT_PORT_NAME)
+	err = reader.Open()
+	if err != nil {
+		return newFunctionError("sortRecords", "opening input", err)
+	}
+
+	var entries []sortEntry
+	var runs []*spillRun
+	defer func() {
+		removeSpillRuns(runs)
+	}()
+
+	//Loop through all data, writing a sorted run whenever there are too many records to keep in memory
+	for reader.HasNext() {
+		rec, err := reader.Next()
+		if err != nil {
+			return newFunctionError("sortRecords", "reading input", err)
+		}
+
+		recVal, err := rec.GetAsRecord()
+		if err != nil {
+			writeRecordError(out, &(RecordError{FunctionKey: "sortRecords", Err: err}))
+			continue
+		}
+
+		entry, err := f.newEntry(recVal)
+		if err != nil {
+			writeRecordError(out, &(RecordError{FunctionKey: "sortRecords", Record: recVal, Err: err}))
+			continue
+		}
+		entries = append(entries, entry)
+
+		if len(entries) >= f.config.maxRecordsInMemory {
+			run, err := f.spill(entries)
+			if err != nil {
+				return newFunctionError("sortRecords", "writing sorted run", err)
+			}
+			runs = append(runs, run)
+			entries = nil
+		}
+	}
+
+	if len(runs) == 0 {
+		f.sortEntries(entries)
+		for i := range entries {
+			out.WriteRecord(dataflow.DEFAULT_OUTPUT_PORT_NAME, &(entries[i].Record))
+		}
+		return nil
+	}
+
+	if len(entries) > 0 {
+		run, err := f.spill(entries)
+		if err != nil {
+			return newFunctionError("sortRecords", "writing sorted run", err)
+		}
+		runs = append(runs, run)
+	}
+
+	//Merge groups of runs into longer runs until they can all be merged at once
+	for len(runs) > f.config.maxMergeRuns {
+		runs, err = mergeSpillPass("sortRecords", runs, f.config.maxMergeRuns, f.mergeRuns)
+		if err != nil {
+			return newFunctionError("sortRecords", "merging sorted runs", err)
+		}
+	}
+
+	err = f.mergeRuns(runs, func(val interface{}) error {
+		out.WriteRecord(dataflow.DEFAULT_OUTPUT_PORT_NAME, &(val.(*sortEntry).Record))
+		return nil
+	})
+	if err != nil {
+		return newFunctionError("sortRecords", "merging sorted runs", err)
+	}
+
+	return nil
+}
+
+// newEntry gets the sort key values of the record, converted to the key types
+func (f *sortRecords) newEntry(recVal dataflow.Record) (sortEntry, error) {
+	entry := sortEntry{Keys: make([]interface{}, len(f.config.keys)), Record: recVal}
+
+	for i := range f.config.keys {
+		key := &(f.config.keys[i])
+		val, _ := key.field.get(recVal)
+
+		var err error
+		entry.Keys[i], err = key.convert(val)
+		if err != nil {
+			return entry, fmt.Errorf("keys[%d]: %v: %w", i, key.field, err)
+		}
+	}
+
+	return entry, nil
+}
+
+// convert converts a value to the key's type. Nulls stay null.
+func (k *sortKey) convert(val interface{}) (interface{}, error) {
+	if val == nil {
+		return nil, nil
+	}
+
+	switch k.keyType {
+	case sortTypeString:
+		str, ok := val.(string)
+		if !ok {
+			str = fmt.Sprintf("%v", val)
+		}
+		if k.ignoreCase {
+			str = strings.ToLower(str)
+		}
+		return str, nil
+	case sortTypeNumber:
+		//Integers stay int64 so large ones (e.g. account numbers) keep their order; see compareRecordValues
+		if num, ok := valueAsInt64(val); ok {
+			return num, nil
+		}
+		if num, ok := configValueAsFloat(val); ok {
+			return num, nil
+		}
+		str, ok := val.(string)
+		if !ok {
+			return nil, fmt.Errorf("%T %v is not a number", val, val)
+		}
+		if num, err := strconv.ParseInt(strings.TrimSpace(str), 10, 64); err == nil {
+			return num, nil
+		}
+		num, err := strconv.ParseFloat(strings.TrimSpace(str), 64)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a number", str)
+		}
+		return num, nil
+	case sortTypeDate:
+		switch v := val.(type) {
+		case time.Time:
+			return v, nil
+		case string:
+			t, err := time.Parse(k.format, strings.TrimSpace(v))
+			if err != nil {
+				return nil, err
+			}
+			return t, nil
+		}
+		return nil, fmt.Errorf("%T %v is not a date", val, val)
+	}
+
+	if str, ok := val.(string); ok && k.ignoreCase {
+		return strings.ToLower(str), nil
+	}
+	return val, nil
+}
+
+// compareEntries orders two entries by their keys, in the key directions
+func (f *sortRecords) compareEntries(a *sortEntry, b *sortEntry) int {
+	for i := range f.config.keys {
+		cmp, err := compareRecordValues(a.Keys[i], b.Keys[i])
+		if err != nil {
+			//Values of different kinds (only possible with the auto type) are ordered by kind, so the order is stable
+			cmp = strings.Compare(fmt.Sprintf("%T", a.Keys[i]), fmt.Sprintf("%T", b.Keys[i]))
+		}
+
+		if f.config.keys[i].descending {
+			cmp = -cmp
+		}
+		if cmp != 0 {
+			return cmp
+		}
+	}
+
+	return 0
+}
+
+func (f *sortRecords) sortEntries(entries []sortEntry) {
+	sort.SliceStable(entries, func(i, j int) bool {
+		return f.compareEntries(&(entries[i]), &(entries[j])) < 0
+	})
+}
+
+// spill sorts the entries and writes them to a new run
+func (f *sortRecords) spill(entries []sortEntry) (*spillRun, error) {
+	f.sortEntries(entries)
+
+	run, err := newSpillRun("sortRecords")
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range entries {
+		entry := sortEntry{Keys: spillValue(entries[i].Keys).([]interface{}), Record: spillValue(entries[i].Record).(dataflow.Record)}
+		err = run.write(&entry)
+		if err != nil {
+			run.remove()
+			return nil, err
+		}
+	}
+
+	err = run.close()
+	if err != nil {
+		run.remove()
+		return nil, err
+	}
+
+	return run, nil
+}
+
+// mergeRuns reads the sorted runs together, passing the *sortEntry values to fn in order. Equal entries are taken from
+// the earliest run first, which keeps the sort stable.
+func (f *sortRecords) mergeRuns(runs []*spillRun, fn func(interface{}) error) error {
+	return mergeSpillRuns(runs, func() interface{} {
+		return &(sortEntry{})
+	}, func(a interface{}, b interface{}) int {
+		return f.compareEntries(a.(*sortEntry), b.(*sortEntry))
+	}, fn)
+}
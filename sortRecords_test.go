@@ -0,0 +1,168 @@
+package builtin
+
+import (
+	"bitbucket.org/primelogic_io/bitlantern/service/dataflow"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func sortRecordsTestConfig() map[string]interface{} {
+	return map[string]interface{}{
+		"keys": []interface{}{
+			map[string]interface{}{"field": "state", "ignoreCase": true},
+			map[string]interface{}{"field": "opened", "direction": "desc"},
+			map[string]interface{}{"field": "account.number", "type": "number"},
+		},
+	}
+}
+
+func sortRecordsTestRecords() []dataflow.Record {
+	day := func(d int) time.Time { return time.Date(2020, 1, d, 0, 0, 0, 0, time.UTC) }
+	account := func(number string) map[string]interface{} { return map[string]interface{}{"number": number} }
+
+	return []dataflow.Record{
+		{"id": int64(1), "state": "TX", "opened": day(1), "account": account("10")},
+		{"id": int64(2), "state": "ca", "opened": day(1), "account": account("9")},
+		{"id": int64(3), "state": "CA", "opened": day(3), "account": account("100")},
+		{"id": int64(4), "state": "tx", "opened": day(1), "account": account("2")},
+		{"id": int64(5), "state": "CA", "opened": day(1), "account": account("9")},
+		{"id": int64(6), "state": nil, "opened": day(2), "account": account("1")},
+	}
+}
+
+func sortRecordsIDs(recs []dataflow.Record) []int64 {
+	ids := make([]int64, len(recs))
+	for i := range recs {
+		ids[i] = recs[i]["id"].(int64)
+	}
+	return ids
+}
+
+func TestSortRecords(t *testing.T) {
+	//Null first, then states ignoring case, newest first, then account numbers as numbers. 2 and 5 are equal so
+	//keep their input order.
+	want := []int64{6, 3, 2, 5, 4, 1}
+
+	for _, maxRecords := range []float64{100000, 1, 2} {
+		config := sortRecordsTestConfig()
+		config["maxRecordsInMemory"] = maxRecords
+		if maxRecords == 1 {
+			//6 runs, merged 2 at a time in 2 passes before the final merge
+			config["maxMergeRuns"] = 2.0
+		}
+
+		out, err := runFunction(t, "sortRecords", config, recordInput(sortRecordsTestRecords()...))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got := out.Records(dataflow.DEFAULT_OUTPUT_PORT_NAME)
+		if ids := sortRecordsIDs(got); !reflect.DeepEqual(ids, want) {
+			t.Errorf("maxRecordsInMemory %v: got %v, want %v", maxRecords, ids, want)
+		}
+		if len(got) > 0 && !reflect.DeepEqual(got[0], sortRecordsTestRecords()[5]) {
+			t.Errorf("maxRecordsInMemory %v: got %v, want %v", maxRecords, got[0], sortRecordsTestRecords()[5])
+		}
+	}
+}
+
+func TestSortRecordsDateStrings(t *testing.T) {
+	config := map[string]interface{}{
+		"keys": []interface{}{
+			map[string]interface{}{"field": "opened", "type": "date", "format": "01/02/2006", "direction": "desc"},
+		},
+		"maxRecordsInMemory": 2.0,
+	}
+
+	bad := dataflow.Record{"id": int64(3), "opened": "2020-01-01"}
+	out, err := runFunction(t, "sortRecords", config, recordInput(
+		dataflow.Record{"id": int64(1), "opened": "01/02/2020"},
+		dataflow.Record{"id": int64(2), "opened": "12/31/2019"},
+		bad,
+		dataflow.Record{"id": int64(4), "opened": "02/01/2020"},
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ids, want := sortRecordsIDs(out.Records(dataflow.DEFAULT_OUTPUT_PORT_NAME)), []int64{4, 1, 2}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("got %v, want %v", ids, want)
+	}
+	assertErrorRecords(t, out, []dataflow.Record{{
+		"functionKey": "sortRecords",
+		"record":      bad,
+	}})
+}
+
+func TestSortRecordsInvalidConfig(t *testing.T) {
+	configs := []map[string]interface{}{
+		{"keys": []interface{}{}},
+		{"keys": []interface{}{map[string]interface{}{"field": "a", "direction": "up"}}},
+		{"keys": []interface{}{map[string]interface{}{"field": "a["}}},
+		{"keys": []interface{}{map[string]interface{}{"field": "a"}}, "maxRecordsInMemory": 0.0},
+		{"keys": []interface{}{map[string]interface{}{"field": "a"}}, "maxMergeRuns": 1.0},
+	}
+
+	for i, config := range configs {
+		if _, err := runFunction(t, "sortRecords", config, recordInput()); err == nil {
+			t.Errorf("config %d: expected an error", i)
+		}
+	}
+}
+
+func TestSortRecordsLargeIntegerKeys(t *testing.T) {
+	//These differ past a float64's precision, so they'd keep their input order if sorted as floats
+	config := map[string]interface{}{
+		"keys":               []interface{}{map[string]interface{}{"field": "accountNumber", "type": "number", "direction": "desc"}},
+		"maxRecordsInMemory": 1.0,
+	}
+
+	out, err := runFunction(t, "sortRecords", config, recordInput(
+		dataflow.Record{"id": int64(1), "accountNumber": int64(1 << 53)},
+		dataflow.Record{"id": int64(2), "accountNumber": "9007199254740993"},
+		dataflow.Record{"id": int64(3), "accountNumber": int64(1<<53 + 2)},
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ids, want := sortRecordsIDs(out.Records(dataflow.DEFAULT_OUTPUT_PORT_NAME)), []int64{3, 2, 1}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("got %v, want %v", ids, want)
+	}
+}
+
+func TestSortRecordsSpillsTransformDataOutput(t *testing.T) {
+	//transformData exports arrays of objects as []map[string]interface{}, which has to be spilled too
+	transformConfig := map[string]interface{}{
+		"rules": []interface{}{transformRuleMap("items", "[{a: data.id}, {a: data.id * 10}]")},
+	}
+	transformed, err := runFunction(t, "transformData", transformConfig, recordInput(
+		dataflow.Record{"id": int64(2)},
+		dataflow.Record{"id": int64(1)},
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := map[string]interface{}{
+		"keys":               []interface{}{map[string]interface{}{"field": "id"}},
+		"maxRecordsInMemory": 1.0,
+	}
+	out, err := runFunction(t, "sortRecords", config, recordInput(transformed.Records(dataflow.DEFAULT_OUTPUT_PORT_NAME)...))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := out.Records(dataflow.DEFAULT_OUTPUT_PORT_NAME)
+	if ids, want := sortRecordsIDs(got), []int64{1, 2}; !reflect.DeepEqual(ids, want) {
+		t.Fatalf("got %v, want %v", ids, want)
+	}
+	items, ok := got[0]["items"].([]interface{})
+	if !ok || len(items) != 2 {
+		t.Fatalf("got items %#v, want a list of 2 objects", got[0]["items"])
+	}
+	if a, _ := configValueAsFloat(items[1].(map[string]interface{})["a"]); a != 10 {
+		t.Errorf("got items %v, want a = 10 in the second", items)
+	}
+}
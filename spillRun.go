@@ -0,0 +1,278 @@
+package builtin
+
+import (
+	"bitbucket.org/primelogic_io/bitlantern/service/dataflow"
+	"bufio"
+	"container/heap"
+	"encoding/gob"
+	"io"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"time"
+)
+
+func init() {
+	//Record values are stored in interface{} fields when spilled, so gob needs to know the non-basic types they can have
+	gob.Register(time.Time{})
+	gob.Register(map[string]interface{}{})
+	gob.Register([]interface{}{})
+	gob.Register(dataflow.Record{})
+}
+
+// spillRun is a temp file that values are written to in order, then read back in the same order. It's how builtins
+// that need all of their input before writing anything (aggregate, sortRecords) handle more input than fits in memory.
+//
+// The file is only open while it's being written or read, so there can be more runs than the process can have open
+// files.
+type spillRun struct {
+	name   string
+	file   *os.File
+	writer *bufio.Writer
+	enc    *gob.Encoder
+	dec    *gob.Decoder
+}
+
+func newSpillRun(prefix string) (*spillRun, error) {
+	file, err := ioutil.TempFile("", prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &(spillRun{name: file.Name(), file: file, writer: bufio.NewWriter(file)})
+	r.enc = gob.NewEncoder(r.writer)
+
+	return r, nil
+}
+
+// write appends v, which must be a pointer to a gob encodable value, to the run
+func (r *spillRun) write(v interface{}) error {
+	return r.enc.Encode(v)
+}
+
+// close finishes writing, or reading, and closes the file. rewind opens it again.
+func (r *spillRun) close() error {
+	if r.file == nil {
+		return nil
+	}
+
+	err := r.writer.Flush()
+	closeErr := r.file.Close()
+	r.file = nil
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
+
+// rewind finishes writing and opens the run from the start, so it can be read
+func (r *spillRun) rewind() error {
+	err := r.close()
+	if err != nil {
+		return err
+	}
+
+	r.file, err = os.Open(r.name)
+	if err != nil {
+		return err
+	}
+
+	r.dec = gob.NewDecoder(bufio.NewReader(r.file))
+	return nil
+}
+
+// read decodes the next value into v. It returns io.EOF after the last value.
+func (r *spillRun) read(v interface{}) error {
+	return r.dec.Decode(v)
+}
+
+// remove closes and deletes the temp file
+func (r *spillRun) remove() {
+	if r.file != nil {
+		r.file.Close()
+		r.file = nil
+	}
+	os.Remove(r.name)
+}
+
+// removeSpillRuns removes every run in runs
+func removeSpillRuns(runs []*spillRun) {
+	for _, run := range runs {
+		run.remove()
+	}
+}
+
+// mergeSpillPass merges each maxMergeRuns runs into one new run with merge, and returns the new runs. Consecutive runs
+// are merged, so the new runs are still in input order. The merged runs are removed, and on error so are the new ones.
+func mergeSpillPass(prefix string, runs []*spillRun, maxMergeRuns int, merge func(runs []*spillRun, fn func(interface{}) error) error) ([]*spillRun, error) {
+	var merged []*spillRun
+	for start := 0; start < len(runs); start += maxMergeRuns {
+		end := start + maxMergeRuns
+		if end > len(runs) {
+			end = len(runs)
+		}
+		if end-start == 1 {
+			merged = append(merged, runs[start])
+			continue
+		}
+
+		run, err := newSpillRun(prefix)
+		if err == nil {
+			err = merge(runs[start:end], run.write)
+			if err == nil {
+				err = run.close()
+			}
+			merged = append(merged, run)
+		}
+		removeSpillRuns(runs[start:end])
+
+		if err != nil {
+			removeSpillRuns(runs[end:])
+			removeSpillRuns(merged)
+			return nil, err
+		}
+	}
+
+	return merged, nil
+}
+
+// mergeSpillRuns reads the runs together, passing their values to fn in the order of compare. newValue returns a
+// pointer to read the next value of a run into. Equal values are taken from the earliest run first, so runs written in
+// input order are merged stably.
+func mergeSpillRuns(runs []*spillRun, newValue func() interface{}, compare func(a interface{}, b interface{}) int, fn func(interface{}) error) error {
+	heads := &(spillRunHeads{newValue: newValue, compare: compare})
+	for i, run := range runs {
+		err := run.rewind()
+		if err != nil {
+			return err
+		}
+
+		err = heads.pushNext(run, i)
+		if err != nil {
+			return err
+		}
+	}
+
+	for heads.Len() > 0 {
+		next := heap.Pop(heads).(*spillRunHead)
+		err := fn(next.value)
+		if err != nil {
+			return err
+		}
+
+		err = heads.pushNext(next.run, next.runIndex)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// spillRunHead is the next value of a run
+type spillRunHead struct {
+	value    interface{}
+	run      *spillRun
+	runIndex int
+}
+
+// spillRunHeads is a heap of the next value of each run, ordered by compare and then run
+type spillRunHeads struct {
+	heads    []*spillRunHead
+	newValue func() interface{}
+	compare  func(a interface{}, b interface{}) int
+}
+
+func (h *spillRunHeads) Len() int {
+	return len(h.heads)
+}
+
+func (h *spillRunHeads) Less(i, j int) bool {
+	cmp := h.compare(h.heads[i].value, h.heads[j].value)
+	if cmp != 0 {
+		return cmp < 0
+	}
+	return h.heads[i].runIndex < h.heads[j].runIndex
+}
+
+func (h *spillRunHeads) Swap(i, j int) {
+	h.heads[i], h.heads[j] = h.heads[j], h.heads[i]
+}
+
+func (h *spillRunHeads) Push(x interface{}) {
+	h.heads = append(h.heads, x.(*spillRunHead))
+}
+
+func (h *spillRunHeads) Pop() interface{} {
+	head := h.heads[len(h.heads)-1]
+	h.heads = h.heads[:len(h.heads)-1]
+	return head
+}
+
+// pushNext reads the next value from the run onto the heap, if the run has any left. The run is closed once it's
+// all been read.
+func (h *spillRunHeads) pushNext(run *spillRun, runIndex int) error {
+	value := h.newValue()
+	err := run.read(value)
+	if err == io.EOF {
+		return run.close()
+	} else if err != nil {
+		return err
+	}
+
+	heap.Push(h, &(spillRunHead{value: value, run: run, runIndex: runIndex}))
+	return nil
+}
+
+// spillValue returns val with the maps and lists inside it converted to map[string]interface{} and []interface{}, so it
+// can be gob encoded. Record values can be maps and slices of any type (e.g. otto exports an array of objects as
+// []map[string]interface{}), and gob can only encode the types registered above.
+func spillValue(val interface{}) interface{} {
+	switch v := val.(type) {
+	case nil, string, bool, int, int64, float64, time.Time:
+		return val
+	case dataflow.Record:
+		return dataflow.Record(spillMap(v))
+	case map[string]interface{}:
+		return spillMap(v)
+	}
+
+	rv := reflect.ValueOf(val)
+	switch rv.Kind() {
+	case reflect.Map:
+		if rv.Type().Key().Kind() != reflect.String {
+			return val
+		}
+		m := make(map[string]interface{}, rv.Len())
+		iter := rv.MapRange()
+		for iter.Next() {
+			m[iter.Key().String()] = spillValue(iter.Value().Interface())
+		}
+		return m
+	case reflect.Slice, reflect.Array:
+		if rv.Type().Elem().Kind() == reflect.Uint8 {
+			return val
+		}
+		list := make([]interface{}, rv.Len())
+		for i := range list {
+			list[i] = spillValue(rv.Index(i).Interface())
+		}
+		return list
+	case reflect.Ptr:
+		if rv.IsNil() {
+			return nil
+		}
+		return spillValue(rv.Elem().Interface())
+	}
+
+	return val
+}
+
+// spillMap returns a copy of m with its values converted by spillValue
+func spillMap(m map[string]interface{}) map[string]interface{} {
+	result := make(map[string]interface{}, len(m))
+	for key, val := range m {
+		result[key] = spillValue(val)
+	}
+	return result
+}
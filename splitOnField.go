@@ -2,9 +2,13 @@ package builtin
 
 import (
 	"bitbucket.org/primelogic_io/bitlantern/service/dataflow"
+	"errors"
 	"fmt"
+	"math"
 	"regexp"
 	"strconv"
+	"strings"
+	"time"
 )
 
 func init() {
@@ -14,11 +18,28 @@ func init() {
 			FunctionSpec: dataflow.FunctionSpec{
 				Key:           "splitOnField",
 				Name:          "Split Data by Field",
-				Description:   "Splits the input data",
+				Description:   "Splits the input data by comparing record fields. By default a record goes to the output port of the last rule that matches (matchMode last)",
 				Category:      "Data",
 				ExecutionMode: "sync",
-				InputPorts:    nil,
-				OutputPorts:   nil,
+				InputPorts:    dataflowPorts(recordInputPort),
+				OutputPorts:   dataflowPorts(errorOutputPort),
+			},
+			ConfigSchema: ConfigSchema{
+				Fields: []ConfigField{
+					{Key: "defaultOutputPort", Type: ConfigTypeString, Required: true, Description: "Output port for records that don't match any rule"},
+					{Key: "rules", Type: ConfigTypeArray, Required: true, Items: &ConfigField{
+						Type: ConfigTypeObject,
+						Fields: append(append([]ConfigField{}, splitConditionConfigFields...),
+							ConfigField{Key: "outputPort", Type: ConfigTypeString, Required: true},
+						),
+					}},
+					matchModeConfigField(matchModeLast),
+					{Key: "timeFormat", Type: ConfigTypeString, Default: "2006-01-02", Description: "Go time layout of the date/time literals compared against date/time fields"},
+					{Key: "missingFields", Type: ConfigTypeString, Enum: []interface{}{missingFieldsFalse, missingFieldsDefault}, Default: missingFieldsFalse, Description: "Whether a comparison with a missing or null field is false, or sends the record to the default output port"},
+				},
+			},
+			ResolveOutputPorts: func(config map[string]interface{}) ([]PortSpec, error) {
+				return (&(splitOnField{})).outputPorts(config)
 			},
 			NewFunction: func() dataflow.Function {
 				return &(splitOnField{})
@@ -30,24 +51,96 @@ type splitOnField struct {
 }
 
 type splitConfig struct {
-	// splits contains the rules for data splitting. The first rule that matches the data will be used.
+	// rules are the field comparisons checked against each record. matchMode decides which of the matching rules'
+	// output ports the record is sent to.
 	rules []splitRule
 
 	// defaultOutputPort specifies the output port into which to send data that doesn't match any other split rule
 	defaultOutputPort string
+
+	// matchMode is one of matchModeFirst, matchModeLast or matchModeAll
+	matchMode string
+
+	// timeFormat is the layout of date/time literals, e.g. "2006-01-02"
+	timeFormat string
+
+	// missingFields is missingFieldsFalse or missingFieldsDefault
+	missingFields string
+
+	// now is the time relative date/time literals (e.g. "now-30d") are relative to. It's fixed for the run, so every
+	// record is routed against the same cut off.
+	now time.Time
 }
 
+// Values of the missingFields option: comparisons with a missing or null field are false, or route to the default port
+const (
+	missingFieldsFalse   = "false"
+	missingFieldsDefault = "default"
+)
+
+// errSplitMissingField is returned when a comparison's field is missing or null and missingFields is default
+var errSplitMissingField = errors.New("missing field")
+
 type splitRule struct {
-	field      string
-	op         string
-	value      interface{}
-	valueType  string
+	condition  splitCondition
 	outputPort string
 }
 
+// splitCondition is either a single comparison (field op value) or a group of conditions combined with all, any or
+// not. Groups can be nested to any depth.
+type splitCondition struct {
+	field     *fieldPath
+	op        string
+	value     interface{}
+	valueType string
+
+	// valueField is the path of the field holding the value, when valueType is field
+	valueField *fieldPath
+
+	// ignoreCase compares strings in lower case
+	ignoreCase bool
+
+	// regex is the compiled pattern of a regex comparison against a literal
+	regex *regexp.Regexp
+
+	// all matches when every one of its conditions does
+	all []splitCondition
+
+	// any matches when at least one of its conditions does
+	any []splitCondition
+
+	// not matches when its condition doesn't
+	not *splitCondition
+}
+
+// splitOps are the comparison operators of a splitCondition. in and notIn take a list of values, and between a list of
+// the low and high bounds (inclusive). contains, startsWith, endsWith and regex only apply to strings.
+var splitOps = []interface{}{
+	"<", "<=", "==", "!=", ">", ">=", "regex",
+	"in", "notIn", "contains", "startsWith", "endsWith", "between",
+	"isNull", "isNotNull", "isEmpty",
+}
+
+// splitNullOps are the ops that only look at the field, so they take no value. A field is empty when it's null or "".
+var splitNullOps = []interface{}{"isNull", "isNotNull", "isEmpty"}
+
+// splitConditionConfigFields are the keys of a condition: either field, op, value and valueType for a comparison, or
+// one of all, any and not for a group. The schema can't describe the nesting, so buildSplitCondition checks it.
+var splitConditionConfigFields = []ConfigField{
+	{Key: "field", Type: ConfigTypeString, Description: "Field to compare. Nested fields can be referenced by path, e.g. customer.address.zip or items[0].sku"},
+	{Key: "op", Type: ConfigTypeString, Enum: splitOps},
+	{Key: "value", Type: ConfigTypeAny},
+	{Key: "valueType", Type: ConfigTypeString, Enum: []interface{}{"literal", "field"}},
+	{Key: "ignoreCase", Type: ConfigTypeBoolean, Description: "Compare strings ignoring case"},
+	{Key: "all", Type: ConfigTypeArray, Items: &ConfigField{Type: ConfigTypeObject}, Description: "Conditions that must all match"},
+	{Key: "any", Type: ConfigTypeArray, Items: &ConfigField{Type: ConfigTypeObject}, Description: "Conditions of which at least one must match"},
+	{Key: "not", Type: ConfigTypeObject, Description: "Condition that must not match"},
+}
+
 // buildConfig builds a splitConfig from the passed in map. The map must be in the form:
 // {
 //		"defaultOutputPort": "not poor",
+//		"matchMode": "first",
 //		"rules": [
 //			{
 //				"field":"balance".
@@ -61,10 +154,36 @@ type splitRule struct {
 //
 // rules.value can either be a value literal (ex: 100.00, "M", etc.) or a reference to another field in the record.
 // rules.valueType accepts the values: "literal", "field"
+//
+// matchMode defaults to last, so the last matching rule wins, as it did before match modes were added.
+//
+// Instead of a single comparison a rule can have a group of conditions, each of which is a comparison or another group:
+//
+//	{
+//		"outputPort": "big texans",
+//		"all": [
+//			{"field": "state", "op": "==", "value": "TX", "valueType": "literal"},
+//			{"any": [
+//				{"field": "balance", "op": ">", "value": 1000, "valueType": "literal"},
+//				{"not": {"field": "status", "op": "==", "value": "active", "valueType": "literal"}}
+//			]}
+//		]
+//	}
+//
+// Date/time fields (time.Time) are compared against literals in the timeFormat layout, or relative to the time of the
+// run: "now", "today" (midnight), or either with offsets in s, m, h, d, w, M (months) or y, e.g. "now-30d" or
+// "today+1M-1d". Boolean fields are compared with == and != against true/false or "true"/"false".
 func (f *splitOnField) buildConfig(config map[string]interface{}) (splitConfig, error) {
 	c := splitConfig{}
 
 	c.defaultOutputPort = config["defaultOutputPort"].(string)
+	if err := checkRoutedPortName(c.defaultOutputPort); err != nil {
+		return c, fmt.Errorf("defaultOutputPort: %w", err)
+	}
+	c.matchMode, _ = config["matchMode"].(string)
+	c.timeFormat, _ = config["timeFormat"].(string)
+	c.missingFields, _ = config["missingFields"].(string)
+	c.now = time.Now()
 	rules := config["rules"].([]interface{})
 	c.rules = make([]splitRule, len(rules))
 
@@ -73,10 +192,14 @@ func (f *splitOnField) buildConfig(config map[string]interface{}) (splitConfig,
 		newRule := splitRule{}
 
 		newRule.outputPort = curRuleMap["outputPort"].(string)
-		newRule.field = curRuleMap["field"].(string)
-		newRule.op = curRuleMap["op"].(string)
-		newRule.value = curRuleMap["value"]
-		newRule.valueType = curRuleMap["valueType"].(string)
+		if err := checkRoutedPortName(newRule.outputPort); err != nil {
+			return c, fmt.Errorf("rules[%d].outputPort: %w", i, err)
+		}
+		condition, err := buildSplitCondition(fmt.Sprintf("rules[%d]", i), curRuleMap)
+		if err != nil {
+			return c, err
+		}
+		newRule.condition = condition
 
 		c.rules[i] = newRule
 	}
@@ -84,41 +207,351 @@ func (f *splitOnField) buildConfig(config map[string]interface{}) (splitConfig,
 	return c, nil
 }
 
-func (f *splitOnField) matches(record *dataflow.Record, rule *splitRule) bool {
-	leftValue, _ := record.Get(rule.field)
+// buildSplitCondition builds the condition in condMap, and the conditions nested in it. path is where condMap is in
+// the config, for error messages.
+func buildSplitCondition(path string, condMap map[string]interface{}) (splitCondition, error) {
+	c := splitCondition{}
+
+	var kinds []string
+	for _, key := range []string{"field", "all", "any", "not"} {
+		if condMap[key] != nil {
+			kinds = append(kinds, key)
+		}
+	}
+	if len(kinds) != 1 {
+		return c, fmt.Errorf("%v: must have exactly one of field, all, any or not, got %v", path, kinds)
+	}
+
+	switch kinds[0] {
+	case "field":
+		field, fieldOk := condMap["field"].(string)
+		op, opOk := condMap["op"].(string)
+		if !fieldOk || !opOk {
+			return c, fmt.Errorf("%v: field and op are required for a comparison", path)
+		}
+		if !configEnumContains(splitOps, op) {
+			return c, fmt.Errorf("%v.op: must be one of %v, got %v", path, splitOps, op)
+		}
+		if condMap["value"] == nil && !configEnumContains(splitNullOps, op) {
+			return c, fmt.Errorf("%v: value is required for op %v", path, op)
+		}
+
+		var err error
+		c.field, err = parseFieldPath(field)
+		if err != nil {
+			return c, fmt.Errorf("%v.field: %w", path, err)
+		}
+		c.op = op
+		c.value = condMap["value"]
+		c.ignoreCase, _ = condMap["ignoreCase"].(bool)
+		c.valueType, _ = condMap["valueType"].(string)
+		if c.valueType == "" {
+			c.valueType = "literal"
+		}
+		if c.valueType != "literal" && c.valueType != "field" {
+			return c, fmt.Errorf("%v.valueType: must be literal or field, got %v", path, c.valueType)
+		}
+
+		if c.valueType == "literal" {
+			err := c.prepareLiteral()
+			if err != nil {
+				return c, fmt.Errorf("%v.value: %w", path, err)
+			}
+		} else if !configEnumContains(splitNullOps, op) {
+			//If not a literal, then the "value" is pointing to a field
+			fieldName, ok := c.value.(string)
+			if !ok {
+				return c, fmt.Errorf("%v.value: must be a field name when valueType is \"field\", got %v", path, c.value)
+			}
+			c.valueField, err = parseFieldPath(fieldName)
+			if err != nil {
+				return c, fmt.Errorf("%v.value: %w", path, err)
+			}
+		}
+	case "all", "any":
+		condList, ok := condMap[kinds[0]].([]interface{})
+		if !ok || len(condList) == 0 {
+			return c, fmt.Errorf("%v.%v: must be a non-empty list of conditions", path, kinds[0])
+		}
+
+		group := make([]splitCondition, len(condList))
+		for i := range condList {
+			itemPath := fmt.Sprintf("%v.%v[%d]", path, kinds[0], i)
+			itemMap, ok := condList[i].(map[string]interface{})
+			if !ok {
+				return c, fmt.Errorf("%v: must be a condition object", itemPath)
+			}
+
+			var err error
+			group[i], err = buildSplitCondition(itemPath, itemMap)
+			if err != nil {
+				return c, err
+			}
+		}
+
+		if kinds[0] == "all" {
+			c.all = group
+		} else {
+			c.any = group
+		}
+	case "not":
+		notMap, ok := condMap["not"].(map[string]interface{})
+		if !ok {
+			return c, fmt.Errorf("%v.not: must be a condition object", path)
+		}
+
+		notCondition, err := buildSplitCondition(path+".not", notMap)
+		if err != nil {
+			return c, err
+		}
+		c.not = &notCondition
+	}
+
+	return c, nil
+}
+
+// prepareLiteral checks the literal value suits the op, and compiles regex patterns so it's only done once per run
+func (c *splitCondition) prepareLiteral() error {
+	switch c.op {
+	case "in", "notIn":
+		list, ok := c.value.([]interface{})
+		if !ok {
+			return fmt.Errorf("must be a list for op %v", c.op)
+		}
+		return checkSplitNumericList(list)
+	case "between":
+		bounds, ok := c.value.([]interface{})
+		if !ok || len(bounds) != 2 {
+			return fmt.Errorf("must be a list of the low and high bounds for op between")
+		}
+		return checkSplitNumericList(bounds)
+	case "regex":
+		pattern, ok := c.value.(string)
+		if !ok {
+			return fmt.Errorf("must be a string pattern for op regex")
+		}
+
+		var err error
+		c.regex, err = compileSplitRegex(pattern, c.ignoreCase)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// checkSplitNumericList rejects a list of literals that has numbers in it along with strings that aren't numbers (e.g.
+// [0, "N/A"]), since those strings can't be compared with a number field
+func checkSplitNumericList(list []interface{}) error {
+	numeric := false
+	for i := range list {
+		if _, ok := configValueAsFloat(list[i]); ok {
+			numeric = true
+		}
+	}
+	if !numeric {
+		return nil
+	}
+
+	for i := range list {
+		if str, ok := list[i].(string); ok {
+			if _, err := strconv.ParseFloat(str, 64); err != nil {
+				return fmt.Errorf("[%d]: %q is not a number like the other values", i, str)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (f *splitOnField) matches(record *dataflow.Record, rule *splitRule, opts *splitConfig) (bool, error) {
+	return f.conditionMatches(record, &(rule.condition), opts)
+}
+
+// conditionMatches evaluates a condition against the record. Groups stop evaluating as soon as their result is known.
+func (f *splitOnField) conditionMatches(record *dataflow.Record, cond *splitCondition, opts *splitConfig) (bool, error) {
+	switch {
+	case cond.all != nil:
+		for i := range cond.all {
+			matches, err := f.conditionMatches(record, &(cond.all[i]), opts)
+			if err != nil {
+				return false, fmt.Errorf("all[%d]: %w", i, err)
+			}
+			if !matches {
+				return false, nil
+			}
+		}
+		return true, nil
+	case cond.any != nil:
+		for i := range cond.any {
+			matches, err := f.conditionMatches(record, &(cond.any[i]), opts)
+			if err != nil {
+				return false, fmt.Errorf("any[%d]: %w", i, err)
+			}
+			if matches {
+				return true, nil
+			}
+		}
+		return false, nil
+	case cond.not != nil:
+		matches, err := f.conditionMatches(record, cond.not, opts)
+		if err != nil {
+			return false, fmt.Errorf("not: %w", err)
+		}
+		return !matches, nil
+	}
+
+	return f.compare(record, cond, opts)
+}
+
+// compare evaluates a single comparison against the record
+func (f *splitOnField) compare(record *dataflow.Record, cond *splitCondition, opts *splitConfig) (bool, error) {
+	leftValue, _ := cond.field.get(*record)
+
+	//These ops only look at the field
+	switch cond.op {
+	case "isNull":
+		return leftValue == nil, nil
+	case "isNotNull":
+		return leftValue != nil, nil
+	case "isEmpty":
+		return leftValue == nil || leftValue == "", nil
+	}
+
 	var rightValue interface{}
-	if rule.valueType == "literal" {
-		rightValue = rule.value
+	if cond.valueType == "literal" {
+		rightValue = cond.value
 	} else {
 		//If not a literal, then the "value" is pointing to a field. Let's get the value from that field for this record
-		rightValue, _ = record.Get(rule.value.(string))
+		rightValue, _ = cond.valueField.get(*record)
+	}
+
+	if leftValue == nil || rightValue == nil {
+		if opts.missingFields == missingFieldsDefault {
+			return false, errSplitMissingField
+		}
+		return false, nil
+	}
+
+	compareOpts := splitCompareOptions{field: cond.field.String(), ignoreCase: cond.ignoreCase, timeFormat: opts.timeFormat, now: opts.now}
+
+	switch cond.op {
+	case "in", "notIn":
+		list, ok := rightValue.([]interface{})
+		if !ok {
+			return false, fmt.Errorf("value must be a list for op %v, got %v", cond.op, rightValue)
+		}
+
+		found := false
+		for i := range list {
+			equal, err := compareValues(leftValue, "==", list[i], compareOpts)
+			if err != nil {
+				return false, err
+			}
+			if equal {
+				found = true
+				break
+			}
+		}
+		return found == (cond.op == "in"), nil
+	case "between":
+		bounds, ok := rightValue.([]interface{})
+		if !ok || len(bounds) != 2 {
+			return false, fmt.Errorf("value must be a list of the low and high bounds for op between, got %v", rightValue)
+		}
+
+		aboveLow, err := compareValues(leftValue, ">=", bounds[0], compareOpts)
+		if err != nil || !aboveLow {
+			return false, err
+		}
+		return compareValues(leftValue, "<=", bounds[1], compareOpts)
+	case "regex":
+		leftStr, ok := leftValue.(string)
+		if !ok {
+			return false, fmt.Errorf("unsupported type %T for field %v in split rule with op regex", leftValue, cond.field)
+		}
+
+		re := cond.regex
+		if re == nil {
+			//The pattern comes from a field, so it can only be compiled now
+			pattern, ok := rightValue.(string)
+			if !ok {
+				return false, fmt.Errorf("unsupported type %T for split rule value with op regex", rightValue)
+			}
+
+			var err error
+			re, err = compileSplitRegex(pattern, cond.ignoreCase)
+			if err != nil {
+				return false, err
+			}
+		}
+		return re.MatchString(leftStr), nil
+	}
+
+	return compareValues(leftValue, cond.op, rightValue, compareOpts)
+}
+
+// splitCompareOptions are what compareValues needs to know besides the values
+type splitCompareOptions struct {
+	// field is the name of the field being compared, for error messages
+	field string
+
+	// ignoreCase compares strings in lower case
+	ignoreCase bool
+
+	// timeFormat and now are used to parse date/time literals
+	timeFormat string
+	now        time.Time
+}
+
+// compareValues compares the value of a field with right, as the type of the field's value
+func compareValues(leftValue interface{}, op string, right interface{}, opts splitCompareOptions) (bool, error) {
+	if opts.ignoreCase {
+		if rightStr, ok := right.(string); ok {
+			right = strings.ToLower(rightStr)
+		}
 	}
 
 	switch leftValue.(type) {
 	case string:
-		return compareAsStrings(leftValue.(string), rule.op, rightValue)
+		if opts.ignoreCase {
+			return compareAsStrings(strings.ToLower(leftValue.(string)), op, right)
+		}
+		return compareAsStrings(leftValue.(string), op, right)
+	case bool:
+		return compareAsBools(leftValue.(bool), op, right)
+	case time.Time:
+		return compareAsTimes(leftValue.(time.Time), op, right, opts.timeFormat, opts.now)
 	case int:
-		return compareAsInts(leftValue.(int), rule.op, rightValue)
+		return compareAsInts(int64(leftValue.(int)), op, right)
 	case int8:
-		return compareAsInts(int(leftValue.(int8)), rule.op, rightValue)
+		return compareAsInts(int64(leftValue.(int8)), op, right)
 	case int16:
-		return compareAsInts(int(leftValue.(int16)), rule.op, rightValue)
+		return compareAsInts(int64(leftValue.(int16)), op, right)
 	case int32:
-		return compareAsInts(int(leftValue.(int32)), rule.op, rightValue)
+		return compareAsInts(int64(leftValue.(int32)), op, right)
 	case int64:
-		return compareAsInts(int(leftValue.(int64)), rule.op, rightValue)
+		return compareAsInts(leftValue.(int64), op, right)
 	case float32:
-		return compareAsFloats(float64(leftValue.(float32)), rule.op, rightValue)
+		return compareAsFloats(float64(leftValue.(float32)), op, right)
 	case float64:
-		return compareAsFloats(leftValue.(float64), rule.op, rightValue)
+		return compareAsFloats(leftValue.(float64), op, right)
 	default:
-		panic("Unsupported type in split rule config")
+		return false, fmt.Errorf("unsupported type %T for field %v in split rule", leftValue, opts.field)
 	}
+}
 
-	return false
+// compileSplitRegex compiles the pattern of a regex condition
+func compileSplitRegex(pattern string, ignoreCase bool) (*regexp.Regexp, error) {
+	if ignoreCase {
+		pattern = "(?i)" + pattern
+	}
+
+	return regexp.Compile(pattern)
 }
 
-func compareAsStrings(left string, op string, right interface{}) bool {
+func compareAsStrings(left string, op string, right interface{}) (bool, error) {
 	//Convert the second value (if not a string)
 	var rightStr string
 	switch right.(type) {
@@ -129,70 +562,93 @@ func compareAsStrings(left string, op string, right interface{}) bool {
 	case float32, float64:
 		rightStr = fmt.Sprintf("%f", right)
 	default:
-		panic("Unsupported type in split rule config")
+		return false, fmt.Errorf("unsupported type %T for split rule value", right)
 	}
 
 	switch op {
 	case "<":
-		return left < rightStr
+		return left < rightStr, nil
 	case "<=":
-		return left <= rightStr
+		return left <= rightStr, nil
 	case "==":
-		return left == rightStr
+		return left == rightStr, nil
 	case "!=":
-		return left != rightStr
+		return left != rightStr, nil
 	case ">":
-		return left > rightStr
+		return left > rightStr, nil
 	case ">=":
-		return left >= rightStr
-	case "regex":
-		matched, _ := regexp.Match(rightStr, []byte(left))
-		return matched
+		return left >= rightStr, nil
+	case "contains":
+		return strings.Contains(left, rightStr), nil
+	case "startsWith":
+		return strings.HasPrefix(left, rightStr), nil
+	case "endsWith":
+		return strings.HasSuffix(left, rightStr), nil
 	default:
-		panic("Unsupported split op")
+		return false, fmt.Errorf("unsupported split op %v", op)
 	}
 }
 
-func compareAsInts(left int, op string, right interface{}) bool {
-	//Convert the second value (if not a int)
-	var rightInt int
+// compareAsInts compares an integer field as an int64, so large values like account numbers keep their precision.
+// Fractional values (e.g. 36.5) are compared as floats instead of being rounded.
+func compareAsInts(left int64, op string, right interface{}) (bool, error) {
+	//Convert the second value (if not a whole number, compare as floats)
+	var rightInt int64
 	switch right.(type) {
 	case string:
-		rightInt, _ = strconv.Atoi(right.(string))
+		var err error
+		rightInt, err = strconv.ParseInt(right.(string), 10, 64)
+		if err != nil {
+			return compareAsFloats(float64(left), op, right)
+		}
 	case int:
-		rightInt = right.(int)
-	case int8, int16, int32, int64:
-		rightInt, _ = strconv.Atoi(fmt.Sprintf("%d", right))
+		rightInt = int64(right.(int))
+	case int8:
+		rightInt = int64(right.(int8))
+	case int16:
+		rightInt = int64(right.(int16))
+	case int32:
+		rightInt = int64(right.(int32))
+	case int64:
+		rightInt = right.(int64)
 	case float32, float64:
-		rightInt, _ = strconv.Atoi(fmt.Sprintf("%.0f", right))
+		rightFloat, _ := configValueAsFloat(right)
+		if rightFloat != math.Trunc(rightFloat) || math.Abs(rightFloat) >= math.MaxInt64 {
+			return compareAsFloats(float64(left), op, right)
+		}
+		rightInt = int64(rightFloat)
 	default:
-		panic("Unsupported type in split rule config")
+		return false, fmt.Errorf("unsupported type %T for split rule value", right)
 	}
 
 	switch op {
 	case "<":
-		return left < rightInt
+		return left < rightInt, nil
 	case "<=":
-		return left <= rightInt
+		return left <= rightInt, nil
 	case "==":
-		return left == rightInt
+		return left == rightInt, nil
 	case "!=":
-		return left != rightInt
+		return left != rightInt, nil
 	case ">":
-		return left > rightInt
+		return left > rightInt, nil
 	case ">=":
-		return left >= rightInt
+		return left >= rightInt, nil
 	default:
-		panic("Unsupported split op")
+		return false, fmt.Errorf("unsupported split op %v for numbers", op)
 	}
 }
 
-func compareAsFloats(left float64, op string, right interface{}) bool {
+func compareAsFloats(left float64, op string, right interface{}) (bool, error) {
 	//Convert the second value (if not a float)
 	var rightFloat float64
 	switch right.(type) {
 	case string:
-		rightFloat, _ = strconv.ParseFloat(right.(string), 64)
+		var err error
+		rightFloat, err = strconv.ParseFloat(right.(string), 64)
+		if err != nil {
+			return false, fmt.Errorf("non-numeric split rule value %q compared with a number", right)
+		}
 	case int, int8, int16, int32, int64:
 		rightFloat, _ = strconv.ParseFloat(fmt.Sprintf("%d", right), 64)
 	case float32:
@@ -200,67 +656,199 @@ func compareAsFloats(left float64, op string, right interface{}) bool {
 	case float64:
 		rightFloat = right.(float64)
 	default:
-		panic("Unsupported type in split rule config")
+		return false, fmt.Errorf("unsupported type %T for split rule value", right)
 	}
 
 	switch op {
 	case "<":
-		return left < rightFloat
+		return left < rightFloat, nil
 	case "<=":
-		return left <= rightFloat
+		return left <= rightFloat, nil
 	case "==":
-		return left == rightFloat
+		return left == rightFloat, nil
 	case "!=":
-		return left != rightFloat
+		return left != rightFloat, nil
 	case ">":
-		return left > rightFloat
+		return left > rightFloat, nil
 	case ">=":
-		return left >= rightFloat
+		return left >= rightFloat, nil
 	default:
-		panic("Unsupported split op")
+		return false, fmt.Errorf("unsupported split op %v for numbers", op)
 	}
 }
 
+func compareAsBools(left bool, op string, right interface{}) (bool, error) {
+	//Convert the second value (if not a bool)
+	var rightBool bool
+	switch right.(type) {
+	case bool:
+		rightBool = right.(bool)
+	case string:
+		var err error
+		rightBool, err = strconv.ParseBool(right.(string))
+		if err != nil {
+			return false, fmt.Errorf("invalid boolean split rule value %q", right)
+		}
+	default:
+		return false, fmt.Errorf("unsupported type %T for split rule value", right)
+	}
+
+	switch op {
+	case "==":
+		return left == rightBool, nil
+	case "!=":
+		return left != rightBool, nil
+	default:
+		return false, fmt.Errorf("unsupported split op %v for booleans", op)
+	}
+}
+
+func compareAsTimes(left time.Time, op string, right interface{}, timeFormat string, now time.Time) (bool, error) {
+	//Convert the second value (if not a time)
+	var rightTime time.Time
+	switch right.(type) {
+	case time.Time:
+		rightTime = right.(time.Time)
+	case string:
+		var err error
+		rightTime, err = parseSplitTime(right.(string), timeFormat, now, left.Location())
+		if err != nil {
+			return false, err
+		}
+	default:
+		return false, fmt.Errorf("unsupported type %T for split rule value", right)
+	}
+
+	switch op {
+	case "<":
+		return left.Before(rightTime), nil
+	case "<=":
+		return !left.After(rightTime), nil
+	case "==":
+		return left.Equal(rightTime), nil
+	case "!=":
+		return !left.Equal(rightTime), nil
+	case ">":
+		return left.After(rightTime), nil
+	case ">=":
+		return !left.Before(rightTime), nil
+	default:
+		return false, fmt.Errorf("unsupported split op %v for dates", op)
+	}
+}
+
+var relativeTimePattern = regexp.MustCompile(`^(now|today)((?:[+-]\d+[smhdwMy])*)$`)
+var relativeTimeOffsetPattern = regexp.MustCompile(`([+-]\d+)([smhdwMy])`)
+
+// parseSplitTime parses a date/time literal. It's either in the layout, in the location of the field it's compared
+// to, or relative to now: "now" or "today" (midnight in loc) followed by any number of offsets such as -30d or +1M.
+func parseSplitTime(text string, layout string, now time.Time, loc *time.Location) (time.Time, error) {
+	parts := relativeTimePattern.FindStringSubmatch(strings.TrimSpace(text))
+	if parts == nil {
+		t, err := time.ParseInLocation(layout, text, loc)
+		if err != nil {
+			return t, fmt.Errorf("invalid date/time split rule value %q: %w", text, err)
+		}
+		return t, nil
+	}
+
+	t := now.In(loc)
+	if parts[1] == "today" {
+		t = time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, loc)
+	}
+
+	for _, offset := range relativeTimeOffsetPattern.FindAllStringSubmatch(parts[2], -1) {
+		n, _ := strconv.Atoi(offset[1])
+		switch offset[2] {
+		case "s":
+			t = t.Add(time.Duration(n) * time.Second)
+		case "m":
+			t = t.Add(time.Duration(n) * time.Minute)
+		case "h":
+			t = t.Add(time.Duration(n) * time.Hour)
+		case "d":
+			t = t.AddDate(0, 0, n)
+		case "w":
+			t = t.AddDate(0, 0, 7*n)
+		case "M":
+			t = t.AddDate(0, n, 0)
+		case "y":
+			t = t.AddDate(n, 0, 0)
+		}
+	}
+
+	return t, nil
+}
+
+// outputPorts returns the default output port and the output ports named in the rules
+func (f *splitOnField) outputPorts(config map[string]interface{}) ([]PortSpec, error) {
+	c, err := f.buildConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
+	rulePorts := make([]string, len(c.rules))
+	for i := range c.rules {
+		rulePorts[i] = c.rules[i].outputPort
+	}
+
+	return routedOutputPorts(c.defaultOutputPort, rulePorts, PortDataTypeRecord)
+}
+
 func (f *splitOnField) Execute(in dataflow.InputReader, out dataflow.OutputWriter, config map[string]interface{}) error {
 	defer out.Close()
 
 	//Parse/read config options
+	config, err := prepareConfig("splitOnField", config)
+	if err != nil {
+		return err
+	}
+
 	splitOpts, err := f.buildConfig(config)
 	if err != nil {
-		panic("Error parsing/building split config")
+		return newFunctionError("splitOnField", "building config", err)
 	}
 
 	//Open the data stream
 	reader := in.PortReader(dataflow.DEFAULT_INPUT_PORT_NAME)
 	err = reader.Open()
 	if err != nil {
-		panic("Unable to read record from input")
+		return newFunctionError("splitOnField", "opening input", err)
+	}
+
+	rulePorts := make([]string, len(splitOpts.rules))
+	for i := range splitOpts.rules {
+		rulePorts[i] = splitOpts.rules[i].outputPort
 	}
 
 	//Loop through all data
 	for reader.HasNext() {
 		rec, err := reader.Next()
 		if err != nil {
-			panic("Failed to read record")
+			return newFunctionError("splitOnField", "reading input", err)
 		}
 
 		//We should perform a check here to make sure we are getting records instead of files
 		recVal, err := rec.GetAsRecord()
 		if err != nil {
-			panic("Failed to read record as a map")
+			writeRecordError(out, &(RecordError{FunctionKey: "splitOnField", Err: err}))
+			continue
 		}
 
 		/* START - The actual work */
-		destPort := splitOpts.defaultOutputPort
-		for i := 0; i < len(splitOpts.rules); i++ {
-			curRule := splitOpts.rules[i]
-			if f.matches(&recVal, &curRule) {
-				destPort = curRule.outputPort
-			}
+		destPorts, err := matchPorts(splitOpts.matchMode, splitOpts.defaultOutputPort, rulePorts, func(i int) (bool, error) {
+			return f.matches(&recVal, &(splitOpts.rules[i]), &splitOpts)
+		})
+		if errors.Is(err, errSplitMissingField) {
+			destPorts, err = []string{splitOpts.defaultOutputPort}, nil
+		}
+		if err != nil {
+			writeRecordError(out, &(RecordError{FunctionKey: "splitOnField", Record: recVal, Err: err}))
+			continue
 		}
 
 		//Output
-		out.WriteRecord(destPort, &recVal)
+		writeRecordToPorts(out, destPorts, recVal)
 
 		/* END - The actual work */
 	}
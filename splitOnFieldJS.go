@@ -2,12 +2,7 @@ package builtin
 
 import (
 	"bitbucket.org/primelogic_io/bitlantern/service/dataflow"
-	"bytes"
 	"fmt"
-	"github.com/robertkrimen/otto"
-	_ "github.com/robertkrimen/otto"
-	_ "github.com/robertkrimen/otto/underscore"
-	"text/template"
 )
 
 func init() {
@@ -17,11 +12,27 @@ func init() {
 			FunctionSpec: dataflow.FunctionSpec{
 				Key:           "splitOnFieldJS",
 				Name:          "Split Data by Field - JS",
-				Description:   "Splits the input data using Javascript for conditions/rules",
+				Description:   "Splits the input data using Javascript for conditions/rules. By default a record goes to the output port of the first rule that matches (matchMode first)",
 				Category:      "Data",
 				ExecutionMode: "sync",
-				InputPorts:    nil,
-				OutputPorts:   nil,
+				InputPorts:    dataflowPorts(recordInputPort),
+				OutputPorts:   dataflowPorts(errorOutputPort),
+			},
+			ConfigSchema: ConfigSchema{
+				Fields: append([]ConfigField{
+					{Key: "defaultOutputPort", Type: ConfigTypeString, Required: true, Description: "Output port for records that don't match any rule"},
+					{Key: "rules", Type: ConfigTypeArray, Required: true, Items: &ConfigField{
+						Type: ConfigTypeObject,
+						Fields: []ConfigField{
+							{Key: "jsCondition", Type: ConfigTypeString, Required: true, Description: "Javascript condition evaluated against the record"},
+							{Key: "outputPort", Type: ConfigTypeString, Required: true},
+						},
+					}},
+					matchModeConfigField(matchModeFirst),
+				}, jsRuntimeConfigFields...),
+			},
+			ResolveOutputPorts: func(config map[string]interface{}) ([]PortSpec, error) {
+				return (&(splitOnFieldJS{})).outputPorts(config)
 			},
 			NewFunction: func() dataflow.Function {
 				return &(splitOnFieldJS{})
@@ -33,11 +44,18 @@ type splitOnFieldJS struct {
 }
 
 type splitConfigJS struct {
-	// splits contains the rules for data splitting. The first rule that matches the data will be used.
+	// rules are the JS conditions run against each record. matchMode decides which of the matching rules' output
+	// ports the record is sent to.
 	rules []splitRuleJS
 
 	// defaultOutputPort specifies the output port into which to send data that doesn't match any other split rule
 	defaultOutputPort string
+
+	// matchMode is one of matchModeFirst, matchModeLast or matchModeAll
+	matchMode string
+
+	// js holds the JS runtime options: helper scripts and execution limits
+	js jsRuntimeConfig
 }
 
 type splitRuleJS struct {
@@ -49,6 +67,7 @@ type splitRuleJS struct {
 // buildConfig builds a splitConfig from the passed in map. The map must be in the form:
 // {
 //		"defaultOutputPort": "not poor",
+//		"matchMode": "first",
 //		"rules": [
 //			{
 //				"jsCondition": "gender.lowerCase().startsWith('f')",
@@ -57,12 +76,15 @@ type splitRuleJS struct {
 //		]
 // }
 //
-// rules.value can either be a value literal (ex: 100.00, "M", etc.) or a reference to another field in the record.
-// rules.valueType accepts the values: "literal", "field"
+// helperScripts (files) and helperScript (inline JS) can optionally be used to load extra JS functions for the rules.
 func (f *splitOnFieldJS) buildConfig(config map[string]interface{}) (splitConfigJS, error) {
 	c := splitConfigJS{}
 
 	c.defaultOutputPort = config["defaultOutputPort"].(string)
+	if err := checkRoutedPortName(c.defaultOutputPort); err != nil {
+		return c, fmt.Errorf("defaultOutputPort: %w", err)
+	}
+	c.matchMode, _ = config["matchMode"].(string)
 	rules := config["rules"].([]interface{})
 	c.rules = make([]splitRuleJS, len(rules))
 
@@ -71,107 +93,115 @@ func (f *splitOnFieldJS) buildConfig(config map[string]interface{}) (splitConfig
 		newRule := splitRuleJS{}
 
 		newRule.outputPort = curRuleMap["outputPort"].(string)
+		if err := checkRoutedPortName(newRule.outputPort); err != nil {
+			return c, fmt.Errorf("rules[%d].outputPort: %w", i, err)
+		}
 		newRule.jsCondition = curRuleMap["jsCondition"].(string)
 
 		c.rules[i] = newRule
 	}
 
+	c.js = buildJSRuntimeConfig(config)
+
 	return c, nil
 }
 
+// outputPorts returns the default output port and the output ports named in the rules
+func (f *splitOnFieldJS) outputPorts(config map[string]interface{}) ([]PortSpec, error) {
+	c, err := f.buildConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
+	rulePorts := make([]string, len(c.rules))
+	for i := range c.rules {
+		rulePorts[i] = c.rules[i].outputPort
+	}
+
+	return routedOutputPorts(c.defaultOutputPort, rulePorts, PortDataTypeRecord)
+}
+
 func (f *splitOnFieldJS) Execute(in dataflow.InputReader, out dataflow.OutputWriter, config map[string]interface{}) error {
 	defer out.Close()
 
 	//Parse/read config options
+	config, err := prepareConfig("splitOnFieldJS", config)
+	if err != nil {
+		return err
+	}
+
 	splitOpts, err := f.buildConfig(config)
 	if err != nil {
-		panic("Error parsing/building split config")
+		return newFunctionError("splitOnFieldJS", "building config", err)
 	}
 
 	//Open the data stream
 	reader := in.PortReader(dataflow.DEFAULT_INPUT_PORT_NAME)
 	err = reader.Open()
 	if err != nil {
-		panic("Unable to read record from input")
+		return newFunctionError("splitOnFieldJS", "opening input", err)
 	}
 
-	//JS Template - We will wrap the condition express in a function that can be called more easily
-	jsFuncTemplate, err := template.New("someName").Parse(`
-		var {{.FuncName}} = function(data) {
-			if ({{.Condition}}) {
-				return true;
-			} else {
-				return false;
-			}
-		};
-	`)
-
-	vm := otto.New()
+	vm, err := newJSRuntime(splitOpts.js)
+	if err != nil {
+		return newFunctionError("splitOnFieldJS", "starting JS runtime", err)
+	}
 
-	//Parse all the JS rules
+	//Compile all the JS rules
+	compileErrs := jsRuleCompileErrors{}
 	for i := range splitOpts.rules {
 		curRule := &(splitOpts.rules[i])
 
-		var b bytes.Buffer
-		templateVars := make(map[string]string)
-		templateVars["Condition"] = curRule.jsCondition
-		templateVars["FuncName"] = fmt.Sprintf("splitRuleFunc_%d", i)
-		jsFuncTemplate.Execute(&b, templateVars)
-
-		fmt.Printf("\n\n%s", b.String())
-
-		_, err := vm.Run(b.String())
+		curRule.jsFuncName, err = vm.compileCondition(curRule.jsCondition)
 		if err != nil {
-			panic(err)
+			compileErrs.add(fmt.Sprintf("rules[%d].jsCondition", i), err)
 		}
-
-		curRule.jsFuncName = templateVars["FuncName"]
+	}
+	if err := compileErrs.err("splitOnFieldJS"); err != nil {
+		return newFunctionError("splitOnFieldJS", "compiling rules", err)
 	}
 
 	//Loop through all data
 	for reader.HasNext() {
 		rec, err := reader.Next()
 		if err != nil {
-			panic("Failed to read record")
+			return newFunctionError("splitOnFieldJS", "reading input", err)
 		}
 
 		//We should perform a check here to make sure we are getting records instead of files
 		recVal, err := rec.GetAsRecord()
 		if err != nil {
-			panic("Failed to read record as a map")
+			writeRecordError(out, &(RecordError{FunctionKey: "splitOnFieldJS", Err: err}))
+			continue
 		}
 
 		/* START - The actual work */
 
-		// Run the script rules for each record
-		matchFound := false
-		for i := range splitOpts.rules {
-			curRule := splitOpts.rules[i]
-			recData, _ := rec.GetAsRecord()
-			value, err := vm.Call(curRule.jsFuncName, nil, recData)
-			if err != nil {
-				panic(err)
-			}
-
-			matches, err := value.ToBoolean()
-			if err != nil {
-				panic(err)
-			}
-
-			if matches {
-				matchFound = true
-				out.WriteRecord(curRule.outputPort, &recVal)
-				break
+		destPorts, err := f.route(vm, &splitOpts, recVal)
+		if err != nil {
+			writeRecordError(out, &(RecordError{FunctionKey: "splitOnFieldJS", Record: recVal, Err: err}))
+			if isJSRunBudgetExceeded(err) {
+				return newFunctionError("splitOnFieldJS", "running rules", err)
 			}
+			continue
 		}
 
-		//No matches!
-		if !matchFound {
-			out.WriteRecord(splitOpts.defaultOutputPort, &recVal)
-		}
+		writeRecordToPorts(out, destPorts, recVal)
 
 		/* END - The actual work */
 	}
 
 	return nil
 }
+
+// route runs the script rules for the record and returns the output ports of the rules that match, per the match mode
+func (f *splitOnFieldJS) route(vm *jsRuntime, splitOpts *splitConfigJS, recData dataflow.Record) ([]string, error) {
+	rulePorts := make([]string, len(splitOpts.rules))
+	for i := range splitOpts.rules {
+		rulePorts[i] = splitOpts.rules[i].outputPort
+	}
+
+	return matchPorts(splitOpts.matchMode, splitOpts.defaultOutputPort, rulePorts, func(i int) (bool, error) {
+		return vm.callCondition(splitOpts.rules[i].jsFuncName, recData)
+	})
+}
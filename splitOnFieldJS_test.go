@@ -0,0 +1,64 @@
+package builtin
+
+import (
+	"bitbucket.org/primelogic_io/bitlantern/service/dataflow"
+	"testing"
+)
+
+func TestSplitOnFieldJS(t *testing.T) {
+	rules := []interface{}{
+		map[string]interface{}{"jsCondition": "data.gender.toLowerCase() == 'f'", "outputPort": "female"},
+		map[string]interface{}{"jsCondition": "data.balance > 100", "outputPort": "rich"},
+	}
+
+	tests := []struct {
+		name     string
+		record   dataflow.Record
+		wantPort string
+	}{
+		{name: "first rule", record: dataflow.Record{"gender": "F", "balance": 10.0}, wantPort: "female"},
+		{name: "first matching rule wins", record: dataflow.Record{"gender": "F", "balance": 500.0}, wantPort: "female"},
+		{name: "second rule", record: dataflow.Record{"gender": "M", "balance": 500.0}, wantPort: "rich"},
+		{name: "default", record: dataflow.Record{"gender": "M", "balance": 5.0}, wantPort: "other"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := map[string]interface{}{"defaultOutputPort": "other", "rules": rules}
+			out, err := runFunction(t, "splitOnFieldJS", config, recordInput(tt.record))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(out.Records(tt.wantPort)) != 1 {
+				t.Errorf("expected the record on port %v, ports written: %v", tt.wantPort, out.Ports())
+			}
+		})
+	}
+}
+
+func TestSplitOnFieldJSErrors(t *testing.T) {
+	config := map[string]interface{}{
+		"defaultOutputPort": "other",
+		"rules": []interface{}{
+			map[string]interface{}{"jsCondition": "data.name.toLowerCase() == 'x'", "outputPort": "x"},
+		},
+	}
+
+	//The first record has no name, so the condition throws
+	out, err := runFunction(t, "splitOnFieldJS", config, recordInput(dataflow.Record{}, dataflow.Record{"name": "X"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out.Records("x")) != 1 {
+		t.Errorf("expected the good record on port x, ports written: %v", out.Ports())
+	}
+	assertErrorRecords(t, out, []dataflow.Record{{"functionKey": "splitOnFieldJS"}})
+
+	//A condition that doesn't compile is fatal
+	config["rules"] = []interface{}{map[string]interface{}{"jsCondition": "data.name ==", "outputPort": "x"}}
+	_, err = runFunction(t, "splitOnFieldJS", config, recordInput())
+	if err == nil {
+		t.Error("expected an error for a condition that doesn't compile")
+	}
+}
@@ -0,0 +1,427 @@
+package builtin
+
+import (
+	"bitbucket.org/primelogic_io/bitlantern/service/dataflow"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSplitOnField(t *testing.T) {
+	tests := []struct {
+		name     string
+		rules    []interface{}
+		record   dataflow.Record
+		wantPort string
+	}{
+		{
+			name:     "float literal",
+			rules:    []interface{}{splitRuleMap("balance", "<=", 50.0, "literal", "poor")},
+			record:   dataflow.Record{"balance": 49.99},
+			wantPort: "poor",
+		},
+		{
+			name:     "no match goes to default",
+			rules:    []interface{}{splitRuleMap("balance", "<=", 50.0, "literal", "poor")},
+			record:   dataflow.Record{"balance": 50.01},
+			wantPort: "other",
+		},
+		{
+			name:     "int64 field against float literal",
+			rules:    []interface{}{splitRuleMap("age", ">=", 65.0, "literal", "senior")},
+			record:   dataflow.Record{"age": int64(70)},
+			wantPort: "senior",
+		},
+		{
+			name:     "string equality",
+			rules:    []interface{}{splitRuleMap("state", "==", "TX", "literal", "texas")},
+			record:   dataflow.Record{"state": "TX"},
+			wantPort: "texas",
+		},
+		{
+			name:     "regex",
+			rules:    []interface{}{splitRuleMap("zip", "regex", "^7[5-9]", "literal", "texas")},
+			record:   dataflow.Record{"zip": "75001"},
+			wantPort: "texas",
+		},
+		{
+			name:     "compare against another field",
+			rules:    []interface{}{splitRuleMap("balance", ">", "limit", "field", "over")},
+			record:   dataflow.Record{"balance": 120.0, "limit": 100.0},
+			wantPort: "over",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := map[string]interface{}{"defaultOutputPort": "other", "rules": tt.rules}
+			out, err := runFunction(t, "splitOnField", config, recordInput(tt.record))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := out.Records(tt.wantPort)
+			if len(got) != 1 || !reflect.DeepEqual(got[0], tt.record) {
+				t.Errorf("records on port %v = %v, want %v (ports written: %v)", tt.wantPort, got, tt.record, out.Ports())
+			}
+		})
+	}
+}
+
+func TestSplitOnFieldOps(t *testing.T) {
+	record := dataflow.Record{
+		"state": "TX", "name": "Ada Lovelace", "age": int64(36), "account": int64(1<<53 + 1), "balance": 250.5, "note": "", "limits": []interface{}{"tx", "ca"},
+		"customer": map[string]interface{}{"address": map[string]interface{}{"zip": "75001"}, "phones": []interface{}{"555-0100"}},
+	}
+
+	tests := []struct {
+		name      string
+		condition map[string]interface{}
+		want      bool
+	}{
+		{name: "in", condition: map[string]interface{}{"field": "state", "op": "in", "value": []interface{}{"CA", "TX"}}, want: true},
+		{name: "in numbers", condition: map[string]interface{}{"field": "age", "op": "in", "value": []interface{}{35.0, 36.0}}, want: true},
+		{name: "notIn", condition: map[string]interface{}{"field": "state", "op": "notIn", "value": []interface{}{"CA", "NY"}}, want: true},
+		{name: "in is case sensitive", condition: map[string]interface{}{"field": "state", "op": "in", "value": []interface{}{"tx"}}, want: false},
+		{name: "in ignoring case", condition: map[string]interface{}{"field": "state", "op": "in", "value": []interface{}{"tx"}, "ignoreCase": true}, want: true},
+		{name: "in list from field", condition: map[string]interface{}{"field": "state", "op": "in", "value": "limits", "valueType": "field", "ignoreCase": true}, want: true},
+		{name: "contains", condition: map[string]interface{}{"field": "name", "op": "contains", "value": "Love"}, want: true},
+		{name: "contains ignoring case", condition: map[string]interface{}{"field": "name", "op": "contains", "value": "LOVE", "ignoreCase": true}, want: true},
+		{name: "startsWith", condition: map[string]interface{}{"field": "name", "op": "startsWith", "value": "Ada"}, want: true},
+		{name: "endsWith", condition: map[string]interface{}{"field": "name", "op": "endsWith", "value": "Ada"}, want: false},
+		{name: "between", condition: map[string]interface{}{"field": "balance", "op": "between", "value": []interface{}{100.0, 250.5}}, want: true},
+		{name: ">= fraction", condition: map[string]interface{}{"field": "age", "op": ">=", "value": 36.5}, want: false},
+		{name: "< fraction", condition: map[string]interface{}{"field": "age", "op": "<", "value": 36.5}, want: true},
+		{name: "large integer ==", condition: map[string]interface{}{"field": "account", "op": "==", "value": "9007199254740993"}, want: true},
+		{name: "large integer neighbour", condition: map[string]interface{}{"field": "account", "op": "==", "value": "9007199254740992"}, want: false},
+		{name: "large integer >", condition: map[string]interface{}{"field": "account", "op": ">", "value": "9007199254740992"}, want: true},
+		{name: "== fraction string", condition: map[string]interface{}{"field": "age", "op": "==", "value": "36.0"}, want: true},
+		{name: "not between", condition: map[string]interface{}{"field": "age", "op": "between", "value": []interface{}{40.0, 50.0}}, want: false},
+		{name: "== ignoring case", condition: map[string]interface{}{"field": "name", "op": "==", "value": "ada lovelace", "ignoreCase": true}, want: true},
+		{name: "regex ignoring case", condition: map[string]interface{}{"field": "name", "op": "regex", "value": `^ada\s`, "ignoreCase": true}, want: true},
+		{name: "nested path", condition: map[string]interface{}{"field": "customer.address.zip", "op": "startsWith", "value": "75"}, want: true},
+		{name: "nested list", condition: map[string]interface{}{"field": "customer.phones[0]", "op": "==", "value": "555-0100"}, want: true},
+		{name: "missing nested path", condition: map[string]interface{}{"field": "customer.phones[1]", "op": "isNull"}, want: true},
+		{name: "isNull", condition: map[string]interface{}{"field": "missing", "op": "isNull"}, want: true},
+		{name: "isNotNull", condition: map[string]interface{}{"field": "note", "op": "isNotNull"}, want: true},
+		{name: "isEmpty", condition: map[string]interface{}{"field": "note", "op": "isEmpty"}, want: true},
+		{name: "isEmpty with a value", condition: map[string]interface{}{"field": "state", "op": "isEmpty"}, want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rule := map[string]interface{}{"outputPort": "matched"}
+			for key, val := range tt.condition {
+				rule[key] = val
+			}
+
+			config := map[string]interface{}{"defaultOutputPort": "other", "rules": []interface{}{rule}}
+			out, err := runFunction(t, "splitOnField", config, recordInput(record))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := len(out.Records("matched")) == 1; got != tt.want {
+				t.Errorf("matched = %v, want %v (ports written: %v)", got, tt.want, out.Ports())
+			}
+		})
+	}
+}
+
+func TestSplitOnFieldDatesAndBooleans(t *testing.T) {
+	record := dataflow.Record{
+		"opened":   time.Date(2020, 3, 15, 0, 0, 0, 0, time.UTC),
+		"lastSeen": time.Now().AddDate(0, 0, -10),
+		"active":   true,
+	}
+
+	tests := []struct {
+		name      string
+		condition map[string]interface{}
+		want      bool
+	}{
+		{name: "date literal", condition: map[string]interface{}{"field": "opened", "op": "<", "value": "2020-04-01"}, want: true},
+		{name: "date equality", condition: map[string]interface{}{"field": "opened", "op": "==", "value": "2020-03-15"}, want: true},
+		{name: "date between", condition: map[string]interface{}{"field": "opened", "op": "between", "value": []interface{}{"2020-01-01", "2020-12-31"}}, want: true},
+		{name: "relative", condition: map[string]interface{}{"field": "lastSeen", "op": ">=", "value": "now-30d"}, want: true},
+		{name: "relative to today", condition: map[string]interface{}{"field": "lastSeen", "op": ">=", "value": "today-1w"}, want: false},
+		{name: "against another date field", condition: map[string]interface{}{"field": "opened", "op": "<", "value": "lastSeen", "valueType": "field"}, want: true},
+		{name: "bool", condition: map[string]interface{}{"field": "active", "op": "==", "value": true}, want: true},
+		{name: "bool from string", condition: map[string]interface{}{"field": "active", "op": "!=", "value": "false"}, want: true},
+		{name: "missing field is false", condition: map[string]interface{}{"field": "closed", "op": "<", "value": "2020-01-01"}, want: false},
+		{name: "not missing field is true", condition: map[string]interface{}{"not": map[string]interface{}{"field": "closed", "op": "==", "value": "x"}}, want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rule := map[string]interface{}{"outputPort": "matched"}
+			for key, val := range tt.condition {
+				rule[key] = val
+			}
+
+			config := map[string]interface{}{"defaultOutputPort": "other", "rules": []interface{}{rule}}
+			out, err := runFunction(t, "splitOnField", config, recordInput(record))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := len(out.Records("matched")) == 1; got != tt.want {
+				t.Errorf("matched = %v, want %v (ports written: %v)", got, tt.want, out.Ports())
+			}
+		})
+	}
+}
+
+func TestSplitOnFieldMissingFieldsToDefault(t *testing.T) {
+	config := map[string]interface{}{
+		"defaultOutputPort": "other",
+		"missingFields":     "default",
+		"timeFormat":        "01/02/2006",
+		"rules": []interface{}{
+			map[string]interface{}{"outputPort": "unopened", "not": map[string]interface{}{"field": "opened", "op": "<", "value": "01/01/2021"}},
+		},
+	}
+
+	opened := dataflow.Record{"opened": time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC)}
+	missing := dataflow.Record{"name": "x"}
+	out, err := runFunction(t, "splitOnField", config, recordInput(opened, missing))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := out.Records("unopened"); len(got) != 1 || !reflect.DeepEqual(got[0], opened) {
+		t.Errorf("records on port unopened = %v", got)
+	}
+	if got := out.Records("other"); len(got) != 1 || !reflect.DeepEqual(got[0], missing) {
+		t.Errorf("records on port other = %v", got)
+	}
+}
+
+func TestParseSplitTime(t *testing.T) {
+	now := time.Date(2020, 1, 31, 15, 30, 0, 0, time.UTC)
+
+	tests := []struct {
+		text string
+		want time.Time
+	}{
+		{text: "now", want: now},
+		{text: "now-30d", want: time.Date(2020, 1, 1, 15, 30, 0, 0, time.UTC)},
+		{text: "now+90m", want: time.Date(2020, 1, 31, 17, 0, 0, 0, time.UTC)},
+		{text: "today", want: time.Date(2020, 1, 31, 0, 0, 0, 0, time.UTC)},
+		{text: "today-1y+2w", want: time.Date(2019, 2, 14, 0, 0, 0, 0, time.UTC)},
+		{text: "2020-02-29", want: time.Date(2020, 2, 29, 0, 0, 0, 0, time.UTC)},
+	}
+
+	for _, tt := range tests {
+		got, err := parseSplitTime(tt.text, "2006-01-02", now, time.UTC)
+		if err != nil || !got.Equal(tt.want) {
+			t.Errorf("parseSplitTime(%q) = %v, %v, want %v", tt.text, got, err, tt.want)
+		}
+	}
+
+	if _, err := parseSplitTime("now-3x", "2006-01-02", now, time.UTC); err == nil {
+		t.Errorf("expected an error for an unknown unit")
+	}
+}
+
+func TestSplitOnFieldUnsupportedType(t *testing.T) {
+	config := map[string]interface{}{
+		"defaultOutputPort": "other",
+		"rules":             []interface{}{splitRuleMap("flag", "==", "true", "literal", "flagged")},
+	}
+
+	bad := dataflow.Record{"flag": []string{"x"}}
+	good := dataflow.Record{"flag": "true"}
+	out, err := runFunction(t, "splitOnField", config, recordInput(bad, good))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(out.Records("flagged")) != 1 {
+		t.Errorf("expected the good record to keep flowing, got ports %v", out.Ports())
+	}
+	assertErrorRecords(t, out, []dataflow.Record{{"functionKey": "splitOnField", "record": bad}})
+}
+
+func TestSplitOnFieldNonNumericValue(t *testing.T) {
+	config := map[string]interface{}{
+		"defaultOutputPort": "other",
+		"rules":             []interface{}{splitRuleMap("age", "<", "N/A", "literal", "young")},
+	}
+
+	bad := dataflow.Record{"age": int64(36)}
+	out, err := runFunction(t, "splitOnField", config, recordInput(bad, dataflow.Record{"age": 36.5}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(out.Records("young")) != 0 {
+		t.Errorf("N/A should not compare as 0, got ports %v", out.Ports())
+	}
+	assertErrorRecords(t, out, []dataflow.Record{
+		{"functionKey": "splitOnField", "record": bad},
+		{"functionKey": "splitOnField", "record": dataflow.Record{"age": 36.5}},
+	})
+}
+
+func TestSplitOnFieldMatchMode(t *testing.T) {
+	rules := []interface{}{
+		splitRuleMap("balance", ">", 100.0, "literal", "audit"),
+		splitRuleMap("state", "==", "TX", "literal", "texas"),
+	}
+	record := dataflow.Record{"state": "TX", "balance": 500.0}
+
+	tests := []struct {
+		matchMode string
+		wantPorts []string
+	}{
+		{matchMode: matchModeFirst, wantPorts: []string{"audit"}},
+		{matchMode: matchModeLast, wantPorts: []string{"texas"}},
+		{matchMode: matchModeAll, wantPorts: []string{"audit", "texas"}},
+		//The last match wins by default, as it did before matchMode
+		{matchMode: "", wantPorts: []string{"texas"}},
+	}
+
+	for _, tt := range tests {
+		t.Run("mode "+tt.matchMode, func(t *testing.T) {
+			config := map[string]interface{}{"defaultOutputPort": "other", "rules": rules}
+			if tt.matchMode != "" {
+				config["matchMode"] = tt.matchMode
+			}
+			out, err := runFunction(t, "splitOnField", config, recordInput(record))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, port := range tt.wantPorts {
+				got := out.Records(port)
+				if len(got) != 1 || !reflect.DeepEqual(got[0], record) {
+					t.Errorf("records on port %v = %v, want %v", port, got, record)
+				}
+			}
+			if len(out.Ports()) != len(tt.wantPorts) {
+				t.Errorf("ports written: %v, want %v", out.Ports(), tt.wantPorts)
+			}
+		})
+	}
+}
+
+func TestSplitOnFieldRuleGroups(t *testing.T) {
+	bigTexans := map[string]interface{}{
+		"outputPort": "big texans",
+		"all": []interface{}{
+			map[string]interface{}{"field": "state", "op": "==", "value": "TX"},
+			map[string]interface{}{"any": []interface{}{
+				map[string]interface{}{"field": "balance", "op": ">", "value": 1000.0, "valueType": "literal"},
+				map[string]interface{}{"not": map[string]interface{}{"field": "status", "op": "==", "value": "active"}},
+			}},
+		},
+	}
+	config := map[string]interface{}{"defaultOutputPort": "other", "rules": []interface{}{bigTexans}}
+
+	tests := []struct {
+		name     string
+		record   dataflow.Record
+		wantPort string
+	}{
+		{name: "all and any match", record: dataflow.Record{"state": "TX", "balance": 5000.0, "status": "active"}, wantPort: "big texans"},
+		{name: "not matches", record: dataflow.Record{"state": "TX", "balance": 5.0, "status": "closed"}, wantPort: "big texans"},
+		{name: "any fails", record: dataflow.Record{"state": "TX", "balance": 5.0, "status": "active"}, wantPort: "other"},
+		{name: "all fails", record: dataflow.Record{"state": "CA", "balance": 5000.0, "status": "active"}, wantPort: "other"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, err := runFunction(t, "splitOnField", config, recordInput(tt.record))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(out.Records(tt.wantPort)) != 1 {
+				t.Errorf("expected the record on port %v, ports written: %v", tt.wantPort, out.Ports())
+			}
+		})
+	}
+
+	//Errors in nested conditions say where they are
+	bad := dataflow.Record{"state": "TX", "balance": []string{"x"}, "status": "active"}
+	out, err := runFunction(t, "splitOnField", config, recordInput(bad))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertErrorRecords(t, out, []dataflow.Record{{
+		"functionKey": "splitOnField",
+		"error":       "rules[0]: all[1]: any[0]: unsupported type []string for field balance in split rule",
+	}})
+}
+
+func TestSplitOnFieldRuleGroupsInvalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		rule    map[string]interface{}
+		wantErr string
+	}{
+		{
+			name:    "field and group",
+			rule:    map[string]interface{}{"outputPort": "x", "field": "a", "op": "==", "value": 1.0, "any": []interface{}{}},
+			wantErr: "rules[0]: must have exactly one of field, all, any or not, got [field any]",
+		},
+		{
+			name:    "empty group",
+			rule:    map[string]interface{}{"outputPort": "x", "all": []interface{}{}},
+			wantErr: "rules[0].all: must be a non-empty list of conditions",
+		},
+		{
+			name: "nested bad op",
+			rule: map[string]interface{}{"outputPort": "x", "not": map[string]interface{}{
+				"all": []interface{}{map[string]interface{}{"field": "a", "op": "~", "value": 1.0}},
+			}},
+			wantErr: "rules[0].not.all[0].op: must be one of " + fmt.Sprint(splitOps) + ", got ~",
+		},
+		{
+			name:    "comparison without value",
+			rule:    map[string]interface{}{"outputPort": "x", "field": "a", "op": "=="},
+			wantErr: "rules[0]: value is required for op ==",
+		},
+		{
+			name:    "bad regex",
+			rule:    map[string]interface{}{"outputPort": "x", "field": "a", "op": "regex", "value": "(["},
+			wantErr: "rules[0].value: error parsing regexp: missing closing ]: `[`",
+		},
+		{
+			name:    "between needs two bounds",
+			rule:    map[string]interface{}{"outputPort": "x", "field": "a", "op": "between", "value": []interface{}{1.0}},
+			wantErr: "rules[0].value: must be a list of the low and high bounds for op between",
+		},
+		{
+			name:    "between with a non-numeric bound",
+			rule:    map[string]interface{}{"outputPort": "x", "field": "a", "op": "between", "value": []interface{}{0.0, "N/A"}},
+			wantErr: `rules[0].value: [1]: "N/A" is not a number like the other values`,
+		},
+		{
+			name:    "in with a non-numeric value",
+			rule:    map[string]interface{}{"outputPort": "x", "field": "a", "op": "in", "value": []interface{}{"N/A", 1.0}},
+			wantErr: `rules[0].value: [0]: "N/A" is not a number like the other values`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := (&(splitOnField{})).buildConfig(map[string]interface{}{"defaultOutputPort": "other", "rules": []interface{}{tt.rule}})
+			if err == nil || err.Error() != tt.wantErr {
+				t.Errorf("got error %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func splitRuleMap(field string, op string, value interface{}, valueType string, outputPort string) map[string]interface{} {
+	return map[string]interface{}{
+		"field":      field,
+		"op":         op,
+		"value":      value,
+		"valueType":  valueType,
+		"outputPort": outputPort,
+	}
+}
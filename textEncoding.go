@@ -0,0 +1,125 @@
+package builtin
+
+import (
+	"bufio"
+	"bytes"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/unicode"
+	"golang.org/x/text/transform"
+	"io"
+	"sort"
+	"unicode/utf8"
+)
+
+// textEncodings are the character encodings the text file parsers (parseCSV, parseFixedLength) can read, by the name
+// used in their encoding option. A nil Encoding means the file is already UTF-8 and the bytes are used as they are.
+// cp037 and cp1047 are EBCDIC.
+var textEncodings = map[string]encoding.Encoding{
+	"utf-8":        nil,
+	"utf-16le":     unicode.UTF16(unicode.LittleEndian, unicode.IgnoreBOM),
+	"utf-16be":     unicode.UTF16(unicode.BigEndian, unicode.IgnoreBOM),
+	"windows-1252": charmap.Windows1252,
+	"iso-8859-1":   charmap.ISO8859_1,
+	"cp037":        charmap.CodePage037,
+	"cp1047":       charmap.CodePage1047,
+}
+
+// ebcdicEncodings are the textEncodings whose newlines are EBCDIC NL or LF, rather than ASCII LF
+var ebcdicEncodings = map[string]bool{"cp037": true, "cp1047": true}
+
+// autoEncoding is the encoding option value that detects the encoding of each file. See detectTextEncoding.
+const autoEncoding = "auto"
+
+// detectEncodingBytes is how much of the start of a file is looked at to detect its encoding
+const detectEncodingBytes = 4096
+
+// textEncodingNames returns the sorted names of the textEncodings plus auto, for use as a config schema enum
+func textEncodingNames() []interface{} {
+	var names []string
+	for name := range textEncodings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	result := []interface{}{autoEncoding}
+	for i := range names {
+		result = append(result, names[i])
+	}
+
+	return result
+}
+
+// detectTextEncoding guesses the encoding of a file from its first bytes, and returns the length of its byte order
+// mark. A BOM decides it; otherwise text with lots of NUL bytes in every other position is UTF-16, valid UTF-8 is
+// UTF-8, and anything else is taken to be Windows-1252. EBCDIC is never detected, so it must be configured.
+func detectTextEncoding(head []byte) (string, int) {
+	switch {
+	case bytes.HasPrefix(head, []byte{0xEF, 0xBB, 0xBF}):
+		return "utf-8", 3
+	case bytes.HasPrefix(head, []byte{0xFF, 0xFE}):
+		return "utf-16le", 2
+	case bytes.HasPrefix(head, []byte{0xFE, 0xFF}):
+		return "utf-16be", 2
+	}
+
+	//Mostly ASCII UTF-16 has a NUL as the high byte of almost every character
+	var evenNuls, oddNuls int
+	for i := range head {
+		if head[i] != 0 {
+			continue
+		}
+		if i%2 == 0 {
+			evenNuls++
+		} else {
+			oddNuls++
+		}
+	}
+	if oddNuls > len(head)/4 && oddNuls > evenNuls*2 {
+		return "utf-16le", 0
+	}
+	if evenNuls > len(head)/4 && evenNuls > oddNuls*2 {
+		return "utf-16be", 0
+	}
+
+	//The head may end part way through a multi-byte character
+	for i := len(head) - 1; i >= 0 && i >= len(head)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(head[i]) {
+			if !utf8.FullRune(head[i:]) {
+				head = head[:i]
+			}
+			break
+		}
+	}
+	if utf8.Valid(head) {
+		return "utf-8", 0
+	}
+
+	return "windows-1252", 0
+}
+
+// resolveTextEncoding returns the encoding of the file being read through br, detecting it if name is auto, and
+// skips its byte order mark if it has one
+func resolveTextEncoding(br *bufio.Reader, name string) string {
+	head, _ := br.Peek(detectEncodingBytes)
+	detected, bomLength := detectTextEncoding(head)
+
+	if name == autoEncoding || name == "" {
+		name = detected
+	}
+	if bomLength > 0 && name == detected {
+		br.Discard(bomLength)
+	}
+
+	return name
+}
+
+// transcodeToUTF8 returns a reader of r's text converted from the named encoding to UTF-8
+func transcodeToUTF8(r io.Reader, name string) io.Reader {
+	enc := textEncodings[name]
+	if enc == nil {
+		return r
+	}
+
+	return transform.NewReader(r, enc.NewDecoder())
+}
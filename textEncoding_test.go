@@ -0,0 +1,103 @@
+package builtin
+
+import (
+	"bitbucket.org/primelogic_io/bitlantern/service/dataflow"
+	"reflect"
+	"testing"
+)
+
+func TestDetectTextEncoding(t *testing.T) {
+	tests := []struct {
+		name          string
+		head          []byte
+		wantEncoding  string
+		wantBOMLength int
+	}{
+		{"UTF-8 BOM", []byte("\xEF\xBB\xBFname,age"), "utf-8", 3},
+		{"UTF-16LE BOM", []byte("\xFF\xFEn\x00a\x00"), "utf-16le", 2},
+		{"UTF-16BE BOM", []byte("\xFE\xFF\x00n\x00a"), "utf-16be", 2},
+		{"UTF-16LE without a BOM", []byte("n\x00a\x00m\x00e\x00"), "utf-16le", 0},
+		{"UTF-16BE without a BOM", []byte("\x00n\x00a\x00m\x00e"), "utf-16be", 0},
+		{"ASCII", []byte("name,age\n"), "utf-8", 0},
+		{"UTF-8", []byte("caf\xC3\xA9"), "utf-8", 0},
+		{"UTF-8 cut off part way through a character", []byte("caf\xC3"), "utf-8", 0},
+		{"Windows-1252", []byte("caf\xE9 \x93quoted\x94"), "windows-1252", 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotEncoding, gotBOMLength := detectTextEncoding(tt.head)
+			if gotEncoding != tt.wantEncoding || gotBOMLength != tt.wantBOMLength {
+				t.Errorf("got %v %d, want %v %d", gotEncoding, gotBOMLength, tt.wantEncoding, tt.wantBOMLength)
+			}
+		})
+	}
+}
+
+func TestParseCSVEncodings(t *testing.T) {
+	columns := []interface{}{
+		map[string]interface{}{"columnName": "name", "datatype": "string", "fieldName": "name"},
+		map[string]interface{}{"columnName": "city", "datatype": "string", "fieldName": "city"},
+	}
+	want := []dataflow.Record{{"name": "Zoë", "city": "Montréal"}}
+
+	tests := []struct {
+		name     string
+		encoding string
+		data     string
+	}{
+		{"UTF-8 BOM is dropped from the header", "utf-8", "\xEF\xBB\xBFname,city\nZo\xC3\xAB,Montr\xC3\xA9al\n"},
+		{"Windows-1252", "windows-1252", "name,city\nZo\xEB,Montr\xE9al\n"},
+		{"auto detects Windows-1252", "auto", "name,city\nZo\xEB,Montr\xE9al\n"},
+		{"auto detects UTF-16LE", "auto", "\xFF\xFEn\x00a\x00m\x00e\x00,\x00c\x00i\x00t\x00y\x00\n\x00Z\x00o\x00\xEB\x00,\x00M\x00o\x00n\x00t\x00r\x00\xE9\x00a\x00l\x00\n\x00"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := map[string]interface{}{"hasHeaderRow": true, "encoding": tt.encoding, "columns": columns}
+			out, err := runFunction(t, "parseCSV", config, fileInput("partner.csv", tt.data))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := out.Records(dataflow.DEFAULT_OUTPUT_PORT_NAME); !reflect.DeepEqual(got, want) {
+				t.Errorf("records = %v, want %v", got, want)
+			}
+			assertErrorRecords(t, out, nil)
+		})
+	}
+}
+
+func TestParseFixedLengthCharacterOffsets(t *testing.T) {
+	config := map[string]interface{}{
+		"encoding": "auto",
+		"columns": []interface{}{
+			map[string]interface{}{"start": 0.0, "length": 5.0, "datatype": "string", "fieldName": "name"},
+			map[string]interface{}{"start": 5.0, "length": 3.0, "datatype": "integer", "fieldName": "age"},
+		},
+	}
+
+	tests := []struct {
+		name string
+		data string
+	}{
+		{"UTF-8", "\xEF\xBB\xBFZo\xC3\xAB  042\n"},
+		{"Windows-1252", "Zo\xEB  042\n"},
+		{"UTF-16BE", "\xFE\xFF\x00Z\x00o\x00\xEB\x00 \x00 \x000\x004\x002\x00\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, err := runFunction(t, "parseFixedLength", config, fileInput("people.txt", tt.data))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			want := []dataflow.Record{{"name": "Zoë", "age": int64(42)}}
+			if got := out.Records(dataflow.DEFAULT_OUTPUT_PORT_NAME); !reflect.DeepEqual(got, want) {
+				t.Errorf("records = %v, want %v", got, want)
+			}
+			assertErrorRecords(t, out, nil)
+		})
+	}
+}
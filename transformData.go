@@ -2,12 +2,7 @@ package builtin
 
 import (
 	"bitbucket.org/primelogic_io/bitlantern/service/dataflow"
-	"bytes"
 	"fmt"
-	"github.com/robertkrimen/otto"
-	_ "github.com/robertkrimen/otto"
-	_ "github.com/robertkrimen/otto/underscore"
-	"text/template"
 )
 
 func init() {
@@ -20,8 +15,37 @@ func init() {
 				Description:   "Adds a field via expression based on existing field",
 				Category:      "Data",
 				ExecutionMode: "sync",
-				InputPorts:    nil,
-				OutputPorts:   nil,
+				InputPorts:    dataflowPorts(recordInputPort),
+				OutputPorts:   dataflowPorts(transformDataRecordsPort, errorOutputPort),
+			},
+			ConfigSchema: ConfigSchema{
+				Fields: append([]ConfigField{
+					{Key: "rules", Type: ConfigTypeArray, Required: true, Items: &ConfigField{
+						Type: ConfigTypeObject,
+						Fields: []ConfigField{
+							{Key: "outputField", Type: ConfigTypeString, Description: "Field the result of jsExpression is stored in. If empty the expression must return an object, which is merged into the record"},
+							{Key: "jsExpression", Type: ConfigTypeString, Description: "Javascript expression whose result is stored in outputField"},
+							{Key: "delete", Type: ConfigTypeArray, Items: &ConfigField{Type: ConfigTypeString}, Description: "Fields to remove from the record"},
+							{Key: "rename", Type: ConfigTypeArray, Description: "Fields to rename", Items: &ConfigField{
+								Type: ConfigTypeObject,
+								Fields: []ConfigField{
+									{Key: "from", Type: ConfigTypeString, Required: true},
+									{Key: "to", Type: ConfigTypeString, Required: true},
+								},
+							}},
+						},
+					}},
+					{Key: "keepFields", Type: ConfigTypeArray, Items: &ConfigField{Type: ConfigTypeString}, Description: "If set, only these fields are kept in the output records, after all the rules have run"},
+					{Key: "initScript", Type: ConfigTypeString, Description: "JS run once before the first record, e.g. to set up the state object"},
+					{Key: "finishScript", Type: ConfigTypeString, Description: "JS run once after the last record. It can call emit(record) to write summary records"},
+				}, jsRuntimeConfigFields...),
+			},
+			ResolveOutputPorts: func(config map[string]interface{}) ([]PortSpec, error) {
+				ports := []PortSpec{transformDataRecordsPort}
+				if finishScript, _ := config["finishScript"].(string); finishScript != "" {
+					ports = append(ports, PortSpec{Name: SUMMARY_OUTPUT_PORT_NAME, Description: "Records emitted by the finish script", DataType: PortDataTypeRecord})
+				}
+				return append(ports, errorOutputPort), nil
 			},
 			NewFunction: func() dataflow.Function {
 				return &(transformData{})
@@ -29,33 +53,80 @@ func init() {
 		})
 }
 
+// transformDataRecordsPort is the output port of the transformed records, which every config has
+var transformDataRecordsPort = PortSpec{Name: dataflow.DEFAULT_OUTPUT_PORT_NAME, Description: "Input records with the output fields set", DataType: PortDataTypeRecord}
+
+// SUMMARY_OUTPUT_PORT_NAME is the port transformData writes the records emitted by its finish script to
+const SUMMARY_OUTPUT_PORT_NAME = "summary"
+
 type transformData struct {
 }
 
 type transformDataJSConfig struct {
 	// splits contains the rules for data splitting. The first rule that matches the data will be used.
 	rules []transformDataConfig
+
+	// keepFields, if not empty, are the only fields kept in the output records
+	keepFields []*fieldPath
+
+	// initScript and finishScript are run before the first and after the last record
+	initScript   string
+	finishScript string
+
+	// js holds the JS runtime options: helper scripts and execution limits
+	js jsRuntimeConfig
 }
 
+// transformDataConfig is a single rule. It either stores the result of jsExpression (in outputField, or merged into
+// the record if outputField is nil), deletes fields, or renames fields.
 type transformDataConfig struct {
 	jsExpression string
-	outputField  string
+	outputField  *fieldPath
 	jsFuncName   string
+
+	deleteFields []*fieldPath
+	renames      []transformDataRename
+}
+
+type transformDataRename struct {
+	from *fieldPath
+	to   *fieldPath
 }
 
-// buildConfig builds a splitConfig from the passed in map. The map must be in the form:
+// buildConfig builds a transformDataJSConfig from the passed in map. The map must be in the form:
 // {
-//		"defaultOutputPort": "not poor",
+//		"helperScripts": ["/path/to/helpers.js"],
 //		"rules": [
 //			{
-//				"jsCondition": "gender.lowerCase().startsWith('f')",
-//				"outputPort": "poor"
+//				"jsExpression": "padLeft(data.accountNumber, 10, '0')",
+//				"outputField": "paddedAccountNumber"
+//			},
+//			{
+//				"jsExpression": "({ first: data.name.split(' ')[0], last: data.name.split(' ')[1] })"
+//			},
+//			{
+//				"rename": [{ "from": "accountNumber", "to": "account.number" }]
+//			},
+//			{
+//				"delete": ["name"]
 //			}
-//		]
+//		],
+//		"keepFields": ["first", "last", "account"]
 // }
 //
-// rules.value can either be a value literal (ex: 100.00, "M", etc.) or a reference to another field in the record.
-// rules.valueType accepts the values: "literal", "field"
+// Each rule has either a jsExpression, a delete list or a rename list. An expression without an outputField must
+// return an object, whose keys are merged into the record. The rules run in order, and keepFields then drops every
+// field that isn't listed.
+//
+// outputField can be a path into nested objects and lists, e.g. customer.address.zip or items[0].sku. Missing
+// objects are created.
+//
+// Each expression is called with the current record as "data". The helper library in jsRuntime.go is always loaded;
+// helperScripts (files) and helperScript (inline JS) are optional and loaded after it.
+//
+// Expressions can also use "state", an object that lasts for the whole run, for running totals, sequence numbers or
+// comparisons with the previous record. initScript runs once before the first record (e.g. "state.seq = 0;") and
+// finishScript once after the last one; it can call emit({...}) to write summary records to the summary port.
 func (f *transformData) buildConfig(config map[string]interface{}) (transformDataJSConfig, error) {
 	c := transformDataJSConfig{}
 
@@ -66,12 +137,64 @@ func (f *transformData) buildConfig(config map[string]interface{}) (transformDat
 		curRuleMap := rules[i].(map[string]interface{})
 		newRule := transformDataConfig{}
 
-		newRule.outputField = curRuleMap["outputField"].(string)
-		newRule.jsExpression = curRuleMap["jsExpression"].(string)
+		newRule.jsExpression, _ = curRuleMap["jsExpression"].(string)
+		deleteFields, _ := curRuleMap["delete"].([]interface{})
+		renames, _ := curRuleMap["rename"].([]interface{})
+
+		kinds := 0
+		for _, isSet := range []bool{newRule.jsExpression != "", len(deleteFields) > 0, len(renames) > 0} {
+			if isSet {
+				kinds++
+			}
+		}
+		if kinds != 1 {
+			return c, fmt.Errorf("rules[%d]: must have exactly one of jsExpression, delete or rename", i)
+		}
+
+		var err error
+		if outputField, _ := curRuleMap["outputField"].(string); outputField != "" {
+			if newRule.jsExpression == "" {
+				return c, fmt.Errorf("rules[%d]: outputField needs a jsExpression", i)
+			}
+			newRule.outputField, err = parseFieldPath(outputField)
+			if err != nil {
+				return c, fmt.Errorf("rules[%d].outputField: %w", i, err)
+			}
+		}
+
+		newRule.deleteFields, err = parseFieldPaths(fmt.Sprintf("rules[%d].delete", i), deleteFields)
+		if err != nil {
+			return c, err
+		}
+
+		newRule.renames = make([]transformDataRename, len(renames))
+		for j := range renames {
+			renameMap := renames[j].(map[string]interface{})
+			newRule.renames[j].from, err = parseFieldPath(renameMap["from"].(string))
+			if err != nil {
+				return c, fmt.Errorf("rules[%d].rename[%d].from: %w", i, j, err)
+			}
+			newRule.renames[j].to, err = parseFieldPath(renameMap["to"].(string))
+			if err != nil {
+				return c, fmt.Errorf("rules[%d].rename[%d].to: %w", i, j, err)
+			}
+		}
 
 		c.rules[i] = newRule
 	}
 
+	keepFields, _ := config["keepFields"].([]interface{})
+	var err error
+	c.keepFields, err = parseFieldPaths("keepFields", keepFields)
+	if err != nil {
+		return c, err
+	}
+
+	c.initScript, _ = config["initScript"].(string)
+	c.finishScript, _ = config["finishScript"].(string)
+
+	c.js = buildJSRuntimeConfig(config)
+
 	return c, nil
 }
 
@@ -79,91 +202,184 @@ func (f *transformData) Execute(in dataflow.InputReader, out dataflow.OutputWrit
 	defer out.Close()
 
 	//Parse/read config options
+	config, err := prepareConfig("transformData", config)
+	if err != nil {
+		return err
+	}
+
 	splitOpts, err := f.buildConfig(config)
 	if err != nil {
-		panic("Error transforming the data")
+		return newFunctionError("transformData", "building config", err)
 	}
 
 	//Open the data stream
 	reader := in.PortReader(dataflow.DEFAULT_INPUT_PORT_NAME)
 	err = reader.Open()
 	if err != nil {
-		panic("Unable to read record from input")
+		return newFunctionError("transformData", "opening input", err)
 	}
 
-	jsDataHelper := `
-		String.prototype.toTitleCase = function(txt) {
-			return this.replace(/\w\S*/g, function(txt){return txt.charAt(0).toUpperCase() + txt.substr(1).toLowerCase();});
-    	};
-		
-	`
-
-	//JS Template - We will wrap the condition express in a function that can be called more easily
-	jsFuncTemplate, err := template.New("someName").Parse(`
-		var {{.FuncName}} = function(data) {
-			return ({{.Expression}});
-		};
-	`)
-
-	vm := otto.New()
-
-	//Run helper JS
-	vm.Run(jsDataHelper)
+	vm, err := newJSRuntime(splitOpts.js)
+	if err != nil {
+		return newFunctionError("transformData", "starting JS runtime", err)
+	}
 
-	//Parse all the JS rules
+	//Compile all the JS rules
+	compileErrs := jsRuleCompileErrors{}
 	for i := range splitOpts.rules {
 		curRule := &(splitOpts.rules[i])
+		if curRule.jsExpression == "" {
+			continue
+		}
 
-		var b bytes.Buffer
-		templateVars := make(map[string]string)
-		templateVars["Expression"] = curRule.jsExpression
-		templateVars["FuncName"] = fmt.Sprintf("transformData_%d", i)
-		jsFuncTemplate.Execute(&b, templateVars)
-
-		fmt.Printf("\n\n%s", b.String())
-
-		_, err := vm.Run(b.String())
+		curRule.jsFuncName, err = vm.compileExpression(curRule.jsExpression)
 		if err != nil {
-			panic(err)
+			compileErrs.add(fmt.Sprintf("rules[%d].jsExpression", i), err)
 		}
+	}
+	if err := compileErrs.err("transformData"); err != nil {
+		return newFunctionError("transformData", "compiling rules", err)
+	}
 
-		curRule.jsFuncName = templateVars["FuncName"]
+	//The state object lives for the whole run, so expressions can keep running totals, sequence numbers, etc.
+	_, err = vm.run("var state = {};")
+	if err != nil {
+		return newFunctionError("transformData", "creating state", err)
+	}
+	if splitOpts.initScript != "" {
+		_, err = vm.run(splitOpts.initScript)
+		if err != nil {
+			return newFunctionError("transformData", "running init script", err)
+		}
 	}
 
 	//Loop through all data
 	for reader.HasNext() {
 		rec, err := reader.Next()
 		if err != nil {
-			panic("Failed to read record")
+			return newFunctionError("transformData", "reading input", err)
 		}
 
 		//We should perform a check here to make sure we are getting records instead of files
 		recVal, err := rec.GetAsRecord()
 		if err != nil {
-			panic("Failed to read record as a map")
+			writeRecordError(out, &(RecordError{FunctionKey: "transformData", Err: err}))
+			continue
 		}
 
 		/* START - The actual work */
 
-		// Run the script rules for each record
-		for i := range splitOpts.rules {
-			curRule := splitOpts.rules[i]
-			recData, _ := rec.GetAsRecord()
-			value, err := vm.Call(curRule.jsFuncName, nil, recData)
-			if err != nil {
-				panic(err)
+		original := copyRecord(recVal)
+		err = f.transform(vm, &splitOpts, recVal)
+		if err != nil {
+			writeRecordError(out, &(RecordError{FunctionKey: "transformData", Record: original, Err: err}))
+			if isJSRunBudgetExceeded(err) {
+				return newFunctionError("transformData", "running rules", err)
 			}
+			continue
+		}
 
-			newVal, err := value.Export()
+		if len(splitOpts.keepFields) > 0 {
+			recVal, err = f.project(&splitOpts, recVal)
 			if err != nil {
-				panic(err)
+				writeRecordError(out, &(RecordError{FunctionKey: "transformData", Record: original, Err: err}))
+				continue
 			}
-
-			recVal.Set(curRule.outputField, newVal)
 		}
+
 		out.WriteRecord(dataflow.DEFAULT_OUTPUT_PORT_NAME, &recVal)
 	}
 	/* END - The actual work */
 
+	if splitOpts.finishScript != "" {
+		vm.setEmitter(func(rec dataflow.Record) {
+			out.WriteRecord(SUMMARY_OUTPUT_PORT_NAME, &rec)
+		})
+
+		_, err = vm.run(splitOpts.finishScript)
+		if err != nil {
+			return newFunctionError("transformData", "running finish script", err)
+		}
+	}
+
 	return nil
 }
+
+// transform runs the rules for the record, in order
+func (f *transformData) transform(vm *jsRuntime, splitOpts *transformDataJSConfig, recVal dataflow.Record) error {
+	for i := range splitOpts.rules {
+		err := f.applyRule(vm, &(splitOpts.rules[i]), recVal)
+		if err != nil {
+			return fmt.Errorf("rules[%d]: %w", i, err)
+		}
+	}
+
+	return nil
+}
+
+func (f *transformData) applyRule(vm *jsRuntime, curRule *transformDataConfig, recVal dataflow.Record) error {
+	for _, field := range curRule.deleteFields {
+		field.delete(recVal)
+	}
+
+	for _, rename := range curRule.renames {
+		val, ok := rename.from.get(recVal)
+		if !ok {
+			continue
+		}
+
+		rename.from.delete(recVal)
+		err := rename.to.set(recVal, val)
+		if err != nil {
+			return err
+		}
+	}
+
+	if curRule.jsFuncName == "" {
+		return nil
+	}
+
+	newVal, err := vm.callExpression(curRule.jsFuncName, recVal)
+	if err != nil {
+		return err
+	}
+
+	if curRule.outputField != nil {
+		return curRule.outputField.set(recVal, newVal)
+	}
+
+	newMap, ok := newVal.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("expression returned %T, not an object, so outputField must be set", newVal)
+	}
+	for key, val := range newMap {
+		recVal.Set(key, val)
+	}
+
+	return nil
+}
+
+// project returns a record with only the keepFields of recVal. Nested fields keep their place, e.g. keeping
+// customer.id gives {"customer": {"id": ...}}.
+func (f *transformData) project(splitOpts *transformDataJSConfig, recVal dataflow.Record) (dataflow.Record, error) {
+	projected := dataflow.Record{}
+	for _, field := range splitOpts.keepFields {
+		val, ok := field.get(recVal)
+		if !ok {
+			continue
+		}
+
+		//A flat key that contains dots stays flat
+		if _, isFlat := recVal[field.String()]; isFlat {
+			projected[field.String()] = val
+			continue
+		}
+
+		err := field.set(projected, val)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return projected, nil
+}
@@ -0,0 +1,206 @@
+package builtin
+
+import (
+	"bitbucket.org/primelogic_io/bitlantern/service/dataflow"
+	"reflect"
+	"testing"
+)
+
+func TestTransformData(t *testing.T) {
+	tests := []struct {
+		name   string
+		rules  []interface{}
+		record dataflow.Record
+		want   dataflow.Record
+	}{
+		{
+			name:   "string expression",
+			rules:  []interface{}{transformRuleMap("fullName", "data.first + ' ' + data.last")},
+			record: dataflow.Record{"first": "ada", "last": "lovelace"},
+			want:   dataflow.Record{"first": "ada", "last": "lovelace", "fullName": "ada lovelace"},
+		},
+		{
+			name:   "title case helper",
+			rules:  []interface{}{transformRuleMap("name", "data.name.toTitleCase()")},
+			record: dataflow.Record{"name": "ADA LOVELACE"},
+			want:   dataflow.Record{"name": "Ada Lovelace"},
+		},
+		{
+			name: "later rules see earlier outputs",
+			rules: []interface{}{
+				transformRuleMap("total", "data.price * data.qty"),
+				transformRuleMap("big", "data.total > 100"),
+			},
+			record: dataflow.Record{"price": 30.0, "qty": 4.0},
+			want:   dataflow.Record{"price": 30.0, "qty": 4.0, "total": 120.0, "big": true},
+		},
+		{
+			name: "nested paths",
+			rules: []interface{}{
+				transformRuleMap("customer.address.zip", "data.customer.address.zip.substring(0, 5)"),
+				transformRuleMap("summary.firstSku", "data.items[0].sku"),
+			},
+			record: dataflow.Record{
+				"customer": map[string]interface{}{"address": map[string]interface{}{"zip": "75001-1234"}},
+				"items":    []interface{}{map[string]interface{}{"sku": "A1"}},
+			},
+			want: dataflow.Record{
+				"customer": map[string]interface{}{"address": map[string]interface{}{"zip": "75001"}},
+				"items":    []interface{}{map[string]interface{}{"sku": "A1"}},
+				"summary":  map[string]interface{}{"firstSku": "A1"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, err := runFunction(t, "transformData", map[string]interface{}{"rules": tt.rules}, recordInput(tt.record))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := out.Records(dataflow.DEFAULT_OUTPUT_PORT_NAME)
+			if len(got) != 1 || !reflect.DeepEqual(got[0], tt.want) {
+				t.Errorf("records = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTransformDataErrorKeepsOriginalRecord(t *testing.T) {
+	rules := []interface{}{
+		transformRuleMap("a", "1"),
+		transformRuleMap("b", "data.missing.length"),
+	}
+
+	original := dataflow.Record{"x": "y"}
+	out, err := runFunction(t, "transformData", map[string]interface{}{"rules": rules}, recordInput(original))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertErrorRecords(t, out, []dataflow.Record{{"functionKey": "transformData", "record": dataflow.Record{"x": "y"}}})
+}
+
+func TestTransformDataReshape(t *testing.T) {
+	config := map[string]interface{}{
+		"rules": []interface{}{
+			map[string]interface{}{"jsExpression": "({first: data.name.split(' ')[0], last: data.name.split(' ')[1]})"},
+			map[string]interface{}{"rename": []interface{}{
+				map[string]interface{}{"from": "acct", "to": "account.number"},
+				map[string]interface{}{"from": "missing", "to": "account.other"},
+			}},
+			map[string]interface{}{"delete": []interface{}{"name", "items[0]"}},
+		},
+		"keepFields": []interface{}{"first", "last", "account", "items", "ssn.last4"},
+	}
+
+	record := dataflow.Record{
+		"name":      "Ada Lovelace",
+		"acct":      "0042",
+		"items":     []interface{}{"a", "b"},
+		"internal":  "drop me",
+		"ssn.last4": "1234",
+	}
+	out, err := runFunction(t, "transformData", config, recordInput(record))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := dataflow.Record{
+		"first":     "Ada",
+		"last":      "Lovelace",
+		"account":   map[string]interface{}{"number": "0042"},
+		"items":     []interface{}{"b"},
+		"ssn.last4": "1234",
+	}
+	got := out.Records(dataflow.DEFAULT_OUTPUT_PORT_NAME)
+	if len(got) != 1 || !reflect.DeepEqual(got[0], want) {
+		t.Errorf("records = %v, want %v", got, want)
+	}
+}
+
+func TestTransformDataMergeNeedsObject(t *testing.T) {
+	config := map[string]interface{}{
+		"rules": []interface{}{map[string]interface{}{"jsExpression": "data.name"}},
+	}
+
+	out, err := runFunction(t, "transformData", config, recordInput(dataflow.Record{"name": "ada"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertErrorRecords(t, out, []dataflow.Record{{
+		"functionKey": "transformData",
+		"error":       "rules[0]: expression returned string, not an object, so outputField must be set",
+	}})
+}
+
+func TestTransformDataInvalidRules(t *testing.T) {
+	tests := []map[string]interface{}{
+		{},
+		{"jsExpression": "1", "delete": []interface{}{"a"}},
+		{"outputField": "a", "delete": []interface{}{"b"}},
+		{"delete": []interface{}{"a..b"}},
+	}
+
+	for _, rule := range tests {
+		_, err := (&(transformData{})).buildConfig(map[string]interface{}{"rules": []interface{}{rule}})
+		if err == nil {
+			t.Errorf("expected an error for rule %v", rule)
+		}
+	}
+}
+
+func TestTransformDataState(t *testing.T) {
+	config := map[string]interface{}{
+		"initScript": "state.seq = 0; state.total = 0; state.prev = null;",
+		"rules": []interface{}{
+			transformRuleMap("seq", "++state.seq"),
+			transformRuleMap("changed", "(function() { var changed = state.prev != null && state.prev != data.state; state.prev = data.state; return changed; })()"),
+			transformRuleMap("runningTotal", "state.total += data.amount"),
+		},
+		"finishScript": "emit({recordCount: state.seq, total: state.total});",
+	}
+
+	records := []dataflow.Record{
+		{"state": "TX", "amount": 10.0},
+		{"state": "TX", "amount": 5.0},
+		{"state": "CA", "amount": 2.5},
+	}
+	out, err := runFunction(t, "transformData", config, recordInput(records...))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []dataflow.Record{
+		{"state": "TX", "amount": 10.0, "seq": 1.0, "changed": false, "runningTotal": 10.0},
+		{"state": "TX", "amount": 5.0, "seq": 2.0, "changed": false, "runningTotal": 15.0},
+		{"state": "CA", "amount": 2.5, "seq": 3.0, "changed": true, "runningTotal": 17.5},
+	}
+	if got := out.Records(dataflow.DEFAULT_OUTPUT_PORT_NAME); !reflect.DeepEqual(got, want) {
+		t.Errorf("records = %v, want %v", got, want)
+	}
+
+	wantSummary := []dataflow.Record{{"recordCount": 3.0, "total": 17.5}}
+	if got := out.Records(SUMMARY_OUTPUT_PORT_NAME); !reflect.DeepEqual(got, wantSummary) {
+		t.Errorf("summary records = %v, want %v", got, wantSummary)
+	}
+}
+
+func TestTransformDataStateScriptErrors(t *testing.T) {
+	rules := []interface{}{transformRuleMap("a", "1")}
+
+	_, err := runFunction(t, "transformData", map[string]interface{}{"rules": rules, "initScript": "state.x.y = 1;"}, recordInput())
+	if err == nil {
+		t.Error("expected an error from the init script")
+	}
+
+	_, err = runFunction(t, "transformData", map[string]interface{}{"rules": rules, "finishScript": "emit(5);"}, recordInput())
+	if err == nil {
+		t.Error("expected an error for emitting a non-object")
+	}
+}
+
+func transformRuleMap(outputField string, jsExpression string) map[string]interface{} {
+	return map[string]interface{}{"outputField": outputField, "jsExpression": jsExpression}
+}
@@ -0,0 +1,118 @@
+package builtin
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// compareRecordValues orders two field values, returning -1, 0 or 1. Numbers are compared numerically whatever their
+// Go type, as int64s when both are whole numbers so that large integers like account numbers keep their order, strings lexically, booleans with false first and time.Time values chronologically. nil comes before any
+// other value. Values of different kinds (e.g. a string and a number) can't be compared.
+func compareRecordValues(a interface{}, b interface{}) (int, error) {
+	if a == nil || b == nil {
+		switch {
+		case a == nil && b == nil:
+			return 0, nil
+		case a == nil:
+			return -1, nil
+		default:
+			return 1, nil
+		}
+	}
+
+	if aNum, ok := configValueAsFloat(a); ok {
+		bNum, ok := configValueAsFloat(b)
+		if !ok {
+			return 0, fmt.Errorf("can't compare number %v with %T %v", a, b, b)
+		}
+		aInt, aIsInt := valueAsInt64(a)
+		bInt, bIsInt := valueAsInt64(b)
+		if aIsInt && bIsInt {
+			return compareOrdered(aInt < bInt, aInt > bInt), nil
+		}
+		return compareOrdered(aNum < bNum, aNum > bNum), nil
+	}
+
+	switch aVal := a.(type) {
+	case string:
+		bVal, ok := b.(string)
+		if !ok {
+			return 0, fmt.Errorf("can't compare string %q with %T %v", aVal, b, b)
+		}
+		return strings.Compare(aVal, bVal), nil
+	case bool:
+		bVal, ok := b.(bool)
+		if !ok {
+			return 0, fmt.Errorf("can't compare boolean %v with %T %v", aVal, b, b)
+		}
+		return compareOrdered(!aVal && bVal, aVal && !bVal), nil
+	case time.Time:
+		bVal, ok := b.(time.Time)
+		if !ok {
+			return 0, fmt.Errorf("can't compare date %v with %T %v", aVal, b, b)
+		}
+		return compareOrdered(aVal.Before(bVal), aVal.After(bVal)), nil
+	}
+
+	return 0, fmt.Errorf("can't compare values of type %T", a)
+}
+
+func compareOrdered(less bool, greater bool) int {
+	switch {
+	case less:
+		return -1
+	case greater:
+		return 1
+	}
+
+	return 0
+}
+
+// valueAsInt64 returns val as an int64 if it's an integer, or a float that is a whole number in the int64 range
+func valueAsInt64(val interface{}) (int64, bool) {
+	switch v := val.(type) {
+	case int:
+		return int64(v), true
+	case int8:
+		return int64(v), true
+	case int16:
+		return int64(v), true
+	case int32:
+		return int64(v), true
+	case int64:
+		return v, true
+	}
+
+	num, ok := configValueAsFloat(val)
+	if !ok || num != math.Trunc(num) || num < math.MinInt64 || num >= math.MaxInt64 {
+		return 0, false
+	}
+	return int64(num), true
+}
+
+// valueKey returns a string that is the same for equal field values, for grouping and distinct counts. Numbers of
+// different Go types that are equal (e.g. int64(1) and 1.0) have the same key, and whole numbers are keyed as int64s so
+// large integers that only differ past a float64's precision get different keys.
+func valueKey(val interface{}) string {
+	if val == nil {
+		return "null"
+	}
+	if num, ok := valueAsInt64(val); ok {
+		return "i:" + strconv.FormatInt(num, 10)
+	}
+	if num, ok := configValueAsFloat(val); ok {
+		return "n:" + strconv.FormatFloat(num, 'g', -1, 64)
+	}
+
+	switch v := val.(type) {
+	case string:
+		return "s:" + v
+	case time.Time:
+		return "t:" + v.UTC().Format(time.RFC3339Nano)
+	}
+
+	return fmt.Sprintf("%T:%v", val, val)
+}
@@ -18,8 +18,13 @@ func init() {
 				Description:   "Writes all input files into the destinationFolder",
 				Category:      "File",
 				ExecutionMode: "sync",
-				InputPorts:    nil,
-				OutputPorts:   nil,
+				InputPorts:    dataflowPorts(fileInputPort),
+				OutputPorts:   dataflowPorts(errorOutputPort),
+			},
+			ConfigSchema: ConfigSchema{
+				Fields: []ConfigField{
+					{Key: "destinationFolder", Type: ConfigTypeString, Required: true},
+				},
 			},
 			NewFunction: func() dataflow.Function {
 				return &(writeFileToDisk{})
@@ -52,9 +57,14 @@ func (f *writeFileToDisk) Execute(in dataflow.InputReader, out dataflow.OutputWr
 	defer out.Close()
 
 	//Parse/read config options
+	config, err := prepareConfig("writeFileToDisk", config)
+	if err != nil {
+		return err
+	}
+
 	parsedConfig, err := f.buildConfig(config)
 	if err != nil {
-		panic("Error parsing function config")
+		return newFunctionError("writeFileToDisk", "building config", err)
 	}
 	f.config = parsedConfig
 
@@ -62,35 +72,40 @@ func (f *writeFileToDisk) Execute(in dataflow.InputReader, out dataflow.OutputWr
 	reader := in.PortReader(dataflow.DEFAULT_INPUT_PORT_NAME)
 	err = reader.Open()
 	if err != nil {
-		panic("Unable to read record from input")
+		return newFunctionError("writeFileToDisk", "opening input", err)
 	}
 
 	//For each file, parse the records and output them
 	for reader.HasNext() {
 		curEntry, err := reader.Next()
 		if err != nil {
-			panic(err)
+			return newFunctionError("writeFileToDisk", "reading input", err)
 		}
 
 		curFile, err := curEntry.GetAsFile()
 		if err != nil {
-			panic(err)
+			writeRecordError(out, &(RecordError{FunctionKey: "writeFileToDisk", Err: err}))
+			continue
 		}
 
-		f.writeFile(curFile)
+		err = f.writeFile(curFile)
+		if err != nil {
+			writeRecordError(out, &(RecordError{FunctionKey: "writeFileToDisk", Filename: curFile.Filename(), Err: err}))
+		}
 	}
 
 	return nil
 }
 
-func (f *writeFileToDisk) writeFile(file dataflow.File) {
+func (f *writeFileToDisk) writeFile(file dataflow.File) error {
 	fileReader := file.Reader()
 
 	diskFile, err := os.Create(f.config.destFolder + "/" + file.Filename())
-	defer diskFile.Close()
 	if err != nil {
-		panic(err)
+		return err
 	}
+	defer diskFile.Close()
 
-	io.Copy(diskFile, fileReader)
+	_, err = io.Copy(diskFile, fileReader)
+	return err
 }
@@ -0,0 +1,35 @@
+package builtin
+
+import (
+	"bitbucket.org/primelogic_io/bitlantern/service/dataflow"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteFileToDisk(t *testing.T) {
+	dir := t.TempDir()
+
+	in := NewMemoryInputReader().
+		AddFileFromString(dataflow.DEFAULT_INPUT_PORT_NAME, "a.txt", "first").
+		AddFileFromString(dataflow.DEFAULT_INPUT_PORT_NAME, "missing/b.txt", "second").
+		AddFileFromString(dataflow.DEFAULT_INPUT_PORT_NAME, "c.txt", "third")
+
+	out, err := runFunction(t, "writeFileToDisk", map[string]interface{}{"destinationFolder": dir}, in)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, want := range map[string]string{"a.txt": "first", "c.txt": "third"} {
+		got, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != want {
+			t.Errorf("%v = %q, want %q", name, got, want)
+		}
+	}
+
+	//The sub folder doesn't exist, so that file fails without stopping the others
+	assertErrorRecords(t, out, []dataflow.Record{{"functionKey": "writeFileToDisk", "filename": "missing/b.txt"}})
+}